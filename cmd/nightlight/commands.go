@@ -0,0 +1,167 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	nl "github.com/mlnoga/nightlight/internal"
+)
+
+// A command of the command line interface, with help text and the flags applicable to it
+type command struct {
+	name  string      // Command name
+	args  string      // Synopsis of the arguments, for help text
+	desc  string      // Description, for help text
+	flags [][]string  // Groups of applicable flag names
+}
+
+// Groups of flags by processing stage, by flag name
+var flagsGeneral =[]string{"cpuprofile", "memprofile", "timings", "config", "log", "out", "lsEst", "noiseEst", "seed", "timeout", "j", "history", "profile"}
+var flagsCalib   =[]string{"dark", "flat"}
+var flagsPre     =[]string{"pre", "stars", "back", "debayer", "cfa", "binning", "bpSigLow", "bpSigHigh", "starSig", "starBpSig", "starRadius", 
+	"backGrid", "backSigma", "backClip", "normRange", "normHist"}
+var flagsPreview =[]string{"previewScale"}
+var flagsPost    =[]string{"post", "align", "alignK", "alignT", "usmSigma", "usmGain", "usmThresh", "wavGains"}
+var flagsStack   =[]string{"batch", "stMode", "stClipPercLow", "stClipPercHigh", "stSigLow", "stSigHigh", "stClipIter", "stClipConv", "stWeight", "stWeightQ", 
+	"stMemory", "stAdapt", "stStore", "stCompress", "stTiles", "stTileDir", "stSpill", "stExclude", "stExcludeFrames", "stDisp", "stDispMode", "stSNR", "stSNRGrid", "stSNRTarget", "stMinFrames", "stMaxSkip", "stMaxEcc", "stTrails", "stTrailSig", "stTrailLen", "stPSF", "pixScale", "stCheckpoint", "stRescale", "stPrecision", "stStream", "report", "scores", "histOut"}
+var flagsLive    =[]string{"livePoll", "liveIdle", "autoLoc", "stSigLow", "stSigHigh", "stMaxEcc", "stTrails", "stTrailSig", "stTrailLen", "stExclude", "stExcludeFrames"}
+var flagsSave    =[]string{"jpg", "nrThresh", "nrLumMask", "gamma"}
+var flagsColor   =[]string{"histOut", "jpg", "jpgEncode", "jpgDither", "jpgICC", "annotate", "annWCS", "annTypes", "annFont", "preset", "rgbBackGrid", "nrThresh", "nrLumMask",
+	"starReduce", "starReduceIter", "spikes", "spikeThresh", "spikeLen", "spikeAngle"}
+var flagsHa      =[]string{"ha", "haBlend", "haLum", "haCont"}
+
+// Commands of the command line interface, in the order of the help text
+var commands=[]command{
+	{"stats",     "(img0.fits ... imgn.fits)", "Show input image statistics", 
+		[][]string{flagsGeneral, flagsCalib, flagsPre, flagsPreview, {"batch", "scores", "histOut"}}},
+	{"select",    "destdir (img0.fits ... imgn.fits)", "Copy or link input images matching the criteria given by -selExpr into the destination directory", 
+		[][]string{flagsGeneral, flagsCalib, flagsPre, {"selExpr", "selLink"}}},
+	{"inspect",   "(img0.fits ... imgn.fits)", "Bin detected stars across the field and show the HFR per cell, revealing tilt, backfocus and coma, optionally as heatmap", 
+		[][]string{flagsGeneral, flagsCalib, flagsPre, {"inspGrid", "inspOut"}}},
+	{"stack",     "(img0.fits ... imgn.fits)", "Stack input images", 
+		[][]string{flagsGeneral, flagsCalib, flagsPre, flagsPreview, flagsPost, flagsStack, flagsSave}},
+	{"estimate",  "(img0.fits ... imgn.fits)", "Show the batch plan, peak memory and expected runtime per stage for stacking input images with the current flags, without processing them", 
+		[][]string{flagsGeneral, flagsCalib, flagsPre, flagsPost, flagsStack}},
+	{"bench",     "", "Generate synthetic frames and report the throughput in MPix/s of loading, calibration, star detection, alignment and each stacking mode on this machine", 
+		[][]string{flagsGeneral, {"benchWidth", "benchHeight", "benchFrames", "benchStars"}}},
+	{"live",      "directory", "Watch the given directory, add each new frame to a running stack and update the output and JPEG preview", 
+		[][]string{flagsGeneral, flagsCalib, flagsPre, flagsPreview, flagsPost, flagsLive, flagsSave}},
+	{"integrate", "manifest.json", "Stack each session from a JSON manifest with its own dark and flat, then combine sessions weighted by noise", 
+		[][]string{flagsGeneral, flagsPre, flagsPreview, flagsPost, flagsStack, flagsSave}},
+	{"rgb",       "r.fits g.fits b.fits", "Combine color channels. Inputs are treated as r, g and b channel in that order", 
+		[][]string{flagsGeneral, flagsPre, flagsPreview, flagsPost, flagsColor, flagsHa, presetColorFlags, presetToneFlags}},
+	{"palette",   "ha.fits oiii.fits [sii.fits]", "Map narrowband channels to color with a palette preset. Inputs are treated as Ha, OIII and optional SII channels", 
+		[][]string{flagsGeneral, flagsPre, flagsPreview, flagsPost, {"palette", "palGreen", "palWeights"}, flagsColor, presetColorFlags, presetToneFlags}},
+	{"mix",       "(img0.fits ... imgn.fits)", "Mix any number of input channels into RGB with the matrix given by -mix, e.g. L, R, G, B, Ha, OIII and SII", 
+		[][]string{flagsGeneral, flagsPre, flagsPreview, flagsPost, {"mix"}, flagsColor, presetColorFlags, presetToneFlags}},
+	{"contsub",   "narrow.fits broad.fits", "Subtract the continuum from a narrowband channel. Inputs are treated as narrowband and broadband channel, e.g. Ha and R", 
+		[][]string{flagsGeneral, flagsPre, flagsPreview, flagsPost, {"contScale"}, flagsSave}},
+	{"starless",  "img.fits", "Remove stars from a stacked image, saving the starless image and optionally the star-only image", 
+		[][]string{flagsGeneral, flagsPre, flagsPreview, {"starRemRadius", "starsOnly"}, flagsSave}},
+	{"argb",      "l.fits r.fits g.fits b.fits", "Combine color channels and align with luminance. Inputs are treated as l, r, g and b channels", 
+		[][]string{flagsGeneral, flagsPre, flagsPreview, flagsPost, flagsColor, flagsHa, presetColorFlags, presetToneFlags}},
+	{"lrgb",      "l.fits r.fits g.fits b.fits", "Combine color channels and combine with luminance. Inputs are treated as l, r, g and b channels", 
+		[][]string{flagsGeneral, flagsPre, flagsPreview, flagsPost, flagsColor, flagsHa, {"lrgbChromaBlur"}, presetColorFlags, presetToneFlags}},
+	{"header",    "(img0.fits ... imgn.fits)", "Show FITS headers as table, after setting and deleting keys given by -hdrSet and -hdrDel in all files", 
+		[][]string{flagsGeneral, {"hdrKeys", "hdrSet", "hdrDel"}}},
+	{"split",     "img.fits", "Split a multi-channel image into single channel images, named after the output file with suffix _r, _g and _b", 
+		[][]string{flagsGeneral}},
+	{"merge",     "r.fits g.fits b.fits", "Merge single channel images into one multi-channel image, without normalization. Inputs are treated as r, g and b channel", 
+		[][]string{flagsGeneral}},
+	{"preset",    "preset.json", "Save the effective color and tone curve parameters to the given JSON preset file, for reuse with -preset", 
+		[][]string{flagsGeneral, {"preset"}, presetColorFlags, presetToneFlags}},
+	{"project",   "project.json", "Process each target of a JSON project file in turn, with its own inputs, calibration frames and parameters", 
+		nil},  // all flags
+	{"config",    "dump (file.json|file.yaml|file.toml)", "With argument dump, save the effective parameters to the given JSON, YAML or TOML configuration file, for reuse with -config", 
+		nil},  // all flags
+	{"legal",     "", "Show license and attribution information", nil},
+	{"version",   "", "Show version information", nil},
+	{"help",      "[command]", "Show help, for the given command if any", nil},
+}
+
+// Returns the command with the given name, or nil if there is none
+func findCommand(name string) *command {
+	for i:=range commands {
+		if commands[i].name==name { return &commands[i] }
+	}
+	return nil
+}
+
+// Returns a flag set with the flags applicable to the command. The flags share their values with the global flags
+func (c *command) flagSet() *flag.FlagSet {
+	fs:=flag.NewFlagSet(c.name, flag.ExitOnError)
+	add:=func(f *flag.Flag) {
+		if fs.Lookup(f.Name)==nil { fs.Var(f.Value, f.Name, f.Usage) }
+	}
+	if c.flags==nil && (c.name=="config" || c.name=="project") {
+		flag.VisitAll(add)
+	}
+	for _, group:=range c.flags {
+		for _, name:=range group { add(flag.Lookup(name)) }
+	}
+	fs.Usage=func() { c.usage(fs) }
+	return fs
+}
+
+// Prints help text for the command and its applicable flags
+func (c *command) usage(fs *flag.FlagSet) {
+	nl.LogPrintf("Usage: %s [-flag value] %s [-flag value] %s\n\n%s\n", os.Args[0], c.name, c.args, c.desc)
+	numFlags:=0
+	fs.VisitAll(func(*flag.Flag) { numFlags++ })
+	if numFlags>0 {
+		nl.LogPrintf("\nFlags:\n")
+		fs.PrintDefaults()
+	}
+}
+
+// Returns the help text listing all commands
+func commandsHelp() string {
+	names:=make([]string, 0, len(commands))
+	sb:=&strings.Builder{}
+	for _, c:=range commands {
+		names=append(names, c.name)
+		fmt.Fprintf(sb, "  %-9s %s\n", c.name, c.desc)
+	}
+	return fmt.Sprintf("Usage: %s [-flag value] (%s) [-flag value] (img0.fits ... imgn.fits)\n\nCommands:\n%s", 
+		os.Args[0], strings.Join(names, "|"), sb.String())
+}
+
+// Parses the flags given after the command name, accepting only flags applicable to the command.
+// Marks them as set on the global flag set, so they take precedence over config files and presets.
+// Returns the command name and its remaining arguments
+func parseCommandFlags(args []string) []string {
+	if len(args)==0 { return args }
+	c:=findCommand(args[0])
+	if c==nil { return args }
+	fs:=c.flagSet()
+	fs.Parse(args[1:])
+	fs.Visit(func(f *flag.Flag) { flag.Set(f.Name, f.Value.String()) })
+	return append([]string{args[0]}, fs.Args()...)
+}
+
+// Shows help for the given command, or for all commands if none is given
+func cmdHelp(args []string) {
+	if len(args)==0 { 
+		flag.Usage()
+		return
+	}
+	c:=findCommand(args[0])
+	if c==nil { nl.LogFatalf("Unknown command '%s'\n", args[0]) }
+	c.usage(c.flagSet())
+}
@@ -16,15 +16,20 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	nl "github.com/mlnoga/nightlight/internal"
 	"github.com/pbnjay/memory"
@@ -43,13 +48,21 @@ var totalMiBs=memory.TotalMemory()/1024/1024
 
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
 var memprofile = flag.String("memprofile", "", "write memory profile to `file`")
+var timings    = flag.String("timings", "", "write wall time and peak memory per processing stage as JSON to `file`")
 
-var out  = flag.String("out", "out.fits", "save output to `file`")
+var out  = flag.String("out", "out.fits", "save output to `file`. - writes to stdout")
 var jpg  = flag.String("jpg", "%auto",  "save 8bit preview of output as JPEG to `file`. `%auto` replaces suffix of output file with .jpg")
+var jpgEncode= flag.Int64("jpgEncode", 0, "transfer encoding for JPG export. 0=none, write values as they are, 1=sRGB for linear data")
+var jpgDither= flag.Int64("jpgDither", 0, "dithering for JPG export, avoids banding in smooth gradients. 0=none, 1=ordered, 2=Floyd-Steinberg error diffusion")
+var jpgICC   = flag.String("jpgICC", "", "embed ICC color profile from `file` into JPG export")
+var annotate = flag.String("annotate", "", "label objects from catalog `file` on the JPG export of color composites. CSV with name,type,ra,dec in degrees. Blank=off")
+var annWCS   = flag.String("annWCS", "", "read plate-solved WCS solution for annotation from FITS header of `file`, e.g. the output of a plate solver run on the composite")
+var annTypes = flag.String("annTypes", "M,NGC,IC,star", "comma-separated list of catalog object types to annotate, blank=all")
+var annFont  = flag.Int64("annFont", 2, "scale factor for the 5x7 pixel annotation font")
 var log  = flag.String("log", "%auto",    "save log output to `file`. `%auto` replaces suffix of output file with .log")
 var pre  = flag.String("pre",  "",  "save pre-processed frames with given filename pattern, e.g. `pre%04d.fits`")
 var stars= flag.String("stars","","save star detections with given filename pattern, e.g. `stars%04d.fits`")
-var back = flag.String("back","","save extracted background with given filename pattern, e.g. `back%04d.fits`")
+var back = flag.String("back","","save extracted background with given filename pattern, e.g. `back%04d.fits`, plus a false color contour rendering as .jpg and the grid cell statistics as .json with the same stem")
 var post = flag.String("post", "",  "save post-processed frames with given filename pattern, e.g. `post%04d.fits`")
 var batch= flag.String("batch", "", "save stacked batches with given filename pattern, e.g. `batch%04d.fits`")
 
@@ -60,37 +73,94 @@ var debayer = flag.String("debayer", "", "debayer the given channel, one of R, G
 var cfa     = flag.String("cfa", "RGGB", "color filter array type for debayering, one of RGGB, GRBG, GBRG, BGGR")
 
 var binning= flag.Int64("binning", 0, "apply NxN binning, 0 or 1=no binning")
+var previewScale=flag.Int64("previewScale", 1, "fast preview: process NxN binned copies of the inputs with pixel-based parameters scaled to match, e.g. 2 or 4, for iterating on color and tone parameters. Run again without it to apply the final parameters at full resolution. 1=off")
 
 var bpSigLow  = flag.Float64("bpSigLow", 3.0,"low sigma for bad pixel removal as multiple of standard deviations")
 var bpSigHigh = flag.Float64("bpSigHigh",5.0,"high sigma for bad pixel removal as multiple of standard deviations")
 
-var starSig   = flag.Float64("starSig", 10.0,"sigma for star detection as multiple of standard deviations")
+var starSig   = flag.Float64("starSig", 10.0,"sigma for star detection as multiple of standard deviations. Light frames skip star detection unless aligned, saved with -stars, quality weighted, reported or rejected by eccentricity")
 var starBpSig = flag.Float64("starBpSig",-1.0,"sigma for star detection bad pixel removal as multiple of standard deviations, -1: auto")
 var starRadius= flag.Int64("starRadius", 16.0, "radius for star detection in pixels")
 
 var backGrid  = flag.Int64("backGrid", 0, "automated background extraction: grid size in pixels, 0=off")
 var backSigma = flag.Float64("backSigma", 1.5 ,"automated background extraction: sigma for detecting foreground objects")
 var backClip  = flag.Int64("backClip", 0, "automated background extraction: clip the k brightest grid cells and replace with local median")
+var rgbBackGrid=flag.Int64("rgbBackGrid", 0, "remove residual gradients from each channel of color composites with automated background extraction on this grid size in pixels, 0=off")
 
 var usmSigma  = flag.Float64("usmSigma", 1, "unsharp masking sigma, ~1/3 radius")
 var usmGain   = flag.Float64("usmGain", 0, "unsharp masking gain, 0=no op")
 var usmThresh = flag.Float64("usmThresh", 1, "unsharp masking threshold, in standard deviations above background")
 
+var wavGains  = flag.String("wavGains", "", "multi-scale sharpening: comma-separated gains for wavelet layers of 1, 2, 4... pixels, e.g. 1.5,1.2,1. Blank=off")
+
+var nrThresh  = flag.String("nrThresh", "", "multi-scale noise reduction of stacks and stretched color composites: comma-separated thresholds in noise sigmas for wavelet layers of 1, 2, 4... pixels, e.g. 3,2,1. Blank=off")
+var nrLumMask = flag.Float64("nrLumMask", 0, "attenuate noise reduction in bright areas by luminance raised to this exponent. 0=off")
+
 var align     = flag.Int64("align",1,"1=align frames, 0=do not align")
 var alignK    = flag.Int64("alignK",20,"use triangles fromed from K brightest stars for initial alignment")
 var alignT    = flag.Float64("alignT",1.0,"skip frames if alignment to reference frame has residual greater than this")
 
+var jobs      = flag.Int64("j", 0, "process at most n images in parallel, e.g. on shared machines. 0=one per CPU thread")
+var history   = flag.Bool("history", true, "record version, parameters and input file hashes in the HISTORY of FITS outputs")
+var seed      = flag.Int64("seed", 0, "seed for batch randomization and synthetic benchmark frames, for reproducible runs. 0=random. Sampled estimators are always reproducible")
+var timeout   = flag.Int64("timeout", 0, "stop processing with an error after this many seconds, 0=no limit")
 var lsEst     = flag.Int64("lsEst",3,"location and scale estimators 0=mean/stddev, 1=median/MAD, 2=IKSS, 3=iterative sigma-clipped sampled median and sampled Qn (standard)")
+var noiseEst  = flag.Int64("noiseEst",0,"noise estimator for weighting frames and batches, 0=Immerkaer (standard), 1=MAD of finest wavelet detail layer, 2=median of k-sigma clipped block standard deviations. 1 and 2 are robust to nebulosity")
 var normRange = flag.Int64("normRange",0,"normalize range: 1=normalize to [0,1], 0=do not normalize")
 var normHist  = flag.Int64("normHist",3,"normalize histogram: 0=do not normalize, 1=location and scale, 2=black point shift for RGB align, 3=auto")
 
-var stMode    = flag.Int64("stMode", 5, "stacking mode. 0=median, 1=mean, 2=sigma clip, 3=winsorized sigma clip, 4=linear fit, 5=auto")
+var stMode    = flag.Int64("stMode", 5, "stacking mode. 0=median, 1=mean, 2=sigma clip, 3=winsorized sigma clip, 4=linear fit, 5=auto per-pixel rejection, 6=percentile clip, 7=sum, 8=integer average, 9=maximum, 10=minimum. Use normHist 0 with 7 and 8 for photometry")
 var stClipPercLow = flag.Float64("stClipPercLow", 0.5,"set desired low clipping percentage for stacking, 0=ignore (overrides sigmas)")
 var stClipPercHigh= flag.Float64("stClipPercHigh",0.5,"set desired high clipping percentage for stacking, 0=ignore (overrides sigmas)")
-var stSigLow  = flag.Float64("stSigLow", -1,"low sigma for stacking as multiple of standard deviations, -1: use clipping percentage to find")
-var stSigHigh = flag.Float64("stSigHigh",-1,"high sigma for stacking as multiple of standard deviations, -1: use clipping percentage to find")
-var stWeight  = flag.Int64("stWeight", 0, "weights for stacking. 0=unweighted (default), 1=by exposure, 2=by inverse noise")
+var stSigLow  = flag.Float64("stSigLow", -1,"low sigma for stacking as multiple of standard deviations, or fraction of the median for percentile clip, -1: use clipping percentage to find")
+var stClipIter= flag.Int64("stClipIter", 0, "maximum number of clipping iterations per pixel for stacking, 0=until converged")
+var stClipConv= flag.Float64("stClipConv", 0, "stop clipping iterations once at most this fraction of the remaining values is clipped, 0=until no more values are clipped")
+var stSigHigh = flag.Float64("stSigHigh",-1,"high sigma for stacking as multiple of standard deviations, or fraction of the median for percentile clip, -1: use clipping percentage to find")
+var stWeight  = flag.Int64("stWeight", 0, "weights for stacking. 0=unweighted (default), 1=by exposure, 2=by inverse noise, 3=by quality")
+var stWeightQ = flag.String("stWeightQ", "fwhm=2,ecc=1,stars=1,bg=1", "exponents of the relative frame quality factors fwhm, ecc, stars and bg for quality-weighted stacking. Frames without stars get weight 0 if fwhm, ecc or stars is used")
 var stMemory  = flag.Int64("stMemory", int64((totalMiBs*7)/10), "total MiB of memory to use for stacking, default=0.7x physical memory")
+var stAdapt   = flag.Int64("stAdapt", 1, "adapt the batch size to the memory measured while stacking the first batch, for frames where the estimate is off, e.g. debayered or binned. 0=off, 1=on")
+var stStore   = flag.Int64("stStore", 0, "in-memory storage of registered frames for stacking. 0=32-bit float, 1=16-bit half float, 2=16-bit scaled integer. 1 and 2 fit nearly twice the frames per batch")
+var stCompress= flag.Int64("stCompress", 0, "compress registered frames losslessly in memory while awaiting stacking, trading CPU time for memory. 0=off, 1=on")
+var stTiles   = flag.Int64("stTiles", 0, "stack in horizontal bands of this many rows, reading registered frames from temporary files. 0=off, stack in memory")
+var stTileDir = flag.String("stTileDir", "", "directory for temporary files when stacking in bands or from memory-mapped files, blank=system default")
+var stSpill   = flag.Int64("stSpill", 2, "spill registered frames to memory-mapped temporary files and stack them in a single batch, instead of random batches. 0=off, 1=always, 2=if frames exceed stMemory and no checkpoint is used. Use 0 to keep random batches without temporary files")
+var stExclude = flag.String("stExclude", "", "exclude nonzero regions of this mask `file` from light frames when stacking, filling them from other frames")
+var stExcludeFrames = flag.String("stExcludeFrames", "", "apply the exclusion mask to these frame IDs only, e.g. 0-4,7. Blank=all frames")
+var stDisp    = flag.String("stDisp", "", "save per-pixel dispersion map of the stacked frames to `file`, showing insufficient rejection and significance of faint signal")
+var stDispMode= flag.Int64("stDispMode", 0, "dispersion measure for stDisp. 0=standard deviation, 1=median absolute deviation")
+var stSNR     = flag.String("stSNR", "", "save signal-to-noise map of the stack to `file`, as FITS or as JPG with target SNR at middle gray if the name ends in .jpg")
+var stSNRGrid = flag.Int64("stSNRGrid", 64, "region size in pixels for modeling noise in the SNR map")
+var stSNRTarget=flag.Float64("stSNRTarget", 5, "target SNR for the SNR map summary of needed integration time")
+var stMinFrames=flag.Int64("stMinFrames", 0, "abort stacking if fewer than this many frames are usable. 0=no limit")
+var stMaxSkip = flag.Float64("stMaxSkip", 1, "abort stacking if more than this fraction of frames is skipped in alignment. 1=no limit")
+var stTrails  = flag.Int64("stTrails", 0, "detect satellite and plane trails with a Hough transform. 0=off, 1=mask trail pixels so the stacker ignores them, 2=reject frames with trails")
+var stTrailSig= flag.Float64("stTrailSig", 3, "trail detection: threshold for trail pixels in standard deviations above the background and their neighbors")
+var stTrailLen= flag.Int64("stTrailLen", 100, "trail detection: minimum length of a trail in pixels")
+var stPSF     = flag.Int64("stPSF", 0, "report the FWHM of Gaussian fits to this many brightest stars of the stack, compared to the sharpest frame. 0=off")
+var pixScale  = flag.Float64("pixScale", 0, "pixel scale in arcseconds per pixel for reporting the FWHM. 0=from WCS solution, or FOCALLEN and XPIXSZ in the header of the first frame")
+var stMaxEcc  = flag.Float64("stMaxEcc", 0, "reject frames with median star eccentricity above this, e.g. 0.6 for frames trailed by guiding or periodic error. 0=no limit")
+var stCheckpoint=flag.String("stCheckpoint", "", "save batch results to this directory, and resume an interrupted multi-batch stack from there unless processing parameters or calibration frames changed. Blank=off")
+var hdrKeys   = flag.String("hdrKeys", "", "header: comma-separated keys to show, e.g. OBJECT,FILTER,EXPTIME. Blank=edited keys, or all keys")
+var hdrSet    = flag.String("hdrSet", "", "header: comma-separated KEY=value pairs to set, e.g. FILTER=Ha. Quote values with single quotes to force strings")
+var hdrDel    = flag.String("hdrDel", "", "header: comma-separated keys to delete")
+var selExpr   = flag.String("selExpr", "", "select frames matching these criteria, e.g. 'hfr<3.2 && stars>300 && noise<0.002'")
+var selLink   = flag.Bool("selLink", false, "select frames by creating symbolic links instead of copies")
+var stReport  = flag.String("report", "", "write HTML quality report of the stacking run to `file`, with per-frame charts, rejected frames, rejection rates and thumbnails")
+var histOut   = flag.String("histOut", "", "write binned histograms of the light frames, the stack and the final output to `file`, as CSV or as JSON if the name ends in .json")
+var stScores  = flag.String("scores", "", "write per-frame scores to CSV `file`, and trend charts of them to the same name with suffix .svg")
+var stRescale =flag.Int64("stRescale", 1, "for stMode 7, rescale sums of pixels missing in some frames, e.g. after alignment, to the full number of frames. 0=off, 1=on")
+var stPrecision=flag.Int64("stPrecision", 32, "precision for accumulating sums when stacking, 32 or 64 bits. 64 avoids accumulation errors in deep stacks")
+var benchWidth=flag.Int64("benchWidth", 4096, "benchmark: width of the synthetic frames in pixels")
+var benchHeight=flag.Int64("benchHeight", 2048, "benchmark: height of the synthetic frames in pixels")
+var benchFrames=flag.Int64("benchFrames", 16, "benchmark: number of synthetic frames")
+var benchStars=flag.Int64("benchStars", 500, "benchmark: number of stars per synthetic frame")
+
+var inspGrid  = flag.Int64("inspGrid", 5, "inspect: number of cells per axis for binning stars across the field")
+var inspOut   = flag.String("inspOut", "", "inspect: save HFR heatmaps with given filename pattern, as FITS with one pixel per cell or as color JPG if the name ends in .jpg, e.g. `hfr%04d.jpg`")
+var livePoll  = flag.Float64("livePoll", 2, "live stacking: poll the watched directory for new frames every n seconds")
+var liveIdle  = flag.Float64("liveIdle", 0, "live stacking: stop after no new frames arrived for n seconds, 0=run until interrupted")
+var stStream  = flag.Int64("stStream", 0, "stream frames through a one-pass sigma-clipped mean, seeding rejection from a reservoir of this many frames. 0=off, use batches")
 
 var neutSigmaLow  = flag.Float64("neutSigmaLow", -1, "neutralize background color below this threshold, <0 = no op")
 var neutSigmaHigh = flag.Float64("neutSigmaHigh", -1, "keep background color above this threshold, interpolate in between, <0 = no op")
@@ -98,62 +168,131 @@ var neutSigmaHigh = flag.Float64("neutSigmaHigh", -1, "keep background color abo
 var chromaGamma=flag.Float64("chromaGamma", 1.0, "scale LCH chroma curve by given gamma for luminances n sigma above background, 1.0=no op")
 var chromaSigma=flag.Float64("chromaSigma", 1.0, "only scale and add to LCH chroma for luminances n sigma above background")
 
+var chromaNR  = flag.Float64("chromaNR", 0, "reduce color mottle with an edge-preserving bilateral filter of this spatial sigma in pixels on the LCH chroma, 0=off")
+var chromaNRRange=flag.Float64("chromaNRRange", 0.05, "luminance difference sigma for the chroma noise reduction, smaller values preserve more edges")
+
 var chromaFrom= flag.Float64("chromaFrom", 295, "scale LCH chroma for hues in [from,to] by given factor, e.g. 295 to desaturate violet stars")
 var chromaTo  = flag.Float64("chromaTo", 40, "scale LCH chroma for hues in [from,to] by given factor, e.g. 40 to desaturate violet stars")
 var chromaBy  = flag.Float64("chromaBy", 1, "scale LCH chroma for hues in [from,to] by given factor, e.g. -1 to desaturate violet stars")
 
+var chromaLumFrom=flag.Float64("chromaLumFrom", 0, "scale LCH chroma for luminances in [from,to] % by given factor, e.g. 5 to skip background")
+var chromaLumTo = flag.Float64("chromaLumTo", 100, "scale LCH chroma for luminances in [from,to] % by given factor, e.g. 60 to skip star cores")
+var chromaLumBy = flag.Float64("chromaLumBy", 1, "scale LCH chroma for luminances in [from,to] % by given factor, e.g. 1.5 to boost nebula color; 1=no op")
+var chromaLumFeather=flag.Float64("chromaLumFeather", 2, "width in % of the linear transition of the luminance-ranged chroma scaling outside [from,to]")
+
 var rotFrom   = flag.Float64("rotFrom", 100, "rotate LCH color angles in [from,to] by given offset, e.g. 100 to aid Hubble palette for S2HaO3")
 var rotTo     = flag.Float64("rotTo", 190, "rotate LCH color angles in [from,to] by given offset, e.g. 190 to aid Hubble palette for S2HaO3")
 var rotBy     = flag.Float64("rotBy", 0, "rotate LCH color angles in [from,to] by given offset, e.g. -30 to aid Hubble palette for S2HaO3")
 
 var scnr      = flag.Float64("scnr",0,"apply SCNR in [0,1] to green channel, e.g. 0.5 for tricolor with S2HaO3 and 0.1 for bicolor HaO3O3")
+var palette   = flag.String("palette","SHO","narrowband palette preset for the palette command. SHO, HSO, HOS, OHS or bicolor HOO")
+var palGreen  = flag.Float64("palGreen",0,"fraction of Ha in the synthetic green of bicolor palettes, rest is OIII")
+var palWeights= flag.String("palWeights","1,1,1","comma-separated weights for the red, green and blue output channels of the palette command")
+var mix       = flag.String("mix","","mixing matrix for the mix command, one row per output channel R, G and B separated by semicolons, one comma-separated coefficient per input, e.g. 0.5,0.5,0;0,1,0;0,0,1")
+var ha        = flag.String("ha","","blend stacked Ha channel from `file` into red (and optionally luminance) for rgb, argb and lrgb commands")
+var haBlend   = flag.Float64("haBlend",1,"factor for blending the Ha signal above background into the red channel")
+var haLum     = flag.Float64("haLum",0,"factor for blending the Ha signal above background into the luminance channel for lrgb, 0=off")
+var haCont    = flag.Float64("haCont",0,"subtract red continuum scaled by this factor from Ha before blending, -1=estimate from field stars, 0=off")
+var contScale = flag.Float64("contScale",-1,"scale of the broadband channel to subtract from the narrowband channel for contsub, -1=estimate from field stars")
+var starRemRadius=flag.Float64("starRemRadius",3,"star removal: mask and inpaint stars within this multiple of their half-flux radius")
+var starsOnly = flag.String("starsOnly","","star removal: save star-only image to `file`, the difference of input and starless output")
+var starReduce= flag.Float64("starReduce",0,"star reduction strength in [0,1] for color composites, applied after stretching. 0=off")
+var starReduceIter=flag.Int64("starReduceIter",1,"star reduction: number of 3x3 minimum filter passes, more shrinks stars further")
+var spikes    = flag.Float64("spikes",0,"render cosmetic diffraction spikes on stars of color composites with this intensity in [0,1], after stretching. 0=off")
+var spikeThresh=flag.Float64("spikeThresh",0.1,"diffraction spikes: render on stars with at least this fraction of the brightest star's mass")
+var spikeLen  = flag.Float64("spikeLen",100,"diffraction spikes: length in pixels for the brightest star, shorter for fainter stars")
+var spikeAngle= flag.Float64("spikeAngle",45,"diffraction spikes: rotation angle in degrees")
+var scnrMethod= flag.Int64("scnrMethod",0,"SCNR protection method. 0=average neutral, 1=maximum neutral")
+var scnrLumMask=flag.Float64("scnrLumMask",0,"scale SCNR strength by luminance raised to this exponent, concentrating it on bright areas. 0=off")
 
 var autoLoc   = flag.Float64("autoLoc", 10, "histogram peak location in %% to target with automatic curves adjustment, 0=don't")
 var autoScale = flag.Float64("autoScale", 0.4, "histogram peak scale in %% to target with automatic curves adjustment, 0=don't")
 
+var asinh     = flag.Float64("asinh", 0, "apply arcsinh stretch of given strength to luminance, preserving star color, e.g. 100; 0=no op")
+var asinhBlack= flag.Float64("asinhBlack", 2, "arcsinh stretch black point in multiples of standard deviation below background location")
+
 var midtone   = flag.Float64("midtone", 0, "midtone value in multiples of standard deviation; 0=no op")
 var midBlack  = flag.Float64("midBlack", 2, "midtone black in multiples of standard deviation below background location")
 
+var hdr       = flag.Float64("hdr", 0, "compress large-scale dynamic range of color composites after stretching with this strength, e.g. 4 for bright galaxy cores. 0=off")
+var hdrLayers = flag.Int64("hdrLayers", 6, "number of wavelet layers kept as small-scale detail for HDR compression, structures above 2^n pixels are compressed")
+
 var gamma     = flag.Float64("gamma", 1, "apply output gamma, 1: keep linear light data")
 var ppGamma   = flag.Float64("ppGamma", 1, "apply post-peak gamma, scales curve from location+scale...ppLimit, 1: keep linear light data")
 var ppSigma   = flag.Float64("ppSigma", 1, "apply post-peak gamma this amount of scales from the peak (to avoid scaling background noise)")
 
 var scaleBlack= flag.Float64("scaleBlack", 0, "move black point so histogram peak location is given value in %%, 0=don't")
 
+var lrgbChromaBlur=flag.Float64("lrgbChromaBlur", 0, "LRGB combination: smooth color from the RGB channels with a gauss filter of this sigma in pixels, taking detail from luminance. 0=off")
+
+var config    = flag.String("config", "", "load parameters keyed by flag name from configuration `file` in JSON, YAML or TOML format. Flags given on the command line take precedence")
+var profile   = flag.String("profile", "", "load default parameters for the capture type from built-in profile dslr_osc, mono_lrgb or narrowband. Flags given explicitly, by configuration file or preset take precedence")
+var preset    = flag.String("preset", "", "load color and tone curve parameters from JSON preset `file`. Flags given on the command line take precedence")
+
+// Color and tone curve parameters covered by processing presets, by flag name
+var presetColorFlags=[]string{"neutSigmaLow", "neutSigmaHigh", "chromaNR", "chromaNRRange", "chromaGamma", "chromaSigma", 
+	"chromaFrom", "chromaTo", "chromaBy", "chromaLumFrom", "chromaLumTo", "chromaLumBy", "chromaLumFeather", "rotFrom", "rotTo", "rotBy", "scnr", "scnrMethod", "scnrLumMask"}
+var presetToneFlags =[]string{"autoLoc", "autoScale", "asinh", "asinhBlack", "midtone", "midBlack", "gamma", 
+	"ppGamma", "ppSigma", "scaleBlack", "hdr", "hdrLayers"}
+
 var darkF *nl.FITSImage=nil
 var flatF *nl.FITSImage=nil
+var exclusionMask *nl.ExclusionMask=nil
+var report *nl.StackReport=nil
+var psfTracker *nl.PSFTracker=nil
+var histograms *nl.HistogramSet=nil
+
+var provenanceCommand string        // Command for the processing history of FITS outputs
+var provenanceInputs  []string      // Input files for the processing history, as globbed by the command
+var provenance        []string=nil  // Processing history, computed on first use
 
 var lights   =[]*nl.FITSImage{}
+var wavGainsF []float32=nil
+var nrThreshF []float32=nil
+var lsEstimator nl.LSEstimatorMode=nl.LSESCMedianQn  // location and scale estimator for the current command
+var noiseEstimator nl.NoiseEstimatorMode=nl.NEImmerkaer  // noise estimator for weighting frames and batches
+var autoFlags=map[string]bool{}  // flags given as %auto before resolution, for config dump
+var ctx, cancel=context.WithCancel(context.Background())  // context for the current command, cancelled on interrupt or timeout
 
 func main() {
 	debug.SetGCPercent(10)
 	start:=time.Now()
+
+	// Stop processing when interrupted, and remove temporary files when interrupted again
+	interrupts:=make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupts
+		nl.LogPrintln("\nInterrupted, stopping. Interrupt again to exit immediately")
+		cancel()
+		<-interrupts
+		nl.LogFatal("\nInterrupted")
+	}()
+
 	flag.Usage=func(){
  	    nl.LogPrintf(`Nightlight Copyright (c) 2020 Markus L. Noga
 This program comes with ABSOLUTELY NO WARRANTY.
 This is free software, and you are welcome to redistribute it under certain conditions.
 Refer to https://www.gnu.org/licenses/gpl-3.0.en.html for details.
 
-Usage: %s [-flag value] (stats|stack|rgb|argb|lrgb|legal) (img0.fits ... imgn.fits)
-
-Commands:
-  stats   Show input image statistics
-  stack   Stack input images
-  rgb     Combine color channels. Inputs are treated as r, g and b channel in that order
-  argb    Combine color channels and align with luminance. Inputs are treated as l, r, g and b channels
-  lrgb    Combine color channels and combine with luminance. Inputs are treated as l, r, g and b channels
-  legal   Show license and attribution information
-  version Show version information
+%s
+Flags may be given before or after the command. After the command, only flags applicable to it are accepted.
+Use help with a command name to list these flags.
 
 Flags:
-`, os.Args[0])
+`, commandsHelp())
 	    flag.PrintDefaults()
 	}
 	flag.Parse()
+	args:=parseCommandFlags(flag.Args())
+
+	// Load parameters from configuration file, if selected
+	if *config!="" { loadConfig(*config) }
 
 	// Initialize logging to file in addition to stdout, if selected
 	if *log=="%auto" {
-		if *out!="" {
+		autoFlags["log"]=true
+		if *out!="" && *out!=nl.StdioFileName {
 			*log=strings.TrimSuffix(*out, filepath.Ext(*out))+".log"			
 		} else {
 			*log=""
@@ -164,15 +303,25 @@ Flags:
 		if err!=nil { nl.LogFatalf("Unable to open logfile '%s'\n", *log) }
 	}
 
+	// Load color and tone curve parameters from preset, if selected
+	if *preset!="" { loadPreset(*preset, explicitFlags()) }
+
+	// Load default parameters for the capture type from built-in profile, if selected
+	if *profile!="" { loadProfile(*profile, explicitFlags()) }
+
 	// Also auto-select JPEG output target
 	if *jpg=="%auto" {
-		if *out!="" {
+		autoFlags["jpg"]=true
+		if *out!="" && *out!=nl.StdioFileName {
 			*jpg=strings.TrimSuffix(*out, filepath.Ext(*out))+".jpg"			
 		} else {
 			*jpg=""
 		}
 	}
 
+	// Keep stdout free for output data if writing to it
+	if *out==nl.StdioFileName || *jpg==nl.StdioFileName { nl.LogToStderr() }
+
 	// Enable CPU profiling if flagged
     if *cpuprofile != "" {
         f, err := os.Create(*cpuprofile)
@@ -186,34 +335,17 @@ Flags:
       defer pprof.StopCPUProfile()
     }
 
-    args:=flag.Args()
     if len(args)<1 {
     	flag.Usage()
     	return
     }
-    if args[0]=="stats" || args[0]=="stack" || args[0]=="rgb" || args[0]=="argb" || args[0]=="lrgb" {
-	    nl.LogPrintf("Using location and scale estimator %d\n", *lsEst)
-		nl.LSEstimator=nl.LSEstimatorMode(*lsEst)
-	}
-
-    switch args[0] {
-    case "stats":
-    	cmdStats(args[1:], *batch)
-    case "stack":
-    	cmdStack(args[1:], *batch)
-    case "rgb":
-    	cmdRGB(args[1:])
-    case "argb":
-    	cmdLRGB(args[1:],false)
-    case "lrgb":
-    	cmdLRGB(args[1:],true)
-    case "legal":
-    	cmdLegal()
-    case "version":
-    	nl.LogPrintf("Version %s\n", version)
-    case "help", "?":
-    	flag.Usage()
-    default:
+    if *timeout>0 {
+    	var cancelTimeout context.CancelFunc
+    	ctx, cancelTimeout=context.WithTimeout(ctx, time.Duration(*timeout)*time.Second)
+    	defer cancelTimeout()
+    }
+    setupCommand(args[0])
+    if !runCommand(args) {
     	nl.LogPrintf("Unknown command '%s'\n\n", args[0])
     	flag.Usage()
     	return 
@@ -223,6 +355,13 @@ Flags:
 	elapsed:=now.Sub(start)
 	nl.LogPrintf("\nDone after %v\n", elapsed)
 
+	// Show timing telemetry per stage, and store it if flagged
+	nl.LogPrintf("\n%s", nl.Timings)
+	if len(nl.ArrayPoolsStats())>0 { nl.LogPrintf("\n%s", nl.ArrayPoolsString()) }
+	if *timings!="" {
+		if err:=nl.Timings.WriteJSONFile(*timings, elapsed); err!=nil { nl.LogFatalf("Error writing timings: %s\n", err) }
+	}
+
 	// Store memory profile if flagged
     if *memprofile != "" {
         f, err := os.Create(*memprofile)
@@ -238,6 +377,121 @@ Flags:
     nl.LogSync()
 }
 
+// Sets up global state for the given command from the flags
+func setupCommand(name string) {
+    if name=="stats" || name=="inspect" || name=="stack" || name=="bench" || name=="live" || name=="integrate" || name=="rgb" || name=="palette" || name=="mix" || name=="contsub" || name=="starless" || name=="argb" || name=="lrgb" {
+	    nl.LogPrintf("Using location and scale estimator %d\n", *lsEst)
+		lsEstimator=nl.LSEstimatorMode(*lsEst)
+	} else {
+		lsEstimator=nl.LSESCMedianQn
+	}
+	if name=="stack" || name=="bench" || name=="live" || name=="integrate" {
+		if *stPrecision!=32 && *stPrecision!=64 { nl.LogFatalf("Invalid stacking precision %d, must be 32 or 64\n", *stPrecision) }
+		if *stStore<0 || *stStore>2 { nl.LogFatalf("Invalid frame storage %d, must be 0, 1 or 2\n", *stStore) }
+		if *stCompress<0 || *stCompress>1 { nl.LogFatalf("Invalid frame compression %d, must be 0 or 1\n", *stCompress) }
+		if *stTrails<0 || *stTrails>2 { nl.LogFatalf("Invalid trail detection mode %d, must be 0, 1 or 2\n", *stTrails) }
+	}
+	if *noiseEst<0 || *noiseEst>2 { nl.LogFatalf("Invalid noise estimator %d, must be 0, 1 or 2\n", *noiseEst) }
+	noiseEstimator=nl.NoiseEstimatorMode(*noiseEst)
+	wavGainsF, nrThreshF=nil, nil
+	if *wavGains!="" {
+		var err error
+		wavGainsF, err=parseFloats(*wavGains)
+		if err!=nil { nl.LogFatalf("Invalid wavelet gains '%s': %s\n", *wavGains, err) }
+	}
+	if *nrThresh!="" {
+		var err error
+		nrThreshF, err=parseFloats(*nrThresh)
+		if err!=nil { nl.LogFatalf("Invalid noise reduction thresholds '%s': %s\n", *nrThresh, err) }
+	}
+	if *previewScale<1 { nl.LogFatalf("Invalid preview scale %d, must be 1 or more\n", *previewScale) }
+	if *previewScale>1 && (name=="stats" || name=="stack" || name=="live" || name=="integrate" || name=="rgb" || name=="palette" || name=="mix" || 
+	   name=="contsub" || name=="starless" || name=="argb" || name=="lrgb") {
+		setupPreview(*previewScale)
+	}
+}
+
+// Sets up a fast preview at 1/n scale. Bins the inputs by a further factor n, and scales the parameters given in pixels
+// accordingly, so the preview resembles the full resolution result. Wavelet layers finer than a preview pixel are dropped
+func setupPreview(n int64) {
+	if *binning<=1 { *binning=n } else { *binning*=n }
+	scale:=1/float64(n)
+	*starRadius=int64(math.Max(2, math.Round(float64(*starRadius)*scale)))
+	*backGrid   =*backGrid   /n
+	*rgbBackGrid=*rgbBackGrid/n
+	*usmSigma      *=scale
+	*spikeLen      *=scale
+	*lrgbChromaBlur*=scale
+	*alignT        *=scale
+
+	// each binning factor of 2 halves the size of the wavelet layers
+	layers:=int(math.Round(math.Log2(float64(n))))
+	if layers>=len(wavGainsF) { wavGainsF=nil } else { wavGainsF=wavGainsF[layers:] }
+	if layers>=len(nrThreshF) { nrThreshF=nil } else { nrThreshF=nrThreshF[layers:] }
+	*hdrLayers=int64(math.Max(1, float64(*hdrLayers-int64(layers))))
+
+	nl.LogPrintf("Preview at 1/%d scale with binning=%d starRadius=%d backGrid=%d rgbBackGrid=%d usmSigma=%.2f spikeLen=%.1f lrgbChromaBlur=%.2f alignT=%.3f wavGains=%v nrThresh=%v hdrLayers=%d\n",
+		n, *binning, *starRadius, *backGrid, *rgbBackGrid, *usmSigma, *spikeLen, *lrgbChromaBlur, *alignT, wavGainsF, nrThreshF, *hdrLayers)
+}
+
+// Runs the command given as first argument, with the remaining arguments. Returns false if the command is unknown
+func runCommand(args []string) bool {
+	provenanceCommand, provenanceInputs, provenance=args[0], nil, nil
+    switch args[0] {
+    case "stats":
+    	cmdStats(args[1:], *batch)
+    case "stack":
+    	cmdStack(args[1:], *batch)
+    case "select":
+    	cmdSelect(args[1:])
+    case "inspect":
+    	cmdInspect(args[1:])
+    case "estimate":
+    	cmdEstimate(args[1:])
+    case "bench":
+    	cmdBench(args[1:])
+    case "live":
+    	cmdLive(args[1:])
+    case "integrate":
+    	cmdIntegrate(args[1:])
+    case "rgb":
+    	cmdRGB(args[1:])
+    case "palette":
+    	cmdPalette(args[1:])
+    case "mix":
+    	cmdMix(args[1:])
+    case "contsub":
+    	cmdContsub(args[1:])
+    case "starless":
+    	cmdStarless(args[1:])
+    case "argb":
+    	cmdLRGB(args[1:],false)
+    case "lrgb":
+    	cmdLRGB(args[1:],true)
+    case "header":
+    	cmdHeader(args[1:])
+    case "split":
+    	cmdSplit(args[1:])
+    case "merge":
+    	cmdMerge(args[1:])
+    case "preset":
+    	cmdPreset(args[1:])
+    case "project":
+    	cmdProject(args[1:])
+    case "config":
+    	cmdConfig(args[1:])
+    case "legal":
+    	cmdLegal()
+    case "version":
+    	nl.LogPrintf("Version %s\n", version)
+    case "help", "?":
+    	cmdHelp(args[1:])
+    default:
+    	return false
+    }
+    return true
+}
+
 // Perform optional preprocessing and statistics
 func cmdStats(args []string, batchPattern string) {
 	// Set default parameters for this command
@@ -245,8 +499,7 @@ func cmdStats(args []string, batchPattern string) {
 	if *starBpSig<0 { *starBpSig=5 } // default to noise elimination, we don't know if stats are called on single frame or resulting stack
 
     // Load dark and flat if flagged
-    if *dark!="" { darkF=nl.LoadDark(*dark) }
-    if *flat!="" { flatF=nl.LoadFlat(*flat) }
+    loadDarkAndFlat(*dark, *flat)
 	if darkF!=nil && flatF!=nil && !nl.EqualInt32Slice(darkF.Naxisn, flatF.Naxisn) {
 		nl.LogFatal("Error: flat and dark files differ in size")
 	}
@@ -258,15 +511,17 @@ func cmdStats(args []string, batchPattern string) {
 	nl.LogPrintf("\nPreprocessing %d frames with dark=%d flat=%d debayer=%s cfa=%s binning=%d normRange=%d bpSigLow=%.2f bpSigHigh=%.2f starSig=%.2f starBpSig=%.2f starRadius=%d backGrid=%d:\n", 
 		len(fileNames), btoi(darkF!=nil), btoi(flatF!=nil), *debayer, *cfa, *binning, *normRange, *bpSigLow, *bpSigHigh, *starSig, *starBpSig, *starRadius, *backGrid)
 
-	sem   :=make(chan bool, runtime.NumCPU())
+	if *histOut!="" { histograms=nl.NewHistogramSet() }
+	lights:=make([]*nl.FITSImage, len(fileNames))
+	group :=nl.DefaultPool.NewGroup(ctx, int(maxParallelism()))
 	for id, fileName := range(fileNames) {
-		sem <- true 
-		go func(id int, fileName string) {
-			defer func() { <-sem }()
-			lightP, err:=nl.PreProcessLight(id, fileName, darkF, flatF, *debayer, *cfa, int32(*binning), int32(*normRange), float32(*bpSigLow), float32(*bpSigHigh), float32(*starSig), float32(*starBpSig), int32(*starRadius), int32(*backGrid), float32(*backSigma), int32(*backClip), *back)
+		id, fileName:=id, fileName
+		group.Go(func() {
+			lightP, err:=nl.PreProcessLight(id, fileName, darkF, flatF, *debayer, *cfa, int32(*binning), int32(*normRange), float32(*bpSigLow), float32(*bpSigHigh), lightStarSig(), float32(*starBpSig), int32(*starRadius), int32(*backGrid), float32(*backSigma), int32(*backClip), *back, lsEstimator)
 			if err!=nil {
 				nl.LogPrintf("%d: Error: %s\n", id, err.Error())
 			} else {
+				lights[id]=lightP
 				if (*pre)!="" {
 					err=lightP.WriteFile(fmt.Sprintf((*pre), id))
 					if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
@@ -277,15 +532,136 @@ func cmdStats(args []string, batchPattern string) {
 					if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
 					starsFits.Data=nil
 				}
+				histPreprocessed([]*nl.FITSImage{lightP})
 				lightP.Data=nil
 			}
-		}(id, fileName)
+		})
 	}
-	for i:=0; i<cap(sem); i++ {  // wait for goroutines to finish
-		sem <- true
+	group.Wait()
+	checkContext()
+	writeHistograms()
+
+	// Write out per-frame scores if desired
+	if *stScores!="" {
+		ids:=make([]int, len(fileNames))
+		for i:=range ids { ids[i]=i }
+		report=nl.NewStackReport(*out, lsEstimator)
+		report.AddPreprocessed(ids, fileNames, lights)
+		writeScores()
+		report=nil
 	}
 }
 
+// Perform inspect command. Preprocesses the given frames, which may also be stacks, and bins the detected
+// stars spatially into a grid. Shows the HFR per cell, with indicators for field curvature and tilt
+func cmdInspect(args []string) {
+	// Set default parameters for this command
+	if *normHist==nl.HNMAuto { *normHist=nl.HNMNone }
+	if *starBpSig<0 { *starBpSig=5 } // default to noise elimination, we don't know if inspect is called on single frame or resulting stack
+
+	loadDarkAndFlat(*dark, *flat)
+	if darkF!=nil && flatF!=nil && !nl.EqualInt32Slice(darkF.Naxisn, flatF.Naxisn) {
+		nl.LogFatal("Error: flat and dark files differ in size")
+	}
+
+	// Glob file name wildcards
+	fileNames:=globFilenameWildcards(args)
+	if fileNames==nil || len(fileNames)==0 {
+		nl.LogFatal("Error: no input files")
+	}
+
+	nl.LogPrintf("\nInspecting %d frames with %dx%d cells:\n", len(fileNames), *inspGrid, *inspGrid)
+	group :=nl.DefaultPool.NewGroup(ctx, int(maxParallelism()))
+	for id, fileName := range(fileNames) {
+		id, fileName:=id, fileName
+		group.Go(func() {
+			lightP, err:=nl.PreProcessLight(id, fileName, darkF, flatF, *debayer, *cfa, int32(*binning), int32(*normRange), float32(*bpSigLow), float32(*bpSigHigh), float32(*starSig), float32(*starBpSig), int32(*starRadius), int32(*backGrid), float32(*backSigma), int32(*backClip), *back, lsEstimator)
+			if err!=nil {
+				nl.LogPrintf("%d: Error: %s\n", id, err.Error())
+				return
+			}
+			width, height:=lightP.Naxisn[0], lightP.Naxisn[1]
+			lightP.Data=nil
+			hfrMap, err:=nl.NewStarFieldMap("HFR", lightP.Stars, width, height, int32(*inspGrid), int32(*inspGrid), func(s *nl.Star) float32 { return s.HFR })
+			if err!=nil {
+				nl.LogPrintf("%d: Error: %s\n", id, err.Error())
+				return
+			}
+			nl.LogPrintf("%d: %s: HFR per cell (stars):\n%v", id, fileName, hfrMap)
+
+			if (*inspOut)!="" {
+				outName:=fmt.Sprintf((*inspOut), id)
+				ext:=strings.ToLower(filepath.Ext(outName))
+				if ext==".jpg" || ext==".jpeg" {
+					err=hfrMap.Heatmap(64).WriteJPGToFile(outName, 95, nl.EENone, nl.DINone, nil)
+				} else {
+					err=hfrMap.FITS().WriteFile(outName)
+				}
+				if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+			}
+		})
+	}
+	group.Wait()
+	checkContext()
+}
+
+// Perform frame selection command. Preprocesses the given frames, and copies or links those matching
+// the selection criteria into the destination directory given as first argument
+func cmdSelect(args []string) {
+	// Set default parameters for this command
+	if *normHist==nl.HNMAuto { *normHist=nl.HNMNone }
+	if *starBpSig<0 { *starBpSig=5 } // default to noise elimination when working with individual subexposures
+
+	if len(args)<2 { nl.LogFatal("Need a destination directory and at least one input file for frame selection") }
+	if *selExpr=="" { nl.LogFatal("Need selection criteria given with -selExpr") }
+	criteria, err:=nl.ParseCriteria(*selExpr)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	destDir:=args[0]
+
+	loadDarkAndFlat(*dark, *flat)
+	if darkF!=nil && flatF!=nil && !nl.EqualInt32Slice(darkF.Naxisn, flatF.Naxisn) {
+		nl.LogFatal("Error: flat and dark files differ in size")
+	}
+
+	// Glob file name wildcards
+	fileNames:=globFilenameWildcards(args[1:])
+	if fileNames==nil || len(fileNames)==0 {
+		nl.LogFatal("Error: no input files")
+	}
+
+	// Preprocess light frames and evaluate criteria
+	nl.LogPrintf("\nSelecting from %d frames with criteria '%s'\n", len(fileNames), criteria.Expr)
+	matches:=make([]bool, len(fileNames))
+	group :=nl.DefaultPool.NewGroup(ctx, int(maxParallelism()))
+	for id, fileName := range(fileNames) {
+		id, fileName:=id, fileName
+		group.Go(func() {
+			lightP, err:=nl.PreProcessLight(id, fileName, darkF, flatF, *debayer, *cfa, int32(*binning), int32(*normRange), float32(*bpSigLow), float32(*bpSigHigh), float32(*starSig), float32(*starBpSig), int32(*starRadius), int32(*backGrid), float32(*backSigma), int32(*backClip), *back, lsEstimator)
+			if err!=nil {
+				nl.LogPrintf("%d: Error: %s\n", id, err.Error())
+				return
+			}
+			matches[id]=criteria.Match(lightP)
+			nl.LogPrintf("%d: %s: selected=%t\n", id, fileName, matches[id])
+			lightP.Data=nil
+		})
+	}
+	group.Wait()
+	checkContext()
+
+	// Copy or link the matching frames
+	if err:=os.MkdirAll(destDir, 0755); err!=nil { nl.LogFatalf("Error creating directory: %s\n", err) }
+	numSelected:=0
+	for id, fileName:=range fileNames {
+		if !matches[id] { continue }
+		destName, err:=nl.CopyOrLinkFile(fileName, destDir, *selLink)
+		if err!=nil { nl.LogFatalf("Error selecting file: %s\n", err) }
+		nl.LogPrintf("%d: %s -> %s\n", id, fileName, destName)
+		numSelected++
+	}
+	nl.LogPrintf("Selected %d of %d frames into %s\n", numSelected, len(fileNames), destDir)
+}
+
 
 // Perform stacking command
 func cmdStack(args []string, batchPattern string) {
@@ -293,63 +669,583 @@ func cmdStack(args []string, batchPattern string) {
 	if *normHist==nl.HNMAuto { *normHist=nl.HNMLocScale }
 	if *starBpSig<0 { *starBpSig=5 } // default to noise elimination when working with individual subexposures
 
-	// The stack of stacks
-	var stack *nl.FITSImage = nil
-	var stackFrames int64 = 0
-	var stackNoise  float32 = 0
+	loadDarkAndFlat(*dark, *flat)
+	if darkF!=nil && flatF!=nil && !nl.EqualInt32Slice(darkF.Naxisn, flatF.Naxisn) {
+		nl.LogFatal("Error: flat and dark files differ in size")
+	}
+	loadExclusionMask()
+
+	// Glob file name wildcards
+	fileNames:=globFilenameWildcards(args)
+	if fileNames==nil || len(fileNames)==0 {
+		nl.LogFatal("Error: no input files")
+	}
 
-    // Load dark and flat in parallel if flagged
-    sem   :=make(chan bool, 2) // limit parallelism to 2
-    if *dark!="" { 
-		sem <- true 
-		go func() { 
-    		defer func() { <-sem }()
-			darkF=nl.LoadDark(*dark) 
-		}() 
+	if *stReport!="" || *stScores!="" { report=nl.NewStackReport(*out, lsEstimator) }
+	if *stPSF>0 { psfTracker=nl.NewPSFTracker() }
+	if *histOut!="" { histograms=nl.NewHistogramSet() }
+
+	stack, disp:=stackFiles(fileNames, batchPattern, *stCheckpoint, *dark, *flat)
+	if psfTracker!=nil {
+		reportPSF(stack, fileNames[0])
+		psfTracker=nil
 	}
-    if *flat!="" { 
-		sem <- true 
-    	go func() { 
-	    	defer func() { <-sem }()
-    		flatF=nl.LoadFlat(*flat) 
-		}() 
+	if report!=nil {
+		if err:=report.SetStack(stack); err!=nil { nl.LogPrintf("Error creating report thumbnail: %s\n", err) }
 	}
-    if *dark!="" {   // wait for goroutine to finish
-		sem <- true
+	if *stSNR!="" { saveSNRMap(stack) }
+	histImage("stack", stack)
+	saveStack(stack)
+
+	// Write out dispersion map if desired
+	if disp!=nil {
+		nl.LogPrintf("Writing dispersion map to %s: %v\n", *stDisp, disp.Stats)
+		err:=withProvenance(disp).WriteFile(*stDisp)
+		if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
 	}
-    if *flat!="" {   // wait for goroutine to finish
-		sem <- true
+
+	// Write out quality report and scores if desired
+	if report!=nil && *stReport!="" {
+		nl.LogPrintf("Writing quality report to %s\n", *stReport)
+		err:=report.WriteHTMLFile(*stReport)
+		if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
 	}
+	writeScores()
+	report=nil
+	writeHistograms()
+}
 
-	if darkF!=nil && flatF!=nil && !nl.EqualInt32Slice(darkF.Naxisn, flatF.Naxisn) {
-		nl.LogFatal("Error: flat and dark files differ in size")
+// Fits the point spread function of the given linear stack, and compares it to the sharpest frame.
+// Reports the FWHM in arcseconds if the pixel scale is flagged, or found in the header of the given frame
+func reportPSF(stack *nl.FITSImage, fileName string) {
+	scale:=float32(*pixScale)
+	if scale<=0 {
+		h, err:=nl.ReadFITSHeaderFile(fileName)
+		if err==nil { scale, err=nl.PixelScale(&h) }
+		if err!=nil {
+			nl.LogPrintf("Reporting FWHM in pixels only: %s\n", err)
+		} else {
+			if *binning>1 { scale*=float32(*binning) }
+			nl.LogPrintf("Pixel scale %.3g\"/pixel from header of %s\n", scale, fileName)
+		}
+	}
+
+	psf:=nl.FitPSF(stack.Data, stack.Naxisn[0], stack.Stars, stack.Stats.Location, 0.95*stack.Stats.Max, int32(*starRadius), int(*stPSF))
+	if psf.NumStars==0 {
+		nl.LogPrintf("Unable to fit the PSF of the stack\n")
+		return
 	}
+	nl.LogPrintf("PSF of stack: %s\n", psf.Format(scale))
+	if psfTracker.ID>=0 {
+		best:=psfTracker.PSF
+		nl.LogPrintf("PSF of sharpest frame %d %s: %s\n", psfTracker.ID, psfTracker.FileName, best.Format(scale))
+		nl.LogPrintf("Alignment and stacking changed the FWHM by %+.1f%% over the sharpest frame\n", (psf.FWHM/best.FWHM-1)*100)
+	}
+}
+
+// Records histograms of the given preprocessed light frames, if desired
+func histPreprocessed(lights []*nl.FITSImage) {
+	if histograms==nil { return }
+	for _, l:=range lights {
+		if l==nil || l.Data==nil { continue }
+		if err:=histograms.AddImage("light", l.ID, l, lsEstimator); err!=nil { nl.LogFatal(err) }
+	}
+}
+
+// Records histograms of all channels of the given image under the given name, if desired
+func histImage(name string, img *nl.FITSImage) {
+	if histograms==nil { return }
+	if err:=histograms.AddImage(name, -1, img, lsEstimator); err!=nil { nl.LogFatal(err) }
+}
+
+// Writes the recorded histograms, if desired, and stops recording
+func writeHistograms() {
+	if histograms==nil { return }
+	nl.LogPrintf("Writing %d histograms to %s\n", len(histograms.Histograms), *histOut)
+	if err:=histograms.WriteFile(*histOut); err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+	histograms=nil
+}
+
+// Writes per-frame scores and their trend charts from the report, if desired
+func writeScores() {
+	if report==nil || *stScores=="" { return }
+	chartsName:=strings.TrimSuffix(*stScores, filepath.Ext(*stScores))+".svg"
+	nl.LogPrintf("Writing per-frame scores to %s and trend charts to %s\n", *stScores, chartsName)
+	if err:=report.WriteScoresCSV(*stScores); err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+	if err:=report.WriteScoresSVG(chartsName); err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+}
+
+// Perform estimate command. Scans the headers of the input frames, and shows the batch plan, peak memory
+// and expected runtime per stage for stacking them with the current flags on this machine, without processing them
+func cmdEstimate(args []string) {
+	// Set default parameters for this command, like for stacking
+	if *normHist==nl.HNMAuto { *normHist=nl.HNMLocScale }
 
 	// Glob file name wildcards
 	fileNames:=globFilenameWildcards(args)
 	if fileNames==nil || len(fileNames)==0 {
 		nl.LogFatal("Error: no input files")
 	}
-	// Split input into required number of randomized batches, given the permissible amount of memory
-	numBatches, batchSize, overallIDs, overallFileNames, imageLevelParallelism:=nl.PrepareBatches(fileNames, *stMemory, darkF, flatF)
+
+	// Scan input headers for image sizes
+	nl.LogPrintf("\nScanning %d frames:\n", len(fileNames))
+	var naxisn []int32
+	numErrors, numMismatched:=0, 0
+	for id, fileName:=range fileNames {
+		n, err:=nl.ReadImageSize(fileName)
+		if err!=nil {
+			nl.LogPrintf("%d: Error: %s\n", id, err.Error())
+			numErrors++
+		} else if naxisn==nil {
+			naxisn=n
+		} else if !nl.EqualInt32Slice(n, naxisn) {
+			nl.LogPrintf("%d: Warning: %s has size %v, differs from %v\n", id, fileName, n, naxisn)
+			numMismatched++
+		}
+	}
+	if naxisn==nil { nl.LogFatal("Error: no readable input files") }
+	nl.LogPrintf("%d frames of size %v, %d unreadable, %d with different size\n", len(fileNames)-numErrors-numMismatched, naxisn, numErrors, numMismatched)
+
+	// Calibration frames determine the frame size for stacking, if given
+	numCalib:=int64(0)
+	for _, calib:=range []string{*dark, *flat} {
+		if calib=="" { continue }
+		n, err:=nl.ReadImageSize(calib)
+		if err!=nil { nl.LogFatalf("Error reading calibration frame: %s\n", err) }
+		if numCalib==0 { naxisn=n }
+		numCalib++
+	}
+
+	if *stStream>0 || *stTiles>0 || *stSpill==1 {
+		nl.LogPrintf("Note: -stStream, -stTiles and -stSpill stack without batches, estimating batched stacking instead\n")
+	}
+
+	pixels:=int64(naxisn[0])*int64(naxisn[1])
+	params:=nl.EstimateParams{
+		NumFrames     : int64(len(fileNames)),
+		Pixels        : pixels,
+		StMemory      : *stMemory,
+		MaxParallelism: maxParallelism(),
+		NumCalib      : numCalib,
+		Storage       : nl.FrameStorage(*stStore),
+		BackGrid      : *backGrid>0,
+		Align         : *align!=0,
+		Normalize     : *normHist!=nl.HNMNone,
+		Mode          : nl.StackMode(*stMode),
+		FindSigmas    : !(*stSigLow>=0 && *stSigHigh>=0),
+		Disp          : *stDisp!="",
+	}
+	nsPerOp:=nl.MeasureSpeed()
+	e, err:=nl.EstimateStack(params, nsPerOp)
+	if err!=nil { nl.LogFatal(err.Error()) }
+
+	nl.LogPrintf("\nEach frame has %dx%d pixels (%.1f MPixels) and takes %.1f MiB in-memory as floating point\n",
+		naxisn[0], naxisn[1], float32(pixels)*1e-6, float32(pixels*4)/(1024*1024))
+	nl.LogPrintf("CPU has %d threads, using up to %d. -stMemory is %d MiB\n", runtime.GOMAXPROCS(0), maxParallelism(), *stMemory)
+	nl.LogPrintf("Batch plan: %d batches of batch size %d with %d images in parallel\n", e.NumBatches, e.BatchSize, e.ImageLevelParallelism)
+	if e.NumBatches>1 && *stSpill==2 && *stCheckpoint=="" && nl.MmapSupported {
+		nl.LogPrintf("Note: -stSpill 2 stacks these frames in a single batch from memory-mapped temporary files instead\n")
+	}
+	nl.LogPrintf("Peak memory: %d MiB for %d frames\n", e.PeakMiB, e.PeakFrames)
+	nl.LogPrintf("Machine speed: %.2fns per reference operation\n", nsPerOp)
+	nl.LogPrintf("\nExpected runtime per stage:\n")
+	for _, s:=range e.Stages {
+		nl.LogPrintf("%-20s %10s\n", s.Name, s.Runtime.Round(time.Millisecond))
+	}
+	nl.LogPrintf("%-20s %10s\n", "Total", e.Total().Round(time.Millisecond))
+}
+
+// Benchmark command. Generates synthetic frames and reports the throughput of loading, calibration,
+// star detection, alignment and each stacking mode on this machine
+func cmdBench(args []string) {
+	if len(args)>0 { nl.LogFatal("The bench command takes no input files") }
+	params:=nl.BenchParams{
+		Width      : int32(*benchWidth),
+		Height     : int32(*benchHeight),
+		NumFrames  : int(*benchFrames),
+		NumStars   : int(*benchStars),
+		Parallelism: maxParallelism(),
+		Precision  : int32(*stPrecision),
+		Seed       : *seed,
+		LSEst      : lsEstimator,
+	}
+	nl.LogPrintf("\nBenchmarking %d synthetic frames of %dx%d pixels with %d stars, using %d of %d threads\n",
+		params.NumFrames, params.Width, params.Height, params.NumStars, params.Parallelism, runtime.GOMAXPROCS(0))
+	results, err:=nl.RunBenchmark(ctx, params)
+	if err!=nil { nl.LogFatalf("Error: %s\n", err.Error()) }
+	nl.LogPrintf("\nThroughput per stage for %d frames of %.1f MPixels:\n%s", params.NumFrames, float32(params.Width)*float32(params.Height)*1e-6, nl.BenchResultsString(results))
+}
+
+// Records preprocessed frames in the quality report, if any
+func reportPreprocessed(ids []int, fileNames []string, lights []*nl.FITSImage) {
+	if report==nil { return }
+	report.AddPreprocessed(ids, fileNames, lights)
+}
+
+// Records the reference frame in the quality report, if any
+func reportReference(ref *nl.FITSImage) {
+	if report==nil { return }
+	if err:=report.SetReference(ref); err!=nil { nl.LogPrintf("Error creating report thumbnail: %s\n", err) }
+}
+
+// Records the outcome of alignment in the quality report, if any
+func reportPostprocessed(lights []*nl.FITSImage) {
+	if report==nil { return }
+	report.AddPostprocessed(lights)
+}
+
+// Perform live stacking command. Watches the given directory for new light frames, calibrates and aligns
+// each, and adds it to a running stack. Writes the stack and a stretched JPEG preview after each frame
+func cmdLive(args []string) {
+	// Set default parameters for this command
+	if *normHist==nl.HNMAuto { *normHist=nl.HNMLocScale }
+	if *starBpSig<0 { *starBpSig=5 } // default to noise elimination when working with individual subexposures
+
+	if len(args)!=1 { nl.LogFatal("Need exactly one directory to watch for live stacking") }
+	dir:=args[0]
+	loadDarkAndFlat(*dark, *flat)
+	if darkF!=nil && flatF!=nil && !nl.EqualInt32Slice(darkF.Naxisn, flatF.Naxisn) {
+		nl.LogFatal("Error: flat and dark files differ in size")
+	}
+	loadExclusionMask()
+
+	reservoirSize:=int(*stStream)
+	if reservoirSize<=0 { reservoirSize=3 }
+	sigLow, sigHigh:=float32(*stSigLow), float32(*stSigHigh)
+	if sigLow <0 { sigLow =3 }
+	if sigHigh<0 { sigHigh=3 }
+	nl.LogPrintf("\nWatching %s for new frames every %gs, stacking with reservoir %d stSigLow %.2f stSigHigh %.2f\n", dir, *livePoll, reservoirSize, sigLow, sigHigh)
+
+	var refFrame *nl.FITSImage
+	var streamer *nl.StreamStacker
+	sizes:=map[string]int64{}  // sizes of files seen in the previous poll, -1 once processed
+	lastFrame, id:=time.Now(), 0
+	for {
+		fileNames, err:=pollNewFrames(dir, sizes)
+		if err!=nil { nl.LogFatalf("Error watching directory: %s\n", err) }
+
+		for _, fileName:=range fileNames {
+			if ctx.Err()!=nil { break }
+			nl.LogPrintf("\nNew frame %d: %s\n", id, fileName)
+			lastFrame=time.Now()
+			lights, err:=preProcessLights([]int{id}, []string{fileName}, 1)
+			if err!=nil { nl.LogFatal(err.Error()) }
+			id++
+			if lights[0]==nil { continue }
+
+			// The first frame with stars becomes the reference frame
+			if (*align!=0 || *normHist!=0) && (refFrame==nil) {
+				if len(lights[0].Stars)==0 {
+					nl.LogPrintf("%d: No stars found, cannot use as reference frame\n", lights[0].ID)
+					continue
+				}
+				refFrame=lights[0]
+				nl.LogPrintf("Using frame %d as reference. %v.\n", refFrame.ID, refFrame.Stats)
+			}
+
+			_, err=nl.PostProcessLights(ctx, refFrame, refFrame, lights, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), nl.OOBModeNaN, exclusionMask,
+			                            float32(*usmSigma), float32(*usmGain), float32(*usmThresh), wavGainsF, *post, lsEstimator, 1)
+			if err!=nil { nl.LogFatal(err.Error()) }
+			if lights[0]==nil { continue }
+
+			if streamer==nil {
+				refFrameLoc:=lights[0].Stats.Location
+				if refFrame!=nil && refFrame.Stats!=nil { refFrameLoc=refFrame.Stats.Location }
+				streamer=nl.NewStreamStacker(reservoirSize, sigLow, sigHigh, refFrameLoc, int32(*stPrecision), lsEstimator)
+			}
+			err=streamer.Add(lights[0])
+			if err!=nil { nl.LogPrintf("%d: Error: %s\n", lights[0].ID, err.Error()); continue }
+
+			// Write out current stack and preview
+			stack, err:=streamer.Current()
+			if err!=nil { nl.LogFatal(err.Error()) }
+			nl.LogPrintf("Live stack of %d frames: Exposure %gs %v\n", streamer.NumFrames, stack.Exposure, stack.Stats)
+			if (*jpg)!="" {
+				err=stack.WritePreviewJPGToFile(*jpg, float32(*autoLoc)/100, 95)
+				if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+			}
+			saveStack(stack)
+			lights, stack=nil, nil
+			debug.FreeOSMemory()
+		}
+
+		if ctx.Err()!=nil {
+			nl.LogPrintln("\nStopping live stacking")
+			break
+		}
+		if *liveIdle>0 && time.Since(lastFrame).Seconds()>*liveIdle {
+			nl.LogPrintf("\nNo new frames for %gs, stopping\n", *liveIdle)
+			break
+		}
+		time.Sleep(time.Duration(*livePoll*float64(time.Second)))
+	}
+}
+
+// Returns the FITS files in the given directory which are new since the last poll, in name order.
+// A file is only returned once its size has not changed between two polls, so capture software
+// can finish writing it. Tracks file sizes in the given map
+func pollNewFrames(dir string, sizes map[string]int64) (fileNames []string, err error) {
+	infos, err:=ioutil.ReadDir(dir)
+	if err!=nil { return nil, err }
+	for _, info:=range infos {
+		if info.IsDir() { continue }
+		name:=strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(info.Name(), ".gz"), ".gzip"))
+		ext:=filepath.Ext(name)
+		if ext!=".fits" && ext!=".fit" && ext!=".fts" { continue }
+
+		fileName:=filepath.Join(dir, info.Name())
+		prev, seen:=sizes[fileName]
+		if prev<0 { continue } // already processed
+		if seen && prev==info.Size() {
+			fileNames=append(fileNames, fileName)
+			sizes[fileName]=-1
+		} else {
+			sizes[fileName]=info.Size()
+		}
+	}
+	return fileNames, nil
+}
+
+// Perform multi-session integration command. Each session from the manifest is calibrated with its own dark
+// and flat, and stacked with its own reference frame. The session stacks are then aligned and normalized to
+// the best session, and combined with inverse variance weights based on their noise
+func cmdIntegrate(args []string) {
+	// Set default parameters for this command
+	if *normHist==nl.HNMAuto { *normHist=nl.HNMLocScale }
+	if *starBpSig<0 { *starBpSig=5 } // default to noise elimination when working with individual subexposures
+
+	if len(args)!=1 { nl.LogFatal("Need exactly one manifest file to perform an integration") }
+	manifest, err:=nl.LoadManifest(args[0])
+	if err!=nil { nl.LogFatal(err.Error()) }
+	loadExclusionMask()
+
+	// Stack each session independently
+	sessions:=make([]*nl.FITSImage, len(manifest.Sessions))
+	for i, s:=range manifest.Sessions {
+		nl.LogPrintf("\nStarting session %d of %d '%s' with dark=%s flat=%s\n", i, len(manifest.Sessions), s.Name, s.Dark, s.Flat)
+		darkF, flatF=nil, nil
+		loadDarkAndFlat(s.Dark, s.Flat)
+		if darkF!=nil && flatF!=nil && !nl.EqualInt32Slice(darkF.Naxisn, flatF.Naxisn) {
+			nl.LogFatalf("Error: flat and dark files differ in size for session '%s'\n", s.Name)
+		}
+
+		fileNames:=globFilenameWildcards(s.Lights)
+		if fileNames==nil || len(fileNames)==0 {
+			nl.LogFatalf("Error: no input files for session '%s'\n", s.Name)
+		}
+
+		checkpointDir:=""
+		if *stCheckpoint!="" { checkpointDir=filepath.Join(*stCheckpoint, fmt.Sprintf("session%02d", i)) }
+		sessions[i], _=stackFiles(fileNames, "", checkpointDir, s.Dark, s.Flat)
+		sessions[i].ID=i
+		darkF, flatF=nil, nil
+		debug.FreeOSMemory()
+	}
+	if len(sessions)==1 {
+		saveStack(sessions[0])
+		return
+	}
+
+	// Select reference session, then align and normalize the other sessions to it
+	refSession, refScore:=nl.SelectReferenceFrame(sessions)
+	if refSession==nil { nl.LogFatal("Reference session for alignment and normalization not found.") }
+	nl.LogPrintf("\nUsing session %d as reference. Score %.4g, %v.\n", refSession.ID, refScore, refSession.Stats)
+
+	// Weight sessions by inverse variance. Noise is estimated before alignment, as out of bounds areas are NaN
+	// afterwards, and adjusted for the scaling applied by histogram normalization
+	weights:=make([]float32, len(sessions))
+	invVarSum:=float32(0)
+	for i, s:=range sessions {
+		noise:=s.Stats.Noise
+		if nl.HistoNormMode(*normHist)==nl.HNMLocScale { noise*=refSession.Stats.Scale/s.Stats.Scale }
+		weights[i]=1/(noise*noise)
+		invVarSum+=weights[i]
+		nl.LogPrintf("Session %d '%s': normalized noise %.4g weight %.4g\n", s.ID, manifest.Sessions[s.ID].Name, noise, weights[i])
+	}
+
+	imageLevelParallelism:=maxParallelism()
+	if imageLevelParallelism>int32(len(sessions)) { imageLevelParallelism=int32(len(sessions)) }
+	nl.LogPrintf("Postprocessing %d sessions with align=%d alignK=%d alignT=%.3f normHist=%d:\n", len(sessions), *align, *alignK, *alignT, *normHist)
+	_, err=nl.PostProcessLights(ctx, refSession, refSession, sessions, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), nl.OOBModeNaN, nil,
+	                            0, 0, 0, nil, "", lsEstimator, imageLevelParallelism)
+	if err!=nil { nl.LogFatal(err.Error()) }
+
+	// Remove nils from sessions, along with their weights
+	o:=0
+	for i:=0; i<len(sessions); i+=1 {
+		if sessions[i]!=nil {
+			sessions[o], weights[o]=sessions[i], weights[i]
+			o+=1
+		} else {
+			invVarSum-=weights[i]
+		}
+	}
+	sessions, weights=sessions[:o], weights[:o]
+
+	nl.LogPrintf("\nCombining %d sessions:\n", len(sessions))
+	stack, _, _, err:=nl.Stack(ctx, sessions, nl.StMean, weights, refSession.Stats.Location, 0, 0, 0, 0, false, int32(*stPrecision), lsEstimator)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	stack.Stars, _, stack.HFR=nl.FindStars(stack.Data, stack.Naxisn[0], stack.Stats.Location, stack.Stats.Scale, 
+		float32(*starSig), float32(*starBpSig), int32(*starRadius), nil)
+	nl.LogPrintf("Integrated stack: Stars %d HFR %.2f Exposure %gs %v\n", len(stack.Stars), stack.HFR, stack.Exposure, stack.Stats)
+	nl.LogPrintf("Expected noise %.4g from combining %d sessions\n", 1/float32(math.Sqrt(float64(invVarSum))), len(sessions))
+
+	sessions=nil
+	debug.FreeOSMemory()
+	saveStack(stack)
+}
+
+// Load dark and flat frames in parallel, if given
+func loadDarkAndFlat(dark, flat string) {
+    // Load dark and flat in parallel if flagged
+    var darkErr, flatErr error
+    group :=nl.DefaultPool.NewGroup(context.Background(), 2) // limit parallelism to 2
+    if dark!="" { 
+		group.Go(func() { 
+			darkF, darkErr=nl.LoadDark(dark) 
+		}) 
+	}
+    if flat!="" { 
+    	group.Go(func() { 
+    		flatF, flatErr=nl.LoadFlat(flat) 
+		}) 
+	}
+	group.Wait()
+	if darkErr!=nil { nl.LogFatalf("Error loading dark: %s\n", darkErr) }
+	if flatErr!=nil { nl.LogFatalf("Error loading flat: %s\n", flatErr) }
+}
+
+// Load the exclusion mask for light frames, if given
+func loadExclusionMask() {
+	if *stExclude=="" { return }
+	var err error
+	exclusionMask, err=nl.LoadExclusionMask(*stExclude, *stExcludeFrames)
+	if err!=nil { nl.LogFatalf("Error loading exclusion mask: %s\n", err) }
+}
+
+// Stack the given files into a single image, using batches, streaming or bands as flagged.
+// Applies the currently loaded dark and flat frames, loaded from the given files, and frees them when done.
+// Checkpoints completed batches to the given directory if not blank, and resumes from there.
+// Also returns the dispersion map of the stacked frames if desired, else nil
+func stackFiles(fileNames []string, batchPattern, checkpointDir, darkFile, flatFile string) (stack, disp *nl.FITSImage) {
+	var stackFrames     int64   = 0
+	var stackInputNoise float32 = 0
+	var dispPool        *nl.DispersionPool
+
+	gates:=nl.NewQualityGates(int64(len(fileNames)), *stMinFrames, float32(*stMaxSkip))
+
+	// Stream frames through a one-pass stack if desired, which needs no batches
+	if *stStream>0 {
+		return stackStream(fileNames, int(*stStream), gates)
+	}
+
+	// Stack in bands from temporary files if desired, which needs no batches
+	if *stTiles>0 {
+		return stackTiled(fileNames, int32(*stTiles), gates)
+	}
+
+	// Stack in a single batch from memory-mapped temporary files if desired
+	if *stSpill==1 {
+		return stackMapped(fileNames, gates)
+	}
+
+	// Split input into required number of randomized batches, given the permissible amount of memory.
+	// If the frames do not fit into a single batch, spill them to memory-mapped temporary files instead if desired
+	numBatches, batchSize, overallIDs, overallFileNames, imageLevelParallelism, err:=nl.PrepareBatches(fileNames, *stMemory, maxParallelism(), darkF, flatF, nl.FrameStorage(*stStore), *seed)
+	if (err!=nil || numBatches>1) && *stSpill==2 && checkpointDir=="" && nl.MmapSupported {
+		nl.LogPrintf("Frames exceed -stMemory, spilling them to memory-mapped temporary files instead of batches\n")
+		return stackMapped(fileNames, gates)
+	}
+	if err!=nil { nl.LogFatal(err.Error()) }
+	if scheduled:=numBatches*batchSize; scheduled<int64(len(fileNames)) {
+		nl.LogPrintf("Warning: batches cover only %d of %d frames\n", scheduled, len(fileNames))
+		gates.Total=scheduled
+	}
+	scheduledFrames:=numBatches*batchSize
+	if scheduledFrames>int64(len(fileNames)) { scheduledFrames=int64(len(fileNames)) }
 
 	// Process each batch. The first batch sets the reference image, and if solving for sigLow/High also those. 
 	// They are then reused in subsequent batches
 	refFrame:=(*nl.FITSImage)(nil)
 	sigLow, sigHigh:=float32(-1), float32(-1)
-	for b:=int64(0); b<numBatches; b++ {
+
+	if checkpointDir!="" && *stDisp!="" {
+		nl.LogPrintf("Note: dispersion map covers only batches stacked since the last resume\n")
+	}
+
+	// Adds a batch to the stack of stacks, combined as suitable for the stacking mode, and tracks
+	// the average noise of the input frames. The stack of stacks is complete once finalized
+	batches:=nl.NewBatchStacker(nl.StackMode(*stMode), int32(*stPrecision))
+	addBatch:=func(batch *nl.FITSImage, frames int64, inputNoise float32) {
+		stackFrames    +=frames
+		stackInputNoise+=inputNoise*float32(frames)
+		if numBatches>1 {
+			batches.Add(batch, frames)
+		} else {
+			stack=batch
+		}
+	}
+
+	// Resume from checkpoint if desired and available, restoring batch order, reference frame and sigmas
+	// and re-integrating the completed batches. Otherwise start a fresh checkpoint
+	var cp *nl.Checkpoint
+	firstBatch, batchStartOffset:=int64(0), int64(0)
+	if checkpointDir!="" {
+		if err:=os.MkdirAll(checkpointDir, 0755); err!=nil { nl.LogFatalf("Error creating checkpoint directory: %s\n", err) }
+		var err error
+		params, err:=checkpointParams(darkFile, flatFile)
+		if err!=nil { nl.LogFatalf("Error hashing calibration frames: %s\n", err) }
+		cp, err=nl.LoadCheckpoint(checkpointDir, fileNames, params)
+		if err!=nil { nl.LogFatalf("Error loading checkpoint: %s\n", err) }
+		if cp==nil {
+			cp=nl.NewCheckpoint(checkpointDir, overallIDs, overallFileNames, numBatches, batchSize, params)
+		} else {
+			numBatches, batchSize, overallIDs, overallFileNames=cp.NumBatches, cp.BatchSize, cp.IDs, cp.FileNames
+			refFrame, sigLow, sigHigh=cp.RefFrame(), cp.SigLow, cp.SigHigh
+			firstBatch=int64(len(cp.Batches))
+			nl.LogPrintf("Resuming from checkpoint in %s with %d of %d batches completed\n", checkpointDir, firstBatch, numBatches)
+			for b, cb:=range cp.Batches {
+				nl.LogPrintf("Reading batch %d result from %s\n", b, cb.FileName)
+				batch:=nl.NewFITSImage()
+				err:=batch.ReadFile(cb.FileName)
+				if err!=nil { nl.LogFatalf("Error reading checkpoint batch: %s\n", err) }
+				batch.Stats, err=nl.CalcExtendedStats(batch.Data, batch.Naxisn[0], lsEstimator)
+				if err!=nil { nl.LogFatalf("Error calculating extended stats: %s\n", err) }
+				batch.Stats.Noise=cb.Noise
+				if numBatches==1 {
+					batch.Stars, _, batch.HFR=nl.FindStars(batch.Data, batch.Naxisn[0], batch.Stats.Location, batch.Stats.Scale, 
+						float32(*starSig), float32(*starBpSig), int32(*starRadius), nil)
+				}
+				addBatch(&batch, cb.Frames, cb.InputNoise)
+				gates.Add(cb.Frames, 0, 0)
+				batchStartOffset+=cb.Frames
+			}
+			scheduledFrames=batchStartOffset+(numBatches-firstBatch)*batchSize
+			if scheduledFrames>int64(len(fileNames)) { scheduledFrames=int64(len(fileNames)) }
+		}
+	}
+
+	for b:=firstBatch; b<numBatches; b++ {
 		// Cut out relevant part of the overall input filenames
-		batchStartOffset:= b   *batchSize
-		batchEndOffset  :=(b+1)*batchSize
-		if batchEndOffset>int64(len(fileNames)) { batchEndOffset=int64(len(fileNames)) }
+		batchEndOffset  :=batchStartOffset+batchSize
+		if batchEndOffset>scheduledFrames { batchEndOffset=scheduledFrames }
 		batchFrames     :=batchEndOffset-batchStartOffset
 		ids      :=overallIDs      [batchStartOffset:batchEndOffset]
 		fileNames:=overallFileNames[batchStartOffset:batchEndOffset]
 		nl.LogPrintf("\nStarting batch %d of %d with %d images: %v...\n", b, numBatches, len(ids), ids)
 
-		// Stack the files in this batch
-		batch, avgNoise :=(*nl.FITSImage)(nil), float32(0)
-		batch, refFrame, sigLow, sigHigh, avgNoise=stackBatch(ids, fileNames, refFrame, sigLow, sigHigh, imageLevelParallelism)
+		// Stack the files in this batch, measuring its memory use if the remaining batches are to be adapted
+		var monitor *nl.MemoryMonitor
+		if *stAdapt!=0 && b==0 && numBatches>1 {
+			debug.FreeOSMemory()
+			monitor=nl.StartMemoryMonitor(20*time.Millisecond)
+		}
+		batch, batchDisp, avgNoise :=(*nl.FITSImage)(nil), (*nl.FITSImage)(nil), float32(0)
+		batchMoments:=&nl.PixelMoments{}
+		batch, batchDisp, refFrame, sigLow, sigHigh, avgNoise=stackBatch(ids, fileNames, refFrame, sigLow, sigHigh, imageLevelParallelism, gates, batchMoments)
+
+		// Weight the batch by the noise from the selected estimator, if it differs from the standard one in the stats
+		if noiseEstimator!=nl.NEImmerkaer { batch.Stats.Noise=nl.EstimateNoise(batch.Data, batch.Naxisn[0], noiseEstimator) }
 
 		// Find stars in the newly stacked batch and report out on them
 		batch.Stars, _, batch.HFR=nl.FindStars(batch.Data, batch.Naxisn[0], batch.Stats.Location, batch.Stats.Scale, 
@@ -368,18 +1264,32 @@ func cmdStack(args []string, batchPattern string) {
 			if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
 		}
 
+		// Update checkpoint if desired
+		if cp!=nil {
+			err:=cp.AddBatch(batch, batchFrames, avgNoise, refFrame, sigLow, sigHigh)
+			if err!=nil { nl.LogFatalf("Error writing checkpoint: %s\n", err) }
+		}
+
 		// Update stack of stacks
-		if numBatches>1 {
-			stack=nl.StackIncremental(stack, batch, float32(batchFrames))
-			stackFrames+=batchFrames
-			stackNoise +=batch.Stats.Noise*float32(batchFrames)
-		} else {
-			stack=batch
+		addBatch(batch, batchFrames, avgNoise)
+		if batchDisp!=nil {
+			if dispPool==nil { dispPool=&nl.DispersionPool{} }
+			dispPool.Add(batchDisp, batchMoments)
 		}
 
 		// Free memory
-		ids, fileNames, batch=nil, nil, nil
+		ids, fileNames, batch, batchDisp, batchMoments=nil, nil, nil, nil, nil
 		debug.FreeOSMemory()
+		batchStartOffset=batchEndOffset
+
+		// Adapt the size of the remaining batches to the memory measured in this batch
+		if monitor!=nil {
+			numBatches, batchSize=adaptBatches(monitor, batchFrames, int64(len(overallFileNames))-batchEndOffset, batchSize, int64(imageLevelParallelism))
+			numBatches+=b+1
+			scheduledFrames=int64(len(overallFileNames))
+			gates.Total=scheduledFrames
+			if cp!=nil { cp.NumBatches, cp.BatchSize=numBatches, batchSize }
+		}
 	}
 
 	// Free more memory
@@ -390,7 +1300,8 @@ func cmdStack(args []string, batchPattern string) {
 
 	if numBatches>1 {
 		// Finalize stack of stacks
-		err:=nl.StackIncrementalFinalize(stack, float32(stackFrames))
+		var err error
+		stack, err=batches.Finalize(lsEstimator)
 		if err!=nil { nl.LogPrintf("Error calculating extended stats: %s\n", err) }
 
 		// Find stars in newly stacked image and report out on them
@@ -398,10 +1309,83 @@ func cmdStack(args []string, batchPattern string) {
 			float32(*starSig), float32(*starBpSig), int32(*starRadius), nil)
 		nl.LogPrintf("Overall stack: Stars %d HFR %.2f Exposure %gs %v\n", len(stack.Stars), stack.HFR, stack.Exposure, stack.Stats)
 
-		avgNoise:=stackNoise/float32(stackFrames)
-		expectedNoise:=avgNoise/float32(math.Sqrt(float64(numBatches)))
-		nl.LogPrintf("Expected noise %.4g from stacking %d batches with average noise %.4g\n",
-					expectedNoise, int(numBatches), avgNoise )
+		if expectedNoise:=batches.ExpectedNoise(); expectedNoise>0 {
+			nl.LogPrintf("Expected noise %.4g from combining %d batches, measured %.4g\n",
+						expectedNoise, int(numBatches), stack.Stats.Noise )
+		}
+	}
+
+	// Report achieved versus theoretical signal-to-noise gain over an average input frame
+	if stackFrames>0 && stackInputNoise>0 && stack.Stats!=nil && stack.Stats.Noise>0 {
+		inputNoise:=stackInputNoise/float32(stackFrames)
+		achievedGain:=inputNoise/stack.Stats.Noise
+		theoreticalGain:=float32(math.Sqrt(float64(stackFrames)))
+		nl.LogPrintf("SNR gain %.3gx achieved vs. %.3gx theoretical from %d frames with average noise %.4g (%.1f%% efficiency)\n",
+					achievedGain, theoreticalGain, int(stackFrames), inputNoise, achievedGain*100/theoreticalGain)
+	}
+
+	// Finalize dispersion map
+	if dispPool!=nil {
+		var err error
+		disp, err=dispPool.Finalize(lsEstimator)
+		if err!=nil { nl.LogPrintf("Error calculating extended stats: %s\n", err) }
+	}
+
+	// Remove checkpoint after successful completion
+	if cp!=nil {
+		if err:=cp.Remove(); err!=nil { nl.LogPrintf("Error removing checkpoint: %s\n", err) }
+	}
+
+	return stack, disp
+}
+
+// Names of the flags which affect batch results. A checkpoint made with different values cannot be resumed
+var checkpointFlags=[]string{
+	"pre", "debayer", "cfa", "binning", "normRange", "bpSigLow", "bpSigHigh", "starSig", "starBpSig", "starRadius",
+	"backGrid", "backSigma", "backClip", "post", "usmSigma", "usmGain", "usmThresh", "wavGains", "align", "alignK", "alignT",
+	"lsEst", "noiseEst", "normHist", "stMode", "stClipPercLow", "stClipPercHigh", "stSigLow", "stSigHigh", "stClipIter", "stClipConv",
+	"stWeight", "stWeightQ", "stRescale", "stPrecision", "stStore", "stExclude", "stExcludeFrames", "stTrails", "stTrailSig", "stTrailLen", "stMaxEcc",
+}
+
+// Returns the processing parameters recorded in a checkpoint: the values of the checkpoint flags,
+// and the names and content hashes of the given dark and flat files in use, if any
+func checkpointParams(darkFile, flatFile string) (params map[string]string, err error) {
+	params=map[string]string{}
+	for _, name:=range checkpointFlags {
+		params[name]=flag.Lookup(name).Value.String()
+	}
+	for name, fileName:=range map[string]string{"dark":darkFile, "flat":flatFile} {
+		params[name]=fileName
+		if fileName=="" { continue }
+		hash, err:=nl.HashFile(fileName)
+		if err!=nil { return nil, err }
+		params[name+"SHA256"]=hash
+	}
+	return params, nil
+}
+
+// Stops the given memory monitor of a completed batch with the given number of frames, and replans the given
+// number of remaining frames from the measured memory per frame. Returns the number and size of the remaining batches
+func adaptBatches(monitor *nl.MemoryMonitor, batchFrames, remainingFrames, oldBatchSize, imageLevelParallelism int64) (numBatches, batchSize int64) {
+	baseline, peak:=monitor.Stop()
+	fixed:=int64(nl.HeapInUse())
+	frameBytes:=(int64(peak)-int64(baseline))/batchFrames
+	minBatchSize:=imageLevelParallelism
+	if minBatchSize<2 { minBatchSize=2 }
+	numBatches, batchSize=nl.ReplanBatches(remainingFrames, frameBytes, fixed, *stMemory, minBatchSize)
+	nl.LogPrintf("\nMeasured %.1f MiB peak memory per frame and %.1f MiB held across batches, adapting batch size from %d to %d for the remaining %d frames in %d batches\n",
+		float32(frameBytes)/(1024*1024), float32(fixed)/(1024*1024), oldBatchSize, batchSize, remainingFrames, numBatches)
+	return numBatches, batchSize
+}
+
+// Apply noise reduction and output gamma to the stack if desired, and write it out
+func saveStack(stack *nl.FITSImage) {
+	// Apply noise reduction if desired
+	if nrThreshF!=nil {
+		nl.LogPrintf("Applying wavelet noise reduction with layer thresholds %v and luminance mask %.3g\n", nrThreshF, *nrLumMask)
+		var noise float32
+		stack.Data, noise=nl.WaveletDenoise(stack.Data, int(stack.Naxisn[0]), nrThreshF, float32(*nrLumMask), stack.Stats.Min, stack.Stats.Max)
+		nl.LogPrintf("Estimated noise %.4g\n", noise)
 	}
 
 	// Apply output gamma if desired
@@ -410,21 +1394,316 @@ func cmdStack(args []string, batchPattern string) {
 		stack.ApplyGamma(float32(*gamma))
 	}
 
-    // write out results, then free memory for the overall stack
-	err:=stack.WriteFile(*out)
+    // write out results
+	err:=withProvenance(stack).WriteFile(*out)
+	if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+}
+
+// Calculate, summarize and write out the signal-to-noise map of the given linear stack
+func saveSNRMap(stack *nl.FITSImage) {
+	snr, err:=nl.SNRMap(stack, int32(*stSNRGrid), lsEstimator)
+	if err!=nil { nl.LogFatalf("Error calculating SNR map: %s\n", err) }
+	nl.LogPrintf("SNR map with %dx%d noise regions: %v\n", *stSNRGrid, *stSNRGrid, snr.Stats)
+	nl.LogPrintf("%v\n", nl.SummarizeSNR(snr.Data, float32(*stSNRTarget)))
+
+	nl.LogPrintf("Writing SNR map to %s\n", *stSNR)
+	ext:=strings.ToLower(filepath.Ext(*stSNR))
+	if ext==".jpg" || ext==".jpeg" {
+		err=snr.SNRPreview(float32(*stSNRTarget)).WriteJPGToFile(*stSNR, 95, nl.EENone, nl.DINone, nil)
+	} else {
+		err=withProvenance(snr).WriteFile(*stSNR)
+	}
 	if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
-	stack=nil
+}
+
+// Stack the given files in a single streaming pass. Frames are pre- and post-processed in small groups
+// and integrated into a running mean and variance, so only the reservoir and the current group are held in memory.
+// If alignment or normalization needs a reference frame, frames are buffered until one is found
+func stackStream(fileNames []string, reservoirSize int, gates *nl.QualityGates) (stack, disp *nl.FITSImage) {
+	sigLow, sigHigh:=float32(*stSigLow), float32(*stSigHigh)
+	if sigLow <0 { sigLow =3 }
+	if sigHigh<0 { sigHigh=3 }
+	imageLevelParallelism:=maxParallelism()
+	if imageLevelParallelism>4 { imageLevelParallelism=4 }
+	nl.LogPrintf("\nStreaming %d frames with reservoir %d stSigLow %.2f stSigHigh %.2f, ignoring stMode and stWeight\n", len(fileNames), reservoirSize, sigLow, sigHigh)
+
+	ids:=make([]int, len(fileNames))
+	for i:=range ids { ids[i]=i }
+
+	// Frames preprocessed before a usable reference frame exists are buffered, so they can be aligned to it later.
+	// The buffer holds at most as many frames as the reservoir, so peak memory stays within twice the reservoir
+	var refFrame *nl.FITSImage
+	var streamer *nl.StreamStacker
+	var pending []*nl.FITSImage  // preprocessed frames awaiting a reference frame
+	var pendingFailed int64      // number of frames failed in preprocessing while awaiting a reference frame
+	maxPending:=reservoirSize
+	if maxPending<int(imageLevelParallelism) { maxPending=int(imageLevelParallelism) }
+	for start:=0; start<len(fileNames); start+=int(imageLevelParallelism) {
+		end:=start+int(imageLevelParallelism)
+		if end>len(fileNames) { end=len(fileNames) }
+
+		// Preprocess light frames (subtract dark, divide flat, remove bad pixels, detect stars and HFR)
+		lights, err:=preProcessLights(ids[start:end], fileNames[start:end], imageLevelParallelism)
+		if err!=nil { nl.LogFatal(err.Error()) }
+		reportPreprocessed(ids[start:end], fileNames[start:end], lights)
+		histPreprocessed(lights)
+		lights, numFailed:=removeNilLights(lights)
+
+		// Select reference frame from the frames so far, buffering them until one is usable
+		if (*align!=0 || *normHist!=0) && (refFrame==nil) {
+			lights, numFailed=append(pending, lights...), numFailed+pendingFailed
+			refFrameScore:=float32(0)
+			refFrame, refFrameScore=nl.SelectReferenceFrame(lights)
+			if refFrame==nil {
+				if len(lights)>maxPending {
+					nl.LogFatalf("Error: no usable reference frame among the first %d frames, and buffering more would exceed the reservoir\n", end)
+				}
+				pending, pendingFailed=lights, numFailed
+				continue
+			}
+			pending, pendingFailed=nil, 0
+			nl.LogPrintf("Using frame %d as reference. Score %.4g, %v.\n", refFrame.ID, refFrameScore, refFrame.Stats)
+			reportReference(refFrame)
+		}
+
+		// Post-process light frames (align, normalize)
+		_, err=nl.PostProcessLights(ctx, refFrame, refFrame, lights, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), nl.OOBModeNaN, exclusionMask,
+		                            float32(*usmSigma), float32(*usmGain), float32(*usmThresh), wavGainsF, *post, lsEstimator, imageLevelParallelism)
+		if err!=nil { nl.LogFatal(err.Error()) }
+		reportPostprocessed(lights)
+
+		// Remove frames skipped in alignment, and abort if quality gates are no longer met
+		lights, numSkipped:=removeNilLights(lights)
+		gates.Add(int64(len(lights)), numFailed, numSkipped)
+		if err:=gates.Check(); err!=nil { nl.LogFatal(err.Error()) }
+
+		// Integrate into the running stack
+		for _, l:=range lights {
+			if streamer==nil {
+				refFrameLoc:=l.Stats.Location
+				if refFrame!=nil && refFrame.Stats!=nil { refFrameLoc=refFrame.Stats.Location }
+				streamer=nl.NewStreamStacker(reservoirSize, sigLow, sigHigh, refFrameLoc, int32(*stPrecision), lsEstimator)
+			}
+			err:=streamer.Add(l)
+			if err!=nil { nl.LogFatal(err.Error()) }
+		}
+
+		// Free memory
+		lights=nil
+		debug.FreeOSMemory()
+	}
+	if len(pending)>0 || pendingFailed>0 {
+		gates.Add(0, int64(len(pending))+pendingFailed, 0)
+		if err:=gates.Check(); err!=nil { nl.LogFatal(err.Error()) }
+	}
+	if streamer==nil { nl.LogFatal("Error: no usable input frames") }
+
+	// Take dispersion map from the running variance if desired
+	if *stDisp!="" {
+		if nl.DispersionMode(*stDispMode)!=nl.DMStdDev { nl.LogPrintf("Streaming supports only standard deviation for the dispersion map\n") }
+		var err error
+		disp, err=streamer.StdDev()
+		if err!=nil { nl.LogFatal(err.Error()) }
+	}
+
+	stack, err:=streamer.Finalize()
+	if err!=nil { nl.LogFatal(err.Error()) }
+	stack.Stars, _, stack.HFR=nl.FindStars(stack.Data, stack.Naxisn[0], stack.Stats.Location, stack.Stats.Scale, 
+		float32(*starSig), float32(*starBpSig), int32(*starRadius), nil)
+	nl.LogPrintf("Streamed stack: Stars %d HFR %.2f Exposure %gs %v\n", len(stack.Stars), stack.HFR, stack.Exposure, stack.Stats)
+	return stack, disp
+}
+
+// Registers the given files into temporary storage. Frames are pre- and post-processed in small groups and written
+// to temporary files, so only the current group is held in memory. Returns the storage, which the caller must close,
+// and the reference frame without pixel data
+func registerToStore(fileNames []string, gates *nl.QualityGates) (ts *nl.TileStore, refFrame *nl.FITSImage) {
+	imageLevelParallelism:=maxParallelism()
+	if imageLevelParallelism>4 { imageLevelParallelism=4 }
+	ts, err:=nl.NewTileStore(*stTileDir)
+	if err!=nil { nl.LogFatalf("Error creating temporary storage: %s\n", err) }
+	nl.LogPrintf("\nRegistering %d frames into temporary storage %s:\n", len(fileNames), ts.Dir)
+
+	ids:=make([]int, len(fileNames))
+	for i:=range ids { ids[i]=i }
+
+	for start:=0; start<len(fileNames); start+=int(imageLevelParallelism) {
+		end:=start+int(imageLevelParallelism)
+		if end>len(fileNames) { end=len(fileNames) }
+
+		// Preprocess light frames (subtract dark, divide flat, remove bad pixels, detect stars and HFR)
+		lights, err:=preProcessLights(ids[start:end], fileNames[start:end], imageLevelParallelism)
+		if err!=nil { nl.LogFatal(err.Error()) }
+		reportPreprocessed(ids[start:end], fileNames[start:end], lights)
+		histPreprocessed(lights)
+		lights, numFailed:=removeNilLights(lights)
+
+		// Select reference frame from the first group with usable frames
+		if (*align!=0 || *normHist!=0) && (refFrame==nil) {
+			refFrameScore:=float32(0)
+			refFrame, refFrameScore=nl.SelectReferenceFrame(lights)
+			if refFrame==nil {
+				gates.Add(0, int64(end-start), 0)
+				if err:=gates.Check(); err!=nil { nl.LogFatal(err.Error()) }
+				continue
+			}
+			nl.LogPrintf("Using frame %d as reference. Score %.4g, %v.\n", refFrame.ID, refFrameScore, refFrame.Stats)
+			reportReference(refFrame)
+		}
+
+		// Post-process light frames (align, normalize)
+		_, err=nl.PostProcessLights(ctx, refFrame, refFrame, lights, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), nl.OOBModeNaN, exclusionMask,
+		                            float32(*usmSigma), float32(*usmGain), float32(*usmThresh), wavGainsF, *post, lsEstimator, imageLevelParallelism)
+		if err!=nil { nl.LogFatal(err.Error()) }
+		reportPostprocessed(lights)
+
+		// Remove frames skipped in alignment, and abort if quality gates are no longer met
+		lights, numSkipped:=removeNilLights(lights)
+		gates.Add(int64(len(lights)), numFailed, numSkipped)
+		if err:=gates.Check(); err!=nil { nl.LogFatal(err.Error()) }
+
+		// Write to temporary storage, retaining only metadata
+		for _, l:=range lights {
+			if (*stWeight)==2 { l.Stats.Noise=nl.EstimateNoise(l.Data, l.Naxisn[0], noiseEstimator) }
+			err:=ts.Add(l)
+			if err!=nil { nl.LogFatalf("Error writing temporary file: %s\n", err) }
+		}
+		if refFrame!=nil && refFrame.Data!=nil {
+			meta:=*refFrame
+			meta.Data=nil
+			refFrame=&meta
+		}
+
+		// Free memory
+		lights=nil
+		debug.FreeOSMemory()
+	}
+	if len(ts.Frames)==0 { nl.LogFatal("Error: no usable input frames") }
+	return ts, refFrame
+}
+
+// Stack the given files in horizontal bands. Frames are registered into temporary files, then each band 
+// is read back from all frames and stacked, so only the stack result, one band of all frames and the 
+// current group of frames in registration are held in memory
+func stackTiled(fileNames []string, bandRows int32, gates *nl.QualityGates) (stack, disp *nl.FITSImage) {
+	ts, refFrame:=registerToStore(fileNames, gates)
+	defer ts.Close()
+
+	weights:=stackWeights(ts.Frames)
+	refFrameLoc:=float32(0)
+	if refFrame!=nil && refFrame.Stats!=nil {
+		refFrameLoc=refFrame.Stats.Location
+	}
+
+	// Find sigmas if required on a sample of rows spread evenly across the frame, the size of one band,
+	// as gradients and vignetting change the clipping between bands. The sigmas are reused for all bands
+	width, height:=ts.Naxisn[0], ts.Naxisn[1]
+	sigLow, sigHigh:=float32(-1), float32(-1)
+	if bandRows<height && (*stSigLow<0 || *stSigHigh<0) {
+		rows:=make([]int32, bandRows)
+		for i:=range rows { rows[i]=int32(int64(i)*int64(height)/int64(bandRows)) }
+		sample, err:=ts.ReadRows(rows)
+		if err!=nil { nl.LogFatalf("Error reading temporary file: %s\n", err) }
+		nl.LogPrintf("\nFinding sigmas on %d rows sampled across all bands, to achieve stClipLow/high %.2f%%/%.2f%%\n", bandRows, *stClipPercLow, *stClipPercHigh)
+		_, _, _, sigLow, sigHigh, err=nl.FindSigmasAndStack(ctx, sample, nl.StackMode(*stMode), weights, refFrameLoc, float32(*stClipPercLow), float32(*stClipPercHigh), int32(*stClipIter), float32(*stClipConv), *stRescale!=0, int32(*stPrecision), lsEstimator)
+		if err!=nil { nl.LogFatal(err.Error()) }
+		sample=nil
+		debug.FreeOSMemory()
+	}
+
+	// Stack band by band
+	data:=make([]float32, int(width)*int(height))
+	dispData:=[]float32(nil)
+	if *stDisp!="" { dispData=make([]float32, len(data)) }
+	for lower:=int32(0); lower<height; lower+=bandRows {
+		upper:=lower+bandRows
+		if upper>height { upper=height }
+		nl.LogPrintf("\nStacking rows %d to %d of %d:\n", lower, upper, height)
+		bands, err:=ts.ReadBand(lower, upper)
+		if err!=nil { nl.LogFatalf("Error reading temporary file: %s\n", err) }
+
+		band, bandDisp:=(*nl.FITSImage)(nil), (*nl.FITSImage)(nil)
+		band, bandDisp, sigLow, sigHigh=stackLights(bands, weights, refFrameLoc, sigLow, sigHigh, nil)
+		copy(data[int(lower)*int(width):], band.Data)
+		if bandDisp!=nil { copy(dispData[int(lower)*int(width):], bandDisp.Data) }
+
+		// Free memory
+		bands, band, bandDisp=nil, nil, nil
+		debug.FreeOSMemory()
+	}
+
+	exposureSum:=float32(0)
+	for _,l:=range ts.Frames { exposureSum+=l.Exposure }
+	stack=&nl.FITSImage{
+		Header: nl.NewFITSHeader(),
+		Bitpix: -32,
+		Naxisn: []int32{width, height},
+		Pixels: width*height,
+		Data  : data,
+		Exposure: exposureSum,
+		Trans : nl.IdentityTransform2D(),
+	}
+	var err error
+	stack.Stats, err=nl.CalcExtendedStats(stack.Data, width, lsEstimator)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	stack.Stars, _, stack.HFR=nl.FindStars(stack.Data, width, stack.Stats.Location, stack.Stats.Scale, 
+		float32(*starSig), float32(*starBpSig), int32(*starRadius), nil)
+	nl.LogPrintf("Tiled stack: Stars %d HFR %.2f Exposure %gs %v\n", len(stack.Stars), stack.HFR, stack.Exposure, stack.Stats)
+
+	if dispData!=nil {
+		disp=&nl.FITSImage{
+			Header: nl.NewFITSHeader(),
+			Bitpix: -32,
+			Naxisn: []int32{width, height},
+			Pixels: width*height,
+			Data  : dispData,
+			Trans : nl.IdentityTransform2D(),
+		}
+		disp.Stats, err=nl.CalcExtendedStats(disp.Data, width, lsEstimator)
+		if err!=nil { nl.LogFatal(err.Error()) }
+	}
+	return stack, disp
+}
+
+// Stack the given files in a single batch from memory-mapped temporary files. Frames are registered into
+// temporary files, then mapped into memory and stacked together. The operating system pages frame data in 
+// and out as needed, so the batch size is not bounded by physical memory, and no random split into batches is needed
+func stackMapped(fileNames []string, gates *nl.QualityGates) (stack, disp *nl.FITSImage) {
+	ts, refFrame:=registerToStore(fileNames, gates)
+	defer ts.Close()
+	lights, err:=ts.Map()
+	if err!=nil { nl.LogFatalf("Error mapping temporary files: %s\n", err) }
+	nl.LogPrintf("\nMapped %d frames from temporary storage into memory\n", len(lights))
+
+	weights:=stackWeights(lights)
+	refFrameLoc:=float32(0)
+	if refFrame!=nil && refFrame.Stats!=nil {
+		refFrameLoc=refFrame.Stats.Location
+	}
+	stack, disp, _, _=stackLights(lights, weights, refFrameLoc, -1, -1, nil)
+
+	stack.Stars, _, stack.HFR=nl.FindStars(stack.Data, stack.Naxisn[0], stack.Stats.Location, stack.Stats.Scale, 
+		float32(*starSig), float32(*starBpSig), int32(*starRadius), nil)
+	nl.LogPrintf("Mapped stack: Stars %d HFR %.2f Exposure %gs %v\n", len(stack.Stars), stack.HFR, stack.Exposure, stack.Stats)
+	return stack, disp
 }
 
 // Stack a given batch of files, using the reference provided, or selecting a reference frame if nil.
+// Stores the per-pixel moments of the dispersion map in dispMoments, if desired.
 // Returns the stack for the batch, and the reference frame
-func stackBatch(ids []int, fileNames []string, refFrame *nl.FITSImage, sigLow, sigHigh float32, imageLevelParallelism int32) (stack, refFrameOut *nl.FITSImage, sigLowOut, sigHighOut, avgNoise float32) {
+func stackBatch(ids []int, fileNames []string, refFrame *nl.FITSImage, sigLow, sigHigh float32, imageLevelParallelism int32, gates *nl.QualityGates, dispMoments *nl.PixelMoments) (stack, disp, refFrameOut *nl.FITSImage, sigLowOut, sigHighOut, avgNoise float32) {
 	// Preprocess light frames (subtract dark, divide flat, remove bad pixels, detect stars and HFR)
 	nl.LogPrintf("\nPreprocessing %d frames with dark=%d flat=%d debayer=%s cfa=%s binning=%d normRange=%d bpSigLow=%.2f bpSigHigh=%.2f starSig=%.2f starBpSig=%.2f starRadius=%d backGrid=%d:\n", 
 		len(fileNames), btoi(darkF!=nil), btoi(flatF!=nil), *debayer, *cfa, *binning, *normRange, *bpSigLow, *bpSigHigh, *starSig, *starBpSig, *starRadius, *backGrid)
-	lights:=nl.PreProcessLights(ids, fileNames, darkF, flatF, *debayer, *cfa, int32(*binning), int32(*normRange), float32(*bpSigLow), float32(*bpSigHigh), 
-		float32(*starSig), float32(*starBpSig), int32(*starRadius), *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, imageLevelParallelism)
+	lights, err:=preProcessLights(ids, fileNames, imageLevelParallelism)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	reportPreprocessed(ids, fileNames, lights)
+	histPreprocessed(lights)
 	debug.FreeOSMemory()					
+	lights, numFailed:=removeNilLights(lights)
+	gates.Add(0, numFailed, 0)
+	if err:=gates.Check(); err!=nil { nl.LogFatal(err.Error()) }
+	if len(lights)==0 { nl.LogFatal("Error: no usable frames in batch") }
 
 	avgNoise=float32(0)
 	for _,l:=range lights {
@@ -439,16 +1718,87 @@ func stackBatch(ids []int, fileNames []string, refFrame *nl.FITSImage, sigLow, s
 		refFrame, refFrameScore=nl.SelectReferenceFrame(lights)
 		if refFrame==nil { panic("Reference frame for alignment and normalization not found.") }
 		nl.LogPrintf("Using frame %d as reference. Score %.4g, %v.\n", refFrame.ID, refFrameScore, refFrame.Stats)
+		reportReference(refFrame)
 	}
 
-	// Post-process all light frames (align, normalize)
-	nl.LogPrintf("\nPostprocessing %d frames with align=%d alignK=%d alignT=%.3f normHist=%d usmSigma=%g usmGain=%g usmThresh=%g:\n", 
-		         len(lights), *align, *alignK, *alignT, *normHist, float32(*usmSigma), float32(*usmGain), float32(*usmThresh))
-	nl.PostProcessLights(refFrame, refFrame, lights, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), nl.OOBModeNaN, 
-	                     float32(*usmSigma), float32(*usmGain), float32(*usmThresh), *post, imageLevelParallelism)
-	debug.FreeOSMemory()					
+	// Post-process all light frames (align, normalize)
+	nl.LogPrintf("\nPostprocessing %d frames with align=%d alignK=%d alignT=%.3f normHist=%d usmSigma=%g usmGain=%g usmThresh=%g:\n", 
+		         len(lights), *align, *alignK, *alignT, *normHist, float32(*usmSigma), float32(*usmGain), float32(*usmThresh))
+	_, err=nl.PostProcessLights(ctx, refFrame, refFrame, lights, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), nl.OOBModeNaN, exclusionMask,
+	                            float32(*usmSigma), float32(*usmGain), float32(*usmThresh), wavGainsF, *post, lsEstimator, imageLevelParallelism)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	reportPostprocessed(lights)
+	debug.FreeOSMemory()					
+
+	// Remove frames skipped in alignment, and abort if quality gates are no longer met
+	lights, numSkipped:=removeNilLights(lights)
+	gates.Add(int64(len(lights)), 0, numSkipped)
+	if err:=gates.Check(); err!=nil { nl.LogFatal(err.Error()) }
+
+	// Pack registered frames into compact storage and compress them, estimating noise for weighting beforehand
+	if *stStore!=0 || *stCompress!=0 {
+		for _, l:=range lights {
+			if (*stWeight)==2 { l.Stats.Noise=nl.EstimateNoise(l.Data, l.Naxisn[0], noiseEstimator) }
+			if err:=l.Pack(nl.FrameStorage(*stStore)); err!=nil { nl.LogFatal(err.Error()) }
+		}
+		if *stCompress!=0 { compressLights(lights) }
+		debug.FreeOSMemory()
+	}
+
+	weights:=stackWeights(lights)
+
+	refFrameLoc:=float32(0)
+	if refFrame!=nil && refFrame.Stats!=nil {
+		refFrameLoc=refFrame.Stats.Location
+	}
+
+	stack, disp, sigLow, sigHigh=stackLights(lights, weights, refFrameLoc, sigLow, sigHigh, dispMoments)
+
+	// Free memory
+	lights=nil
+	debug.FreeOSMemory()
+
+	return stack, disp, refFrame, sigLow, sigHigh, avgNoise
+}
+
+// Compresses the given registered lights in parallel, and reports the achieved compression ratio
+func compressLights(lights []*nl.FITSImage) {
+	compressed:=make([]int64, len(lights))
+	group:=nl.DefaultPool.NewGroup(ctx, int(maxParallelism()))
+	for i, l:=range lights {
+		i, l:=i, l
+		group.Go(func() {
+			var err error
+			compressed[i], err=l.Compress()
+			if err!=nil { nl.LogFatalf("%d: Error compressing frame: %s\n", l.ID, err) }
+		})
+	}
+	group.Wait()
+	checkContext()
+
+	uncompressed, total:=int64(0), int64(0)
+	for i, l:=range lights {
+		uncompressed+=int64(l.Compressed.Len*l.Compressed.ValueBytes)
+		total+=compressed[i]
+	}
+	if total>0 {
+		nl.LogPrintf("Compressed %d frames from %d MiB to %d MiB, ratio %.2f\n", len(lights), uncompressed/1024/1024, total/1024/1024, float32(uncompressed)/float32(total))
+	}
+}
+
+// Preprocess the given light frames for stacking with the current flags, at most imageLevelParallelism at a time.
+// Rejects frames with elongated stars, masks or rejects trails, and fits the PSF if desired. Frames which fail to preprocess or are rejected are nil
+func preProcessLights(ids []int, fileNames []string, imageLevelParallelism int32) (lights []*nl.FITSImage, err error) {
+	p:=nl.NewPreProcessPipeline(darkF, flatF, *debayer, *cfa, int32(*binning), int32(*normRange), float32(*bpSigLow), float32(*bpSigHigh), 
+		lightStarSig(), float32(*starBpSig), int32(*starRadius), int32(*backGrid), float32(*backSigma), int32(*backClip), *back, lsEstimator)
+	if *stMaxEcc>0 { p.Add("elongation", &nl.OpElongation{MaxEcc: float32(*stMaxEcc)}) }
+	if *stTrails>0 { p.Add("trails", &nl.OpTrails{Sigma: float32(*stTrailSig), MinLength: int32(*stTrailLen), Reject: *stTrails==2}) }
+	if psfTracker!=nil { p.Add("psf", &nl.OpPSF{Stars: int(*stPSF), Radius: int32(*starRadius), Tracker: psfTracker}) }
+	return nl.PreProcessLightsPipeline(ctx, ids, fileNames, p, *stars, *pre, imageLevelParallelism)
+}
 
-	// Remove nils from lights
+// Removes nil entries from the given lights in place. Returns the shortened slice and the number of entries removed
+func removeNilLights(lights []*nl.FITSImage) (res []*nl.FITSImage, numRemoved int64) {
 	o:=0
 	for i:=0; i<len(lights); i+=1 {
 		if lights[i]!=nil {
@@ -456,10 +1806,11 @@ func stackBatch(ids []int, fileNames []string, refFrame *nl.FITSImage, sigLow, s
 			o+=1
 		}
 	}
-	lights=lights[:o]
+	return lights[:o], int64(len(lights)-o)
+}
 
-	// Prepare weights for stacking, using 1/noise. 
-	weights:=[]float32(nil)
+// Prepare weights for stacking, depending on the selected weighting mode. Returns nil for unweighted stacking
+func stackWeights(lights []*nl.FITSImage) (weights []float32) {
 	if (*stWeight)==1 { // exposure weighted stacking
 		weights =make([]float32, len(lights))
 		for i:=0; i<len(lights); i+=1 {
@@ -469,48 +1820,64 @@ func stackBatch(ids []int, fileNames []string, refFrame *nl.FITSImage, sigLow, s
 	} else if (*stWeight)==2 { // noise weighted stacking
 		minNoise, maxNoise:=float32(math.MaxFloat32), float32(-math.MaxFloat32)
 		for i:=0; i<len(lights); i+=1 {
+			if lights[i].Data!=nil { // frames spilled to disk carry their noise estimate already
+				lights[i].Stats.Noise=nl.EstimateNoise(lights[i].Data, lights[i].Naxisn[0], noiseEstimator)
+			}
 			n:=lights[i].Stats.Noise
 			if n<minNoise { minNoise=n }
 			if n>maxNoise { maxNoise=n }
 		}		
+		if maxNoise<=minNoise { maxNoise=minNoise+1 }
 		weights =make([]float32, len(lights))
 		for i:=0; i<len(lights); i+=1 {
-			lights[i].Stats.Noise=nl.EstimateNoise(lights[i].Data, lights[i].Naxisn[0])
 			weights[i]=1/(1+4*(lights[i].Stats.Noise-minNoise)/(maxNoise-minNoise))
 		}
+	} else if (*stWeight)==3 { // quality weighted stacking
+		formula, err:=nl.ParseQualityFormula(*stWeightQ)
+		if err!=nil { nl.LogFatal(err) }
+		weights=nl.QualityWeights(lights, formula)
 	}
 
-	refFrameLoc:=float32(0)
-	if refFrame!=nil && refFrame.Stats!=nil {
-		refFrameLoc=refFrame.Stats.Location
-	}
+	if report!=nil { report.AddWeights(lights, weights) }
+	return weights
+}
 
+// Stack the post-processed lights with the selected mode and weights. Uses the sigma bounds given, if any,
+// else the sigma bounds from the flags, else finds sigma bounds based on desired clipping percentages.
+// Also calculates the dispersion map of the lights if desired, else returns nil, and stores its per-pixel moments in dispMoments if not nil
+func stackLights(lights []*nl.FITSImage, weights []float32, refFrameLoc, sigLow, sigHigh float32, dispMoments *nl.PixelMoments) (stack, disp *nl.FITSImage, sigLowOut, sigHighOut float32) {
 	// Stack the post-processed lights 
+	var clipLow, clipHigh int32
 	if sigLow>=0 && sigHigh>=0 {
 		// Use sigma bounds from prior batch for stacking
 		nl.LogPrintf("\nStacking %d frames with mode %d stWeight %d and sigLow %.2f sigHigh %.2f from prior batch\n", len(lights), *stMode, *stWeight, sigLow, sigHigh)
 		var err error
-		stack, _, _, err=nl.Stack(lights, nl.StackMode(*stMode), weights, refFrameLoc, sigLow, sigHigh)
+		stack, clipLow, clipHigh, err=nl.Stack(ctx, lights, nl.StackMode(*stMode), weights, refFrameLoc, sigLow, sigHigh, int32(*stClipIter), float32(*stClipConv), *stRescale!=0, int32(*stPrecision), lsEstimator)
 		if err!=nil { nl.LogFatal(err.Error()) }
 	} else if *stSigLow>=0 && *stSigHigh>=0 {
 		// Use given sigma bounds for stacking
 		nl.LogPrintf("\nStacking %d frames with mode %d stWeight %d stSigLow %.2f stSigHigh %.2f\n", len(lights), *stMode, *stWeight, *stSigLow, *stSigHigh)
 		var err error
-		stack, _, _, err=nl.Stack(lights, nl.StackMode(*stMode), weights, refFrameLoc, float32(*stSigLow), float32(*stSigHigh))
+		stack, clipLow, clipHigh, err=nl.Stack(ctx, lights, nl.StackMode(*stMode), weights, refFrameLoc, float32(*stSigLow), float32(*stSigHigh), int32(*stClipIter), float32(*stClipConv), *stRescale!=0, int32(*stPrecision), lsEstimator)
 		if err!=nil { nl.LogFatal(err.Error()) }
+		sigLow, sigHigh=float32(*stSigLow), float32(*stSigHigh)
 	} else {
 		// Find sigma bounds based on desired clipping percentages
 		nl.LogPrintf("\nFinding sigmas for stacking %d frames into %s with mode %d stWeight %d to achieve stClipLow/high %.2f%%/%.2f%%\n", len(lights), *out, *stMode, *stWeight, *stClipPercLow, *stClipPercHigh )
 		var err error
-		stack, _, _, sigLow, sigHigh, err=nl.FindSigmasAndStack(lights, nl.StackMode(*stMode), weights, refFrameLoc, float32(*stClipPercLow), float32(*stClipPercHigh))
+		stack, clipLow, clipHigh, sigLow, sigHigh, err=nl.FindSigmasAndStack(ctx, lights, nl.StackMode(*stMode), weights, refFrameLoc, float32(*stClipPercLow), float32(*stClipPercHigh), int32(*stClipIter), float32(*stClipConv), *stRescale!=0, int32(*stPrecision), lsEstimator)
 		if err!=nil { nl.LogFatal(err.Error()) }
 	}
 
-	// Free memory
-	lights=nil
-	debug.FreeOSMemory()
+	if report!=nil { report.AddBatch(len(lights), lights[0].Pixels, sigLow, sigHigh, clipLow, clipHigh) }
 
-	return stack, refFrame, sigLow, sigHigh, avgNoise
+	if *stDisp!="" {
+		var err error
+		disp, err=nl.Dispersion(lights, nl.DispersionMode(*stDispMode), int32(*stPrecision), lsEstimator, dispMoments)
+		if err!=nil { nl.LogFatal(err.Error()) }
+	}
+
+	return stack, disp, sigLow, sigHigh
 }
 
 
@@ -526,13 +1893,18 @@ func cmdRGB(args []string) {
 		nl.LogFatal("Need exactly three input files to perform a RGB combination")
 	}
 	ids:=[]int{0,1,2}
+	if *ha!="" {
+		fileNames=append(fileNames, *ha)
+		ids=append(ids, 3)
+	}
 
 	// Read files and detect stars
-	imageLevelParallelism:=int32(runtime.GOMAXPROCS(0))
-	if imageLevelParallelism>3 { imageLevelParallelism=3 }
+	imageLevelParallelism:=maxParallelism()
+	if imageLevelParallelism>int32(len(ids)) { imageLevelParallelism=int32(len(ids)) }
 	nl.LogPrintf("\nReading color channels and detecting stars:\n")
-	lights:=nl.PreProcessLights(ids, fileNames, nil, nil, *debayer, *cfa, int32(*binning), 1, 0, 0, 
-		float32(*starSig), float32(*starBpSig), int32(*starRadius), *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, imageLevelParallelism)
+	lights, err:=nl.PreProcessLights(ctx, ids, fileNames, nil, nil, *debayer, *cfa, int32(*binning), 1, 0, 0, 
+		float32(*starSig), float32(*starBpSig), int32(*starRadius), *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, lsEstimator, imageLevelParallelism)
+	if err!=nil { nl.LogFatal(err.Error()) }
 
 	// Pick reference frame
 	var refFrame *nl.FITSImage
@@ -548,19 +1920,225 @@ func cmdRGB(args []string) {
 	var oobMode nl.OutOfBoundsMode=nl.OOBModeOwnLocation
 	nl.LogPrintf("Postprocessing %d channels with align=%d alignK=%d alignT=%.3f normHist=%d oobMode=%d usmSigma=%g usmGain=%g usmThresh=%g:\n", 
 				 len(lights), *align, *alignK, *alignT, *normHist, oobMode, float32(*usmSigma), float32(*usmGain), float32(*usmThresh))
-	numErrors:=nl.PostProcessLights(refFrame, refFrame, lights, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), oobMode, 
-									float32(*usmSigma), float32(*usmGain), float32(*usmThresh), *post, imageLevelParallelism)
+	numErrors, err:=nl.PostProcessLights(ctx, refFrame, refFrame, lights, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), oobMode, nil,
+									float32(*usmSigma), float32(*usmGain), float32(*usmThresh), wavGainsF, *post, lsEstimator, imageLevelParallelism)
+	if err!=nil { nl.LogFatal(err.Error()) }
     if numErrors>0 { nl.LogFatal("Need aligned RGB frames to proceed") }
 
+	// Blend Ha into red channel if selected
+	if *ha!="" {
+		stars:=lights[0].Stars
+		if refFrame!=nil { stars=refFrame.Stars }
+		blendHa(lights[3], lights[0], nil, stars)
+	}
+
 	// Combine RGB channels
 	nl.LogPrintf("\nCombining color channels...\n")
-	rgb:=nl.CombineRGB(lights, refFrame)
+	rgb:=nl.CombineRGB(lights[:3], refFrame)
+
+	postProcessAndSaveRGBComposite(&rgb, nil)
+	rgb.Data=nil
+}
+
+
+// Perform narrowband palette command. Maps Ha, OIII and optional SII channels to RGB with a palette preset
+func cmdPalette(args []string) {
+	// Set default parameters for this command. Normalize channels so palette weights are meaningful
+	if *normHist==nl.HNMAuto { *normHist=nl.HNMLocScale }
+	if *starBpSig<0 { *starBpSig=0 }  // inputs are typically stacked and have undergone noise removal
+
+	pal, err:=nl.NewPalette(*palette, float32(*palGreen))
+	if err!=nil { nl.LogFatal(err.Error()) }
+	var weights [3]float32
+	ws, err:=parseFloats(*palWeights)
+	if err!=nil { nl.LogFatalf("Invalid palette weights '%s': %s\n", *palWeights, err) }
+	if len(ws)!=3 { nl.LogFatalf("Need exactly three palette weights, got '%s'\n", *palWeights) }
+	copy(weights[:], ws)
+
+	// Glob file name wildcards
+	fileNames:=globFilenameWildcards(args)
+	if len(fileNames)<2 || len(fileNames)>3 {
+		nl.LogFatal("Need two or three input files to apply a palette: Ha, OIII and optional SII")
+	}
+	if pal.NeedsSII() && len(fileNames)!=3 {
+		nl.LogFatalf("Palette %s needs an SII channel\n", pal.Name)
+	}
+	ids:=make([]int, len(fileNames))
+	for i:=range ids { ids[i]=i }
+
+	// Read files and detect stars
+	imageLevelParallelism:=maxParallelism()
+	if imageLevelParallelism>3 { imageLevelParallelism=3 }
+	nl.LogPrintf("\nReading narrowband channels and detecting stars:\n")
+	lights, err:=nl.PreProcessLights(ctx, ids, fileNames, nil, nil, *debayer, *cfa, int32(*binning), 1, 0, 0, 
+		float32(*starSig), float32(*starBpSig), int32(*starRadius), *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, lsEstimator, imageLevelParallelism)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	for i, l:=range lights {
+		if l==nil { nl.LogFatalf("Unable to read channel %d\n", i) }
+	}
+
+	// Pick reference frame
+	refFrame, refFrameScore:=nl.SelectReferenceFrame(lights)
+	if refFrame==nil { panic("Reference channel for alignment not found.") }
+	nl.LogPrintf("Using channel %d with score %.4g as reference for alignment and normalization.\n\n", refFrame.ID, refFrameScore)
+
+	// Post-process all channels (align, normalize)
+	var oobMode nl.OutOfBoundsMode=nl.OOBModeOwnLocation
+	nl.LogPrintf("Postprocessing %d channels with align=%d alignK=%d alignT=%.3f normHist=%d oobMode=%d usmSigma=%g usmGain=%g usmThresh=%g:\n", 
+				 len(lights), *align, *alignK, *alignT, *normHist, oobMode, float32(*usmSigma), float32(*usmGain), float32(*usmThresh))
+	numErrors, err:=nl.PostProcessLights(ctx, refFrame, refFrame, lights, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), oobMode, nil,
+									float32(*usmSigma), float32(*usmGain), float32(*usmThresh), wavGainsF, *post, lsEstimator, imageLevelParallelism)
+	if err!=nil { nl.LogFatal(err.Error()) }
+    if numErrors>0 { nl.LogFatal("Need aligned narrowband frames to proceed") }
+
+	// Map narrowband channels to RGB, and combine
+	nl.LogPrintf("\nApplying palette %s with weights %v...\n", pal.Name, weights)
+	channels:=[]*nl.FITSImage{lights[0], lights[1], nil}
+	if len(lights)==3 { channels[nl.NBSII]=lights[2] }
+	mapped:=pal.Apply(channels, weights)
+	lights=nil
+	rgb:=nl.CombineRGB(mapped, refFrame)
+
+	postProcessAndSaveRGBComposite(&rgb, nil)
+	rgb.Data=nil
+}
+
+
+// Perform channel mixer command. Linearly combines any number of input channels into RGB
+func cmdMix(args []string) {
+	// Set default parameters for this command
+	if *normHist==nl.HNMAuto { *normHist=nl.HNMNone }
+	if *starBpSig<0 { *starBpSig=0 }  // inputs are typically stacked and have undergone noise removal
+
+	// Glob file name wildcards
+	fileNames:=globFilenameWildcards(args)
+	if len(fileNames)<1 {
+		nl.LogFatal("Need at least one input file to mix")
+	}
+	matrix, err:=nl.ParseMixMatrix(*mix, 3, len(fileNames))
+	if err!=nil { nl.LogFatal(err.Error()) }
+	ids:=make([]int, len(fileNames))
+	for i:=range ids { ids[i]=i }
+
+	// Read files and detect stars
+	imageLevelParallelism:=maxParallelism()
+	if imageLevelParallelism>int32(len(ids)) { imageLevelParallelism=int32(len(ids)) }
+	nl.LogPrintf("\nReading channels and detecting stars:\n")
+	lights, err:=nl.PreProcessLights(ctx, ids, fileNames, nil, nil, *debayer, *cfa, int32(*binning), 1, 0, 0, 
+		float32(*starSig), float32(*starBpSig), int32(*starRadius), *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, lsEstimator, imageLevelParallelism)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	for i, l:=range lights {
+		if l==nil { nl.LogFatalf("Unable to read channel %d\n", i) }
+	}
+
+	// Pick reference frame
+	refFrame, refFrameScore:=nl.SelectReferenceFrame(lights)
+	if refFrame==nil { panic("Reference channel for alignment not found.") }
+	nl.LogPrintf("Using channel %d with score %.4g as reference for alignment and normalization.\n\n", refFrame.ID, refFrameScore)
+
+	// Post-process all channels (align, normalize)
+	var oobMode nl.OutOfBoundsMode=nl.OOBModeOwnLocation
+	nl.LogPrintf("Postprocessing %d channels with align=%d alignK=%d alignT=%.3f normHist=%d oobMode=%d usmSigma=%g usmGain=%g usmThresh=%g:\n", 
+				 len(lights), *align, *alignK, *alignT, *normHist, oobMode, float32(*usmSigma), float32(*usmGain), float32(*usmThresh))
+	numErrors, err:=nl.PostProcessLights(ctx, refFrame, refFrame, lights, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), oobMode, nil,
+									float32(*usmSigma), float32(*usmGain), float32(*usmThresh), wavGainsF, *post, lsEstimator, imageLevelParallelism)
+	if err!=nil { nl.LogFatal(err.Error()) }
+    if numErrors>0 { nl.LogFatal("Need aligned channels to proceed") }
+
+	// Mix channels into RGB, and combine
+	nl.LogPrintf("\nMixing %d channels with matrix %v...\n", len(lights), matrix)
+	mixed:=nl.MixChannels(lights, matrix)
+	lights=nil
+	rgb:=nl.CombineRGB(mixed, refFrame)
 
 	postProcessAndSaveRGBComposite(&rgb, nil)
 	rgb.Data=nil
 }
 
 
+// Perform continuum subtraction command. Subtracts a scaled broadband channel from a narrowband channel,
+// leaving only the emission line signal
+func cmdContsub(args []string) {
+	// Set default parameters for this command. Keep data linear so channel fluxes stay comparable
+	if *normHist==nl.HNMAuto { *normHist=nl.HNMNone }
+	if *starBpSig<0 { *starBpSig=0 }  // inputs are typically stacked and have undergone noise removal
+
+	// Glob file name wildcards
+	fileNames:=globFilenameWildcards(args)
+	if len(fileNames)!=2 {
+		nl.LogFatal("Need exactly two input files to perform continuum subtraction: narrowband and broadband")
+	}
+	ids:=[]int{0,1}
+
+	// Read files and detect stars
+	nl.LogPrintf("\nReading narrowband and broadband channels and detecting stars:\n")
+	lights, err:=nl.PreProcessLights(ctx, ids, fileNames, nil, nil, *debayer, *cfa, int32(*binning), 0, 0, 0, 
+		float32(*starSig), float32(*starBpSig), int32(*starRadius), *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, lsEstimator, 2)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	for i, l:=range lights {
+		if l==nil { nl.LogFatalf("Unable to read channel %d\n", i) }
+	}
+
+	// Always use broadband as reference frame, so its stars are in aligned coordinates
+	refFrame:=lights[1]
+	nl.LogPrintf("Using broadband channel %d as reference for alignment and normalization.\n\n", refFrame.ID)
+
+	// Post-process all channels (align, normalize)
+	var oobMode nl.OutOfBoundsMode=nl.OOBModeOwnLocation
+	nl.LogPrintf("Postprocessing %d channels with align=%d alignK=%d alignT=%.3f normHist=%d oobMode=%d usmSigma=%g usmGain=%g usmThresh=%g:\n", 
+				 len(lights), *align, *alignK, *alignT, *normHist, oobMode, float32(*usmSigma), float32(*usmGain), float32(*usmThresh))
+	numErrors, err:=nl.PostProcessLights(ctx, refFrame, refFrame, lights, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), oobMode, nil,
+									float32(*usmSigma), float32(*usmGain), float32(*usmThresh), wavGainsF, *post, lsEstimator, 2)
+	if err!=nil { nl.LogFatal(err.Error()) }
+    if numErrors>0 { nl.LogFatal("Need aligned channels to proceed") }
+
+	// Subtract scaled continuum
+	scale:=continuumScale(*contScale, lights[0], lights[1], refFrame.Stars)
+	nl.LogPrintf("\nSubtracting broadband continuum scaled by %.4g...\n", scale)
+	res, err:=nl.ContinuumSubtract(lights[0], lights[1], scale, lsEstimator)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	lights=nil
+	nl.LogPrintf("Emission line map stats: %v\n", res.Stats)
+
+	saveStack(res)
+}
+
+
+// Perform star removal command. Removes detected stars from a stacked image, so nebulosity and stars
+// can be stretched separately
+func cmdStarless(args []string) {
+	// Set default parameters for this command
+	if *starBpSig<0 { *starBpSig=0 }  // inputs are typically stacked and have undergone noise removal
+
+	// Glob file name wildcards
+	fileNames:=globFilenameWildcards(args)
+	if len(fileNames)!=1 {
+		nl.LogFatal("Need exactly one input file to remove stars")
+	}
+
+	// Read file and detect stars
+	nl.LogPrintf("\nReading image and detecting stars:\n")
+	lights, err:=nl.PreProcessLights(ctx, []int{0}, fileNames, nil, nil, *debayer, *cfa, int32(*binning), 0, 0, 0, 
+		float32(*starSig), float32(*starBpSig), int32(*starRadius), *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, lsEstimator, 1)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	if lights[0]==nil { nl.LogFatal("Unable to read image") }
+
+	// Remove stars
+	nl.LogPrintf("\nRemoving %d stars within %.3g times their half-flux radius...\n", len(lights[0].Stars), *starRemRadius)
+	starless, starsOnlyImg, err:=nl.RemoveStars(lights[0], lights[0].Stars, float32(*starRemRadius), lsEstimator)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	lights=nil
+	nl.LogPrintf("Starless image stats: %v\n", starless.Stats)
+
+	if *starsOnly!="" {
+		nl.LogPrintf("Writing star-only image to %s: %v\n", *starsOnly, starsOnlyImg.Stats)
+		err:=withProvenance(starsOnlyImg).WriteFile(*starsOnly)
+		if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+	}
+	saveStack(starless)
+}
+
+
 // Perform LRGB combination command
 func cmdLRGB(args []string, applyLuminance bool) {
 	// Set default parameters for this command
@@ -573,13 +2151,18 @@ func cmdLRGB(args []string, applyLuminance bool) {
 		nl.LogFatal("Need exactly four input files to perform a LRGB combination")
 	}
 	ids:=[]int{0,1,2,3}
+	if *ha!="" {
+		fileNames=append(fileNames, *ha)
+		ids=append(ids, 4)
+	}
 
 	// Read files and detect stars
-	imageLevelParallelism:=int32(runtime.GOMAXPROCS(0))
-	if imageLevelParallelism>4 { imageLevelParallelism=4 }
+	imageLevelParallelism:=maxParallelism()
+	if imageLevelParallelism>int32(len(ids)) { imageLevelParallelism=int32(len(ids)) }
 	nl.LogPrintf("\nReading color channels and detecting stars:\n")
-	lights:=nl.PreProcessLights(ids, fileNames, nil, nil, *debayer, *cfa, int32(*binning), 1, 0, 0, 
-		float32(*starSig), float32(*starBpSig), int32(*starRadius), *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, imageLevelParallelism)
+	lights, err:=nl.PreProcessLights(ctx, ids, fileNames, nil, nil, *debayer, *cfa, int32(*binning), 1, 0, 0, 
+		float32(*starSig), float32(*starBpSig), int32(*starRadius), *stars, int32(*backGrid), float32(*backSigma), int32(*backClip), *back, *pre, lsEstimator, imageLevelParallelism)
+	if err!=nil { nl.LogFatal(err.Error()) }
 
 	var refFrame, histoRef *nl.FITSImage
 	if (*align)!=0 {
@@ -592,7 +2175,7 @@ func cmdLRGB(args []string, applyLuminance bool) {
 		// Normalize to [0,1]
 		histoRef=lights[1]
 		minLoc:=float32(histoRef.Stats.Location)
-	    for id, light:=range(lights) {
+	    for id, light:=range(lights[:4]) {
 	    	if id>0 && light.Stats.Location<minLoc { 
 	    		minLoc=light.Stats.Location 
 	    		histoRef=light
@@ -605,13 +2188,23 @@ func cmdLRGB(args []string, applyLuminance bool) {
 	var oobMode nl.OutOfBoundsMode=nl.OOBModeOwnLocation
 	nl.LogPrintf("Postprocessing %d channels with align=%d alignK=%d alignT=%.3f normHist=%d oobMode=%d usmSigma=%g usmGain=%g usmThresh=%g:\n", 
 		         len(lights), *align, *alignK, *alignT, *normHist, oobMode, *usmSigma, *usmGain, *usmThresh)
-	numErrors:=nl.PostProcessLights(refFrame, histoRef, lights, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), oobMode, 
-									float32(*usmSigma), float32(*usmGain), float32(*usmThresh), "", imageLevelParallelism)
+	numErrors, err:=nl.PostProcessLights(ctx, refFrame, histoRef, lights, int32(*align), int32(*alignK), float32(*alignT), nl.HistoNormMode(*normHist), oobMode, nil,
+									float32(*usmSigma), float32(*usmGain), float32(*usmThresh), wavGainsF, "", lsEstimator, imageLevelParallelism)
+	if err!=nil { nl.LogFatal(err.Error()) }
     if numErrors>0 { nl.LogFatal("Need aligned RGB frames to proceed") }
 
+	// Blend Ha into red and luminance channels if selected
+	if *ha!="" {
+		if applyLuminance {
+			blendHa(lights[4], lights[1], lights[0], lights[0].Stars)
+		} else {
+			blendHa(lights[4], lights[1], nil, lights[0].Stars)
+		}
+	}
+
 	// Combine RGB channels
 	nl.LogPrintf("\nCombining color channels...\n")
-	rgb:=nl.CombineRGB(lights[1:], lights[0])
+	rgb:=nl.CombineRGB(lights[1:4], lights[0])
 
 	if applyLuminance {
 		postProcessAndSaveRGBComposite(&rgb, lights[0])
@@ -621,15 +2214,71 @@ func cmdLRGB(args []string, applyLuminance bool) {
 	rgb.Data=nil
 }
 
+// Blends the Ha channel into the red channel, and optionally into the luminance channel.
+// Optionally subtracts the red continuum from Ha first, so only the emission line signal is blended.
+// Stars for continuum scale estimation must be in the aligned coordinates
+func blendHa(ha, red, lum *nl.FITSImage, stars []nl.Star) {
+	if *haCont!=0 {
+		scale:=continuumScale(*haCont, ha, red, stars)
+		nl.LogPrintf("Subtracting red continuum scaled by %.4g from Ha...\n", scale)
+		var err error
+		ha, err=nl.ContinuumSubtract(ha, red, scale, lsEstimator)
+		if err!=nil { nl.LogFatal(err.Error()) }
+	}
+	nl.LogPrintf("Blending Ha into red channel with factor %.4g...\n", *haBlend)
+	if err:=nl.BlendNarrowband(red, ha, float32(*haBlend), lsEstimator); err!=nil { nl.LogFatal(err.Error()) }
+	if lum!=nil && *haLum!=0 {
+		nl.LogPrintf("Blending Ha into luminance channel with factor %.4g...\n", *haLum)
+		if err:=nl.BlendNarrowband(lum, ha, float32(*haLum), lsEstimator); err!=nil { nl.LogFatal(err.Error()) }
+	}
+}
+
+// Returns the given continuum scale, or estimates it from field stars if negative
+func continuumScale(scale float64, narrow, broad *nl.FITSImage, stars []nl.Star) float32 {
+	if scale>=0 { return float32(scale) }
+	est, numStars, err:=nl.EstimateContinuumScale(narrow, broad, stars)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	nl.LogPrintf("Estimated continuum scale %.4g from %d of %d stars\n", est, numStars, len(stars))
+	return est
+}
+
 func postProcessAndSaveRGBComposite(rgb *nl.FITSImage, lum *nl.FITSImage) {
+	stopColor:=nl.StartStage(nl.StageColor)
+	defer stopColor()
+	if *histOut!="" { histograms=nl.NewHistogramSet() }
+	histImage("composite", rgb)
+	if lum!=nil { histImage("luminance", lum) }
+
+	// Optionally remove residual gradients per channel, before color balancing
+	if (*rgbBackGrid)>0 {
+		nl.LogPrintf("Removing residual gradients with grid %d, sigma %.3g and clip %d...\n", *rgbBackGrid, *backSigma, *backClip)
+		for c, bg:=range rgb.RemoveGradients(int32(*rgbBackGrid), float32(*backSigma), int32(*backClip)) {
+			nl.LogPrintf("Channel %d: %s\n", c, bg)
+		}
+		if lum!=nil {
+			for _, bg:=range lum.RemoveGradients(int32(*rgbBackGrid), float32(*backSigma), int32(*backClip)) {
+				nl.LogPrintf("Luminance: %s\n", bg)
+			}
+		}
+	}
+
+	checkContext()
+
 	// Auto-balance colors in linear RGB color space
 	autoBalanceColors(rgb)
 
+	checkContext()
+
 	// Apply LRGB combination in linear CIE xyY color space
 	if lum!=nil {
 		nl.LogPrintln("Converting linear RGB to linear CIE xyY for LRGB combination")
 	    rgb.ToXyy()
 
+		if (*lrgbChromaBlur)!=0 {
+			nl.LogPrintf("Smoothing chromaticity with sigma %.3g...\n", *lrgbChromaBlur)
+			rgb.BlurChromaticity(float32(*lrgbChromaBlur))
+		}
+
 		nl.LogPrintln("Applying luminance to Y channel...")
 		rgb.ApplyLuminanceToCIExyY(lum)
 
@@ -637,15 +2286,22 @@ func postProcessAndSaveRGBComposite(rgb *nl.FITSImage, lum *nl.FITSImage) {
 		rgb.XyyToRGB()
 	}
 
+	checkContext()
+
 	// Apply color corrections in non-linear modified CIE L*C*H space, i.e. HSL
-	if ((*neutSigmaLow>=0) && (*neutSigmaHigh>=0)) || ((*chromaGamma)!=1) || ((*chromaBy)!=0) || ((*rotBy)!=0) || ((*scnr)!=0) {
+	if ((*neutSigmaLow>=0) && (*neutSigmaHigh>=0)) || ((*chromaGamma)!=1) || ((*chromaBy)!=0) || ((*rotBy)!=0) || ((*scnr)!=0) || ((*chromaNR)!=0) || ((*chromaLumBy)!=1) {
 		nl.LogPrintln("Converting image to nonlinear modified CIE L*C*H space, i.e. HSL...")
 		rgb.RGBToCIEHSL()
 
+	    if (*chromaNR)!=0 {
+	    	nl.LogPrintf("Reducing chroma noise with bilateral filter of spatial sigma %.3g and luminance sigma %.3g...\n", *chromaNR, *chromaNRRange)
+	    	rgb.DenoiseChroma(float32(*chromaNR), float32(*chromaNRRange))
+	    }
+
 	    if (*neutSigmaLow>=0) && (*neutSigmaHigh>=0) {
 			nl.LogPrintf("Neutralizing background values below %.4g sigma, keeping color above %.4g sigma\n", *neutSigmaLow, *neutSigmaHigh)    	
 
-			loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0])
+			loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0], lsEstimator)
 			if err!=nil { nl.LogFatal(err) }
 			low :=loc + scale*float32(*neutSigmaLow)
 			high:=loc + scale*float32(*neutSigmaHigh)
@@ -658,7 +2314,7 @@ func postProcessAndSaveRGBComposite(rgb *nl.FITSImage, lum *nl.FITSImage) {
 	    	nl.LogPrintf("Applying gamma %.2f to saturation for values %.4g sigma above background...\n", *chromaGamma, *chromaSigma)
 
 			// calculate basic image stats as a fast location and scale estimate
-			loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0])
+			loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0], lsEstimator)
 			if err!=nil { nl.LogFatal(err) }
 			threshold :=loc + scale*float32(*chromaSigma)
 			nl.LogPrintf("Location %.2f%%, scale %.2f%%, threshold %.2f%%\n", loc*100, scale*100, threshold*100)
@@ -671,25 +2327,42 @@ func postProcessAndSaveRGBComposite(rgb *nl.FITSImage, lum *nl.FITSImage) {
 			rgb.AdjustChromaForHues(float32(*chromaFrom), float32(*chromaTo), float32(*chromaBy))
 	    }
 
+	    if (*chromaLumBy)!=1 {
+	    	nl.LogPrintf("Multiplying LCH chroma (saturation) by %.4g for luminances in [%g%%,%g%%] with feather %g%%...\n", *chromaLumBy, *chromaLumFrom, *chromaLumTo, *chromaLumFeather)
+			rgb.AdjustChromaForLums(float32(*chromaLumFrom/100), float32(*chromaLumTo/100), float32(*chromaLumBy), float32(*chromaLumFeather/100))
+	    }
+
 	    if (*rotBy)!=0 {
 	    	nl.LogPrintf("Rotating LCH hue angles in [%g,%g] by %.4g...\n", *rotFrom, *rotTo, *rotBy)
 			rgb.RotateColors(float32(*rotFrom), float32(*rotTo), float32(*rotBy))
 	    }
 
 	    if (*scnr)!=0 {
-	    	nl.LogPrintf("Applying SCNR of %.4g ...\n", *scnr)
-			rgb.SCNR(float32(*scnr))
+	    	nl.LogPrintf("Applying SCNR of %.4g with method %d and luminance mask %.4g ...\n", *scnr, *scnrMethod, *scnrLumMask)
+			rgb.SCNR(float32(*scnr), nl.SCNRMethod(*scnrMethod), float32(*scnrLumMask))
 	    }
 
 		nl.LogPrintln("Converting nonlinear CIE HSL to linear RGB")
 	    rgb.CIEHSLToRGB()
 	}
 
+	checkContext()
+
 	// Apply luminance curves in linear CIE xyY color space
-	if ((*autoLoc)!=0 && (*autoScale)!=0) || ((*midtone)!=0) || ((*gamma)!=1) || ((*ppGamma)!=1) || ((*scaleBlack)!=0) {
+	if ((*autoLoc)!=0 && (*autoScale)!=0) || ((*asinh)!=0) || ((*midtone)!=0) || ((*gamma)!=1) || ((*ppGamma)!=1) || ((*scaleBlack)!=0) {
 		nl.LogPrintln("Converting linear RGB to linear CIE xyY")
 	    rgb.ToXyy()
 
+	    // Optionally apply arcsinh stretch
+	    if (*asinh)!=0 {
+			loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0], lsEstimator)
+			if err!=nil { nl.LogFatal(err) }
+			absBlack:=loc - float32(*asinhBlack)*scale
+			if absBlack<0 { absBlack=0 }
+	    	nl.LogPrintf("Applying arcsinh stretch with strength %.4g and black=location - %.2f x scale = %.2f%%\n", *asinh, *asinhBlack, 100*absBlack)
+	    	rgb.ApplyArcsinhToChannel(2, float32(*asinh), absBlack)
+	    }
+
 		// Iteratively adjust gamma and shift back histogram peak
 		if (*autoLoc)!=0 && (*autoScale)!=0 {
 			targetLoc  :=float32((*autoLoc)/100.0)    // range [0..1], while autoLoc is [0..100]
@@ -697,13 +2370,14 @@ func postProcessAndSaveRGBComposite(rgb *nl.FITSImage, lum *nl.FITSImage) {
 			nl.LogPrintf("Automatic curves adjustment targeting location %.2f%% and scale %.2f%% ...\n", targetLoc*100, targetScale*100)
 
 			for i:=0; ; i++ {
+				checkContext()
 				if i==30 { 
 					nl.LogPrintf("Warning: did not converge after %d iterations\n",i)
 					break
 				}
 
 				// calculate basic image stats as a fast location and scale estimate
-				loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0])
+				loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0], lsEstimator)
 				if err!=nil { nl.LogFatal(err) }
 				nl.LogPrintf("Location %.2f%% and scale %.2f%%: ", loc*100, scale*100)
 
@@ -725,6 +2399,16 @@ func postProcessAndSaveRGBComposite(rgb *nl.FITSImage, lum *nl.FITSImage) {
 					break
 				}
 			}
+
+			// Record the stretched luminance with the targets, to show how automatic curves converged
+			if histograms!=nil {
+				loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0], lsEstimator)
+				if err!=nil { nl.LogFatal(err) }
+				l:=len(rgb.Data)/3
+				h:=nl.NewExportedHistogram("autoCurves", -1, "", 2, rgb.Data[2*l:], 0, 1, loc, scale)
+				h.TargetLocation, h.TargetScale=targetLoc, targetScale
+				histograms.Add(h)
+			}
 		}
 
 	    // Optionally adjust midtones
@@ -732,7 +2416,7 @@ func postProcessAndSaveRGBComposite(rgb *nl.FITSImage, lum *nl.FITSImage) {
 	    	nl.LogPrintf("Applying midtone correction with midtone=%.2f%% x scale and black=location - %.2f%% x scale\n", *midtone, *midBlack)
 
 			// calculate basic image stats as a fast location and scale estimate
-			loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0])
+			loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0], lsEstimator)
 			if err!=nil { nl.LogFatal(err) }
 			absMid:=float32(*midtone)*scale
 			absBlack:=loc - float32(*midBlack)*scale
@@ -748,7 +2432,7 @@ func postProcessAndSaveRGBComposite(rgb *nl.FITSImage, lum *nl.FITSImage) {
 
 		// Optionally adjust gamma post peak
 	    if (*ppGamma)!=1 {
-			loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0])
+			loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0], lsEstimator)
 			if err!=nil { nl.LogFatal(err) }
 
 	    	from:=loc+float32(*ppSigma)*scale
@@ -760,7 +2444,7 @@ func postProcessAndSaveRGBComposite(rgb *nl.FITSImage, lum *nl.FITSImage) {
 		// Optionally scale histogram peak
 	    if (*scaleBlack)!=0 {
 	    	targetBlack:=float32((*scaleBlack)/100.0)
-			loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0])
+			loc, scale, err:=nl.HCLLumLocScale(rgb.Data, rgb.Naxisn[0], lsEstimator)
 			if err!=nil { nl.LogFatal(err) }
 			nl.LogPrintf("Location %.2f%% and scale %.2f%%: ", loc*100, scale*100)
 
@@ -776,18 +2460,91 @@ func postProcessAndSaveRGBComposite(rgb *nl.FITSImage, lum *nl.FITSImage) {
 		rgb.XyyToRGB()
 	}
 
+	checkContext()
+
+	// Optionally reduce noise on the stretched luminance
+	if nrThreshF!=nil {
+		nl.LogPrintf("Applying wavelet noise reduction with layer thresholds %v and luminance mask %.3g\n", nrThreshF, *nrLumMask)
+		rgb.ToXyy()
+		l:=len(rgb.Data)/3
+		lum:=rgb.Data[2*l:]
+		denoised, noise:=nl.WaveletDenoise(lum, int(rgb.Naxisn[0]), nrThreshF, float32(*nrLumMask), 0, 1)
+		copy(lum, denoised)
+		nl.LogPrintf("Estimated luminance noise %.4g\n", noise)
+		rgb.XyyToRGB()
+	}
+
+	checkContext()
+
+	// Optionally compress large-scale dynamic range on the stretched luminance
+	if (*hdr)!=0 {
+		nl.LogPrintf("Applying HDR compression with strength %.3g and %d detail layers...\n", *hdr, *hdrLayers)
+		rgb.ToXyy()
+		rgb.CompressHDR(2, int(*hdrLayers), float32(*hdr))
+		rgb.XyyToRGB()
+	}
+
+	checkContext()
+
+	// Optionally reduce star sizes on the stretched luminance
+	if (*starReduce)!=0 {
+		nl.LogPrintf("Reducing %d stars with strength %.3g and %d iterations...\n", len(rgb.Stars), *starReduce, *starReduceIter)
+		rgb.ToXyy()
+		rgb.ReduceStars(2, rgb.Stars, 3, float32(*starReduce), int(*starReduceIter))
+		rgb.XyyToRGB()
+	}
+
+	checkContext()
+
+	// Optionally render diffraction spikes on the final stars
+	if (*spikes)!=0 {
+		num:=rgb.RenderSpikes(rgb.Stars, float32(*spikeThresh), float32(*spikeLen), float32(*spikeAngle), float32(*spikes))
+		nl.LogPrintf("Rendered diffraction spikes on %d of %d stars\n", num, len(rgb.Stars))
+	}
+	stopColor()
+	checkContext()
+
 	// Write outputs
 	nl.LogPrintf("Writing FITS to %s ...\n", *out)
-	err:=rgb.WriteFile(*out)
+	err:=withProvenance(rgb).WriteFile(*out)
 	if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
 	if (*jpg)!="" {
 		nl.LogPrintf("Writing JPG to %s ...\n", *jpg)
-		rgb.WriteJPGToFile(*jpg, 95)
+		var icc []byte
+		if *jpgICC!="" {
+			icc, err=ioutil.ReadFile(*jpgICC)
+			if err!=nil { nl.LogFatalf("Error reading ICC profile: %s\n", err) }
+		}
+		jpgImg:=rgb
+		if *annotate!="" { jpgImg=annotateImage(rgb) }
+		err=jpgImg.WriteJPGToFile(*jpg, 95, nl.ExportEncoding(*jpgEncode), nl.DitherMode(*jpgDither), icc)
 		if err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
 	}
+	histImage("output", rgb)
+	writeHistograms()
 }
 
 
+// Returns a copy of the given image annotated with the catalog objects given on the command line,
+// leaving the original untouched for the FITS output
+func annotateImage(img *nl.FITSImage) *nl.FITSImage {
+	if *annWCS=="" { nl.LogFatal("Annotation requires a WCS solution, see -annWCS") }
+	h, err:=nl.ReadFITSHeaderFile(*annWCS)
+	if err!=nil { nl.LogFatalf("Error reading WCS solution: %s\n", err) }
+	wcs, err:=nl.NewWCSFromHeader(&h)
+	if err!=nil { nl.LogFatalf("Error reading WCS solution from %s: %s\n", *annWCS, err) }
+	var types []string
+	if *annTypes!="" { types=strings.Split(*annTypes, ",") }
+	objects, err:=nl.LoadCatalog(*annotate, types)
+	if err!=nil { nl.LogFatalf("Error reading catalog: %s\n", err) }
+
+	res:=*img
+	res.Data=append([]float32(nil), img.Data...) // clone slice
+	num:=res.Annotate(wcs, objects, int(*annFont), [3]float32{1, 0.85, 0.3})
+	nl.LogPrintf("Annotated %d of %d catalog objects\n", num, len(objects))
+	return &res
+}
+
 // Automatically balance colors with multiple iterations of SetBlackWhitePoints, producing log output
 func autoBalanceColors(rgb *nl.FITSImage) {
 	if len(rgb.Stars)==0 {
@@ -795,7 +2552,7 @@ func autoBalanceColors(rgb *nl.FITSImage) {
 	} else {
 		nl.LogPrintln("Setting black point so histogram peaks align and white point so median star color becomes neutral...")
 		for i:=0; i<3; i++ {
-			err:=rgb.SetBlackWhitePoints()
+			err:=rgb.SetBlackWhitePoints(lsEstimator)
 			if err!=nil { nl.LogFatal(err) }
 		}
 	}
@@ -807,10 +2564,16 @@ func globFilenameWildcards(args []string) []string {
 	if len(args)<1 { nl.LogFatal("No frames to process.") }
 	fileNames:=[]string{}
 	for _, pattern := range args {
+		if pattern==nl.StdioFileName { // read from stdin
+			if containsString(fileNames, pattern) { nl.LogFatal("Cannot read more than one frame from stdin") }
+			fileNames=append(fileNames, pattern)
+			continue
+		}
 		matches, err := filepath.Glob(pattern)
 		if err!=nil { nl.LogFatal(err) }
 		fileNames=append(fileNames, matches...)
 	}
+	provenanceInputs=append(provenanceInputs, fileNames...)
 	nl.LogPrintf("Found %d frames:\n", len(fileNames))
 	for i, fileName :=range fileNames {
 		nl.LogPrintf("%d:%s\n",i, fileName)
@@ -818,6 +2581,352 @@ func globFilenameWildcards(args []string) []string {
 	return fileNames
 }
 
+// Returns a shallow copy of the image with the processing history of the current command appended to its
+// header history, if enabled. Records the version, the parameters applicable to the command, and the
+// input files and calibration frames with their hashes
+func withProvenance(img *nl.FITSImage) *nl.FITSImage {
+	if !*history { return img }
+	if provenance==nil {
+		params:=map[string]string{}
+		if c:=findCommand(provenanceCommand); c!=nil {
+			c.flagSet().VisitAll(func(f *flag.Flag) {
+				if f.Name=="cpuprofile" || f.Name=="memprofile" || f.Name=="config" || f.Name=="log" { return }
+				params[f.Name]=f.Value.String()
+			})
+		}
+		inputs:=[]string{}
+		for _, fileName:=range append([]string{*dark, *flat, *stExclude}, provenanceInputs...) {
+			if fileName!="" && !containsString(inputs, fileName) { inputs=append(inputs, fileName) }
+		}
+		var err error
+		provenance, err=nl.ProvenanceHistory(version, provenanceCommand, params, inputs)
+		if err!=nil { nl.LogFatalf("Error recording processing history: %s\n", err) }
+	}
+	res:=*img
+	res.Header.History=append(append([]string(nil), img.Header.History...), provenance...)
+	return &res
+}
+
+// Loads color and tone curve parameters from the given preset file, and applies them to all flags
+// which were not given explicitly
+func loadPreset(fileName string, explicit map[string]bool) {
+	p, err:=nl.LoadPreset(fileName)
+	if err!=nil { nl.LogFatal(err.Error()) }
+
+	applyPresetParams:=func(params map[string]interface{}, allowed []string, group string) {
+		for name, value:=range params {
+			if !containsString(allowed, name) { nl.LogFatalf("Preset %s: unknown %s parameter '%s'\n", fileName, group, name) }
+			if explicit[name] { continue }
+			if err:=flag.Set(name, fmt.Sprint(value)); err!=nil {
+				nl.LogFatalf("Preset %s: invalid value for %s parameter '%s': %s\n", fileName, group, name, err)
+			}
+		}
+	}
+	applyPresetParams(p.Color, presetColorFlags, "color")
+	applyPresetParams(p.Tone,  presetToneFlags,  "tone")
+	nl.LogPrintf("Loaded preset '%s' from %s\n", p.Name, fileName)
+}
+
+// Returns the names of the flags set explicitly, on the command line or in a configuration file
+func explicitFlags() map[string]bool {
+	explicit:=map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name]=true })
+	return explicit
+}
+
+// Applies the parameters of the given built-in profile to all flags which were not given explicitly
+func loadProfile(name string, explicit map[string]bool) {
+	p, err:=nl.FindProfile(name)
+	if err!=nil { nl.LogFatal(err.Error()) }
+	nl.LogPrintf("Using profile %s for %s\n", p.Name, p.Desc)
+	for name, value:=range p.Params {
+		if explicit[name] { continue }
+		if err:=flag.Set(name, value); err!=nil {
+			nl.LogFatalf("Profile %s: invalid value for parameter '%s': %s\n", p.Name, name, err)
+		}
+	}
+}
+
+// Commands which can be run for targets of a project
+var projectCommands=[]string{"stats", "stack", "integrate", "rgb", "palette", "mix", "contsub", "starless", "argb", "lrgb", "split", "merge"}
+
+// Processes each target of a multi-target project in turn, with its own inputs, calibration frames and parameters.
+// Parameters not given by the target keep the values from the command line, configuration file and preset
+func cmdProject(args []string) {
+	if len(args)!=1 { nl.LogFatal("Need exactly one project file to process") }
+	project, err:=nl.LoadProject(args[0])
+	if err!=nil { nl.LogFatal(err.Error()) }
+
+	// Validate all targets before processing the first
+	targetParams:=make([]map[string]string, len(project.Targets))
+	for i, t:=range project.Targets {
+		if !containsString(projectCommands, t.Command) {
+			nl.LogFatalf("Target %d '%s': unsupported command '%s', expecting one of %s\n", i, t.Name, t.Command, strings.Join(projectCommands, ", "))
+		}
+		targetParams[i], err=t.ParamStrings()
+		if err!=nil { nl.LogFatal(err.Error()) }
+		for name:=range targetParams[i] {
+			if flag.Lookup(name)==nil || name=="config" || name=="log" || name=="out" {
+				nl.LogFatalf("Target %d '%s': unsupported parameter '%s'\n", i, t.Name, name)
+			}
+		}
+	}
+
+	// Remember the effective flags, to restore them for each target
+	explicit:=explicitFlags()
+	effective:=map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) { effective[f.Name]=f.Value.String() })
+
+	for i, t:=range project.Targets {
+		nl.LogPrintf("\nStarting target %d of %d '%s' with command %s and output %s\n", i, len(project.Targets), t.Name, t.Command, t.Out)
+		start:=time.Now()
+		for name, value:=range effective { flag.Set(name, value) }
+		flag.Set("out", t.Out)
+		if t.Dark!="" { flag.Set("dark", t.Dark) }
+		if t.Flat!="" { flag.Set("flat", t.Flat) }
+
+		// A profile or preset given by the target applies to all flags not given explicitly or by the target.
+		// The preset takes precedence over the profile
+		params:=targetParams[i]
+		if profileName, ok:=params["profile"]; ok && profileName!="" {
+			targetExplicit:=map[string]bool{}
+			for name:=range explicit { targetExplicit[name]=true }
+			for name:=range params   { targetExplicit[name]=true }
+			loadProfile(profileName, targetExplicit)
+		}
+		if presetName, ok:=params["preset"]; ok && presetName!="" {
+			targetExplicit:=map[string]bool{}
+			for name:=range explicit { targetExplicit[name]=true }
+			for name:=range params   { targetExplicit[name]=true }
+			loadPreset(presetName, targetExplicit)
+		}
+		for name, value:=range params {
+			if err:=flag.Set(name, value); err!=nil {
+				nl.LogFatalf("Target %d '%s': invalid value for parameter '%s': %s\n", i, t.Name, name, err)
+			}
+		}
+		if _, ok:=params["jpg"]; !ok && autoFlags["jpg"] {
+			*jpg=strings.TrimSuffix(*out, filepath.Ext(*out))+".jpg"
+		}
+
+		darkF, flatF, exclusionMask, lights=nil, nil, nil, []*nl.FITSImage{}
+		setupCommand(t.Command)
+		runCommand(append([]string{t.Command}, t.Inputs...))
+		nl.LogPrintf("Finished target %d '%s' after %v\n", i, t.Name, time.Since(start))
+		debug.FreeOSMemory()
+	}
+}
+
+// Loads parameters from the given configuration file. Flags given on the command line take precedence
+func loadConfig(fileName string) {
+	params, err:=nl.LoadConfig(fileName)
+	if err!=nil { nl.LogFatal(err.Error()) }
+
+	explicit:=map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name]=true })
+	for name, value:=range params {
+		if name=="config" || flag.Lookup(name)==nil { nl.LogFatalf("Config %s: unknown parameter '%s'\n", fileName, name) }
+		if explicit[name] { continue }
+		if err:=flag.Set(name, value); err!=nil {
+			nl.LogFatalf("Config %s: invalid value for parameter '%s': %s\n", fileName, name, err)
+		}
+	}
+}
+
+// Performs configuration subcommands. Dump saves the effective parameters to the given configuration file
+func cmdConfig(args []string) {
+	if len(args)!=2 || args[0]!="dump" { nl.LogFatal("Usage: config dump (file.json|file.yaml|file.toml)") }
+	params:=map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name=="config" { return }
+		params[f.Name]=f.Value.String()
+		if autoFlags[f.Name] { params[f.Name]="%auto" }
+	})
+	nl.LogPrintf("Writing %d parameters to %s\n", len(params), args[1])
+	if err:=nl.WriteConfig(args[1], params); err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+}
+
+// Shows FITS headers of the given files as table, after setting and deleting keys as flagged
+func cmdHeader(args []string) {
+	fileNames:=globFilenameWildcards(args)
+	if fileNames==nil || len(fileNames)==0 {
+		nl.LogFatal("Error: no input files")
+	}
+
+	// Parse edits
+	sets:=[][]string{}
+	for _, term:=range strings.Split(*hdrSet, ",") {
+		if strings.TrimSpace(term)=="" { continue }
+		kv:=strings.SplitN(term, "=", 2)
+		if len(kv)!=2 { nl.LogFatalf("Invalid term '%s' in -hdrSet, expecting KEY=value\n", term) }
+		sets=append(sets, []string{strings.ToUpper(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])})
+	}
+	dels:=[]string{}
+	for _, key:=range strings.Split(*hdrDel, ",") {
+		if strings.TrimSpace(key)!="" { dels=append(dels, strings.ToUpper(strings.TrimSpace(key))) }
+	}
+
+	// Select columns, defaulting to the edited keys, else all keys
+	columns:=[]string{}
+	for _, key:=range strings.Split(*hdrKeys, ",") {
+		if strings.TrimSpace(key)!="" { columns=append(columns, strings.ToUpper(strings.TrimSpace(key))) }
+	}
+	if len(columns)==0 {
+		for _, kv:=range sets { columns=append(columns, kv[0]) }
+		columns=append(columns, dels...)
+	}
+	allKeys:=len(columns)==0
+
+	// Read headers and apply edits
+	cards:=make([]*nl.HeaderCards, len(fileNames))
+	for i, fileName:=range fileNames {
+		hc, err:=nl.ReadHeaderCards(fileName)
+		if err!=nil { nl.LogFatalf("Error reading %s: %s\n", fileName, err) }
+		if len(sets)>0 || len(dels)>0 {
+			for _, kv:=range sets {
+				if err:=hc.Set(kv[0], kv[1]); err!=nil { nl.LogFatal(err.Error()) }
+			}
+			for _, key:=range dels {
+				if _, err:=hc.Delete(key); err!=nil { nl.LogFatal(err.Error()) }
+			}
+			if err:=hc.WriteToFile(fileName); err!=nil { nl.LogFatalf("Error writing %s: %s\n", fileName, err) }
+		}
+		if allKeys {
+			for _, key:=range hc.Keys() {
+				if !containsString(columns, key) { columns=append(columns, key) }
+			}
+		}
+		cards[i]=hc
+	}
+	if len(sets)>0 || len(dels)>0 {
+		nl.LogPrintf("Edited headers of %d files\n", len(fileNames))
+	}
+
+	// Print table with padded columns
+	rows:=[][]string{append([]string{"FILE"}, columns...)}
+	for i, fileName:=range fileNames {
+		row:=[]string{fileName}
+		for _, key:=range columns {
+			value, ok:=cards[i].Get(key)
+			if !ok { value="-" }
+			row=append(row, value)
+		}
+		rows=append(rows, row)
+	}
+	widths:=make([]int, len(rows[0]))
+	for _, row:=range rows {
+		for c, value:=range row {
+			if len(value)>widths[c] { widths[c]=len(value) }
+		}
+	}
+	for _, row:=range rows {
+		sb:=strings.Builder{}
+		for c, value:=range row {
+			if c==len(row)-1 {
+				sb.WriteString(value)
+			} else {
+				fmt.Fprintf(&sb, "%-*s  ", widths[c], value)
+			}
+		}
+		nl.LogPrintf("%s\n", sb.String())
+	}
+}
+
+// Splits a multi-channel image into single channel images, named after the output file with a channel suffix
+func cmdSplit(args []string) {
+	fileNames:=globFilenameWildcards(args)
+	if len(fileNames)!=1 { nl.LogFatal("Need exactly one input file to split") }
+	img:=nl.NewFITSImage()
+	if err:=img.ReadFile(fileNames[0]); err!=nil { nl.LogFatalf("Error reading file: %s\n", err) }
+	chans, err:=nl.SplitChannels(&img)
+	if err!=nil { nl.LogFatal(err) }
+
+	ext:=filepath.Ext(*out)
+	for c, ch:=range chans {
+		suffix:=fmt.Sprintf("_%d", c)
+		if len(chans)==3 { suffix="_"+[]string{"r", "g", "b"}[c] }
+		fileName:=strings.TrimSuffix(*out, ext)+suffix+ext
+		nl.LogPrintf("Writing channel %d to %s ...\n", c, fileName)
+		if err:=withProvenance(ch).WriteFile(fileName); err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+	}
+}
+
+// Merges single channel images into one multi-channel image, copying pixel values as they are
+func cmdMerge(args []string) {
+	fileNames:=globFilenameWildcards(args)
+	if len(fileNames)<2 { nl.LogFatal("Need at least two input files to merge") }
+	chans:=make([]*nl.FITSImage, len(fileNames))
+	for i, fileName:=range fileNames {
+		img:=nl.NewFITSImage()
+		if err:=img.ReadFile(fileName); err!=nil { nl.LogFatalf("Error reading file: %s\n", err) }
+		chans[i]=&img
+	}
+	img, err:=nl.MergeChannels(chans)
+	if err!=nil { nl.LogFatal(err) }
+
+	nl.LogPrintf("Writing %d channels to %s ...\n", len(chans), *out)
+	if err:=withProvenance(img).WriteFile(*out); err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+}
+
+// Saves the effective color and tone curve parameters to the given preset file
+func cmdPreset(args []string) {
+	if len(args)!=1 { nl.LogFatal("Need exactly one preset file name to save to") }
+	name:=strings.TrimSuffix(filepath.Base(args[0]), filepath.Ext(args[0]))
+	p:=&nl.Preset{Name: name, Color: map[string]interface{}{}, Tone: map[string]interface{}{}}
+	getPresetParams:=func(params map[string]interface{}, names []string) {
+		for _, name:=range names {
+			value:=flag.Lookup(name).Value.String()
+			if f, err:=strconv.ParseFloat(value, 64); err==nil {
+				params[name]=f
+			} else {
+				params[name]=value
+			}
+		}
+	}
+	getPresetParams(p.Color, presetColorFlags)
+	getPresetParams(p.Tone,  presetToneFlags)
+
+	nl.LogPrintf("Writing preset '%s' to %s\n", p.Name, args[0])
+	if err:=p.WriteFile(args[0]); err!=nil { nl.LogFatalf("Error writing file: %s\n", err) }
+}
+
+// Returns true if the given slice contains the given string
+func containsString(ss []string, s string) bool {
+	for _, t:=range ss {
+		if t==s { return true }
+	}
+	return false
+}
+
+// Parses a comma-separated list of floating point numbers
+func parseFloats(s string) (fs []float32, err error) {
+	for _, term:=range strings.Split(s, ",") {
+		f, err:=strconv.ParseFloat(strings.TrimSpace(term), 32)
+		if err!=nil { return nil, err }
+		fs=append(fs, float32(f))
+	}
+	return fs, nil
+}
+
+// Exits with an error if the current command was interrupted or timed out
+func checkContext() {
+	if err:=ctx.Err(); err!=nil { nl.LogFatalf("Stopped: %s\n", err.Error()) }
+}
+
+// Returns the sigma for star detection in light frames, or 0 to skip the expensive star detection if no
+// alignment, star output, quality weighting, report, scores, eccentricity rejection, trail detection or PSF fitting needs it, e.g. for dark libraries or statistics
+func lightStarSig() float32 {
+	if *align==0 && *stars=="" && *stWeight!=3 && *stReport=="" && *stScores=="" && *stMaxEcc<=0 && *stPSF<=0 && *stTrails<=0 { return 0 }
+	return float32(*starSig)
+}
+
+// Returns the maximum number of images to process in parallel, one per CPU thread, capped by -j if given
+func maxParallelism() int32 {
+	n:=int32(runtime.GOMAXPROCS(0))
+	if *jobs>0 && int32(*jobs)<n { n=int32(*jobs) }
+	return n
+}
+
 // Helper: convert bool to int
 func btoi(b bool) int {
 	if b { return 1 }
@@ -1,6 +1,6 @@
 module github.com/mlnoga/nightlight
 
-go 1.13
+go 1.18
 
 require (
 	github.com/klauspost/cpuid v1.3.0
@@ -9,3 +9,8 @@ require (
 	github.com/valyala/fastrand v1.0.0
 	gonum.org/v1/gonum v0.6.1
 )
+
+require (
+	golang.org/x/exp v0.0.0-20190125153040-c74c464bbbf2 // indirect
+	golang.org/x/tools v0.0.0-20190206041539-40960b6deb8e // indirect
+)
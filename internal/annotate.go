@@ -0,0 +1,171 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+
+// An object from an annotation catalog
+type CatalogObject struct {
+	Name string    // Label, e.g. M31 or NGC 7000
+	Type string    // Catalog type for selection, e.g. M, NGC, IC or star
+	RA   float64   // Right ascension in degrees
+	Dec  float64   // Declination in degrees
+}
+
+// Loads an annotation catalog from a CSV file with one object per line, formatted as name,type,ra,dec
+// with coordinates in degrees. Empty lines and lines starting with # are ignored. If types is not
+// empty, only objects of these types are returned
+func LoadCatalog(fileName string, types []string) (objects []CatalogObject, err error) {
+	f, err:=os.Open(fileName)
+	if err!=nil { return nil, err }
+	defer f.Close()
+
+	selected:=map[string]bool{}
+	for _, t:=range types { selected[strings.ToUpper(strings.TrimSpace(t))]=true }
+
+	scanner:=bufio.NewScanner(f)
+	for lineNo:=1; scanner.Scan(); lineNo++ {
+		line:=strings.TrimSpace(scanner.Text())
+		if line=="" || strings.HasPrefix(line, "#") { continue }
+		fields:=strings.Split(line, ",")
+		if len(fields)<4 { return nil, errors.New(fmt.Sprintf("%s:%d: need name,type,ra,dec", fileName, lineNo)) }
+		o:=CatalogObject{Name: strings.TrimSpace(fields[0]), Type: strings.TrimSpace(fields[1])}
+		if o.RA, err=strconv.ParseFloat(strings.TrimSpace(fields[2]), 64); err!=nil {
+			return nil, errors.New(fmt.Sprintf("%s:%d: invalid right ascension: %s", fileName, lineNo, err.Error()))
+		}
+		if o.Dec, err=strconv.ParseFloat(strings.TrimSpace(fields[3]), 64); err!=nil {
+			return nil, errors.New(fmt.Sprintf("%s:%d: invalid declination: %s", fileName, lineNo, err.Error()))
+		}
+		if len(selected)>0 && !selected[strings.ToUpper(o.Type)] { continue }
+		objects=append(objects, o)
+	}
+	return objects, scanner.Err()
+}
+
+
+// Annotates the given image with the catalog objects inside it, using the given WCS solution. Draws a circle
+// around each object and its label next to it, with a bitmap font scaled by the given integer factor.
+// Image must be normalized to [0,1], with one or three channels. Returns the number of objects annotated
+func (f *FITSImage) Annotate(w *WCS, objects []CatalogObject, fontScale int, color [3]float32) (numAnnotated int) {
+	width, height:=int(f.Naxisn[0]), int(f.Naxisn[1])
+	radius:=6*fontScale
+	for _, o:=range objects {
+		x, y, ok:=w.WorldToPixel(o.RA, o.Dec)
+		if !ok || x<0 || y<0 || x>=float64(width) || y>=float64(height) { continue }
+		xi, yi:=int(x+0.5), int(y+0.5)
+		f.drawCircle(xi, yi, radius, color)
+		f.drawText(xi+radius+2*fontScale, yi-3*fontScale, o.Name, fontScale, color)
+		numAnnotated++
+	}
+	return numAnnotated
+}
+
+// Sets the pixel at the given coordinates to the given color, if it is inside the image
+func (f *FITSImage) setPixelColor(x, y int, color [3]float32) {
+	width, height:=int(f.Naxisn[0]), int(f.Naxisn[1])
+	if x<0 || y<0 || x>=width || y>=height { return }
+	size:=width*height
+	numChannels:=len(f.Data)/size
+	for c:=0; c<numChannels && c<3; c++ {
+		f.Data[c*size+y*width+x]=color[c]
+	}
+}
+
+// Draws the outline of a circle with the given center and radius
+func (f *FITSImage) drawCircle(xc, yc, r int, color [3]float32) {
+	steps:=int(8*math.Pi*float64(r))+8
+	for i:=0; i<steps; i++ {
+		sin, cos:=math.Sincos(2*math.Pi*float64(i)/float64(steps))
+		f.setPixelColor(xc+int(math.Round(float64(r)*cos)), yc+int(math.Round(float64(r)*sin)), color)
+	}
+}
+
+// Draws the given text with its top left corner at the given coordinates, with a 5x7 bitmap font
+// scaled by the given integer factor. Unknown characters are drawn as boxes
+func (f *FITSImage) drawText(x, y int, text string, scale int, color [3]float32) {
+	for _, ch:=range strings.ToUpper(text) {
+		glyph, ok:=font5x7[ch]
+		if !ok { glyph=font5x7[0] }
+		for gy, row:=range glyph {
+			for gx, bit:=range row {
+				if bit!='#' { continue }
+				for sy:=0; sy<scale; sy++ {
+					for sx:=0; sx<scale; sx++ {
+						f.setPixelColor(x+gx*scale+sx, y+gy*scale+sy, color)
+					}
+				}
+			}
+		}
+		x+=6*scale
+	}
+}
+
+// Bitmap font with 5x7 glyphs for annotation labels. Rune 0 is the glyph for unknown characters
+var font5x7=map[rune][7]string{
+	0  : {"#####", "#...#", "#...#", "#...#", "#...#", "#...#", "#####"},
+	' ': {".....", ".....", ".....", ".....", ".....", ".....", "....."},
+	'-': {".....", ".....", ".....", "#####", ".....", ".....", "....."},
+	'+': {".....", "..#..", "..#..", "#####", "..#..", "..#..", "....."},
+	'.': {".....", ".....", ".....", ".....", ".....", ".##..", ".##.."},
+	'/': {".....", "....#", "...#.", "..#..", ".#...", "#....", "....."},
+	'\'':{"..#..", "..#..", ".#...", ".....", ".....", ".....", "....."},
+	'0': {".###.", "#...#", "#..##", "#.#.#", "##..#", "#...#", ".###."},
+	'1': {"..#..", ".##..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'2': {".###.", "#...#", "....#", "...#.", "..#..", ".#...", "#####"},
+	'3': {"#####", "...#.", "..#..", "...#.", "....#", "#...#", ".###."},
+	'4': {"...#.", "..##.", ".#.#.", "#..#.", "#####", "...#.", "...#."},
+	'5': {"#####", "#....", "####.", "....#", "....#", "#...#", ".###."},
+	'6': {"..##.", ".#...", "#....", "####.", "#...#", "#...#", ".###."},
+	'7': {"#####", "....#", "...#.", "..#..", ".#...", ".#...", ".#..."},
+	'8': {".###.", "#...#", "#...#", ".###.", "#...#", "#...#", ".###."},
+	'9': {".###.", "#...#", "#...#", ".####", "....#", "...#.", ".##.."},
+	'A': {".###.", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'B': {"####.", "#...#", "#...#", "####.", "#...#", "#...#", "####."},
+	'C': {".###.", "#...#", "#....", "#....", "#....", "#...#", ".###."},
+	'D': {"###..", "#..#.", "#...#", "#...#", "#...#", "#..#.", "###.."},
+	'E': {"#####", "#....", "#....", "####.", "#....", "#....", "#####"},
+	'F': {"#####", "#....", "#....", "####.", "#....", "#....", "#...."},
+	'G': {".###.", "#...#", "#....", "#.###", "#...#", "#...#", ".####"},
+	'H': {"#...#", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'I': {".###.", "..#..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'J': {"..###", "...#.", "...#.", "...#.", "...#.", "#..#.", ".##.."},
+	'K': {"#...#", "#..#.", "#.#..", "##...", "#.#..", "#..#.", "#...#"},
+	'L': {"#....", "#....", "#....", "#....", "#....", "#....", "#####"},
+	'M': {"#...#", "##.##", "#.#.#", "#.#.#", "#...#", "#...#", "#...#"},
+	'N': {"#...#", "#...#", "##..#", "#.#.#", "#..##", "#...#", "#...#"},
+	'O': {".###.", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'P': {"####.", "#...#", "#...#", "####.", "#....", "#....", "#...."},
+	'Q': {".###.", "#...#", "#...#", "#...#", "#.#.#", "#..#.", ".##.#"},
+	'R': {"####.", "#...#", "#...#", "####.", "#.#..", "#..#.", "#...#"},
+	'S': {".####", "#....", "#....", ".###.", "....#", "....#", "####."},
+	'T': {"#####", "..#..", "..#..", "..#..", "..#..", "..#..", "..#.."},
+	'U': {"#...#", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'V': {"#...#", "#...#", "#...#", "#...#", "#...#", ".#.#.", "..#.."},
+	'W': {"#...#", "#...#", "#...#", "#.#.#", "#.#.#", "#.#.#", ".#.#."},
+	'X': {"#...#", "#...#", ".#.#.", "..#..", ".#.#.", "#...#", "#...#"},
+	'Y': {"#...#", "#...#", ".#.#.", "..#..", "..#..", "..#..", "..#.."},
+	'Z': {"#####", "....#", "...#.", "..#..", ".#...", "#....", "#####"},
+}
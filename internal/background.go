@@ -17,6 +17,7 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"strings"
@@ -36,6 +37,23 @@ type Background struct {
  	OutlierCells int32    // number of outlier cells replaced with interpolation of neighboring cells
  	Max float32           // maximum alpha, beta, gamma values
  	Min float32           // minimum alpha, beta, gamma values
+ 	Stats []BackgroundCell // per-cell statistics of the fit, for verifying the extraction
+}
+
+// Statistics of a single background grid cell, for verifying the automated background extraction
+type BackgroundCell struct {
+	X          int32   `json:"x"`          // Cell column
+	Y          int32   `json:"y"`          // Cell row
+	XStart     int32   `json:"xStart"`     // First pixel column of the cell
+	XEnd       int32   `json:"xEnd"`       // Pixel column after the cell
+	YStart     int32   `json:"yStart"`     // First pixel row of the cell
+	YEnd       int32   `json:"yEnd"`       // Pixel row after the cell
+	Median     float32 `json:"median"`     // Median of all pixels in the cell
+	MAD        float32 `json:"mad"`        // Median absolute deviation, normalized to the standard deviation
+	Foreground float32 `json:"foreground"` // Fraction of pixels above the sigma bound, which were excluded as foreground objects
+	Fit        float32 `json:"fit"`        // Trimmed median of the remaining background pixels
+	Clipped    bool    `json:"clipped"`    // True if clipped as one of the brightest cells and replaced by interpolation
+	Model      float32 `json:"model"`      // Background model value after clipping and smoothing
 }
 
 func (b *Background) String() string {
@@ -73,7 +91,8 @@ func NewBackground(src []float32, width int32, gridSpacing int32, sigma float32,
 	//LogPrintf("GridCells x %d y %d total %d GridSpacing x %.2f y %.2f\n", gridCellsX, gridCellsY, gridCells, gridSpacingX, gridSpacingY)
 	b=&Background{Width:width, Height:height, GridSpacing:gridSpacing, 
 	              GridSpacingX:gridSpacingX, GridSpacingY:gridSpacingY,
-	              GridCellsX:gridCellsX, GridCellsY:gridCellsY, GridCells:gridCells, Cells:cells}
+	              GridCellsX:gridCellsX, GridCellsY:gridCellsY, GridCells:gridCells, Cells:cells,
+	              Stats:make([]BackgroundCell, gridCells)}
 
 	b.init(src, sigma)
 	//LogPrintf("Sigma %f\n", sigma)
@@ -90,13 +109,14 @@ func NewBackground(src []float32, width int32, gridSpacing int32, sigma float32,
 	//LogPrintln(b.CellsString())
 
     b.calculateStats()
+	for c, v:=range b.Cells { b.Stats[c].Model=v }
 
 	return b
 }
 
 // Initialize background by approximating each grid cell with a linear gradient
 func (b *Background) init(src []float32, sigma float32) {
-	buffer:=make([]float32, int32(b.GridSpacingX+1.5)*int32(b.GridSpacingY+1.5)) // reuse for all grid cells to ease GC pressure
+	buffer:=GetArrayF32(int(int32(b.GridSpacingX+1.5)*int32(b.GridSpacingY+1.5))) // reuse for all grid cells and frames to ease GC pressure
 
 	// For all grid cells
 	for y:=int32(0); y<b.GridCellsY; y++ {
@@ -112,24 +132,30 @@ func (b *Background) init(src []float32, sigma float32) {
 			//LogPrintf("y %d yS %d yE %d x %d xS %d xE %d \n", y, yStart, yEnd, x, xStart, xEnd)
 			// Fit linear gradient to masked source image within that cell
 			c:=y*b.GridCellsX + x
-			b.Cells[c]=FitCell(src, b.Width, sigma, xStart, xEnd, yStart, yEnd, buffer)
+			st:=&b.Stats[c]
+			st.X, st.Y, st.XStart, st.XEnd, st.YStart, st.YEnd=x, y, xStart, xEnd, yStart, yEnd
+			st.Fit, st.Median, st.MAD, st.Foreground=fitCell(src, b.Width, sigma, xStart, xEnd, yStart, yEnd, buffer)
+			b.Cells[c]=st.Fit
 		}	
 	}	
 
+	PutArrayF32(buffer)
 	buffer=nil
 }
 
 // Clips the top n entries from the background gradient
 func (b *Background) clip(n int32) {
-	buffer:=make([]float32, b.GridCells)
-	for i,cell:=range b.Cells { buffer[i]=cell }
+	buffer:=GetArrayF32(int(b.GridCells))
+	copy(buffer, b.Cells)
 	threshold:=QSelectFloat32(buffer, len(buffer)-int(n)+1)
+	PutArrayF32(buffer)
 	buffer=nil
 
 	ignoredCells:=int32(0)
 	for i,cell:=range b.Cells { 
 		if cell>=threshold {
 			b.Cells[i]=float32(math.NaN())
+			b.Stats[i].Clipped=true
 			ignoredCells++
 		}
 	}
@@ -150,9 +176,10 @@ func (b *Background) clip(n int32) {
 }
 
 func (b *Background) smoothe() {
-	tmp:=make([]float32, len(b.Cells))
-	gauss3x3(tmp, b.Cells, b.GridCellsX)
-	b.Cells=tmp
+	tmp:=GetArrayF32(len(b.Cells))
+	copy(tmp, b.Cells)
+	gauss3x3(b.Cells, tmp, b.GridCellsX)
+	PutArrayF32(tmp)
 }
 
 func gauss3x3(res, data []float32, width int32) {
@@ -254,6 +281,25 @@ func MedianInterpolation(params []float32, width, height, x,y int32, temp []floa
 }	
 
 
+// Removes residual gradients from each channel of a stacked image with automated background extraction.
+// Subtracts the background model minus its median, so each channel keeps its overall background level.
+// Returns the extracted backgrounds per channel
+func (f *FITSImage) RemoveGradients(gridSpacing int32, sigma float32, backClip int32) (bgs []*Background) {
+	width:=f.Naxisn[0]
+	size:=int(width)*int(f.Naxisn[1])
+	for c:=0; c*size<len(f.Data); c++ {
+		channel:=f.Data[c*size:(c+1)*size]
+		bg:=NewBackground(channel, width, gridSpacing, sigma, backClip)
+		bgImage:=bg.Render()
+		level:=QSelectMedianFloat32(append([]float32(nil), bgImage...))
+		for i, b:=range bgImage {
+			channel[i]-=b-level
+		}
+		bgs=append(bgs, bg)
+	}
+	return bgs
+}
+
 // Render full background into a data array, returning the array
 func (b Background) Render() (dest []float32) {
 	dest=make([]float32, b.Width*b.Height)
@@ -333,9 +379,9 @@ func (b Background) Render() (dest []float32) {
 
 
 // Subtract full background from given data array, changing it in place.
-func (b Background) Subtract(dest []float32) {
+func (b Background) Subtract(dest []float32) error {
 	if int(b.Width)*int(b.Height)!=len(dest) { 
-		LogFatalf("Background size %dx%d does not match destination image size %d\n", b.Width, b.Height, len(dest))
+		return errors.New(fmt.Sprintf("Background size %dx%d does not match destination image size %d", b.Width, b.Height, len(dest)))
 	}
 
 	srcYl    :=int32(-1)
@@ -407,18 +453,28 @@ func (b Background) Subtract(dest []float32) {
 			dest[destX + destY*b.Width]-=v
 		}	
 	}	
+	return nil
 }
 
 
 // Fit background cell to given source image, except where masked out
 func FitCell(src []float32, width int32, sigma float32, xStart, xEnd, yStart, yEnd int32, buffer []float32) float32 {
+	overallMedian, _, _, _:=fitCell(src, width, sigma, xStart, xEnd, yStart, yEnd, buffer)
+	return overallMedian
+}
+
+// Fit background cell to given source image, also returning the median and MAD of the cell,
+// and the fraction of pixels excluded as foreground objects
+func fitCell(src []float32, width int32, sigma float32, xStart, xEnd, yStart, yEnd int32, buffer []float32) (overallMedian, median, mad, foreground float32) {
 	// First we determine the local background location and the scale of its noise level, to filter out stars and bright nebulae
-	median, mad:=medianAndMAD(src, width, xStart, xEnd, yStart, yEnd, buffer)
+	median, mad=medianAndMAD(src, width, xStart, xEnd, yStart, yEnd, buffer)
 	upperBound:=median+sigma*mad
 
 	// Then we determine the trimmed median to approximate the true background
-	overallMedian:=trimmedMedian(src, width, upperBound, xStart, xEnd, yStart, yEnd, buffer)
-	return overallMedian
+	overallMedian, numBackground:=trimmedMedian(src, width, upperBound, xStart, xEnd, yStart, yEnd, buffer)
+	numPixels:=(xEnd-xStart)*(yEnd-yStart)
+	foreground=1-float32(numBackground)/float32(numPixels)
+	return overallMedian, median, mad, foreground
 }
 
 
@@ -440,8 +496,8 @@ func medianAndMAD(src []float32, width int32, xStart, xEnd, yStart, yEnd int32,
 }
 
 
-// Calculates the median of all values below the upper bound in the given grid cell of the image
-func trimmedMedian(src []float32, width int32, upperBound float32, xStart, xEnd, yStart, yEnd int32, buffer []float32) float32 {
+// Calculates the median of all values below the upper bound in the given grid cell of the image, and the number of these values
+func trimmedMedian(src []float32, width int32, upperBound float32, xStart, xEnd, yStart, yEnd int32, buffer []float32) (float32, int) {
 	numSamples:=0
 	for y:=yStart; y<yEnd; y++ {
 		for x:=xStart; x<xEnd; x++ {
@@ -451,5 +507,6 @@ func trimmedMedian(src []float32, width int32, upperBound float32, xStart, xEnd,
 			numSamples++
 		}
 	}
-	return QSelectMedianFloat32(buffer[:numSamples])	
+	if numSamples==0 { return upperBound, 0 } // constant cell with zero MAD, e.g. a blank border
+	return QSelectMedianFloat32(buffer[:numSamples]), numSamples
 }
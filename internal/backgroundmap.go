@@ -0,0 +1,122 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Number of contour levels in false color renderings of the background
+const BackgroundContours = 10
+
+// Renders the given background model as a false color image from blue via green to red, with contour lines
+// in black at evenly spaced levels. Grid cells clipped as the brightest are outlined in white, as they are
+// the most likely to contain nebulosity. The model must be the output of Render()
+func (b *Background) FalseColor(model []float32) *FITSImage {
+	min, max:=b.Min, b.Max
+	if max<=min { max=min+1 }
+	level:=func(v float32) int32 {
+		l:=int32((v-min)/(max-min)*BackgroundContours)
+		if l<0 { return 0 }
+		if l>=BackgroundContours { return BackgroundContours-1 }
+		return l
+	}
+
+	width, height:=b.Width, b.Height
+	size:=int(width)*int(height)
+	data:=make([]float32, 3*size)
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			i:=int(y)*int(width)+int(x)
+			v:=model[i]
+			if v<min { v=min } else if v>max { v=max }
+			r, g, bl:=heatmapColor(v, min, max)
+
+			l:=level(v)
+			if (x+1<width && level(model[i+1])!=l) || (y+1<height && level(model[i+int(width)])!=l) {
+				r, g, bl=0, 0, 0
+			}
+			data[i], data[i+size], data[i+2*size]=r, g, bl
+		}
+	}
+
+	for _, c:=range b.Stats {
+		if !c.Clipped { continue }
+		for x:=c.XStart; x<c.XEnd; x++ {
+			setWhite(data, width, size, x, c.YStart)
+			setWhite(data, width, size, x, c.YEnd-1)
+		}
+		for y:=c.YStart; y<c.YEnd; y++ {
+			setWhite(data, width, size, c.XStart, y)
+			setWhite(data, width, size, c.XEnd-1, y)
+		}
+	}
+
+	return &FITSImage{
+		Header: NewFITSHeader(),
+		Bitpix: -32,
+		Bzero : 0,
+		Naxisn: []int32{width, height, 3},
+		Pixels: width*height*3,
+		Data  : data,
+		Trans : IdentityTransform2D(),
+	}
+}
+
+// Sets the pixel at the given position of a planar RGB image to white
+func setWhite(data []float32, width int32, size int, x, y int32) {
+	i:=int(y)*int(width)+int(x)
+	data[i], data[i+size], data[i+2*size]=1, 1, 1
+}
+
+// Grid cell statistics of a background, as written to JSON
+type backgroundJSON struct {
+	Grid         int32            `json:"grid"`         // Grid spacing in pixels as given by the user
+	CellsX       int32            `json:"cellsX"`       // Number of grid cells, X direction
+	CellsY       int32            `json:"cellsY"`       // Number of grid cells, Y direction
+	SpacingX     float32          `json:"spacingX"`     // Actual grid spacing, X direction
+	SpacingY     float32          `json:"spacingY"`     // Actual grid spacing, Y direction
+	OutlierCells int32            `json:"outlierCells"` // Number of clipped cells
+	Min          float32          `json:"min"`          // Minimum of the background model
+	Max          float32          `json:"max"`          // Maximum of the background model
+	Foreground   float32          `json:"foreground"`   // Mean fraction of pixels excluded as foreground objects
+	Cells        []BackgroundCell `json:"cells"`        // Per-cell statistics in row-major order
+}
+
+// Writes the grid cell statistics of the background to the given file as JSON
+func (b *Background) WriteJSON(fileName string) error {
+	foreground:=float32(0)
+	for _, c:=range b.Stats { foreground+=c.Foreground }
+	if len(b.Stats)>0 { foreground/=float32(len(b.Stats)) }
+
+	bj:=backgroundJSON{
+		Grid        : b.GridSpacing,
+		CellsX      : b.GridCellsX,
+		CellsY      : b.GridCellsY,
+		SpacingX    : b.GridSpacingX,
+		SpacingY    : b.GridSpacingY,
+		OutlierCells: b.OutlierCells,
+		Min         : b.Min,
+		Max         : b.Max,
+		Foreground  : foreground,
+		Cells       : b.Stats,
+	}
+	bytes, err:=json.MarshalIndent(&bj, "", "  ")
+	if err!=nil { return err }
+	return ioutil.WriteFile(fileName, bytes, 0644)
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackgroundMap(t *testing.T) {
+	width, height:=int32(128), int32(128)
+	data:=make([]float32, width*height)
+	rng:=RNG{42}
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			data[y*width+x]=100+float32(x)/4+float32(rng.Uint32()%10)
+		}
+	}
+	for y:=int32(10); y<40; y++ {
+		for x:=int32(10); x<40; x++ { data[y*width+x]+=500 } // bright nebula in the first cell
+	}
+
+	bg:=NewBackground(data, width, 32, 1.5, 1)
+	if len(bg.Stats)!=int(bg.GridCells) {
+		t.Fatalf("NewBackground: got %d cell stats for %d cells", len(bg.Stats), bg.GridCells)
+	}
+	if bg.Stats[0].Foreground<0.4 || bg.Stats[1].Foreground>0.4 {
+		t.Errorf("NewBackground: got foreground %.2f for nebula cell and %.2f for empty cell", bg.Stats[0].Foreground, bg.Stats[1].Foreground)
+	}
+	clipped:=int32(0)
+	for _, c:=range bg.Stats {
+		if c.Clipped { clipped++ }
+	}
+	if clipped!=bg.OutlierCells {
+		t.Errorf("NewBackground: got %d clipped cells, expected %d", clipped, bg.OutlierCells)
+	}
+
+	img:=bg.FalseColor(bg.Render())
+	if img.Naxisn[0]!=width || img.Naxisn[1]!=height || img.Naxisn[2]!=3 || len(img.Data)!=int(width*height*3) {
+		t.Errorf("FalseColor: got size %v with %d values", img.Naxisn, len(img.Data))
+	}
+
+	dir, err:=ioutil.TempDir("", "nightlight")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	fileName:=filepath.Join(dir, "back.json")
+	if err:=bg.WriteJSON(fileName); err!=nil { t.Fatal(err) }
+	bytes, err:=ioutil.ReadFile(fileName)
+	if err!=nil { t.Fatal(err) }
+	var bj backgroundJSON
+	if err:=json.Unmarshal(bytes, &bj); err!=nil { t.Fatal(err) }
+	if bj.CellsX!=bg.GridCellsX || len(bj.Cells)!=len(bg.Stats) || bj.Cells[5]!=bg.Stats[5] {
+		t.Errorf("WriteJSON: got %d cells across %d, expected %d across %d", len(bj.Cells), bj.CellsX, len(bg.Stats), bg.GridCellsX)
+	}
+}
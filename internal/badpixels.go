@@ -17,10 +17,10 @@
 package internal
 
 import (
+	"context"  // for worker pool groups on Median()
 //	"fmt"
 	"runtime"  // for NumCPU() on Median()
 //	"sort"
-	"sync"     // for wait group synchronization on Median()
 )
 
 
@@ -52,15 +52,14 @@ func BadPixelMap(data []float32, width int32, sigmaLow, sigmaHigh float32) (bpm
 // Applies an element-wise Median filter to the data with the local neighborhood defined by the mask,
 // and stores the result in data
 func MedianFilter(output, data []float32, mask []int32) {
-	// Parallelize into as many goroutines as we have CPUs
+	// Parallelize into as many tasks as we have CPUs
 	stepSize:=len(data)/runtime.NumCPU()
-	var wg sync.WaitGroup
-	wg.Add( (len(data)+stepSize-1)/stepSize )
+	group:=DefaultPool.NewGroup(context.Background(), 0)
 
-	// Run the Median operation in parallel
+	// Run the Median operation in parallel on the shared worker pool
 	for step:=0; step<len(data); step+=stepSize {
-		go func(start int) {
-			defer wg.Done()
+		start:=step
+		group.Go(func() {
 			end:=start+stepSize
 			if end>len(data) { 
 				end=len(data) 
@@ -69,10 +68,10 @@ func MedianFilter(output, data []float32, mask []int32) {
 			for i:=start; i<end; i++ {
 				output[i]=Median(data, int32(i), mask, buffer)
 			}
-		}(step)
+		})
 	}
 
-	wg.Wait() // and wait for all goroutines to finish
+	group.Wait() // and wait for all tasks to finish
 }
 
 
@@ -120,7 +119,7 @@ func Median(data []float32, index int32, mask []int32, buffer []float32) float32
 		}
 	}
 
-	return MedianFloat32(buffer)
+	return MedianFloat32(buffer[:num])
 }
 
 
@@ -17,15 +17,16 @@
 package internal
 
 import (
+	"errors"
 	"github.com/pbnjay/memory"
-	"math/rand"
 	"runtime"
 	"sort"
 )
 
 
 // Split input into required number of randomized batches, given the permissible amount of memory
-func PrepareBatches(fileNames []string, stMemory int64, darkF, flatF *FITSImage) (numBatches, batchSize int64, ids []int, shuffledFileNames []string, imageLevelParallelism int32) {
+// and the maximum number of images to process in parallel. Randomization is reproducible if the seed is nonzero
+func PrepareBatches(fileNames []string, stMemory int64, maxParallelism int32, darkF, flatF *FITSImage, storage FrameStorage, seed int64) (numBatches, batchSize int64, ids []int, shuffledFileNames []string, imageLevelParallelism int32, err error) {
 	numFrames:=int64(len(fileNames))
 	width, height:=int64(0), int64(0)
 	if darkF!=nil {
@@ -35,7 +36,7 @@ func PrepareBatches(fileNames []string, stMemory int64, darkF, flatF *FITSImage)
 	} else {
 		LogPrintf("\nEstimating memory needs for %d images from %s:\n", numFrames, fileNames[0])
 		first:=NewFITSImage()
-		first.ReadFile(fileNames[0])
+		if err=first.ReadFile(fileNames[0]); err!=nil { return 0, 0, nil, nil, 0, err }
 		width, height=int64(first.Naxisn[0]), int64(first.Naxisn[1])
 	}
 	pixels:=width*height
@@ -46,31 +47,16 @@ func PrepareBatches(fileNames []string, stMemory int64, darkF, flatF *FITSImage)
 	           numFrames, width, height, mPixels, mib)
 
 	availableFrames:=(int64(stMemory)*1024*1024)/bytes // rounding down
-	imageLevelParallelism=int32(runtime.GOMAXPROCS(0))
-	LogPrintf("CPU has %d threads. Physical memory is %d MiB, -stMemory is %d MiB, this fits %d frames.\n", imageLevelParallelism, memory.TotalMemory()/1024/1024, stMemory, availableFrames)
+	LogPrintf("CPU has %d threads, using up to %d. Physical memory is %d MiB, -stMemory is %d MiB, this fits %d frames.\n", runtime.GOMAXPROCS(0), cappedParallelism(maxParallelism), memory.TotalMemory()/1024/1024, stMemory, availableFrames)
 
-	// Calculate batch sizes for preprocessing
-	for ; imageLevelParallelism>=1; imageLevelParallelism-- {
-		// Besides the lights in the current batch, we need one temp frame per thread,
-		// the optional dark and flat, the reference frame from batch 0 (if >1 batches), 
-		// and the stack of stacks (if >1 bacthes) 
-		batchSize=availableFrames - int64(imageLevelParallelism)
-		if darkF!=nil { batchSize-- }
-		if flatF!=nil { batchSize-- }
-		if batchSize<2 { continue }
-
-		// correct for multi-batch memory requirements 
-		numBatches=(numFrames+batchSize-1)/batchSize
-		if numBatches>1 {
-			batchSize-=2	// reference frame from batch 0, and stack of stacks
-		}
-		if batchSize<2 { continue }
-		if batchSize<int64(imageLevelParallelism) { continue }
-		break
+	numCalib:=int64(0)
+	if darkF!=nil { numCalib++ }
+	if flatF!=nil { numCalib++ }
+	if storage!=FSFloat32 {
+		LogPrintf("Registered frames are stored with %d bytes per pixel.\n", storage.BytesPerPixel())
 	}
-	if imageLevelParallelism<1 || batchSize<2 { LogFatal("Cannot find a stacking execution path within the given memory constraints.") }
-	// even out size of the last frame
-	for ; (batchSize-1)*numBatches>=numFrames ; batchSize-- {}
+	numBatches, batchSize, imageLevelParallelism, err=PlanBatches(numFrames, pixels, stMemory, maxParallelism, numCalib, storage.BytesPerPixel())
+	if err!=nil { return 0, 0, nil, nil, 0, err }
 	LogPrintf("Using %d batches of batch size %d with %d images in parallel.\n", numBatches, batchSize, imageLevelParallelism)
 
 	perm:=make([]int, len(fileNames))
@@ -79,7 +65,7 @@ func PrepareBatches(fileNames []string, stMemory int64, darkF, flatF *FITSImage)
 	}
 	if numBatches>1 {
 		LogPrintf("Randomizing input files across batches...\n")
-		perm=rand.Perm(len(fileNames))
+		perm=RandomPerm(len(fileNames), seed)
 		for i:=0; i<int(numBatches); i++ {
 			from:=i*int(batchSize)
 			to  :=(i+1)*int(batchSize)
@@ -92,5 +78,59 @@ func PrepareBatches(fileNames []string, stMemory int64, darkF, flatF *FITSImage)
 			fileNames[i]=old[perm[i]]
 		}
 	}
-	return numBatches, batchSize, perm, fileNames, imageLevelParallelism
-}
\ No newline at end of file
+	return numBatches, batchSize, perm, fileNames, imageLevelParallelism, nil
+}
+
+// Plans the number of batches, the batch size and the number of images to process in parallel for stacking
+// the given number of frames with the given pixels each, within the permissible amount of memory in MiB.
+// Accounts for the given number of calibration frames held in memory. The lights in a batch are stored with
+// the given bytes per pixel, all other frames as 32-bit floating point
+func PlanBatches(numFrames, pixels, stMemory int64, maxParallelism int32, numCalib int64, bytesPerPixel int64) (numBatches, batchSize int64, imageLevelParallelism int32, err error) {
+	availableBytes:=stMemory*1024*1024
+	frameBytes, storedBytes:=pixels*4, pixels*bytesPerPixel
+
+	// Calculate batch sizes for preprocessing
+	for imageLevelParallelism=cappedParallelism(maxParallelism); imageLevelParallelism>=1; imageLevelParallelism-- {
+		// Besides the lights in the current batch, we need one temp frame per thread,
+		// the optional dark and flat, the reference frame from batch 0 (if >1 batches), 
+		// and the stack of stacks (if >1 bacthes) 
+		fixedBytes:=(int64(imageLevelParallelism)+numCalib)*frameBytes
+		batchSize=(availableBytes-fixedBytes)/storedBytes
+		if batchSize<2 { continue }
+
+		// correct for multi-batch memory requirements 
+		numBatches=(numFrames+batchSize-1)/batchSize
+		if numBatches>1 {
+			batchSize=(availableBytes-fixedBytes-2*frameBytes)/storedBytes	// reference frame from batch 0, and stack of stacks
+		}
+		if batchSize<2 { continue }
+		if batchSize<int64(imageLevelParallelism) { continue }
+		break
+	}
+	if imageLevelParallelism<1 || batchSize<2 { return 0, 0, 0, errors.New("Cannot find a stacking execution path within the given memory constraints.") }
+	// even out size of the last frame
+	for ; (batchSize-1)*numBatches>=numFrames ; batchSize-- {}
+	return numBatches, batchSize, imageLevelParallelism, nil
+}
+
+// Replans the batches for the given number of remaining frames, based on memory measured while stacking a prior batch.
+// The measured bytes per frame include all temporary data, the fixed bytes cover what is held across batches, like
+// calibration frames, the reference frame and the stack of stacks. Batches have at least the given minimum size,
+// and are evened out across the remaining frames
+func ReplanBatches(remainingFrames, frameBytes, fixedBytes, stMemory, minBatchSize int64) (numBatches, batchSize int64) {
+	if remainingFrames<=0 { return 0, 0 }
+	if frameBytes<1 { frameBytes=1 }
+	batchSize=(stMemory*1024*1024-fixedBytes)/frameBytes
+	if batchSize<minBatchSize    { batchSize=minBatchSize }
+	if batchSize>remainingFrames { batchSize=remainingFrames }
+	numBatches=(remainingFrames+batchSize-1)/batchSize
+	batchSize=(remainingFrames+numBatches-1)/numBatches
+	return numBatches, batchSize
+}
+
+// Returns the number of threads available, capped by the given maximum if positive
+func cappedParallelism(maxParallelism int32) int32 {
+	p:=int32(runtime.GOMAXPROCS(0))
+	if maxParallelism>0 && maxParallelism<p { p=maxParallelism }
+	return p
+}
@@ -0,0 +1,259 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+
+// Parameters of a benchmark run on synthetic frames
+type BenchParams struct {
+	Width       int32            // Frame width in pixels
+	Height      int32            // Frame height in pixels
+	NumFrames   int              // Number of synthetic light frames
+	NumStars    int              // Number of stars per frame
+	Parallelism int32            // Number of images processed in parallel
+	Precision   int32            // Precision for accumulating sums when stacking, 32 or 64 bits
+	Seed        int64            // Seed for the synthetic frames, 0=random
+	LSEst       LSEstimatorMode  // Location and scale estimator
+}
+
+// Measured throughput of a benchmarked stage
+type BenchResult struct {
+	Name    string         // Name of the stage
+	Pixels  int64          // Number of pixels processed, summed over all frames
+	Runtime time.Duration  // Measured runtime
+}
+
+// Returns the throughput of the stage in megapixels per second
+func (r BenchResult) MPixPerSec() float64 {
+	if r.Runtime<=0 { return 0 }
+	return float64(r.Pixels)*1e-6/r.Runtime.Seconds()
+}
+
+// Stacking modes to benchmark, with names and low and high sigmas. Percentile clipping takes fractions of the median instead
+var benchStackModes=[]struct{
+	Mode            StackMode
+	Name            string
+	SigLow, SigHigh float32
+}{
+	{StMedian,      "median",                3,   3  },
+	{StMean,        "mean",                  3,   3  },
+	{StSigma,       "sigma clip",            3,   3  },
+	{StWinsorSigma, "winsorized sigma clip", 3,   3  },
+	{StLinearFit,   "linear fit",            3,   3  },
+	{StAuto,        "auto",                  3,   3  },
+	{StPercentile,  "percentile clip",       0.2, 0.2},
+	{StSum,         "sum",                   3,   3  },
+	{StIntAverage,  "integer average",       3,   3  },
+	{StMax,         "maximum",               3,   3  },
+	{StMin,         "minimum",               3,   3  },
+}
+
+// Benchmarks loading, calibration, star detection, alignment and each stacking mode on synthetic frames
+// with the given parameters. Frames are written to a temporary directory, which is removed afterwards.
+// Returns the throughput per stage in the order of processing
+func RunBenchmark(ctx context.Context, p BenchParams) (results []BenchResult, err error) {
+	if p.Width<64 || p.Height<64 { return nil, errors.New(fmt.Sprintf("Benchmark frame size %dx%d too small, need at least 64x64", p.Width, p.Height)) }
+	if p.NumFrames<3 { return nil, errors.New(fmt.Sprintf("Benchmark needs at least 3 frames, got %d", p.NumFrames)) }
+
+	// Create synthetic calibration frames and light frames, and store the lights as files
+	dir, err:=ioutil.TempDir("", "nightlight-bench")
+	if err!=nil { return nil, err }
+	defer os.RemoveAll(dir)
+
+	rng:=NewRNG(p.Seed)
+	stars:=syntheticStars(p.Width, p.Height, p.NumStars, &rng)
+	dark, flat:=syntheticDark(p.Width, p.Height), syntheticFlat(p.Width, p.Height)
+	LogPrintf("Writing %d synthetic frames of %dx%d pixels with %d stars to %s\n", p.NumFrames, p.Width, p.Height, len(stars), dir)
+	fileNames:=make([]string, p.NumFrames)
+	for i:=range fileNames {
+		// shift all frames but the first by up to 8 pixels, so alignment resamples them
+		dx, dy:=float32(0), float32(0)
+		if i>0 { dx, dy=16*rng.Float32()-8, 16*rng.Float32()-8 }
+		f:=SyntheticFrame(i, p.Width, p.Height, stars, dx, dy, dark, flat, &rng)
+		fileNames[i]=filepath.Join(dir, fmt.Sprintf("bench%04d.fits", i))
+		if err=f.WriteFile(fileNames[i]); err!=nil { return nil, err }
+	}
+
+	// Benchmarks the given work on all frames in parallel, like the stacking pipeline
+	pixels:=int64(p.Width)*int64(p.Height)*int64(p.NumFrames)
+	lights:=make([]*FITSImage, p.NumFrames)
+	run:=func(name string, work func(i int) error) error {
+		LogPrintf("\nBenchmarking %s:\n", name)
+		errs:=make([]error, len(lights))
+		start:=time.Now()
+		group:=DefaultPool.NewGroup(ctx, int(p.Parallelism))
+		for i:=range lights {
+			i:=i
+			group.Go(func() { errs[i]=work(i) })
+		}
+		err:=group.Wait()
+		results=append(results, BenchResult{name, pixels, time.Since(start)})
+		if err!=nil { return err }
+		for i, err:=range errs {
+			if err!=nil { return errors.New(fmt.Sprintf("%d: %s", i, err.Error())) }
+		}
+		return nil
+	}
+
+	err=run("load", func(i int) error {
+		f:=NewFITSImage()
+		f.ID=i
+		lights[i]=&f
+		return f.ReadFile(fileNames[i])
+	})
+	if err!=nil { return results, err }
+
+	calibrate:=NewPipeline().Add("dark", &OpDark{Dark: dark}).Add("flat", &OpFlat{Flat: flat}).Add("badPixels", &OpBadPixels{SigmaLow: 3, SigmaHigh: 5})
+	err=run("calibrate", func(i int) error { return calibrate.Apply(lights[i]) })
+	if err!=nil { return results, err }
+
+	detect:=&OpStars{Sigma: 10, BpSigma: 5, Radius: 16, Estimator: p.LSEst}
+	err=run("star detect", func(i int) error {
+		err:=detect.Apply(lights[i])
+		lights[i].bpStats=nil
+		return err
+	})
+	if err!=nil { return results, err }
+
+	ref, _:=SelectReferenceFrame(lights)
+	if ref==nil || len(ref.Stars)==0 { return results, errors.New("No stars detected in synthetic frames") }
+	align:=&OpAlign{K: 20, Threshold: 1, OutOfBounds: OOBModeNaN}
+	align.SetReference(ref)
+	err=run("align", func(i int) error { return align.Apply(lights[i]) })
+	if err!=nil { return results, err }
+
+	// Stacking is parallel within each mode, across horizontal bands
+	for _, m:=range benchStackModes {
+		name:="stack "+m.Name
+		LogPrintf("\nBenchmarking %s:\n", name)
+		start:=time.Now()
+		_, _, _, err=Stack(ctx, lights, m.Mode, nil, ref.Stats.Location, m.SigLow, m.SigHigh, 0, 0, false, p.Precision, p.LSEst)
+		results=append(results, BenchResult{name, pixels, time.Since(start)})
+		if err!=nil { return results, err }
+	}
+	return results, nil
+}
+
+// Returns a table of the given benchmark results, one line per stage
+func BenchResultsString(results []BenchResult) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%-28s %12s %10s\n", "Stage", "Runtime", "MPix/s"))
+	for _, r:=range results {
+		sb.WriteString(fmt.Sprintf("%-28s %12s %10.1f\n", r.Name, r.Runtime.Round(time.Millisecond), r.MPixPerSec()))
+	}
+	return sb.String()
+}
+
+
+// Creates the given number of stars at random positions inside the frame borders, with random peak values.
+// Star positions are returned in X and Y, peak values in Value
+func syntheticStars(width, height int32, numStars int, rng *RNG) []Star {
+	stars:=make([]Star, numStars)
+	for i:=range stars {
+		stars[i]=Star{
+			X    : 32+rng.Float32()*float32(width-64),
+			Y    : 32+rng.Float32()*float32(height-64),
+			Value: 500+rng.Float32()*rng.Float32()*30000,  // more faint than bright stars
+		}
+	}
+	return stars
+}
+
+// Creates a synthetic dark frame with a constant offset
+func syntheticDark(width, height int32) *FITSImage {
+	f:=syntheticImage(-1, width, height)
+	for i:=range f.Data { f.Data[i]=100 }
+	f.Stats=CalcBasicStats(f.Data)
+	return f
+}
+
+// Creates a synthetic flat frame with quadratic vignetting, dimming the corners by 30%
+func syntheticFlat(width, height int32) *FITSImage {
+	f:=syntheticImage(-2, width, height)
+	cx, cy:=float32(width)*0.5, float32(height)*0.5
+	maxR2:=cx*cx+cy*cy
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			dx, dy:=float32(x)-cx, float32(y)-cy
+			f.Data[y*width+x]=1-0.3*(dx*dx+dy*dy)/maxR2
+		}
+	}
+	f.Stats=CalcBasicStats(f.Data)
+	return f
+}
+
+// Creates an empty image of given size
+func syntheticImage(id int, width, height int32) *FITSImage {
+	f:=NewFITSImage()
+	f.ID=id
+	f.Bitpix=-32
+	f.Naxisn=[]int32{width, height}
+	f.Pixels=width*height
+	f.Data=make([]float32, int(f.Pixels))
+	return &f
+}
+
+// Creates a synthetic light frame of given size with gaussian sky noise, a few hot pixels, and gaussian stars
+// shifted by dx and dy. Applies the given flat and adds the given dark, so calibration reverses them
+func SyntheticFrame(id int, width, height int32, stars []Star, dx, dy float32, dark, flat *FITSImage, rng *RNG) *FITSImage {
+	f:=syntheticImage(id, width, height)
+	f.Exposure=60
+
+	// sky background with gaussian noise
+	const background, noise=1000, 20
+	for i:=range f.Data {
+		f.Data[i]=background+noise*rng.NormFloat32()
+	}
+
+	// stars with gaussian profiles
+	const sigma=1.5
+	const radius=int32(4*sigma+1)
+	for _, s:=range stars {
+		sx, sy:=s.X+dx, s.Y+dy
+		x0, y0:=int32(sx), int32(sy)
+		for y:=y0-radius; y<=y0+radius; y++ {
+			if y<0 || y>=height { continue }
+			for x:=x0-radius; x<=x0+radius; x++ {
+				if x<0 || x>=width { continue }
+				ddx, ddy:=float32(x)-sx, float32(y)-sy
+				f.Data[y*width+x]+=s.Value*float32(math.Exp(float64(-(ddx*ddx+ddy*ddy)/(2*sigma*sigma))))
+			}
+		}
+	}
+
+	// hot pixels in 0.01% of the pixels
+	for i:=0; i<len(f.Data)/10000; i++ {
+		f.Data[rng.Uint32n(uint32(len(f.Data)))]=60000
+	}
+
+	// vignetting and dark current
+	for i:=range f.Data {
+		f.Data[i]=f.Data[i]*flat.Data[i]/flat.Stats.Mean+dark.Data[i]
+	}
+	return f
+}
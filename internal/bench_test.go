@@ -0,0 +1,44 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRunBenchmark(t *testing.T) {
+	p:=BenchParams{Width: 256, Height: 192, NumFrames: 4, NumStars: 40, Parallelism: 2, LSEst: LSESCMedianQn}
+	results, err:=RunBenchmark(context.Background(), p)
+	if err!=nil { t.Fatalf("benchmark failed: %s", err) }
+	if len(results)!=4+len(benchStackModes) { t.Errorf("got %d results, want %d", len(results), 4+len(benchStackModes)) }
+	for _, r:=range results {
+		if r.Pixels!=256*192*4 || r.MPixPerSec()<=0 { t.Errorf("unexpected result %+v", r) }
+	}
+
+	if _, err:=RunBenchmark(context.Background(), BenchParams{Width: 32, Height: 32, NumFrames: 4}); err==nil {
+		t.Errorf("expected error for small frames")
+	}
+}
+
+func TestNormFloat32(t *testing.T) {
+	rng:=NewRNG(0)
+	data:=make([]float32, 100000)
+	for i:=range data { data[i]=rng.NormFloat32() }
+	mean, stdDev:=MeanStdDev(data)
+	if mean< -0.02 || mean>0.02 || stdDev<0.98 || stdDev>1.02 { t.Errorf("got mean %g standard deviation %g, want 0 and 1", mean, stdDev) }
+}
@@ -0,0 +1,180 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+
+// Name of the checkpoint state file within the checkpoint directory
+const checkpointStateFile="checkpoint.json"
+
+// A completed batch of a multi-batch stacking run
+type CheckpointBatch struct {
+	FileName   string       `json:"fileName"`   // Stacked batch result, in FITS format
+	Frames     int64        `json:"frames"`     // Number of frames stacked in this batch
+	Noise      float32      `json:"noise"`      // Noise estimate of the batch result
+	InputNoise float32      `json:"inputNoise"` // Average noise of the input frames of this batch
+}
+
+// Metadata of the reference frame needed for aligning and normalizing subsequent batches
+type CheckpointRef struct {
+	ID         int               `json:"id"`
+	Naxisn     []int32           `json:"naxisn"`
+	Exposure   float32           `json:"exposure"`
+	Stats      *BasicStats       `json:"stats"`
+	Stars      []Star            `json:"stars"`
+	HFR        float32           `json:"hfr"`
+}
+
+// Persistent state of a multi-batch stacking run, so an interrupted run can resume from the last completed batch.
+// Holds the randomized batch order, the reference frame metadata and the clipping sigmas chosen in the first batch,
+// and the processing parameters of the run, so batches made with different parameters are never combined
+type Checkpoint struct {
+	Dir        string            `json:"-"`           // Directory holding the state file and the batch results
+	Params     map[string]string `json:"params"`      // Processing parameters of the run, by name
+	IDs        []int             `json:"ids"`         // Frame IDs in batch order
+	FileNames  []string          `json:"fileNames"`   // Input file names in batch order
+	NumBatches int64             `json:"numBatches"`  // Total number of batches
+	BatchSize  int64             `json:"batchSize"`   // Number of frames per batch
+	SigLow     float32           `json:"sigLow"`      // Low clipping sigma chosen in the first batch
+	SigHigh    float32           `json:"sigHigh"`     // High clipping sigma chosen in the first batch
+	Ref        *CheckpointRef    `json:"ref"`         // Reference frame metadata, if any
+	Batches    []CheckpointBatch `json:"batches"`     // Completed batches, in order
+}
+
+// Creates a new, empty checkpoint in the given directory for the given batch layout and processing parameters
+func NewCheckpoint(dir string, ids []int, fileNames []string, numBatches, batchSize int64, params map[string]string) *Checkpoint {
+	return &Checkpoint{
+		Dir       : dir,
+		Params    : params,
+		IDs       : ids,
+		FileNames : fileNames,
+		NumBatches: numBatches,
+		BatchSize : batchSize,
+		SigLow    : -1,
+		SigHigh   : -1,
+	}
+}
+
+// Loads the checkpoint from the given directory. Returns nil without error if no checkpoint exists.
+// Returns an error if the checkpoint was made for a different set of input files, or with different processing parameters
+func LoadCheckpoint(dir string, fileNames []string, params map[string]string) (c *Checkpoint, err error) {
+	bytes, err:=ioutil.ReadFile(filepath.Join(dir, checkpointStateFile))
+	if os.IsNotExist(err) { return nil, nil }
+	if err!=nil { return nil, err }
+	c=&Checkpoint{}
+	if err=json.Unmarshal(bytes, c); err!=nil {
+		return nil, errors.New(fmt.Sprintf("Error parsing checkpoint in %s: %s", dir, err.Error()))
+	}
+	c.Dir=dir
+
+	if !equalStringSets(c.FileNames, fileNames) {
+		return nil, errors.New(fmt.Sprintf("Checkpoint in %s was made for different input files", dir))
+	}
+	if name, ok:=firstDifferentParam(c.Params, params); !ok {
+		return nil, errors.New(fmt.Sprintf("Checkpoint in %s was made with %s '%s', not '%s'", dir, name, c.Params[name], params[name]))
+	}
+	if int64(len(c.Batches))>c.NumBatches {
+		return nil, errors.New(fmt.Sprintf("Checkpoint in %s has %d completed batches, expecting at most %d", dir, len(c.Batches), c.NumBatches))
+	}
+	return c, nil
+}
+
+// Records a completed batch. Writes the batch result to the checkpoint directory, then
+// atomically replaces the state file, so a crash at any point leaves a consistent checkpoint
+func (c *Checkpoint) AddBatch(batch *FITSImage, frames int64, inputNoise float32, ref *FITSImage, sigLow, sigHigh float32) error {
+	fileName:=filepath.Join(c.Dir, fmt.Sprintf("batch%04d.fits", len(c.Batches)))
+	if err:=batch.WriteFile(fileName); err!=nil { return err }
+
+	if ref!=nil && c.Ref==nil {
+		c.Ref=&CheckpointRef{ID: ref.ID, Naxisn: ref.Naxisn, Exposure: ref.Exposure, Stats: ref.Stats, Stars: ref.Stars, HFR: ref.HFR}
+	}
+	c.SigLow, c.SigHigh=sigLow, sigHigh
+	noise:=float32(0)
+	if batch.Stats!=nil { noise=batch.Stats.Noise }
+	c.Batches=append(c.Batches, CheckpointBatch{FileName: fileName, Frames: frames, Noise: noise, InputNoise: inputNoise})
+	return c.save()
+}
+
+// Returns the reference frame recorded in the checkpoint as an image without pixel data, or nil if none was recorded
+func (c *Checkpoint) RefFrame() *FITSImage {
+	if c.Ref==nil { return nil }
+	return &FITSImage{
+		ID      : c.Ref.ID,
+		Header  : NewFITSHeader(),
+		Bitpix  : -32,
+		Naxisn  : c.Ref.Naxisn,
+		Pixels  : c.Ref.Naxisn[0]*c.Ref.Naxisn[1],
+		Exposure: c.Ref.Exposure,
+		Stats   : c.Ref.Stats,
+		Stars   : c.Ref.Stars,
+		HFR     : c.Ref.HFR,
+		Trans   : IdentityTransform2D(),
+	}
+}
+
+// Writes the state file via a temporary file and rename
+func (c *Checkpoint) save() error {
+	bytes, err:=json.MarshalIndent(c, "", "  ")
+	if err!=nil { return err }
+	return WriteBytesAtomic(filepath.Join(c.Dir, checkpointStateFile), bytes)
+}
+
+// Removes the state file and all batch results of the checkpoint. Leaves the directory itself in place
+func (c *Checkpoint) Remove() error {
+	for _, b:=range c.Batches {
+		if err:=os.Remove(b.FileName); err!=nil && !os.IsNotExist(err) { return err }
+	}
+	err:=os.Remove(filepath.Join(c.Dir, checkpointStateFile))
+	if err!=nil && !os.IsNotExist(err) { return err }
+	return nil
+}
+
+// Compares two sets of parameters. Returns true if they are equal, else false and the alphabetically first parameter which differs
+func firstDifferentParam(a, b map[string]string) (name string, equal bool) {
+	names:=[]string{}
+	for n:=range a { names=append(names, n) }
+	for n:=range b { if _, ok:=a[n]; !ok { names=append(names, n) } }
+	sort.Strings(names)
+	for _, n:=range names {
+		va, okA:=a[n]
+		vb, okB:=b[n]
+		if okA!=okB || va!=vb { return n, false }
+	}
+	return "", true
+}
+
+// Returns true if both lists contain the same strings, irrespective of order
+func equalStringSets(a, b []string) bool {
+	if len(a)!=len(b) { return false }
+	as:=append([]string(nil), a...)
+	bs:=append([]string(nil), b...)
+	sort.Strings(as)
+	sort.Strings(bs)
+	for i:=range as {
+		if as[i]!=bs[i] { return false }
+	}
+	return true
+}
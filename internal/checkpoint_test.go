@@ -0,0 +1,43 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCheckpointParams(t *testing.T) {
+	dir, err:=ioutil.TempDir("", "nlcheckpoint")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+
+	fileNames:=[]string{"a.fits", "b.fits"}
+	params:=map[string]string{"stMode": "5", "dark": "dark.fits"}
+	c:=NewCheckpoint(dir, []int{1, 0}, []string{"b.fits", "a.fits"}, 2, 1, params)
+	if err:=c.save(); err!=nil { t.Fatal(err) }
+
+	if c, err=LoadCheckpoint(dir, fileNames, params); err!=nil || c==nil { t.Fatalf("got %v %v; want checkpoint", c, err) }
+
+	// a checkpoint made with different parameters cannot be resumed
+	for _, p:=range []map[string]string{
+		{"stMode": "6", "dark": "dark.fits"},
+		{"stMode": "5"},
+		{"stMode": "5", "dark": "dark.fits", "flat": "flat.fits"},
+	} {
+		if _, err=LoadCheckpoint(dir, fileNames, p); err==nil { t.Errorf("params %v: expected error", p) }
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+
+package internal
+
+import (
+	"context"
+	"math"
+)
+
+
+// Reduces color mottle in an image in CIE HSL space with a bilateral filter on the chroma channels.
+// Hue and saturation are converted to cartesian chroma coordinates, which are averaged over a gaussian
+// neighborhood of the given spatial sigma in pixels. Neighbors are weighted down by their luminance
+// difference with the given range sigma, so color does not bleed across edges like star boundaries.
+// Luminance is not modified. Operates in-place
+func (f *FITSImage) DenoiseChroma(sigmaSpatial, sigmaRange float32) {
+	width:=int(f.Naxisn[0])
+	l:=len(f.Data)/3
+	height:=l/width
+	hs, ss, ls:=f.Data[:l], f.Data[l:2*l], f.Data[2*l:]
+
+	// convert hue and saturation to cartesian chroma coordinates
+	as, bs:=make([]float32, l), make([]float32, l)
+	for i, h:=range hs {
+		sin, cos:=math.Sincos(float64(h)*math.Pi/180)
+		as[i], bs[i]=ss[i]*float32(cos), ss[i]*float32(sin)
+	}
+
+	// precompute spatial weights
+	radius:=int(2*sigmaSpatial+0.5)
+	if radius<1 { radius=1 }
+	spatial:=make([]float32, (2*radius+1)*(2*radius+1))
+	for dy:=-radius; dy<=radius; dy++ {
+		for dx:=-radius; dx<=radius; dx++ {
+			spatial[(dy+radius)*(2*radius+1)+dx+radius]=float32(math.Exp(-float64(dx*dx+dy*dy)/float64(2*sigmaSpatial*sigmaSpatial)))
+		}
+	}
+	rangeFactor:=-1/(2*sigmaRange*sigmaRange)
+
+	// filter rows in parallel on the shared worker pool
+	group:=DefaultPool.NewGroup(context.Background(), 0)
+	for y:=0; y<height; y++ {
+		y:=y
+		group.Go(func() {
+			for x:=0; x<width; x++ {
+				i:=y*width+x
+				lum:=ls[i]
+				sumA, sumB, sumW:=float32(0), float32(0), float32(0)
+				for dy:=-radius; dy<=radius; dy++ {
+					yy:=y+dy
+					if yy<0 || yy>=height { continue }
+					for dx:=-radius; dx<=radius; dx++ {
+						xx:=x+dx
+						if xx<0 || xx>=width { continue }
+						j:=yy*width+xx
+						dl:=ls[j]-lum
+						w:=spatial[(dy+radius)*(2*radius+1)+dx+radius]*float32(math.Exp(float64(dl*dl*rangeFactor)))
+						sumA+=w*as[j]
+						sumB+=w*bs[j]
+						sumW+=w
+					}
+				}
+				a, b:=sumA/sumW, sumB/sumW
+				hs[i]=float32(math.Atan2(float64(b), float64(a))*180/math.Pi)
+				if hs[i]<0 { hs[i]+=360 }
+				ss[i]=float32(math.Sqrt(float64(a*a+b*b)))
+			}
+		})
+	}
+	group.Wait()
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+
+// Number of pixel values per independently compressed block. Blocks allow stacking horizontal bands
+// without decompressing entire frames
+const compressBlockLen=16384
+
+// Image data compressed losslessly for idle storage between registration and stacking. Each block of values
+// is split into byte planes, so the slowly varying high bytes of neighboring pixels line up, and the planes
+// are then Huffman coded. This is fast, and compresses better on noisy data than searching for matches
+type CompressedPixels struct {
+	ValueBytes int       // Bytes per uncompressed value, 4 for floating point data and 2 for packed data
+	Len        int       // Number of values
+	Blocks     [][]byte  // Compressed blocks of compressBlockLen values each, the last one possibly shorter
+}
+
+// Buffers and decompressors reused across blocks
+var compressBufferPool=sync.Pool{New: func() interface{} { b:=make([]byte, 4*compressBlockLen); return &b }}
+var decompressorPool  =sync.Pool{New: func() interface{} { return flate.NewReader(bytes.NewReader(nil)) }}
+
+// Compresses the image data losslessly, freeing the uncompressed data. Compresses the floating point
+// data, or the packed data if the image is packed. Returns the number of compressed bytes
+func (f *FITSImage) Compress() (compressedBytes int64, err error) {
+	if f.Compressed!=nil { return f.Compressed.Bytes(), nil }
+	c:=&CompressedPixels{ValueBytes: 4, Len: len(f.Data)}
+	if f.Data==nil && f.Packed!=nil { c.ValueBytes, c.Len=2, len(f.Packed.Data) }
+
+	bufP:=compressBufferPool.Get().(*[]byte)
+	defer compressBufferPool.Put(bufP)
+	out:=bytes.Buffer{}
+	w, err:=flate.NewWriter(&out, flate.HuffmanOnly)
+	if err!=nil { return 0, err }
+	for lower:=0; lower<c.Len; lower+=compressBlockLen {
+		upper:=lower+compressBlockLen
+		if upper>c.Len { upper=c.Len }
+		n:=upper-lower
+		buf:=(*bufP)[:n*c.ValueBytes]
+		if c.ValueBytes==4 {
+			for i, d:=range f.Data[lower:upper] {
+				v:=math.Float32bits(d)
+				buf[i], buf[n+i], buf[2*n+i], buf[3*n+i]=byte(v), byte(v>>8), byte(v>>16), byte(v>>24)
+			}
+		} else {
+			for i, v:=range f.Packed.Data[lower:upper] {
+				buf[i], buf[n+i]=byte(v), byte(v>>8)
+			}
+		}
+
+		out.Reset()
+		w.Reset(&out)
+		if _, err=w.Write(buf); err!=nil { return 0, err }
+		if err=w.Close(); err!=nil { return 0, err }
+		c.Blocks=append(c.Blocks, append([]byte(nil), out.Bytes()...))
+	}
+
+	f.Compressed=c
+	if c.ValueBytes==4 { f.Data=nil } else { f.Packed.Data=nil }
+	return c.Bytes(), nil
+}
+
+// Returns the number of compressed bytes
+func (c *CompressedPixels) Bytes() (n int64) {
+	for _, b:=range c.Blocks { n+=int64(len(b)) }
+	return n
+}
+
+// Decompresses the values starting at index lower into dst, filling all of dst. Converts packed values
+// with the given packing parameters, which must be non-nil if the compressed data is packed
+func (c *CompressedPixels) Unpack(p *PackedPixels, lower int, dst []float32) error {
+	bufP:=compressBufferPool.Get().(*[]byte)
+	defer compressBufferPool.Put(bufP)
+	r:=decompressorPool.Get().(io.ReadCloser)
+	defer decompressorPool.Put(r)
+	var packed []uint16
+	if c.ValueBytes==2 {
+		packed=make([]uint16, compressBlockLen)
+	}
+
+	upper:=lower+len(dst)
+	for block:=lower/compressBlockLen; block*compressBlockLen<upper; block++ {
+		// decompress the block into its byte planes
+		blockLower:=block*compressBlockLen
+		n:=c.Len-blockLower
+		if n>compressBlockLen { n=compressBlockLen }
+		buf:=(*bufP)[:n*c.ValueBytes]
+		if err:=r.(flate.Resetter).Reset(bytes.NewReader(c.Blocks[block]), nil); err!=nil { return err }
+		if _, err:=io.ReadFull(r, buf); err!=nil {
+			return errors.New(fmt.Sprintf("Error decompressing block %d: %s", block, err.Error()))
+		}
+
+		// reassemble the values overlapping with dst
+		from, to:=lower-blockLower, upper-blockLower
+		if from<0 { from=0 }
+		if to>n   { to=n }
+		out:=dst[blockLower+from-lower : blockLower+to-lower]
+		if c.ValueBytes==4 {
+			for i:=range out {
+				j:=from+i
+				out[i]=math.Float32frombits(uint32(buf[j]) | uint32(buf[n+j])<<8 | uint32(buf[2*n+j])<<16 | uint32(buf[3*n+j])<<24)
+			}
+		} else {
+			values:=packed[:len(out)]
+			for i:=range values {
+				j:=from+i
+				values[i]=uint16(buf[j]) | uint16(buf[n+j])<<8
+			}
+			p.unpackValues(values, out)
+		}
+	}
+	return nil
+}
+
+// Returns the row width for splitting the given lights into horizontal bands for stacking.
+// For compressed lights, returns the block length instead, so each band decompresses whole blocks
+func bandWidth(lights []*FITSImage) int {
+	if lights[0].Compressed!=nil { return compressBlockLen }
+	if len(lights[0].Naxisn)>0 { return int(lights[0].Naxisn[0]) }
+	return 0
+}
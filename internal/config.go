@@ -0,0 +1,142 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+
+// Loads a flat configuration file with parameters keyed by their command line flag name. The format is
+// selected by file extension: JSON objects (.json), YAML mappings with key: value lines (.yaml, .yml), or
+// TOML with key = value lines (.toml). Nested structures are not supported. Returns values as strings
+func LoadConfig(fileName string) (params map[string]string, err error) {
+	bytes, err:=ioutil.ReadFile(fileName)
+	if err!=nil { return nil, err }
+
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		values:=map[string]interface{}{}
+		if err=unmarshalUseNumber(bytes, &values); err!=nil {
+			return nil, errors.New(fmt.Sprintf("Error parsing config %s: %s", fileName, err.Error()))
+		}
+		return ConfigValuesToStrings(fileName, values)
+	case ".yaml", ".yml":
+		return parseConfigLines(fileName, string(bytes), ":")
+	case ".toml":
+		return parseConfigLines(fileName, string(bytes), "=")
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown config format '%s', expecting .json, .yaml, .yml or .toml", filepath.Ext(fileName)))
+	}
+}
+
+// Unmarshals JSON like json.Unmarshal, but keeps numbers in untyped values as json.Number, so
+// integers keep their full precision and are not formatted in exponent notation
+func unmarshalUseNumber(data []byte, v interface{}) error {
+	dec:=json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// Converts parameter values from JSON to strings. Values must be strings, numbers or booleans.
+// Numbers are formatted without exponent, so integer flags accept them
+func ConfigValuesToStrings(fileName string, values map[string]interface{}) (params map[string]string, err error) {
+	params=map[string]string{}
+	for key, value:=range values {
+		switch v:=value.(type) {
+		case string, bool: params[key]=fmt.Sprint(v)
+		case json.Number : params[key]=v.String()
+		case float64     : params[key]=strconv.FormatFloat(v, 'f', -1, 64)
+		default: return nil, errors.New(fmt.Sprintf("Error parsing %s: parameter '%s' must be a string, number or boolean", fileName, key))
+		}
+	}
+	return params, nil
+}
+
+// Parses flat key-value lines with the given separator. Skips empty lines, comments starting with #
+// and YAML document markers. Values may be double or single quoted
+func parseConfigLines(fileName, text, sep string) (params map[string]string, err error) {
+	params=map[string]string{}
+	for lineNo, line:=range strings.Split(text, "\n") {
+		line=strings.TrimSpace(line)
+		if line=="" || strings.HasPrefix(line, "#") || line=="---" { continue }
+		kv:=strings.SplitN(line, sep, 2)
+		key:=strings.TrimSpace(kv[0])
+		if len(kv)!=2 || key=="" || strings.ContainsAny(key, " \t[]{}") {
+			return nil, errors.New(fmt.Sprintf("%s:%d: expecting key%svalue", fileName, lineNo+1, sep))
+		}
+		value:=strings.TrimSpace(kv[1])
+		if strings.HasPrefix(value, "\"") {
+			end:=strings.LastIndex(value, "\"")
+			if end<=0 { return nil, errors.New(fmt.Sprintf("%s:%d: unterminated string", fileName, lineNo+1)) }
+			if value, err=strconv.Unquote(value[:end+1]); err!=nil {
+				return nil, errors.New(fmt.Sprintf("%s:%d: invalid string: %s", fileName, lineNo+1, err.Error()))
+			}
+		} else if strings.HasPrefix(value, "'") {
+			end:=strings.LastIndex(value, "'")
+			if end<=0 { return nil, errors.New(fmt.Sprintf("%s:%d: unterminated string", fileName, lineNo+1)) }
+			value=value[1:end]
+		} else if i:=strings.Index(value, "#"); i>=0 {
+			value=strings.TrimSpace(value[:i])
+		}
+		params[key]=value
+	}
+	return params, nil
+}
+
+// Writes a flat configuration file with the given parameters, in the format selected by file extension as for
+// LoadConfig. Numbers and booleans are written unquoted, all other values as strings. Keys are sorted
+func WriteConfig(fileName string, params map[string]string) error {
+	keys:=make([]string, 0, len(params))
+	for key:=range params { keys=append(keys, key) }
+	sort.Strings(keys)
+
+	// writes a value as number or boolean if it parses as one, else as quoted string
+	literal:=func(value string) string {
+		if f, err:=strconv.ParseFloat(value, 64); err==nil && !math.IsInf(f, 0) && !math.IsNaN(f) { return value }
+		if value=="true" || value=="false" { return value }
+		return strconv.Quote(value)
+	}
+
+	sb:=&strings.Builder{}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		sb.WriteString("{\n")
+		for i, key:=range keys {
+			fmt.Fprintf(sb, "  %s: %s", strconv.Quote(key), literal(params[key]))
+			if i<len(keys)-1 { sb.WriteString(",") }
+			sb.WriteString("\n")
+		}
+		sb.WriteString("}\n")
+	case ".yaml", ".yml":
+		for _, key:=range keys { fmt.Fprintf(sb, "%s: %s\n", key, literal(params[key])) }
+	case ".toml":
+		for _, key:=range keys { fmt.Fprintf(sb, "%s = %s\n", key, literal(params[key])) }
+	default:
+		return errors.New(fmt.Sprintf("Unknown config format '%s', expecting .json, .yaml, .yml or .toml", filepath.Ext(fileName)))
+	}
+	return WriteBytesAtomic(fileName, []byte(sb.String()))
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigRoundtrip(t *testing.T) {
+	dir, err:=ioutil.TempDir("", "nlconfig")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+
+	params:=map[string]string{"gamma": "1.7", "out": "m 42.fits", "hdrLayers": "6", "jpg": "%auto", "quote": "a\"b", "empty": "",
+	                          "stMemory": "123456789", "seed": "9007199254740993"}
+	for _, ext:=range []string{".json", ".yaml", ".toml"} {
+		fileName:=filepath.Join(dir, "cfg"+ext)
+		if err:=WriteConfig(fileName, params); err!=nil { t.Fatal(err) }
+		loaded, err:=LoadConfig(fileName)
+		if err!=nil { t.Fatalf("%s: %s", ext, err) }
+		if len(loaded)!=len(params) { t.Errorf("%s: got %d parameters, want %d", ext, len(loaded), len(params)) }
+		for key, value:=range params {
+			if loaded[key]!=value { t.Errorf("%s: %s got '%s' want '%s'", ext, key, loaded[key], value) }
+		}
+	}
+}
+
+func TestConfigValuesToStrings(t *testing.T) {
+	params, err:=ConfigValuesToStrings("test", map[string]interface{}{"stMemory": float64(123456789), "gamma": 1.5})
+	if err!=nil { t.Fatal(err) }
+	if params["stMemory"]!="123456789" || params["gamma"]!="1.5" { t.Errorf("got %v", params) }
+}
+
+func TestConfigLines(t *testing.T) {
+	params, err:=parseConfigLines("test.yaml", "---\n# comment\ngamma: 1.2  # trailing\nout: 'a.fits'\n", ":")
+	if err!=nil { t.Fatal(err) }
+	if params["gamma"]!="1.2" || params["out"]!="a.fits" { t.Errorf("got %v", params) }
+
+	if _, err:=parseConfigLines("test.toml", "[section]\n", "="); err==nil {
+		t.Errorf("expected error for TOML section")
+	}
+}
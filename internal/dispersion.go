@@ -0,0 +1,155 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"context"
+	"math"
+	"sync"
+)
+
+
+// Dispersion measure for per-pixel dispersion maps
+type DispersionMode int
+
+const (
+	DMStdDev DispersionMode = iota  // Standard deviation
+	DMMAD                           // Median absolute deviation, scaled by 1.4826 to be comparable to the standard deviation
+)
+
+
+// Calculates a per-pixel dispersion map across the given light frames, skipping NaNs. Shows where
+// outlier rejection was insufficient, and how significant faint signal is. Pixels with fewer than
+// two valid values have zero dispersion. Standard deviations accumulate with the given precision, 32 or 64 bits. Lights may be packed.
+// If moments is not nil, also stores the number and mean of the valid values per pixel there, for pooling across batches.
+// Returns an error if a frame fails to unpack
+func Dispersion(lights []*FITSImage, mode DispersionMode, precision int32, lsEst LSEstimatorMode, moments *PixelMoments) (res *FITSImage, err error) {
+	data:=make([]float32, lights[0].numValues())
+	if moments!=nil {
+		moments.Count, moments.Mean=make([]float32, len(data)), make([]float32, len(data))
+	}
+
+	// process horizontal bands across all lights in parallel. The first error unpacking frames cancels the remaining bands
+	ctx, cancel:=context.WithCancel(context.Background())
+	defer cancel()
+	errLock, bandErr:=sync.Mutex{}, error(nil)
+	forEachBand(ctx, len(data), bandWidth(lights), len(lights), func(w, lower, upper int) {
+		ldBatch, release, err:=gatherLights(lights, lower, upper)
+		if err!=nil {
+			errLock.Lock()
+			if bandErr==nil { bandErr=err }
+			errLock.Unlock()
+			cancel()
+			return
+		}
+		defer release()
+		gathered:=make([]float32, len(lights))
+		for i:=lower; i<upper; i++ {
+			// gather valid values for this pixel across all lights
+			num:=0
+			for _, ld:=range ldBatch {
+				v:=ld[i-lower]
+				if !math.IsNaN(float64(v)) {
+					gathered[num]=v
+					num++
+				}
+			}
+			if moments!=nil {
+				moments.Count[i]=float32(num)
+				if num>0 { moments.Mean[i], _=stackMeanStdDev(gathered[:num], precision) }
+			}
+			if num<2 { continue }
+
+			if mode==DMMAD {
+				median:=MedianFloat32(gathered[:num])
+				for j, g:=range gathered[:num] {
+					gathered[j]=float32(math.Abs(float64(g-median)))
+				}
+				data[i]=1.4826*MedianFloat32(gathered[:num])
+			} else {
+				_, data[i]=stackMeanStdDev(gathered[:num], precision)
+			}
+		}
+	})
+	if bandErr!=nil { return nil, bandErr }
+
+	res=&FITSImage{
+		Header: NewFITSHeader(),
+		Bitpix: -32,
+		Bzero : 0,
+		Naxisn: append([]int32(nil), lights[0].Naxisn...), // clone slice
+		Pixels: lights[0].Pixels,
+		Data  : data,
+		Trans : IdentityTransform2D(),
+	}
+	res.Stats, err=CalcExtendedStats(data, res.Naxisn[0], lsEst)
+	return res, err
+}
+
+// Per-pixel moments of the valid values across a set of frames, for pooling dispersion maps across batches
+type PixelMoments struct {
+	Count []float32  // Number of valid values
+	Mean  []float32  // Mean of the valid values
+}
+
+// Pools the per-pixel dispersion maps of several batches into one. Carries the number of values, the mean and the
+// sum of squared deviations from the mean per pixel, and combines batches with the parallel algorithm of Chan et al.,
+// so differences between batch means add to the dispersion. Median absolute deviations are pooled like standard deviations
+type DispersionPool struct {
+	Naxisn []int32    // Axis dimensions of the dispersion maps
+	Pixels int32      // Number of pixels of the dispersion maps
+	Count  []float32  // Number of values per pixel
+	Mean   []float64  // Mean per pixel
+	M2     []float64  // Sum of squared deviations from the mean per pixel
+}
+
+// Adds the dispersion map of a batch with the given per-pixel moments to the pool
+func (p *DispersionPool) Add(disp *FITSImage, moments *PixelMoments) {
+	if p.Count==nil {
+		p.Naxisn, p.Pixels=append([]int32(nil), disp.Naxisn...), disp.Pixels // clone slice
+		p.Count, p.Mean, p.M2=make([]float32, len(disp.Data)), make([]float64, len(disp.Data)), make([]float64, len(disp.Data))
+	}
+	for i, d:=range disp.Data {
+		nb:=float64(moments.Count[i])
+		if nb==0 { continue }
+		na:=float64(p.Count[i])
+		n:=na+nb
+		delta:=float64(moments.Mean[i])-p.Mean[i]
+		p.Mean[i]+=delta*nb/n
+		p.M2[i]  +=float64(d)*float64(d)*nb + delta*delta*na*nb/n
+		p.Count[i]=float32(n)
+	}
+}
+
+// Returns the pooled dispersion map with extended stats. Pixels with fewer than two values have zero dispersion
+func (p *DispersionPool) Finalize(lsEst LSEstimatorMode) (res *FITSImage, err error) {
+	data:=make([]float32, len(p.M2))
+	for i, m2:=range p.M2 {
+		if p.Count[i]>=2 { data[i]=float32(math.Sqrt(m2/float64(p.Count[i]))) }
+	}
+	res=&FITSImage{
+		Header: NewFITSHeader(),
+		Bitpix: -32,
+		Bzero : 0,
+		Naxisn: p.Naxisn,
+		Pixels: p.Pixels,
+		Data  : data,
+		Trans : IdentityTransform2D(),
+	}
+	res.Stats, err=CalcExtendedStats(data, res.Naxisn[0], lsEst)
+	return res, err
+}
@@ -0,0 +1,47 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDispersionPool(t *testing.T) {
+	// two batches with identical spread but different means, and a pixel with a NaN
+	nan:=float32(math.NaN())
+	values:=[][]float32{ {1, 5}, {3, 5}, {1, nan}, {11, 7}, {13, 7}, {12, 9} }
+	lights:=make([]*FITSImage, len(values))
+	for i, v:=range values {
+		lights[i]=&FITSImage{ID: i, Naxisn: []int32{2, 1}, Pixels: 2, Data: v}
+	}
+
+	all, err:=Dispersion(lights, DMStdDev, 64, LSESCMedianQn, nil)
+	if err!=nil { t.Fatal(err) }
+	pool:=&DispersionPool{}
+	for _, batch:=range [][]*FITSImage{lights[:3], lights[3:]} {
+		moments:=&PixelMoments{}
+		disp, err:=Dispersion(batch, DMStdDev, 64, LSESCMedianQn, moments)
+		if err!=nil { t.Fatal(err) }
+		pool.Add(disp, moments)
+	}
+	pooled, err:=pool.Finalize(LSESCMedianQn)
+	if err!=nil { t.Fatal(err) }
+	for i:=range all.Data {
+		if math.Abs(float64(pooled.Data[i]-all.Data[i]))>1e-5 { t.Errorf("pixel %d: pooled %f; want %f", i, pooled.Data[i], all.Data[i]) }
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+// Parameters of a stacking run which determine its memory and runtime needs
+type EstimateParams struct {
+	NumFrames      int64        // Number of input frames
+	Pixels         int64        // Pixels per frame
+	StMemory       int64        // Total MiB of memory to use for stacking
+	MaxParallelism int32        // Maximum number of images to process in parallel. 0=no limit
+	NumCalib       int64        // Number of calibration frames held in memory, i.e. dark and flat
+	Storage        FrameStorage // In-memory storage format of registered frames
+	BackGrid       bool         // True if background extraction is active
+	Align          bool         // True if frames are aligned
+	Normalize      bool         // True if histograms are normalized
+	Mode           StackMode    // Stacking mode
+	FindSigmas     bool         // True if stacking sigmas are searched to meet the clipping percentages
+	Disp           bool         // True if a dispersion map is calculated
+}
+
+// Expected runtime of a processing stage
+type StageEstimate struct {
+	Name    string         // Name of the stage
+	Runtime time.Duration  // Expected runtime
+}
+
+// Estimated batch plan, memory and runtime needs of a stacking run
+type StackEstimate struct {
+	NumBatches            int64            // Number of batches
+	BatchSize             int64            // Frames per batch
+	ImageLevelParallelism int32            // Number of images processed in parallel
+	PeakFrames            int64            // Peak number of frames held in memory
+	PeakMiB               int64            // Peak memory in MiB
+	Stages                []StageEstimate  // Expected runtime per stage
+}
+
+// Approximate number of stacking passes to find sigmas meeting the clipping percentages
+const estimateSigmaSearchPasses=10
+
+// Approximate cost of each stacking mode per pixel of each frame and pass, in reference operations
+var estimateStackModeCost=map[StackMode]float64{
+	StMedian: 3, StMean: 1, StSigma: 2, StWinsorSigma: 3, StLinearFit: 4, StAuto: 3, StPercentile: 3,
+	StSum: 1, StIntAverage: 1, StMax: 1, StMin: 1,
+}
+
+// Estimates the batch plan, peak memory and expected runtime per stage of a stacking run with the given parameters,
+// on a machine taking the given nanoseconds per reference operation. Stage costs are approximations in reference operations
+// per pixel, calibrated on typical runs
+func EstimateStack(p EstimateParams, nsPerOp float64) (e *StackEstimate, err error) {
+	e=&StackEstimate{}
+	e.NumBatches, e.BatchSize, e.ImageLevelParallelism, err=PlanBatches(p.NumFrames, p.Pixels, p.StMemory, p.MaxParallelism, p.NumCalib, p.Storage.BytesPerPixel())
+	if err!=nil { return nil, err }
+
+	// Besides the lights in the batch, one temp frame per thread, the calibration frames,
+	// and for multiple batches the reference frame and the stack of stacks
+	// Lights in the batch may use compact storage
+	e.PeakFrames=e.BatchSize+int64(e.ImageLevelParallelism)+p.NumCalib
+	fullFrames:=int64(e.ImageLevelParallelism)+p.NumCalib
+	if e.NumBatches>1 { e.PeakFrames+=2; fullFrames+=2 }
+	peakBytes:=e.BatchSize*p.Pixels*p.Storage.BytesPerPixel() + fullFrames*p.Pixels*4
+	e.PeakMiB=(peakBytes+1024*1024-1)/(1024*1024)
+
+	// Convert reference operations per pixel to runtime, given the number of pixels and threads
+	frames, pixels:=float64(p.NumFrames), float64(p.Pixels)
+	duration:=func(ops float64, threads int32) time.Duration {
+		return time.Duration(ops*nsPerOp/float64(threads))
+	}
+	threads:=cappedParallelism(p.MaxParallelism)
+
+	pre:=45.0
+	if p.BackGrid { pre+=10 }
+	e.Stages=append(e.Stages, StageEstimate{"Load and preprocess", duration(pre*pixels*frames, e.ImageLevelParallelism)})
+
+	post:=0.0
+	if p.Align     { post+=16 }
+	if p.Normalize { post+=4  }
+	if post>0 {
+		e.Stages=append(e.Stages, StageEstimate{"Align and normalize", duration(post*pixels*frames, e.ImageLevelParallelism)})
+	}
+
+	// Sigmas are searched in the first batch only, and reused for the others. Each pass also calculates stats on the result
+	passes:=float64(e.NumBatches)
+	if p.FindSigmas && (p.Mode==StSigma || p.Mode==StWinsorSigma || p.Mode==StLinearFit || p.Mode==StAuto || p.Mode==StPercentile) {
+		passes+=estimateSigmaSearchPasses-1
+	}
+	framesPerPass:=frames/float64(e.NumBatches)
+	e.Stages=append(e.Stages, StageEstimate{"Stack", duration((estimateStackModeCost[p.Mode]*framesPerPass+80)*pixels*passes, threads)})
+
+	if p.Disp {
+		e.Stages=append(e.Stages, StageEstimate{"Dispersion map", duration(10*pixels*frames, threads)})
+	}
+
+	// Star detection on each batch, and combination and stats of the stack of stacks
+	comb:=5*float64(e.NumBatches)
+	if e.NumBatches>1 { comb+=85 }
+	e.Stages=append(e.Stages, StageEstimate{"Combine batches", duration(comb*pixels, threads)})
+
+	return e, nil
+}
+
+// Returns the total expected runtime of all stages
+func (e *StackEstimate) Total() (total time.Duration) {
+	for _, s:=range e.Stages {
+		total+=s.Runtime
+	}
+	return total
+}
+
+// Measures the speed of this machine as nanoseconds per reference operation, i.e. per value
+// of a median selection on a single thread. Returns the best of three runs
+func MeasureSpeed() (nsPerOp float64) {
+	data:=make([]float32, 1<<20)
+	rng:=NewRNG(samplingSeed)
+	for run:=0; run<3; run++ {
+		for i:=range data {
+			data[i]=float32(rng.Uint32n(65536))
+		}
+		start:=time.Now()
+		QSelectMedianFloat32(data)
+		ns:=float64(time.Since(start).Nanoseconds())/float64(len(data))
+		if run==0 || ns<nsPerOp { nsPerOp=ns }
+	}
+	return nsPerOp
+}
+
+// Reads the image dimensions from the header of the given FITS file, without reading the data.
+// Decompresses gzip if .gz or .gzip suffix is present. The file name - reads from stdin
+func ReadImageSize(fileName string) (naxisn []int32, err error) {
+	var r io.Reader
+	if fileName==StdioFileName {
+		if r, err=stdinFITSReader(); err!=nil { return nil, err }
+	} else {
+		f, err:=os.Open(fileName)
+		if err!=nil { return nil, err }
+		defer f.Close()
+		r=f
+		if ext:=strings.ToLower(filepath.Ext(fileName)); ext==".gz" || ext==".gzip" {
+			gz, err:=gzip.NewReader(f)
+			if err!=nil { return nil, err }
+			defer gz.Close()
+			r=gz
+		}
+	}
+	hc, err:=readHeaderCards(r)
+	if err!=nil { return nil, err }
+
+	naxis, err:=headerCardsInt(hc, "NAXIS")
+	if err!=nil { return nil, err }
+	if naxis<2 { return nil, errors.New(fmt.Sprintf("%s: Expecting an image with at least 2 axes, got %d", fileName, naxis)) }
+	naxisn=make([]int32, naxis)
+	for i:=range naxisn {
+		n, err:=headerCardsInt(hc, fmt.Sprintf("NAXIS%d", i+1))
+		if err!=nil { return nil, err }
+		naxisn[i]=int32(n)
+	}
+	return naxisn, nil
+}
+
+// Returns the integer value of the given key from the header cards
+func headerCardsInt(hc *HeaderCards, key string) (int, error) {
+	value, ok:=hc.Get(key)
+	if !ok { return 0, errors.New(fmt.Sprintf("Missing header key %s", key)) }
+	n, err:=strconv.Atoi(value)
+	if err!=nil { return 0, errors.New(fmt.Sprintf("Invalid value '%s' for header key %s", value, key)) }
+	return n, nil
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEstimateStack(t *testing.T) {
+	p:=EstimateParams{NumFrames: 100, Pixels: 1024*1024, StMemory: 100, MaxParallelism: 1, Align: true, Mode: StAuto, FindSigmas: true}
+	e, err:=EstimateStack(p, 10)
+	if err!=nil { t.Fatal(err) }
+	if e.NumBatches!=5 || e.BatchSize!=20 || e.ImageLevelParallelism!=1 {
+		t.Errorf("got %d batches of size %d with parallelism %d, want 5 of size 20 with 1", e.NumBatches, e.BatchSize, e.ImageLevelParallelism)
+	}
+	if e.PeakFrames!=23 || e.PeakMiB!=92 { t.Errorf("got peak %d frames %d MiB, want 23 frames 92 MiB", e.PeakFrames, e.PeakMiB) }
+	if len(e.Stages)!=4 { t.Errorf("got %d stages want 4", len(e.Stages)) }
+	for _, s:=range e.Stages {
+		if s.Runtime<=0 { t.Errorf("%s: got runtime %v", s.Name, s.Runtime) }
+	}
+
+	p.StMemory=8
+	if _, err:=EstimateStack(p, 10); err==nil { t.Errorf("expected error for insufficient memory") }
+}
+
+func TestReadImageSize(t *testing.T) {
+	dir, err:=ioutil.TempDir("", "nlestimate")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+
+	for _, name:=range []string{"a.fits", "a.fits.gz"} {
+		img:=NewFITSImage()
+		img.Naxisn=[]int32{3, 2}
+		img.Pixels=6
+		img.Data=make([]float32, 6)
+		fileName:=filepath.Join(dir, name)
+		if err:=img.WriteFile(fileName); err!=nil { t.Fatal(err) }
+		naxisn, err:=ReadImageSize(fileName)
+		if err!=nil { t.Fatal(err) }
+		if !EqualInt32Slice(naxisn, img.Naxisn) { t.Errorf("%s: got %v want %v", name, naxisn, img.Naxisn) }
+	}
+}
+
+func TestReplanBatches(t *testing.T) {
+	for _, c:=range []struct{ remaining, frameBytes, fixedBytes, stMemory, minSize, wantBatches, wantSize int64 }{
+		{ 90, 4<<20, 20<<20, 100, 2, 5, 18 },  // 20 frames fit, evened out across 90 frames
+		{ 10, 4<<20, 20<<20, 100, 2, 1, 10 },  // all remaining frames fit
+		{ 90, 4<<20, 120<<20, 100, 4, 23, 4 }, // fixed memory exceeds budget, fall back to minimum
+		{  0, 4<<20, 20<<20, 100, 2, 0, 0 },
+	} {
+		n, s:=ReplanBatches(c.remaining, c.frameBytes, c.fixedBytes, c.stMemory, c.minSize)
+		if n!=c.wantBatches || s!=c.wantSize { t.Errorf("%v: got %d batches of size %d", c, n, s) }
+	}
+}
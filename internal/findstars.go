@@ -20,7 +20,6 @@ import (
 	"io"
 	"fmt"
 	"math"
-	"github.com/valyala/fastrand"
 	//"sort"
 )
 
@@ -32,6 +31,8 @@ type Star struct {
 	Y     float32       // Precise star y position via center of mass
 	Mass  float32       // Star mass. Summed pixel values above location estimate, within given radius
 	HFR	  float32       // Half-Flux Radius of the star, in pixels
+	Ecc   float32       // Eccentricity of the star from its second moments. 0 is perfectly round
+	Angle float32       // Orientation of the major axis in radians within [-pi/2,pi/2], from the x axis towards the y axis
 }
 
 // Adapter method 1 to make Star work with KD-Tree  
@@ -55,9 +56,11 @@ func PrintStars(w io.Writer, stars []Star) {
 
 // Find stars in the given image with data type int16
 func FindStars(data []float32, width int32, location, scale, starSig, bpSigma float32, radius int32, medianDiffStats *BasicStats) (stars []Star, sumOfShifts, avgHFR float32) {
+	defer StartStage(StageStars)()
 	// Begin star identification based on pixels significantly above the background
 	threshold :=location+scale*starSig
 	stars=findBrightPixels(data, width, threshold, radius)
+	candidates:=stars
 	// LogPrintf("%d (%.4g%%) initial stars \n", len(stars), (100.0*float32(len(stars))/float32(len(data))))
 
 	// reject bad pixels which differ significantly from the local median
@@ -92,19 +95,20 @@ func FindStars(data []float32, width int32, location, scale, starSig, bpSigma fl
 	// LogPrintf("Bottom %d stars: %v\n", maxIndex, stars[len(stars)-maxIndex:])
 	// PrintStars(stars)
 
-	// Return a clone of the final shortlist of stars, so the longer original object can be reclaimed
+	// Return a clone of the final shortlist of stars, so the longer candidate array can be reused
 	res:=make([]Star, len(stars))
 	copy(res, stars)
 	stars=nil
+	PutArrayStar(candidates)
 
 	return res, sumOfShifts, avgHFR
 }
 
 
 // Find pixels above the threshold and return them as stars. Applies early overlap rejection based on radius to reduce allocations.
-// Uses central pixel value as initial mass, 1 as initial HFR.
+// Uses central pixel value as initial mass, 1 as initial HFR. The result is taken from the array pool
 func findBrightPixels(data []float32, width int32, threshold float32, radius int32) []Star {
-	stars:=make([]Star,len(data)/100)[:0] // []Star{}
+	stars:=GetArrayStar(len(data)/100)[:0] // []Star{}
 
 	for i,v :=range data {
 		if v>threshold {
@@ -133,21 +137,22 @@ func findBrightPixels(data []float32, width int32, threshold float32, radius int
 // Reject bad pixels which differ from the local median by more than sigma times the estimated standard deviation
 // Modifies the given stars array values, and returns shortened slice
 func rejectBadPixels(stars []Star, data []float32, width int32, sigma float32, medianDiffStats *BasicStats) []Star {
-	// Create mask for local 9-neighborhood
-	mask:=CreateMask(width, 1.5)
+	// Mask for local 9-neighborhood
+	mask:=cachedMask(width, 1.5)
 	buffer:=make([]float32, len(mask))
 
 	if medianDiffStats==nil {
 		// Estimate standard deviation of pixels from local neighborhood median based on random 1% of pixels
 		numSamples:=len(data)/100
-		samples:=make([]float32,numSamples)
-		rng:=fastrand.RNG{}
+		samples:=GetArrayF32(numSamples)
+		rng:=NewRNG(samplingSeed)
 		for i:=0; i<numSamples; i++ {
 			index:=int32(rng.Uint32n(uint32(len(data))))
 			median :=Median(data, index, mask, buffer)
 			samples[i]=data[index]-median
 		}
 		medianDiffStats=CalcBasicStats(samples)
+		PutArrayF32(samples)
 		samples=nil
 	}
 
@@ -214,7 +219,7 @@ func filterOutOverlaps(stars []Star, width, height, radius int32) []Star {
 	xBins  :=(width +binSize-1)/binSize
 	yBins  :=(height+binSize-1)/binSize
 	bins   :=make([]*starListItem,int(xBins*yBins))
-	slis   :=make([]starListItem,((len(stars)+1023)/1024)*1024) // use tiered sizing to help the allocator
+	slis   :=getArraySLI(len(stars))
 	radiusSquared:=radius*radius
 
 	// For all stars, filter list in place
@@ -266,6 +271,7 @@ func filterOutOverlaps(stars []Star, width, height, radius int32) []Star {
 	}
 
 	bins=nil
+	putArraySLI(slis, numRemainingStars)
 	slis=nil
 	// Return shortened list of stars as result
 	return stars[:numRemainingStars]
@@ -323,27 +329,35 @@ func shiftToCenterOfMass(stars []Star, data []float32, width int32, location flo
 }
 
 // Calculate the Half-Flux Radius of each star. Returns a new list of stars, each enriched with the HFR field
-// Based on the algorithm in https://en.wikipedia.org/wiki/Half_flux_diameter
+// and the eccentricity and angle fields. Based on the algorithm in https://en.wikipedia.org/wiki/Half_flux_diameter
 func calcHalfFluxRadius(stars []Star, data []float32, width int32, location float32, radius float32) (avgHFR float32) {
 	avgHFR=float32(0)
+	disc:=cachedDisc(radius)
 	//LogPrintf("bzero=%d location=%g\n", bzero, location)
 	for i,c:=range stars {
 		moment, mass:=float32(0), float32(0)
-		rad:=int32(radius)
-		for y:=-rad; y<=rad; y++ {
-			for x:=-rad; x<=rad; x++ {
-				index:=c.Index+y*width+x
-				value:=float32(0.0)
-				if index>=0 && index<int32(len(data)) {
-					//LogPrintf("V%d ", data[index])
-					value=data[index]-location
-					//if value<0 { value=0 }
-				}
-				distance:=float32(math.Sqrt(float64(x*x+y*y)))
-				if distance>float32(radius)+1e-8 { continue }
-				//LogPrintf("v%6.6f d%.1f  ", value, distance)
-				moment  +=distance*value
-				mass    +=value
+		xx, yy, xy, posMass:=float32(0), float32(0), float32(0), float32(0)
+		offX:=float32(c.Index % width)-c.X
+		offY:=float32(c.Index / width)-c.Y
+		for _, e:=range disc {
+			index:=c.Index+e.Y*width+e.X
+			value:=float32(0.0)
+			if index>=0 && index<int32(len(data)) {
+				//LogPrintf("V%d ", data[index])
+				value=data[index]-location
+				//if value<0 { value=0 }
+			}
+			//LogPrintf("v%6.6f d%.1f  ", value, e.Distance)
+			moment  +=e.Distance*value
+			mass    +=value
+
+			// second moments around the precise center, ignoring values below the background
+			if value>0 {
+				dx, dy:=float32(e.X)+offX, float32(e.Y)+offY
+				xx+=dx*dx*value
+				yy+=dy*dy*value
+				xy+=dx*dy*value
+				posMass+=value
 			}
 		}
 		if mass==0.0 { mass=1e-8 }
@@ -351,19 +365,36 @@ func calcHalfFluxRadius(stars []Star, data []float32, width int32, location floa
 		// LogPrintf("-> mass %6.6g hfr %6.6g\n", c.Mass, hfr)
 		avgHFR+=float32(hfr)
 		stars[i].HFR=hfr
+		stars[i].Ecc, stars[i].Angle=elongationFromMoments(xx, yy, xy, posMass)
 	}
 	avgHFR/=float32(len(stars))
 	return avgHFR
 }
 
 
+// Calculate eccentricity and orientation of the major axis from the second moments of a star, via the eigenvalues
+// and eigenvectors of the covariance matrix
+func elongationFromMoments(xx, yy, xy, mass float32) (ecc, angle float32) {
+	if mass<=0 { return 0, 0 }
+	xx, yy, xy=xx/mass, yy/mass, xy/mass
+	halfSum, halfDiff:=0.5*(xx+yy), 0.5*(xx-yy)
+	root:=float32(math.Sqrt(float64(halfDiff*halfDiff+xy*xy)))
+	major, minor:=halfSum+root, halfSum-root
+	if major<=0 { return 0, 0 }
+	if minor<0 { minor=0 }
+	angle=float32(0.5*math.Atan2(float64(2*xy), float64(xx-yy)))
+	return float32(math.Sqrt(float64(1-minor/major))), angle
+}
+
+
 func massOverHFA(mass, hfr float32) float32 {
 	return mass / (hfr*hfr*float32(math.Pi))
 }
 
 func filterByMassAndHFR(stars []Star, sigma, scale, radius float32, width, height int32) (res []Star, medianHFR float32) {
-	hfrs:=make([]float32, len(stars))
-	massOverHFAs:=make([]float32, len(stars))
+	hfrs:=GetArrayF32(len(stars))
+	massOverHFAs:=GetArrayF32(len(stars))
+	defer func() { PutArrayF32(hfrs); PutArrayF32(massOverHFAs) }()
 
 	// Pass 1: filter out based on expected signal and noise
 	// expected noise adds with square root of circle size considered for HFR calculation
@@ -17,6 +17,8 @@
 package internal
 
 import (
+	"errors"
+	"fmt"
 	"math"
 )
 
@@ -35,15 +37,21 @@ type FITSImage struct {
 	Pixels int32 		 // Number of pixels in the image. Product of Naxisn[]
 
 	Data   []float32     // The image data
+	Packed *PackedPixels // The image data in compact storage for stacking, if packed. Data is nil then
+	Compressed *CompressedPixels // The image data compressed for stacking, if compressed. Data, or the packed data if packed, is nil then
+	pooled bool          // Data was taken from the frame pool, and can be returned to it once replaced
 
 	Exposure float32     // Image exposure in seconds
 
 	Stats  *BasicStats   // Basic image statistics: min, mean, max
 	Stars  []Star        // Star detections
 	HFR    float32       // Half-flux radius of the star detections
+	Background float32   // Background level before normalization, for quality weighting
 
 	Trans    Transform2D // Transformation to reference frame
 	Residual float32     // Residual error from the above transformation 
+
+	bpStats  *BasicStats // Statistics of the deviations from the local median in bad pixel removal, reused for star detection
 }
 
 // Creates a FITS image initialized with empty header
@@ -116,6 +124,55 @@ func CombineRGB(chans []*FITSImage, ref *FITSImage) FITSImage {
 	return rgb
 } 
 
+// Splits a multi-channel image into single channel images, copying pixel values as they are
+func SplitChannels(img *FITSImage) (chans []*FITSImage, err error) {
+	if len(img.Naxisn)!=3 {
+		return nil, errors.New(fmt.Sprintf("Need an image with three axes to split channels, have %d", len(img.Naxisn)))
+	}
+	size:=img.Naxisn[0]*img.Naxisn[1]
+	for c:=int32(0); c<img.Naxisn[2]; c++ {
+		ch:=&FITSImage{
+			ID    :int(c),
+			Header:NewFITSHeader(),
+			Bitpix:-32,
+			Bzero :0,
+			Naxisn:[]int32{img.Naxisn[0], img.Naxisn[1]},
+			Pixels:size,
+			Data  :append([]float32(nil), img.Data[c*size:(c+1)*size]...), // clone slice
+			Exposure: img.Exposure,
+			Trans :IdentityTransform2D(),
+		}
+		ch.Header.History=append([]string(nil), img.Header.History...) // keep processing history
+		chans=append(chans, ch)
+	}
+	return chans, nil
+}
+
+// Merges single channel images into one multi-channel image, copying pixel values as they are.
+// Unlike CombineRGB, values are not normalized. All images must have the same dimensions
+func MergeChannels(chans []*FITSImage) (img *FITSImage, err error) {
+	for _, ch:=range chans {
+		if len(ch.Naxisn)!=2 || !EqualInt32Slice(ch.Naxisn, chans[0].Naxisn) {
+			return nil, errors.New(fmt.Sprintf("Need single channel images of identical size to merge, have %v and %v", chans[0].Naxisn, ch.Naxisn))
+		}
+	}
+	size:=chans[0].Pixels
+	img=&FITSImage{
+		Header:NewFITSHeader(),
+		Bitpix:-32,
+		Bzero :0,
+		Naxisn:[]int32{chans[0].Naxisn[0], chans[0].Naxisn[1], int32(len(chans))},
+		Pixels:size*int32(len(chans)),
+		Data  :make([]float32, int(size)*len(chans)),
+		Exposure: chans[0].Exposure,
+		Trans :IdentityTransform2D(),
+	}
+	for c, ch:=range chans {
+		copy(img.Data[int32(c)*size:], ch.Data)
+	}
+	return img, nil
+}
+
 // calculate common normalization factors to [0..1] across all channels
 func getCommonNormalizationFactors(chans []*FITSImage) (min, mult float32) {
 	min =chans[0].Stats.Min
@@ -141,17 +198,31 @@ func (hsl *FITSImage) ApplyLuminanceToCIExyY(lum *FITSImage) {
 	copy(dest, lum.Data)
 }
 
+// Smoothes the chromaticity channels x and y of an image in CIE xyY space with a gauss filter of given sigma,
+// leaving the luminance unchanged. For LRGB combination, this removes color noise from the RGB channels 
+// while sharp detail is taken from the luminance. Operates in-place
+func (xyy *FITSImage) BlurChromaticity(sigma float32) {
+	l:=len(xyy.Data)/3
+	width:=int(xyy.Naxisn[0])
+	tmp, res:=make([]float32, l), make([]float32, l)
+	for c:=0; c<2; c++ {
+		ch:=xyy.Data[c*l:(c+1)*l]
+		GaussFilter2D(res, tmp, ch, width, sigma)
+		copy(ch, res)
+	}
+}
+
 
 // Set image black point so histogram peaks match the rightmost channel peak,
-// and median star colors are of a neutral tone. 
-func (f *FITSImage) SetBlackWhitePoints() error {
+// and median star colors are of a neutral tone. Uses the given location and scale estimator
+func (f *FITSImage) SetBlackWhitePoints(lsEst LSEstimatorMode) error {
 	// Estimate location (=histogram peak, background black point) per color channel
 	l:=len(f.Data)/3
-	statsR,err:=CalcExtendedStats(f.Data[   :  l], f.Naxisn[0])
+	statsR,err:=CalcExtendedStats(f.Data[   :  l], f.Naxisn[0], lsEst)
 	if err!=nil {return err}
-	statsG,err:=CalcExtendedStats(f.Data[l  :2*l], f.Naxisn[0])
+	statsG,err:=CalcExtendedStats(f.Data[l  :2*l], f.Naxisn[0], lsEst)
 	if err!=nil {return err}
-	statsB,err:=CalcExtendedStats(f.Data[2*l:   ], f.Naxisn[0])
+	statsB,err:=CalcExtendedStats(f.Data[2*l:   ], f.Naxisn[0], lsEst)
 	if err!=nil {return err}
 	locR, locG, locB:=statsR.Location, statsG.Location, statsB.Location
 
@@ -304,6 +375,14 @@ func ShowStars(src *FITSImage, hfrMultiple float32) FITSImage {
 
 
 
+// Adds the elements of b to the elements of a, in place. Both must be of the same length
+func addInt32Slice(a, b []int32) {
+	for i, v:=range b {
+		a[i]+=v
+	}
+}
+
+
 // Equal tells whether a and b contain the same elements.
 // A nil argument is equivalent to an empty slice.
 func EqualInt32Slice(a, b []int32) bool {
@@ -0,0 +1,67 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+)
+
+
+// Quality gates for a stacking run. Tracks how many input frames failed preprocessing or were skipped
+// in alignment, and flags an error as soon as the thresholds can no longer be met, so the run can abort
+// before writing a misleading stack
+type QualityGates struct {
+	MinFrames       int64    // Minimum number of usable frames in the stack. 0=no limit
+	MaxSkipFraction float32  // Maximum fraction of input frames skipped in alignment. 1=no limit
+
+	Total           int64    // Number of input frames
+	Failed          int64    // Number of frames which failed to load or preprocess
+	Skipped         int64    // Number of frames skipped in alignment
+	Usable          int64    // Number of frames usable for stacking
+}
+
+// Creates new quality gates for the given number of input frames and thresholds
+func NewQualityGates(total, minFrames int64, maxSkipFraction float32) *QualityGates {
+	return &QualityGates{
+		MinFrames      : minFrames,
+		MaxSkipFraction: maxSkipFraction,
+		Total          : total,
+	}
+}
+
+// Records the outcome of a group of frames
+func (q *QualityGates) Add(usable, failed, skipped int64) {
+	q.Usable +=usable
+	q.Failed +=failed
+	q.Skipped+=skipped
+}
+
+// Checks the thresholds. Returns an error if the skipped frames already exceed the maximum fraction,
+// or if the minimum number of usable frames cannot be reached even if all remaining frames are usable
+func (q *QualityGates) Check() error {
+	if q.Total>0 && float32(q.Skipped)>q.MaxSkipFraction*float32(q.Total) {
+		return errors.New(fmt.Sprintf("Quality gate failed: %d of %d frames (%.1f%%) skipped in alignment, maximum is %.1f%%",
+			q.Skipped, q.Total, float32(q.Skipped)*100/float32(q.Total), q.MaxSkipFraction*100))
+	}
+	remaining:=q.Total-q.Usable-q.Failed-q.Skipped
+	if q.Usable+remaining<q.MinFrames {
+		return errors.New(fmt.Sprintf("Quality gate failed: at most %d of %d frames usable (%d failed, %d skipped in alignment), minimum is %d",
+			q.Usable+remaining, q.Total, q.Failed, q.Skipped, q.MinFrames))
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+
+package internal
+
+
+// Compresses the large-scale dynamic range of the given channel, keeping small-scale contrast. Splits the
+// channel into wavelet detail layers and a large-scale residual with the given number of layers, and maps the
+// residual with a rational curve r*(1+strength)/(1+strength*r), which lifts faint areas and compresses bright
+// ones while keeping 0 and 1 fixed. The detail layers are added back unchanged. Data must be normalized
+// to [0,1]. Operates in-place
+func (f *FITSImage) CompressHDR(chanID int, numLayers int, strength float32) {
+	width:=int(f.Naxisn[0])
+	l:=width*int(f.Naxisn[1])
+	data:=f.Data[chanID*l : (chanID+1)*l]
+
+	layers, residual:=WaveletDecompose(data, width, numLayers)
+	for i, r:=range residual {
+		if r<0 { r=0 } else if r>1 { r=1 }
+		residual[i]=r*(1+strength)/(1+strength*r)
+	}
+	res:=WaveletReconstruct(layers, residual, nil, 0, 1)
+	copy(data, res)
+}
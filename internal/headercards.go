@@ -0,0 +1,222 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+
+// Raw header cards of a FITS file, for inspecting and editing keywords without touching the data
+type HeaderCards struct {
+	Cards  []string  // Header cards of 80 characters each, including the END card
+	Length int64     // Length of the header in the file, in bytes
+}
+
+// Structural keywords which cannot be edited, as changing them would corrupt the data
+var protectedKeys=map[string]bool{"SIMPLE": true, "BITPIX": true, "NAXIS": true, "END": true, "CONTINUE": true}
+
+// Reads the raw header cards of the given FITS file
+func ReadHeaderCards(fileName string) (hc *HeaderCards, err error) {
+	f, err:=os.Open(fileName)
+	if err!=nil { return nil, err }
+	defer f.Close()
+	return readHeaderCards(f)
+}
+
+func readHeaderCards(r io.Reader) (hc *HeaderCards, err error) {
+	hc=&HeaderCards{}
+	buf:=make([]byte, fitsBlockSize)
+	for {
+		if _, err:=io.ReadFull(r, buf); err!=nil {
+			return nil, errors.New(fmt.Sprintf("Cannot read FITS header, END card missing: %s", err.Error()))
+		}
+		hc.Length+=int64(fitsBlockSize)
+		for i:=0; i<fitsBlockSize; i+=fitsHeaderLineSize {
+			card:=string(buf[i:i+fitsHeaderLineSize])
+			hc.Cards=append(hc.Cards, card)
+			if cardKey(card)=="END" { return hc, nil }
+		}
+	}
+}
+
+// Returns the keyword of the given header card
+func cardKey(card string) string {
+	return strings.TrimSpace(card[:8])
+}
+
+// Returns the index of the first card with the given key, or -1 if there is none
+func (hc *HeaderCards) find(key string) int {
+	for i, c:=range hc.Cards {
+		if cardKey(c)==key { return i }
+	}
+	return -1
+}
+
+// Returns the number of cards used by the keyword at index i, including CONTINUE cards of long strings
+func (hc *HeaderCards) numCards(i int) int {
+	n:=1
+	for i+n<len(hc.Cards) && cardKey(hc.Cards[i+n])=="CONTINUE" { n++ }
+	return n
+}
+
+// Returns the keys of all valued cards in order of occurrence, without COMMENT, HISTORY and END
+func (hc *HeaderCards) Keys() (keys []string) {
+	for _, c:=range hc.Cards {
+		key:=cardKey(c)
+		if key!="" && key!="COMMENT" && key!="HISTORY" && key!="CONTINUE" && key!="END" && c[8:10]=="= " {
+			keys=append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Returns the value of the given key as string, with quotes and comments removed and long strings joined
+func (hc *HeaderCards) Get(key string) (value string, ok bool) {
+	i:=hc.find(strings.ToUpper(key))
+	if i<0 || hc.Cards[i][8:10]!="= " { return "", false }
+	value, _=cardValue(hc.Cards[i][10:])
+	for j:=1; j<hc.numCards(i) && strings.HasSuffix(value, "&"); j++ {
+		cont, _:=cardValue(hc.Cards[i+j][8:])
+		value=value[:len(value)-1]+cont
+	}
+	return value, true
+}
+
+// Parses the value part of a header card. Returns the value with quotes removed, and the comment
+func cardValue(s string) (value, comment string) {
+	s=strings.TrimLeft(s, " ")
+	if strings.HasPrefix(s, "'") {
+		sb:=strings.Builder{}
+		i:=1
+		for ; i<len(s); i++ {
+			if s[i]=='\'' {
+				if i+1<len(s) && s[i+1]=='\'' {
+					sb.WriteByte('\'')
+					i++
+					continue
+				}
+				break
+			}
+			sb.WriteByte(s[i])
+		}
+		rest:=""
+		if i+1<len(s) { rest=s[i+1:] }
+		if j:=strings.Index(rest, "/"); j>=0 { comment=strings.TrimSpace(rest[j+1:]) }
+		return strings.TrimRight(sb.String(), " "), comment
+	}
+	if j:=strings.Index(s, "/"); j>=0 {
+		return strings.TrimSpace(s[:j]), strings.TrimSpace(s[j+1:])
+	}
+	return strings.TrimSpace(s), ""
+}
+
+// Checks if the given key can be edited
+func checkEditableKey(key string) error {
+	if len(key)==0 || len(key)>8 {
+		return errors.New(fmt.Sprintf("Invalid FITS header key '%s', need 1 to 8 characters", key))
+	}
+	for _, c:=range key {
+		if !(c>='A' && c<='Z') && !(c>='0' && c<='9') && c!='_' && c!='-' {
+			return errors.New(fmt.Sprintf("Invalid FITS header key '%s', allowed are A-Z, 0-9, _ and -", key))
+		}
+	}
+	if protectedKeys[key] || strings.HasPrefix(key, "NAXIS") {
+		return errors.New(fmt.Sprintf("Cannot edit structural FITS header key '%s'", key))
+	}
+	return nil
+}
+
+// Sets the given key to the given value, keeping the comment of an existing card. Values T and F are
+// written as booleans, numbers as numbers, and everything else as string. Quote a value with single
+// quotes to force a string
+func (hc *HeaderCards) Set(key, value string) error {
+	key=strings.ToUpper(key)
+	if err:=checkEditableKey(key); err!=nil { return err }
+
+	comment:=""
+	i:=hc.find(key)
+	if i>=0 && hc.Cards[i][8:10]=="= " { _, comment=cardValue(hc.Cards[i][10:]) }
+
+	sb:=strings.Builder{}
+	if len(value)>=2 && strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") {
+		writeString(&sb, key, value[1:len(value)-1], comment)
+	} else if value=="T" || value=="F" {
+		writeBool(&sb, key, value=="T", comment)
+	} else if v, err:=strconv.ParseInt(value, 10, 64); err==nil {
+		writeInt64(&sb, key, v, comment)
+	} else if v, err:=strconv.ParseFloat(value, 64); err==nil {
+		writeFloat64(&sb, key, v, comment)
+	} else {
+		writeString(&sb, key, value, comment)
+	}
+	s:=sb.String()
+	cards:=[]string{}
+	for j:=0; j<len(s); j+=fitsHeaderLineSize {
+		cards=append(cards, s[j:j+fitsHeaderLineSize])
+	}
+
+	if i<0 { i=len(hc.Cards)-1 } else { hc.delete(i) } // insert before END, or replace
+	hc.Cards=append(hc.Cards[:i], append(cards, hc.Cards[i:]...)...)
+	return nil
+}
+
+// Deletes the given key. Returns false if the key was not present
+func (hc *HeaderCards) Delete(key string) (found bool, err error) {
+	key=strings.ToUpper(key)
+	if err:=checkEditableKey(key); err!=nil { return false, err }
+	i:=hc.find(key)
+	if i<0 { return false, nil }
+	hc.delete(i)
+	return true, nil
+}
+
+func (hc *HeaderCards) delete(i int) {
+	hc.Cards=append(hc.Cards[:i], hc.Cards[i+hc.numCards(i):]...)
+}
+
+// Rewrites the given FITS file with the edited header cards, copying the data unchanged.
+// Writes to a temporary file first, and replaces the original only on success
+func (hc *HeaderCards) WriteToFile(fileName string) (err error) {
+	lExt:=strings.ToLower(path.Ext(fileName))
+	if lExt==".gz" || lExt==".gzip" { return errors.New("Editing headers of compressed FITS files is not supported") }
+
+	in, err:=os.Open(fileName)
+	if err!=nil { return err }
+	defer in.Close()
+	if _, err=readHeaderCards(in); err!=nil { return err } // skip old header
+
+	// Pad header cards to full blocks
+	header:=strings.Join(hc.Cards, "")
+	if rem:=len(header)%fitsBlockSize; rem>0 { header+=strings.Repeat(" ", fitsBlockSize-rem) }
+
+	err=WriteFileAtomic(fileName, func(w io.Writer) error {
+		if _, err:=io.WriteString(w, header); err!=nil { return err }
+		// Copy data unchanged
+		_, err:=io.Copy(w, in)
+		return err
+	})
+	if err!=nil { return err }
+	hc.Length=int64(len(header))
+	return nil
+}
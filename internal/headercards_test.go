@@ -0,0 +1,58 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHeaderCardsEdit(t *testing.T) {
+	dir, err:=ioutil.TempDir("", "nlheader")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+
+	img:=FITSImage{Header: NewFITSHeader(), Naxisn: []int32{4, 3}, Pixels: 12, Data: make([]float32, 12), Exposure: 60}
+	for i:=range img.Data { img.Data[i]=float32(i) }
+	fileName:=filepath.Join(dir, "a.fits")
+	if err:=img.WriteFile(fileName); err!=nil { t.Fatal(err) }
+
+	hc, err:=ReadHeaderCards(fileName)
+	if err!=nil { t.Fatal(err) }
+	long:="a long object name with 'quotes' which needs several continuation cards to fit into the header"
+	for key, value:=range map[string]string{"filter": "Ha", "OBJECT": long, "EXPOSURE": "300", "CCD-TEMP": "-10.5", "NUMSTR": "'42'"} {
+		if err:=hc.Set(key, value); err!=nil { t.Fatal(err) }
+	}
+	if _, err:=hc.Delete("BZERO"); err!=nil { t.Fatal(err) }
+	if err:=hc.Set("NAXIS2", "1"); err==nil { t.Errorf("expected error for structural key") }
+	if err:=hc.WriteToFile(fileName); err!=nil { t.Fatal(err) }
+
+	hc, err=ReadHeaderCards(fileName)
+	if err!=nil { t.Fatal(err) }
+	for key, want:=range map[string]string{"FILTER": "Ha", "OBJECT": long, "EXPOSURE": "300", "CCD-TEMP": "-10.5", "NUMSTR": "42"} {
+		if got, ok:=hc.Get(key); !ok || got!=want { t.Errorf("%s: got '%s' want '%s'", key, got, want) }
+	}
+	if _, ok:=hc.Get("BZERO"); ok { t.Errorf("BZERO not deleted") }
+
+	res:=NewFITSImage()
+	if err:=res.ReadFile(fileName); err!=nil { t.Fatal(err) }
+	if res.Exposure!=300 { t.Errorf("exposure got %g want 300", res.Exposure) }
+	for i, d:=range res.Data {
+		if d!=float32(i) { t.Fatalf("data %d got %g want %d", i, d, i) }
+	}
+}
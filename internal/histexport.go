@@ -0,0 +1,138 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Number of bins of exported histograms
+const HistogramExportBins = 256
+
+// A binned histogram of one channel of an image, for export to external quality assurance
+type ExportedHistogram struct {
+	Name           string  `json:"name"`                     // Name of the image, e.g. light, stack or output
+	ID             int     `json:"id"`                       // Frame ID for light frames, else -1
+	File           string  `json:"file,omitempty"`           // File name of the image, if any
+	Channel        int     `json:"channel"`                  // Channel of the image
+	Min            float32 `json:"min"`                      // Lower bound of the first bin
+	Max            float32 `json:"max"`                      // Upper bound of the last bin
+	Location       float32 `json:"location"`                 // Location estimate of the channel
+	Scale          float32 `json:"scale"`                    // Scale estimate of the channel
+	TargetLocation float32 `json:"targetLocation,omitempty"` // Target location of automatic curves adjustment, if any
+	TargetScale    float32 `json:"targetScale,omitempty"`    // Target scale of automatic curves adjustment, if any
+	Counts         []int64 `json:"counts"`                   // Number of values per bin. NaNs are skipped, values out of range go to the outer bins
+}
+
+// Calculates a binned histogram of the given data between min and max. Skips NaNs, and
+// counts values out of range in the outer bins
+func NewExportedHistogram(name string, id int, file string, channel int, data []float32, min, max, loc, scale float32) *ExportedHistogram {
+	h:=&ExportedHistogram{Name: name, ID: id, File: file, Channel: channel, Min: min, Max: max, Location: loc, Scale: scale,
+	                      Counts: make([]int64, HistogramExportBins)}
+	factor:=float32(0)
+	if max>min { factor=HistogramExportBins/(max-min) }
+	for _, d:=range data {
+		if math.IsNaN(float64(d)) { continue }
+		bin:=int((d-min)*factor)
+		if bin<0 { bin=0 } else if bin>=HistogramExportBins { bin=HistogramExportBins-1 }
+		h.Counts[bin]++
+	}
+	return h
+}
+
+// A set of histograms for export, collected from the inputs and outputs of a command. Safe for concurrent use
+type HistogramSet struct {
+	mutex      sync.Mutex
+	Histograms []*ExportedHistogram
+}
+
+// Creates a new empty histogram set
+func NewHistogramSet() *HistogramSet {
+	return &HistogramSet{}
+}
+
+// Adds histograms of all channels of the given image under the given name and frame ID, using -1 for images
+// other than light frames. Bins span each channel's range. Uses location and scale from the image statistics
+// for single channel images, else calculates them per channel with the given estimator
+func (s *HistogramSet) AddImage(name string, id int, f *FITSImage, lsEst LSEstimatorMode) error {
+	width, size:=f.Naxisn[0], int(f.Naxisn[0])*int(f.Naxisn[1])
+	for c:=0; (c+1)*size<=len(f.Data); c++ {
+		data:=f.Data[c*size:(c+1)*size]
+		stats:=f.Stats
+		if stats==nil || len(f.Data)>size {
+			var err error
+			if stats, err=CalcExtendedStats(data, width, lsEst); err!=nil { return err }
+		}
+		s.Add(NewExportedHistogram(name, id, f.FileName, c, data, stats.Min, stats.Max, stats.Location, stats.Scale))
+	}
+	return nil
+}
+
+// Adds the given histogram to the set
+func (s *HistogramSet) Add(h *ExportedHistogram) {
+	s.mutex.Lock()
+	s.Histograms=append(s.Histograms, h)
+	s.mutex.Unlock()
+}
+
+// Writes the histograms of the set to the given file, as JSON if the name ends in .json, else as CSV
+// with one row per bin. Light frames come first in order of IDs, followed by other images in order of addition
+func (s *HistogramSet) WriteFile(fileName string) error {
+	s.mutex.Lock()
+	hs:=append([]*ExportedHistogram(nil), s.Histograms...)
+	s.mutex.Unlock()
+	key:=func(h *ExportedHistogram) int {
+		if h.ID<0 { return math.MaxInt32 }
+		return h.ID
+	}
+	sort.SliceStable(hs, func(i, j int) bool { return key(hs[i])<key(hs[j]) })
+
+	if strings.ToLower(filepath.Ext(fileName))==".json" {
+		return WriteFileAtomic(fileName, func(w io.Writer) error {
+			bytes, err:=json.MarshalIndent(hs, "", "  ")
+			if err!=nil { return err }
+			_, err=w.Write(bytes)
+			return err
+		})
+	}
+
+	return WriteFileAtomic(fileName, func(w io.Writer) error {
+		cw:=csv.NewWriter(w)
+		header:=[]string{"name", "id", "file", "channel", "bin", "lower", "upper", "count", "location", "scale", "targetLocation", "targetScale"}
+		if err:=cw.Write(header); err!=nil { return err }
+		ff:=func(f float32) string { return strconv.FormatFloat(float64(f), 'g', 6, 32) }
+		for _, h:=range hs {
+			width:=(h.Max-h.Min)/HistogramExportBins
+			for b, count:=range h.Counts {
+				row:=[]string{h.Name, strconv.Itoa(h.ID), h.File, strconv.Itoa(h.Channel), strconv.Itoa(b),
+				              ff(h.Min+float32(b)*width), ff(h.Min+float32(b+1)*width), strconv.FormatInt(count, 10),
+				              ff(h.Location), ff(h.Scale), ff(h.TargetLocation), ff(h.TargetScale)}
+				if err:=cw.Write(row); err!=nil { return err }
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportedHistogram(t *testing.T) {
+	data:=[]float32{0, 0.5, 1, 1, -5, 7, float32(math.NaN())}
+	h:=NewExportedHistogram("test", -1, "", 0, data, 0, 1, 0.5, 0.1)
+	sum:=int64(0)
+	for _, c:=range h.Counts { sum+=c }
+	if sum!=6 || h.Counts[0]!=2 || h.Counts[HistogramExportBins/2]!=1 || h.Counts[HistogramExportBins-1]!=3 {
+		t.Errorf("NewExportedHistogram: got sum %d first %d mid %d last %d, expected 6 2 1 3", sum, h.Counts[0], h.Counts[HistogramExportBins/2], h.Counts[HistogramExportBins-1])
+	}
+}
+
+func TestHistogramSetWriteFile(t *testing.T) {
+	width, height:=int32(16), int32(16)
+	rgb:=&FITSImage{Naxisn: []int32{width, height, 3}, Data: make([]float32, width*height*3)}
+	for i:=range rgb.Data { rgb.Data[i]=float32(i%97) }
+	light:=&FITSImage{ID: 3, FileName: "l3.fits", Naxisn: []int32{width, height}, Data: rgb.Data[:width*height]}
+	light.Stats, _=CalcExtendedStats(light.Data, width, LSEMedianMAD)
+
+	s:=NewHistogramSet()
+	if err:=s.AddImage("output", -1, rgb, LSEMedianMAD); err!=nil { t.Fatal(err) }
+	if err:=s.AddImage("light", light.ID, light, LSEMedianMAD); err!=nil { t.Fatal(err) }
+	if len(s.Histograms)!=4 { t.Fatalf("AddImage: got %d histograms, expected 4", len(s.Histograms)) }
+
+	dir, err:=ioutil.TempDir("", "nightlight")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+
+	jsonName:=filepath.Join(dir, "hist.json")
+	if err:=s.WriteFile(jsonName); err!=nil { t.Fatal(err) }
+	bytes, err:=ioutil.ReadFile(jsonName)
+	if err!=nil { t.Fatal(err) }
+	var hs []ExportedHistogram
+	if err:=json.Unmarshal(bytes, &hs); err!=nil { t.Fatal(err) }
+	if len(hs)!=4 || hs[0].Name!="light" || hs[0].File!="l3.fits" || hs[3].Channel!=2 {
+		t.Errorf("WriteFile: got unexpected JSON order or content %v", hs)
+	}
+
+	csvName:=filepath.Join(dir, "hist.csv")
+	if err:=s.WriteFile(csvName); err!=nil { t.Fatal(err) }
+	f, err:=os.Open(csvName)
+	if err!=nil { t.Fatal(err) }
+	defer f.Close()
+	rows, err:=csv.NewReader(f).ReadAll()
+	if err!=nil { t.Fatal(err) }
+	if len(rows)!=1+4*HistogramExportBins || rows[1][0]!="light" || rows[1][1]!="3" {
+		t.Errorf("WriteFile: got %d CSV rows starting with %v", len(rows), rows[1])
+	}
+}
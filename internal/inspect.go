@@ -0,0 +1,171 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+
+// A spatial map of a per-star metric across the field, binning detected stars into a grid of cells.
+// Mapping the HFR reveals sensor tilt, backfocus and coma, which make stars grow towards one side,
+// towards all corners, or towards the center
+type StarFieldMap struct {
+	Name   string     // Name of the metric, for log output
+	Cols   int32      // Number of cells horizontally
+	Rows   int32      // Number of cells vertically
+	Values []float32  // Median metric of the stars in each cell, row by row. NaN if the cell has no stars
+	Counts []int32    // Number of stars in each cell
+}
+
+// Creates a map of the given metric for stars detected in an image of the given size, binned into a grid of the given number of cells
+func NewStarFieldMap(name string, stars []Star, width, height, cols, rows int32, metric func(s *Star) float32) (m *StarFieldMap, err error) {
+	if cols<1 || rows<1 || cols>width || rows>height {
+		return nil, errors.New(fmt.Sprintf("Invalid grid of %dx%d cells for image size %dx%d", cols, rows, width, height))
+	}
+	numCells:=int(cols)*int(rows)
+	m=&StarFieldMap{Name: name, Cols: cols, Rows: rows, Values: make([]float32, numCells), Counts: make([]int32, numCells)}
+
+	// bin metrics of stars by cell
+	binned:=make([][]float32, numCells)
+	for i:=range stars {
+		s:=&stars[i]
+		col:=int32(s.X*float32(cols)/float32(width))
+		row:=int32(s.Y*float32(rows)/float32(height))
+		if col<0 || col>=cols || row<0 || row>=rows { continue }
+		cell:=row*cols+col
+		binned[cell]=append(binned[cell], metric(s))
+	}
+
+	// take the median per cell, which is robust against misdetections
+	for i, b:=range binned {
+		m.Counts[i]=int32(len(b))
+		if len(b)==0 {
+			m.Values[i]=float32(math.NaN())
+		} else {
+			m.Values[i]=QSelectMedianFloat32(b)
+		}
+	}
+	return m, nil
+}
+
+// Returns the value of the cell at the given column and row
+func (m *StarFieldMap) At(col, row int32) float32 {
+	return m.Values[row*m.Cols+col]
+}
+
+// Returns the values of the four corner cells, in the order top left, top right, bottom left and bottom right
+func (m *StarFieldMap) Corners() [4]float32 {
+	return [4]float32{m.At(0, 0), m.At(m.Cols-1, 0), m.At(0, m.Rows-1), m.At(m.Cols-1, m.Rows-1)}
+}
+
+// Returns the value of the central cell, or the average of the central cells for even grid sizes. NaN if any is empty
+func (m *StarFieldMap) Center() float32 {
+	c0, c1:=(m.Cols-1)/2, m.Cols/2
+	r0, r1:=(m.Rows-1)/2, m.Rows/2
+	return (m.At(c0, r0)+m.At(c1, r0)+m.At(c0, r1)+m.At(c1, r1))/4
+}
+
+// Returns the ratio of the average corner value to the center value. For the HFR, values well above 1 indicate
+// field curvature or a wrong backfocus distance, values well below 1 are rare and hint at a focus offset. NaN if cells are empty
+func (m *StarFieldMap) Curvature() float32 {
+	c:=m.Corners()
+	return (c[0]+c[1]+c[2]+c[3])/(4*m.Center())
+}
+
+// Returns the differences between the right and left, and the bottom and top corner values, relative to the
+// average corner value. For the HFR, values well away from 0 indicate a sensor tilt in that direction. NaN if cells are empty
+func (m *StarFieldMap) Tilt() (tiltX, tiltY float32) {
+	c:=m.Corners()
+	avg:=(c[0]+c[1]+c[2]+c[3])/4
+	tiltX=((c[1]+c[3])-(c[0]+c[2]))/(2*avg)
+	tiltY=((c[2]+c[3])-(c[0]+c[1]))/(2*avg)
+	return tiltX, tiltY
+}
+
+// Pretty print the map as table of values per cell, with the number of stars in parentheses
+func (m *StarFieldMap) String() string {
+	sb:=strings.Builder{}
+	for row:=int32(0); row<m.Rows; row++ {
+		for col:=int32(0); col<m.Cols; col++ {
+			i:=row*m.Cols+col
+			fmt.Fprintf(&sb, " %6.3g (%4d)", m.Values[i], m.Counts[i])
+		}
+		sb.WriteString("\n")
+	}
+	tiltX, tiltY:=m.Tilt()
+	fmt.Fprintf(&sb, "%s center %.3g corners %.3g curvature %.3g tiltX %+.3g tiltY %+.3g\n", m.Name, m.Center(), m.Corners(), m.Curvature(), tiltX, tiltY)
+	return sb.String()
+}
+
+// Returns the map as a monochrome FITS image with one pixel per cell
+func (m *StarFieldMap) FITS() *FITSImage {
+	return &FITSImage{
+		Header: NewFITSHeader(),
+		Bitpix: -32,
+		Bzero : 0,
+		Naxisn: []int32{m.Cols, m.Rows},
+		Pixels: m.Cols*m.Rows,
+		Data  : append([]float32(nil), m.Values...), // clone slice
+		Trans : IdentityTransform2D(),
+	}
+}
+
+// Renders the map as a color heatmap normalized to [0,1] for 8-bit export, with the given number of pixels per cell.
+// Maps the smallest value to blue, the middle to green and the largest value to red. Empty cells are gray
+func (m *StarFieldMap) Heatmap(cellSize int32) *FITSImage {
+	min, max:=float32(math.MaxFloat32), float32(-math.MaxFloat32)
+	for _, v:=range m.Values {
+		if math.IsNaN(float64(v)) { continue }
+		if v<min { min=v }
+		if v>max { max=v }
+	}
+	if max<=min { max=min+1 }
+
+	width, height:=m.Cols*cellSize, m.Rows*cellSize
+	size:=int(width)*int(height)
+	data:=make([]float32, 3*size)
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			r, g, b:=heatmapColor(m.At(x/cellSize, y/cellSize), min, max)
+			i:=int(y)*int(width)+int(x)
+			data[i], data[i+size], data[i+2*size]=r, g, b
+		}
+	}
+	return &FITSImage{
+		Header: NewFITSHeader(),
+		Bitpix: -32,
+		Bzero : 0,
+		Naxisn: []int32{width, height, 3},
+		Pixels: width*height*3,
+		Data  : data,
+		Trans : IdentityTransform2D(),
+	}
+}
+
+// Maps the given value within [min,max] to a color from blue via green to red. NaN is mapped to gray
+func heatmapColor(v, min, max float32) (r, g, b float32) {
+	if math.IsNaN(float64(v)) { return 0.5, 0.5, 0.5 }
+	t:=(v-min)/(max-min)
+	if t<0.5 {
+		return 0, 2*t, 1-2*t
+	}
+	return 2*t-1, 2-2*t, 0
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStarFieldMap(t *testing.T) {
+	// stars on a regular grid, growing from left to right like with a tilted sensor
+	width, height:=int32(300), int32(300)
+	stars:=[]Star{}
+	for y:=float32(10); y<float32(height); y+=20 {
+		for x:=float32(10); x<float32(width); x+=20 {
+			stars=append(stars, Star{X: x, Y: y, HFR: 2+x/float32(width)})
+		}
+	}
+	m, err:=NewStarFieldMap("HFR", stars, width, height, 3, 3, func(s *Star) float32 { return s.HFR })
+	if err!=nil { t.Fatal(err) }
+	if m.Counts[0]!=25 || m.Counts[8]!=25 { t.Errorf("counts %v; want 25 per cell", m.Counts) }
+	tiltX, tiltY:=m.Tilt()
+	if tiltX<0.2 || tiltX>0.3 { t.Errorf("tiltX %f; want about 0.27", tiltX) }
+	if tiltY!=0 { t.Errorf("tiltY %f; want 0", tiltY) }
+	if c:=m.Curvature(); c<0.99 || c>1.01 { t.Errorf("curvature %f; want 1", c) }
+
+	heat:=m.Heatmap(4)
+	if !EqualInt32Slice(heat.Naxisn, []int32{12, 12, 3}) || len(heat.Data)!=12*12*3 { t.Errorf("heatmap size %v", heat.Naxisn) }
+	if heat.Data[0]!=0 || heat.Data[2*144]!=1 { t.Errorf("smallest value not blue") }
+	if heat.Data[11]!=1 || heat.Data[2*144+11]!=0 { t.Errorf("largest value not red") }
+
+	// empty cells are NaN
+	m, err=NewStarFieldMap("HFR", stars[:1], width, height, 3, 3, func(s *Star) float32 { return s.HFR })
+	if err!=nil { t.Fatal(err) }
+	if !math.IsNaN(float64(m.Values[1])) || !math.IsNaN(float64(m.Center())) { t.Errorf("empty cells %v; want NaN", m.Values) }
+
+	if _, err=NewStarFieldMap("HFR", stars, width, height, 0, 3, nil); err==nil { t.Errorf("0 columns accepted; want error") }
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+
+// A cache for convolution kernels, masks and structuring elements, which depend only on their parameters.
+// Avoids recomputing them for every frame. Cached values are shared across goroutines and must not be modified
+type KernelCache struct {
+	gets      int64  // Number of requests. Accessed atomically
+	hits      int64  // Number of requests served from the cache. Accessed atomically
+
+	mutex     sync.RWMutex
+	items     map[interface{}]interface{}
+}
+
+// Cache for kernels and masks of all frames
+var kernelCache=&KernelCache{}
+
+// Cache keys for the different kinds of cached values
+type gaussKernelKey struct { Sigma float32 }
+type maskKey struct { Width int32; Radius float32 }
+type discKey struct { Radius float32 }
+
+// Returns the cached value for the given key, creating it with the given function if it is not cached yet
+func (c *KernelCache) get(key interface{}, create func() interface{}) interface{} {
+	atomic.AddInt64(&c.gets, 1)
+	c.mutex.RLock()
+	v, ok:=c.items[key]
+	c.mutex.RUnlock()
+	if ok {
+		atomic.AddInt64(&c.hits, 1)
+		return v
+	}
+
+	v=create()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if old, ok:=c.items[key]; ok { return old } // another goroutine was faster
+	if c.items==nil { c.items=make(map[interface{}]interface{}) }
+	c.items[key]=v
+	return v
+}
+
+// Returns the hit rate statistics of the cache
+func (c *KernelCache) Stats() ArrayPoolStats {
+	return ArrayPoolStats{
+		Name : "kernel",
+		Gets : atomic.LoadInt64(&c.gets),
+		Hits : atomic.LoadInt64(&c.hits),
+	}
+}
+
+// Returns a cached 1D gaussian kernel for the given sigma. See GaussianKernel1D. Must not be modified
+func cachedGaussianKernel1D(sigma float32) []float32 {
+	return kernelCache.get(gaussKernelKey{sigma}, func() interface{} { return GaussianKernel1D(sigma) }).([]float32)
+}
+
+// Returns a cached mask of given radius for images of given width. See CreateMask. Must not be modified
+func cachedMask(width int32, radius float32) []int32 {
+	return kernelCache.get(maskKey{width, radius}, func() interface{} { return CreateMask(width, radius) }).([]int32)
+}
+
+// An element of a circular structuring element, with its offset from the center and distance to the center
+type discElement struct {
+	X, Y     int32
+	Distance float32
+}
+
+// Returns a cached circular structuring element of given radius, in row-major order. Must not be modified
+func cachedDisc(radius float32) []discElement {
+	return kernelCache.get(discKey{radius}, func() interface{} { return createDisc(radius) }).([]discElement)
+}
+
+// Creates a circular structuring element of given radius, in row-major order
+func createDisc(radius float32) (disc []discElement) {
+	rad:=int32(radius)
+	for y:=-rad; y<=rad; y++ {
+		for x:=-rad; x<=rad; x++ {
+			distance:=float32(math.Sqrt(float64(x*x+y*y)))
+			if distance>radius+1e-8 { continue }
+			disc=append(disc, discElement{x, y, distance})
+		}
+	}
+	return disc
+}
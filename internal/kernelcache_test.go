@@ -0,0 +1,51 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestKernelCache(t *testing.T) {
+	c:=&KernelCache{}
+	created:=0
+	create:=func() interface{} { created++; return []int32{1, 2, 3} }
+	a:=c.get(maskKey{100, 1.5}, create).([]int32)
+	b:=c.get(maskKey{100, 1.5}, create).([]int32)
+	if &a[0]!=&b[0] || created!=1 { t.Errorf("cached value not reused, created %d times", created) }
+	c.get(maskKey{101, 1.5}, create)
+	if created!=2 { t.Errorf("different key did not create a new value") }
+	if s:=c.Stats(); s.Gets!=3 || s.Hits!=1 { t.Errorf("unexpected stats %+v", s) }
+
+	k1, k2:=cachedGaussianKernel1D(1.5), GaussianKernel1D(1.5)
+	if len(k1)!=len(k2) { t.Errorf("cached kernel %v differs from %v", k1, k2) }
+	for i:=range k1 {
+		if k1[i]!=k2[i] { t.Errorf("cached kernel %v differs from %v", k1, k2); break }
+	}
+	m1, m2:=cachedMask(100, 1.5), CreateMask(100, 1.5)
+	if !EqualInt32Slice(m1, m2) { t.Errorf("cached mask %v differs from %v", m1, m2) }
+}
+
+func TestCreateDisc(t *testing.T) {
+	disc:=createDisc(1.5)
+	if len(disc)!=9 { t.Errorf("disc of radius 1.5 has %d elements, want 9", len(disc)) }
+	disc=createDisc(2)
+	if len(disc)!=13 { t.Errorf("disc of radius 2 has %d elements, want 13", len(disc)) }
+	for _, e:=range disc {
+		if e.Distance>2 { t.Errorf("element %+v outside radius", e) }
+	}
+}
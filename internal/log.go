@@ -19,12 +19,21 @@ package internal
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 )
 
 // Singleton log writer. Writes to stdout, and optionally to a file.
 // Does not add prefixes, or force newlines.
 
+// The console to log into. Stdout, or stderr if stdout carries output data
+var logConsole io.Writer=os.Stdout
+
+// Logs to stderr instead of stdout, so stdout can carry output data
+func LogToStderr() {
+	logConsole=os.Stderr
+}
+
 // The optional additional file to log into
 var logFile   *bufio.Writer
 var logFileOS *os.File
@@ -43,25 +52,27 @@ func LogAlsoToFile(fileName string) (err error) {
 }
 
 func LogPrint(args ...interface{}) (n int, err error) {
-	n, err=fmt.Print(args...)
+	n, err=fmt.Fprint(logConsole, args...)
 	if err!=nil || logFile==nil { return n, err }
 	return fmt.Fprint(logFile, args...)
 }
 
 func LogPrintln(args ...interface{}) (n int, err error) {
-	n, err=fmt.Println(args...)
+	n, err=fmt.Fprintln(logConsole, args...)
 	if err!=nil || logFile==nil { return n, err }
 	return fmt.Fprintln(logFile, args...)
 }
 
 func LogPrintf(format string, args ...interface{}) (n int, err error) {
-	n, err=fmt.Printf(format, args...)
+	n, err=fmt.Fprintf(logConsole, format, args...)
 	if err!=nil || logFile==nil { return n, err }
 	return fmt.Fprintf(logFile, format, args...)
 }
 
+// Logs the arguments, removes temporary files and exits with an error code
 func LogFatal(args ...interface{}) {
-	fmt.Println(args...)
+	RemoveTempFiles()
+	fmt.Fprintln(logConsole, args...)
 	if logFile!=nil { 
 		fmt.Fprint(logFile, args...)
 		logFile.Flush()
@@ -70,8 +81,10 @@ func LogFatal(args ...interface{}) {
 	os.Exit(1)
 }
 
+// Logs the formatted arguments, removes temporary files and exits with an error code
 func LogFatalf(format string, args ...interface{}) {
-	fmt.Printf(format, args...)
+	RemoveTempFiles()
+	fmt.Fprintf(logConsole, format, args...)
 	if logFile!=nil { 
 		fmt.Fprintf(logFile, format, args...)
 		logFile.Flush()
@@ -81,6 +94,7 @@ func LogFatalf(format string, args ...interface{}) {
 }
 
 func LogSync() {
+	if logFile==nil { return }
 	logFile.Flush()
 	logFileOS.Sync()
 }
@@ -0,0 +1,54 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+
+// A capture session with its own calibration frames, for multi-session integration
+type Session struct {
+	Name   string   `json:"name"`    // Name of the session, for log output
+	Dark   string   `json:"dark"`    // Master dark for this session, if any
+	Flat   string   `json:"flat"`    // Master flat for this session, if any
+	Lights []string `json:"lights"`  // Light frame file names for this session. May contain wildcards
+}
+
+// A manifest describing the sessions to integrate, in JSON format. For example:
+//   { "sessions": [ { "name": "night1", "dark": "d1.fits", "flat": "f1.fits", "lights": [ "night1/*.fits" ] } ] }
+type Manifest struct {
+	Sessions []Session `json:"sessions"`
+}
+
+// Loads a manifest from the given JSON file, and validates it
+func LoadManifest(fileName string) (m *Manifest, err error) {
+	bytes, err:=ioutil.ReadFile(fileName)
+	if err!=nil { return nil, err }
+	m=&Manifest{}
+	if err=json.Unmarshal(bytes, m); err!=nil {
+		return nil, errors.New(fmt.Sprintf("Error parsing manifest %s: %s", fileName, err.Error()))
+	}
+	if len(m.Sessions)==0 { return nil, errors.New(fmt.Sprintf("Manifest %s contains no sessions", fileName)) }
+	for i, s:=range m.Sessions {
+		if len(s.Lights)==0 { return nil, errors.New(fmt.Sprintf("Session %d '%s' in manifest %s has no lights", i, s.Name, fileName)) }
+	}
+	return m, nil
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+
+// A mask of sensor regions to exclude from stacking, e.g. a dead sensor corner or persistent amplifier glow.
+// Nonzero mask pixels are replaced with NaN in the selected frames before alignment, so the stack fills
+// these regions from the other frames
+type ExclusionMask struct {
+	Mask *FITSImage     // Mask in sensor coordinates. Nonzero pixels are excluded
+	IDs  map[int]bool   // IDs of the frames to apply the mask to. Nil applies it to all frames
+}
+
+// Loads an exclusion mask from the given FITS file, applying to the frames given as comma-separated
+// list of IDs and ranges, like "0-4,7". An empty list applies the mask to all frames
+func LoadExclusionMask(fileName, frames string) (em *ExclusionMask, err error) {
+	mask:=NewFITSImage()
+	mask.ID=-3
+	if err=mask.ReadFile(fileName); err!=nil { return nil, err }
+	ids, err:=ParseFrameIDs(frames)
+	if err!=nil { return nil, err }
+
+	numMasked:=0
+	for _, m:=range mask.Data {
+		if m!=0 { numMasked++ }
+	}
+	LogPrintf("Exclusion mask %s excludes %d pixels (%.2f%%)\n", fileName, numMasked, float32(numMasked)*100/float32(len(mask.Data)))
+	return &ExclusionMask{Mask: &mask, IDs: ids}, nil
+}
+
+// Parses a comma-separated list of frame IDs and inclusive ranges, like "0-4,7". Returns nil for an empty list
+func ParseFrameIDs(s string) (ids map[int]bool, err error) {
+	s=strings.TrimSpace(s)
+	if s=="" { return nil, nil }
+	ids=make(map[int]bool)
+	for _, term:=range strings.Split(s, ",") {
+		term=strings.TrimSpace(term)
+		fromTo:=strings.SplitN(term, "-", 2)
+		from, err:=strconv.Atoi(strings.TrimSpace(fromTo[0]))
+		if err!=nil { return nil, errors.New(fmt.Sprintf("Invalid frame ID in '%s': %s", term, err.Error())) }
+		to:=from
+		if len(fromTo)==2 {
+			to, err=strconv.Atoi(strings.TrimSpace(fromTo[1]))
+			if err!=nil { return nil, errors.New(fmt.Sprintf("Invalid frame ID in '%s': %s", term, err.Error())) }
+			if to<from { return nil, errors.New(fmt.Sprintf("Invalid frame range '%s'", term)) }
+		}
+		for id:=from; id<=to; id++ {
+			ids[id]=true
+		}
+	}
+	return ids, nil
+}
+
+// Replaces the masked pixels of the given light frame with NaN, if the mask applies to this frame.
+// Returns the number of pixels excluded
+func (em *ExclusionMask) Apply(light *FITSImage) (numExcluded int, err error) {
+	if em.IDs!=nil && !em.IDs[light.ID] { return 0, nil }
+	if !EqualInt32Slice(em.Mask.Naxisn, light.Naxisn) {
+		return 0, errors.New(fmt.Sprintf("%d: Frame size %v differs from exclusion mask size %v", light.ID, light.Naxisn, em.Mask.Naxisn))
+	}
+	nan:=float32(math.NaN())
+	for i, m:=range em.Mask.Data {
+		if m!=0 {
+			light.Data[i]=nan
+			numExcluded++
+		}
+	}
+	return numExcluded, nil
+}
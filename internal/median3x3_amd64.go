@@ -55,3 +55,18 @@ func medianFilter3x3AVX2(output, data []float32, width int32) {
 // Does not touch first and last column. AVX2 implementation
 func medianFilterLine3x3AVX2(output, data []float32, width int64)
 
+
+
+// For each index, moves the lesser value of lo and hi into lo and the greater into hi
+func compareExchange(lo, hi []float32) {
+    if cpuid.CPU.AVX2() {
+        n:=len(lo)&^7
+        compareExchangeAVX2(lo[:n], hi[:n])
+        compareExchangePureGo(lo[n:], hi[n:len(lo)])
+        return
+    }
+    compareExchangePureGo(lo, hi)
+}
+
+// For each index, moves the lesser value of lo and hi into lo and the greater into hi. AVX2 implementation for multiples of 8 values
+func compareExchangeAVX2(lo, hi []float32)
@@ -234,3 +234,35 @@ lineLoopCondition:      // continue while inside the body of the line
 dontFixUpLine:
 
     RET
+
+
+// func compareExchangeAVX2(lo, hi []float32)
+//    0(FP) 8 byte lo pointer
+//    8(FP) 8 byte lo length, multiple of 8
+//   16(FP) 8 byte lo capacity
+//   24(FP) 8 byte hi pointer
+//   32(FP) 8 byte hi length
+//   40(FP) 8 byte hi capacity
+TEXT ·compareExchangeAVX2(SB),(NOSPLIT|NOFRAME),$0-48
+    MOVQ lo_base+0(FP),SI                   // load lo pointer in SI, hi pointer in DI
+    MOVQ hi_base+24(FP),DI
+    MOVQ lo_len+8(FP),DX                    // load end pointer of lo in DX
+    SHLQ $2,DX
+    ADDQ SI,DX
+
+    JMP ceLoopCond
+ceLoopStart:
+    VMOVUPS (SI),Y0                         // load next 8 values of lo and hi
+    VMOVUPS (DI),Y1
+    VMINPS Y1,Y0,Y2                         // lesser values into lo, greater into hi
+    VMAXPS Y1,Y0,Y3
+    VMOVUPS Y2,(SI)
+    VMOVUPS Y3,(DI)
+    ADDQ $32,SI
+    ADDQ $32,DI
+ceLoopCond:
+    CMPQ SI,DX
+    JL   ceLoopStart
+
+    VZEROUPPER
+    RET
@@ -23,3 +23,8 @@ package internal
 func MedianFilter3x3(output, data []float32, width int32) {
     medianFilter3x3PureGo(output, data,width)
 }
+
+// For each index, moves the lesser value of lo and hi into lo and the greater into hi
+func compareExchange(lo, hi []float32) {
+    compareExchangePureGo(lo, hi)
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+
+// Median selection networks for small odd sizes, as lists of compare-exchange operations on index pairs.
+// After applying all operations of a network to an array, its median is in the middle element.
+// From http://ndevilla.free.fr/median/median/src/optmed.c
+var medianNetworks=[...][][2]uint8{
+	3: {{0,1}, {1,2}, {0,1}},
+	5: {{0,1}, {3,4}, {0,3}, {1,4}, {1,2}, {2,3}, {1,2}},
+	7: {{0,5}, {0,3}, {1,6}, {2,4}, {0,1}, {3,5}, {2,6}, {2,3}, {3,6}, {4,5}, {1,4}, {1,3}, {3,4}},
+	9: {{1,2}, {4,5}, {7,8}, {0,1}, {3,4}, {6,7}, {1,2}, {4,5}, {7,8}, {0,3}, {5,8}, {4,7}, {3,6}, {1,4}, {2,5}, {4,7}, {4,2}, {6,4}, {4,2}},
+}
+
+// Returns the median selection network for arrays of the given size, or nil if there is none
+func medianNetwork(n int) [][2]uint8 {
+	if n<0 || n>=len(medianNetworks) { return nil }
+	return medianNetworks[n]
+}
+
+// Calculates the median of a small array of float32 with a median selection network, which must exist for its size.
+// Modifies the elements in place. Array must not contain IEEE NaN
+func medianFloat32Network(a []float32, network [][2]uint8) float32 {
+	for _, p:=range network {
+		i, j:=p[0], p[1]
+		if a[i]>a[j] { a[i], a[j]=a[j], a[i] }
+	}
+	return a[len(a)>>1]
+}
+
+// Calculates the per-pixel median across the given rows of equal length with a median selection network,
+// which must exist for the number of rows. Applies each compare-exchange to entire rows at once, which
+// vectorizes. Stores the result in res. Uses the given scratch space of rows*len(res) values. The result
+// is undefined for pixels where any row holds a NaN
+func medianRowsNetwork(rows [][]float32, network [][2]uint8, res, scratch []float32) {
+	n:=len(res)
+	tmp:=make([][]float32, len(rows))
+	for r, row:=range rows {
+		tmp[r]=scratch[r*n:(r+1)*n]
+		copy(tmp[r], row[:n])
+	}
+	for _, p:=range network {
+		compareExchange(tmp[p[0]], tmp[p[1]])
+	}
+	copy(res, tmp[len(rows)>>1])
+}
+
+// For each index, moves the lesser value of lo and hi into lo and the greater into hi. Pure Go implementation
+func compareExchangePureGo(lo, hi []float32) {
+	hi=hi[:len(lo)]
+	for i, l:=range lo {
+		if h:=hi[i]; l>h { lo[i], hi[i]=h, l }
+	}
+}
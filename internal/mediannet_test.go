@@ -0,0 +1,80 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestMedianNetworks(t *testing.T) {
+	rng:=rand.New(rand.NewSource(1))
+	for _, n:=range []int{3, 5, 7, 9} {
+		network:=medianNetwork(n)
+		if network==nil { t.Fatalf("no network for %d", n) }
+		a, b:=make([]float32, n), make([]float32, n)
+		for trial:=0; trial<2000; trial++ {
+			for i:=range a { a[i]=float32(rng.Intn(5)) }
+			copy(b, a)
+			if got, want:=medianFloat32Network(a, network), QSelectMedianFloat32(b); got!=want {
+				t.Fatalf("n=%d trial %d: got %g want %g", n, trial, got, want)
+			}
+		}
+	}
+	if medianNetwork(4)!=nil || medianNetwork(100)!=nil { t.Errorf("expected no networks for 4 and 100") }
+}
+
+func TestStackMedianNetwork(t *testing.T) {
+	rng:=rand.New(rand.NewSource(2))
+	nan:=float32(math.NaN())
+	for _, n:=range []int{3, 4, 5, 7, 9} {
+		lights:=make([][]float32, n)
+		for l:=range lights {
+			lights[l]=make([]float32, 37)
+			for i:=range lights[l] {
+				lights[l][i]=rng.Float32()
+				if rng.Intn(10)==0 { lights[l][i]=nan }
+			}
+		}
+		res:=make([]float32, 37)
+		StackMedian(lights, -1, res)
+
+		gathered:=make([]float32, 0, n)
+		for i, r:=range res {
+			gathered=gathered[:0]
+			for l:=range lights {
+				if v:=lights[l][i]; !math.IsNaN(float64(v)) { gathered=append(gathered, v) }
+			}
+			want:=float32(-1)
+			if len(gathered)>0 { want=QSelectMedianFloat32(gathered) }
+			if r!=want { t.Errorf("n=%d pixel %d: got %g want %g", n, i, r, want) }
+		}
+	}
+}
+
+func TestQSortFloat32(t *testing.T) {
+	rng:=rand.New(rand.NewSource(3))
+	for _, n:=range []int{0, 1, 2, 11, 12, 13, 100} {
+		a:=make([]float32, n)
+		for i:=range a { a[i]=float32(rng.Intn(20)) }
+		QSortFloat32(a)
+		for i:=1; i<n; i++ {
+			if a[i-1]>a[i] { t.Fatalf("n=%d: not sorted at %d: %v", n, i, a) }
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+
+// Parses a channel mixing matrix with one row per output channel, separated by semicolons, and one
+// comma-separated coefficient per input channel, e.g. "1,0,0.5;0,1,0;0,0,1". Validates the matrix
+// has the given number of rows and columns
+func ParseMixMatrix(s string, rows, cols int) (matrix [][]float32, err error) {
+	rowStrs:=strings.Split(s, ";")
+	if len(rowStrs)!=rows {
+		return nil, errors.New(fmt.Sprintf("Mixing matrix '%s' has %d rows, need %d", s, len(rowStrs), rows))
+	}
+	matrix=make([][]float32, rows)
+	for r, rowStr:=range rowStrs {
+		colStrs:=strings.Split(rowStr, ",")
+		if len(colStrs)!=cols {
+			return nil, errors.New(fmt.Sprintf("Row %d of mixing matrix '%s' has %d coefficients, need %d", r, s, len(colStrs), cols))
+		}
+		matrix[r]=make([]float32, cols)
+		for c, colStr:=range colStrs {
+			f, err:=strconv.ParseFloat(strings.TrimSpace(colStr), 32)
+			if err!=nil { return nil, errors.New(fmt.Sprintf("Invalid coefficient in row %d of mixing matrix: %s", r, err.Error())) }
+			matrix[r][c]=float32(f)
+		}
+	}
+	return matrix, nil
+}
+
+// Linearly combines the given input channels into output channels. Each output channel is the sum of the
+// input channels weighted with the coefficients of its matrix row. Input channels may be nil if their
+// coefficients are all zero. All input channels must have the same dimensions
+func MixChannels(channels []*FITSImage, matrix [][]float32) (res []*FITSImage) {
+	var ref *FITSImage
+	for _, ch:=range channels {
+		if ch!=nil { ref=ch; break }
+	}
+	res=make([]*FITSImage, len(matrix))
+	for r, row:=range matrix {
+		data:=make([]float32, len(ref.Data))
+		exposure:=float32(0)
+		for k, ch:=range channels {
+			w:=row[k]
+			if ch==nil || w==0 { continue }
+			for i, v:=range ch.Data {
+				data[i]+=w*v
+			}
+			exposure+=ch.Exposure
+		}
+		res[r]=&FITSImage{
+			ID      : r,
+			Header  : NewFITSHeader(),
+			Bitpix  : -32,
+			Naxisn  : append([]int32(nil), ref.Naxisn...), // clone slice
+			Pixels  : ref.Pixels,
+			Data    : data,
+			Exposure: exposure,
+			Trans   : IdentityTransform2D(),
+		}
+		res[r].Stats=CalcBasicStats(data)
+	}
+	return res
+}
@@ -0,0 +1,37 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package internal
+
+import (
+	"errors"
+	"os"
+)
+
+
+// True if memory-mapped files are supported on this platform
+const MmapSupported=false
+
+// Maps the first size bytes of the given file into memory. Not supported on this platform
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("Memory-mapped files are not supported on this platform")
+}
+
+// Unmaps memory mapped with mmapFile
+func munmapFile(b []byte) error {
+	return nil
+}
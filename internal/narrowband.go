@@ -0,0 +1,93 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+)
+
+
+// Subtracts the continuum from a narrowband channel, using a broadband channel scaled by the given factor.
+// Only the broadband signal above its background location is subtracted, so the narrowband background
+// level is preserved. Returns a new image with the emission line signal, with stats from the given estimator
+func ContinuumSubtract(narrow, broad *FITSImage, scale float32, lsEst LSEstimatorMode) (res *FITSImage, err error) {
+	data:=make([]float32, len(narrow.Data))
+	broadLoc:=broad.Stats.Location
+	for i, n:=range narrow.Data {
+		data[i]=n-scale*(broad.Data[i]-broadLoc)
+	}
+	res=&FITSImage{
+		ID      : narrow.ID,
+		Header  : NewFITSHeader(),
+		Bitpix  : -32,
+		Naxisn  : append([]int32(nil), narrow.Naxisn...), // clone slice
+		Pixels  : narrow.Pixels,
+		Data    : data,
+		Exposure: narrow.Exposure,
+		Stars   : narrow.Stars,
+		HFR     : narrow.HFR,
+		Trans   : narrow.Trans,
+	}
+	res.Stats, err=CalcExtendedStats(data, res.Naxisn[0], lsEst)
+	return res, err
+}
+
+// Estimates the scale factor for continuum subtraction from field stars. Stars emit mostly continuum,
+// so the ratio of their narrowband flux to their broadband flux measures the relative continuum response of
+// both channels. Fluxes are summed above the background location within twice the half-flux radius of each
+// star. Returns the median ratio across all stars, and the number of stars used
+func EstimateContinuumScale(narrow, broad *FITSImage, stars []Star) (scale float32, numStars int, err error) {
+	width, height:=broad.Naxisn[0], broad.Naxisn[1]
+	narrowLoc, broadLoc:=narrow.Stats.Location, broad.Stats.Location
+	ratios:=make([]float32, 0, len(stars))
+	for _, s:=range stars {
+		radius:=2*s.HFR
+		if radius<2 { radius=2 }
+		r:=int32(radius+0.5)
+		xc, yc:=int32(s.X+0.5), int32(s.Y+0.5)
+		if xc-r<0 || xc+r>=width || yc-r<0 || yc+r>=height { continue }
+
+		narrowFlux, broadFlux:=float32(0), float32(0)
+		for y:=yc-r; y<=yc+r; y++ {
+			for x:=xc-r; x<=xc+r; x++ {
+				dx, dy:=float32(x)-s.X, float32(y)-s.Y
+				if dx*dx+dy*dy>radius*radius { continue }
+				narrowFlux+=narrow.Data[y*width+x]-narrowLoc
+				broadFlux +=broad.Data[y*width+x]-broadLoc
+			}
+		}
+		if broadFlux<=0 || narrowFlux<=0 { continue }
+		ratios=append(ratios, narrowFlux/broadFlux)
+	}
+	if len(ratios)==0 {
+		return 0, 0, errors.New(fmt.Sprintf("Unable to estimate continuum scale, no usable stars among %d", len(stars)))
+	}
+	return QSelectMedianFloat32(ratios), len(ratios), nil
+}
+
+// Blends the signal of a narrowband channel above its background location into the given channel,
+// scaled by the blend factor. Adds emission line detail without shifting the background of the channel
+func BlendNarrowband(dest, narrow *FITSImage, blend float32, lsEst LSEstimatorMode) (err error) {
+	narrowLoc:=narrow.Stats.Location
+	for i, n:=range narrow.Data {
+		dest.Data[i]+=blend*(n-narrowLoc)
+	}
+	dest.Stats, err=CalcExtendedStats(dest.Data, dest.Naxisn[0], lsEst)
+	return err
+}
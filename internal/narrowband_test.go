@@ -0,0 +1,48 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEstimateContinuumScale(t *testing.T) {
+	width, height:=int32(64), int32(64)
+	stars:=[]Star{
+		Star{X:16.2, Y:15.7, HFR:1.5},
+		Star{X:40.5, Y:20.1, HFR:1.5},
+		Star{X:30.0, Y:45.3, HFR:1.5},
+	}
+	broad :=&FITSImage{Naxisn:[]int32{width, height}, Data:make([]float32, width*height), Stats:&BasicStats{Location:100}}
+	narrow:=&FITSImage{Naxisn:[]int32{width, height}, Data:make([]float32, width*height), Stats:&BasicStats{Location:50}}
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			star:=float32(0)
+			for _, s:=range stars {
+				dx, dy:=float32(x)-s.X, float32(y)-s.Y
+				star+=1000*float32(math.Exp(float64(-(dx*dx+dy*dy)/2)))
+			}
+			broad.Data [y*width+x]=100+star
+			narrow.Data[y*width+x]=50+0.3*star
+		}
+	}
+
+	scale, numStars, err:=EstimateContinuumScale(narrow, broad, stars)
+	if err!=nil { t.Fatal(err) }
+	if numStars!=len(stars) { t.Errorf("numStars=%d; want %d", numStars, len(stars)) }
+	if math.Abs(float64(scale-0.3))>1e-4 { t.Errorf("scale=%f; want 0.3", scale) }
+}
@@ -20,6 +20,110 @@ import (
 	"math"
 )
 
+// Noise estimation method
+type NoiseEstimatorMode int
+const (
+	NEImmerkaer NoiseEstimatorMode = iota  // Fast noise variance estimation by Immerkaer. Standard
+	NEWaveletMAD                           // Median absolute deviation of the finest wavelet detail layer. Robust to nebulosity
+	NEBlockKSigma                          // Median of k-sigma clipped standard deviations of small blocks. Robust to nebulosity
+)
+
+// Block size in pixels and clipping sigma for block-based noise estimation
+const noiseBlockSize  = 16
+const noiseBlockSigma = 3
+
+// Estimate the level of gaussian noise on a natural image, with the given method.
+// Unlike the standard method, the alternatives skip NaNs, e.g. from out of bounds areas of aligned frames
+func EstimateNoise(data []float32, width int32, mode NoiseEstimatorMode) float32 {
+	switch mode {
+	case NEWaveletMAD:
+		return EstimateNoiseWaveletMAD(data, width)
+	case NEBlockKSigma:
+		return EstimateNoiseBlockKSigma(data, width)
+	}
+	return estimateNoiseImmerkaer(data, width)
+}
+
+// Estimate the level of gaussian noise from the median absolute deviation of the finest layer of the
+// B3 spline a trous wavelet transform. Stars and nebulosity are mostly in coarser layers and barely affect it
+func EstimateNoiseWaveletMAD(data []float32, width int32) float32 {
+	layers, _:=WaveletDecompose(data, int(width), 1)
+	abs:=layers[0][:0]  // reuse buffer
+	for _, l:=range layers[0] {
+		if !math.IsNaN(float64(l)) { abs=append(abs, float32(math.Abs(float64(l)))) }
+	}
+	if len(abs)==0 { return 0 }
+	return QSelectMedianFloat32(abs)/(0.6745*waveletNoiseB3[0])
+}
+
+// Estimate the level of gaussian noise as the median of the standard deviations of small blocks of the image,
+// each with a linear gradient removed and iteratively clipped at k sigma. Stars are clipped, and smooth
+// nebulosity is mostly removed with the gradient
+func EstimateNoiseBlockKSigma(data []float32, width int32) float32 {
+	height:=int32(len(data))/width
+	xs, ys:=make([]float32, noiseBlockSize*noiseBlockSize), make([]float32, noiseBlockSize*noiseBlockSize)
+	vs:=make([]float32, noiseBlockSize*noiseBlockSize)
+	sigmas:=[]float32{}
+	for y0:=int32(0); y0+noiseBlockSize<=height; y0+=noiseBlockSize {
+		for x0:=int32(0); x0+noiseBlockSize<=width; x0+=noiseBlockSize {
+			// gather valid values of this block
+			num:=0
+			for y:=int32(0); y<noiseBlockSize; y++ {
+				for x:=int32(0); x<noiseBlockSize; x++ {
+					v:=data[(y0+y)*width+x0+x]
+					if math.IsNaN(float64(v)) { continue }
+					xs[num], ys[num], vs[num]=float32(x), float32(y), v
+					num++
+				}
+			}
+			if num<noiseBlockSize*noiseBlockSize/2 { continue }
+			subtractPlane(xs[:num], ys[:num], vs[:num])
+			if sigma:=kSigmaStdDev(vs[:num], noiseBlockSigma); sigma>0 { sigmas=append(sigmas, sigma) }
+		}
+	}
+	if len(sigmas)==0 { return 0 }
+	return QSelectMedianFloat32(sigmas)
+}
+
+// Fits a plane to the values vs at the given coordinates with least squares, and subtracts it from the values
+func subtractPlane(xs, ys, vs []float32) {
+	n:=float64(len(vs))
+	mx, my, mv:=float64(0), float64(0), float64(0)
+	for i:=range vs { mx+=float64(xs[i]); my+=float64(ys[i]); mv+=float64(vs[i]) }
+	mx, my, mv=mx/n, my/n, mv/n
+
+	sxx, syy, sxy, sxv, syv:=float64(0), float64(0), float64(0), float64(0), float64(0)
+	for i:=range vs {
+		dx, dy, dv:=float64(xs[i])-mx, float64(ys[i])-my, float64(vs[i])-mv
+		sxx+=dx*dx; syy+=dy*dy; sxy+=dx*dy; sxv+=dx*dv; syv+=dy*dv
+	}
+	det:=sxx*syy-sxy*sxy
+	a, b:=float64(0), float64(0)
+	if det!=0 {
+		a=(sxv*syy-syv*sxy)/det
+		b=(syv*sxx-sxv*sxy)/det
+	}
+	for i:=range vs {
+		vs[i]=float32(float64(vs[i])-mv-a*(float64(xs[i])-mx)-b*(float64(ys[i])-my))
+	}
+}
+
+// Standard deviation of the given values, iteratively excluding values more than k sigma from the mean
+func kSigmaStdDev(xs []float32, k float32) float32 {
+	mean, stdDev:=MeanStdDev(xs)
+	for iter:=0; iter<10; iter++ {
+		lower, upper:=mean-k*stdDev, mean+k*stdDev
+		num:=0
+		for _, x:=range xs {
+			if x>=lower && x<=upper { xs[num]=x; num++ }
+		}
+		if num==len(xs) || num<2 { break }
+		xs=xs[:num]
+		mean, stdDev=MeanStdDev(xs)
+	}
+	return stdDev
+}
+
 // Weights for noise estimation
 var enWeights []float32 = []float32{
      1, -2,  1,
@@ -20,6 +20,6 @@ package internal
 
 // Estimate the level of gaussian noise on a natural image.
 // From J. Immerkær, “Fast Noise Variance Estimation”, Computer Vision and Image Understanding, Vol. 64, No. 2, pp. 300-302, Sep. 1996
-func EstimateNoise(data []float32, width int32) float32 {
+func estimateNoiseImmerkaer(data []float32, width int32) float32 {
     return estimateNoisePureGo(data, width)
 }
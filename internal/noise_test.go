@@ -0,0 +1,46 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNoiseEstimators(t *testing.T) {
+	width, height:=int32(256), int32(256)
+	data:=make([]float32, width*height)
+	rng:=RNG{42}
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			dx, dy:=float64(x-128), float64(y-128)
+			nebula:=1000*math.Exp(-(dx*dx+dy*dy)/(2*80*80))  // broad bright nebula
+			data[y*width+x]=1000+float32(nebula)+10*rng.NormFloat32()
+		}
+	}
+	for i:=int32(0); i<int32(len(data)); i+=997 { data[i]+=5000 } // hot pixels and faint stars
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<8; x++ { data[y*width+x]=float32(math.NaN()) } // out of bounds border after alignment
+	}
+
+	for _, est:=range []NoiseEstimatorMode{NEWaveletMAD, NEBlockKSigma} {
+		noise:=EstimateNoise(data, width, est)
+		if math.Abs(float64(noise)-10)>1 {
+			t.Errorf("EstimateNoise with estimator %d: got %.3f, expected 10", est, noise)
+		}
+	}
+}
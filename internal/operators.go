@@ -0,0 +1,442 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+
+// Registers the built-in operators
+func init() {
+	RegisterOperator("dark",       func() Operator { return &OpDark{} })
+	RegisterOperator("flat",       func() Operator { return &OpFlat{} })
+	RegisterOperator("badPixels",  func() Operator { return &OpBadPixels{SigmaLow: 3, SigmaHigh: 5, CFA: "RGGB"} })
+	RegisterOperator("debayer",    func() Operator { return &OpDebayer{CFA: "RGGB"} })
+	RegisterOperator("bin",        func() Operator { return &OpBin{N: 2} })
+	RegisterOperator("background", func() Operator { return &OpBackground{Grid: 256, Sigma: 1.5} })
+	RegisterOperator("stars",      func() Operator { return &OpStars{Sigma: 10, BpSigma: 5, Radius: 16, Estimator: LSESCMedianQn} })
+	RegisterOperator("elongation", func() Operator { return &OpElongation{MaxEcc: 0.6} })
+	RegisterOperator("psf",        func() Operator { return &OpPSF{Stars: 25, Radius: 16} })
+	RegisterOperator("trails",     func() Operator { return &OpTrails{Sigma: 3, MinLength: 100} })
+	RegisterOperator("normRange",  func() Operator { return &OpNormRange{Estimator: LSESCMedianQn} })
+	RegisterOperator("histogram",  func() Operator { return &OpHistogram{Mode: HNMLocScale, Estimator: LSESCMedianQn} })
+	RegisterOperator("mask",       func() Operator { return &OpMask{} })
+	RegisterOperator("align",      func() Operator { return &OpAlign{K: 20, Threshold: 1} })
+	RegisterOperator("usm",        func() Operator { return &OpUSM{Sigma: 1, Gain: 1, Thresh: 1, Estimator: LSESCMedianQn} })
+	RegisterOperator("wavelet",    func() Operator { return &OpWavelet{Estimator: LSESCMedianQn} })
+}
+
+
+// Creates the preprocessing pipeline for light frames with the given settings: dark subtraction, flat division,
+// bad pixel removal, debayering, binning, background extraction, statistics and star detection, and range normalization
+func NewPreProcessPipeline(darkF, flatF *FITSImage, debayer, cfa string, binning, normRange int32, bpSigLow, bpSigHigh, 
+	starSig, starBpSig float32, starRadius int32, backGrid int32, backSigma float32, backClip int32, backPattern string, lsEst LSEstimatorMode) *Pipeline {
+	p:=NewPipeline()
+	if darkF!=nil && darkF.Pixels>0 { p.Add("dark", &OpDark{File: darkF.FileName, Dark: darkF}) }
+	if flatF!=nil && flatF.Pixels>0 { p.Add("flat", &OpFlat{File: flatF.FileName, Flat: flatF}) }
+	if bpSigLow!=0 && bpSigHigh!=0  { p.Add("badPixels", &OpBadPixels{SigmaLow: bpSigLow, SigmaHigh: bpSigHigh, Debayer: debayer, CFA: cfa}) }
+	if debayer!=""                  { p.Add("debayer", &OpDebayer{Channel: debayer, CFA: cfa}) }
+	if binning>1                    { p.Add("bin", &OpBin{N: binning}) }
+	if backGrid>0                   { p.Add("background", &OpBackground{Grid: backGrid, Sigma: backSigma, Clip: backClip, Pattern: backPattern}) }
+	p.Add("stars", &OpStars{Sigma: starSig, BpSigma: starBpSig, Radius: starRadius, Estimator: lsEst})
+	if normRange>0                  { p.Add("normRange", &OpNormRange{Estimator: lsEst}) }
+	return p
+}
+
+// Creates the postprocessing pipeline for light frames with the given settings: histogram normalization,
+// exclusion of masked regions, alignment and resampling in the reference frame, unsharp masking and wavelet sharpening
+func NewPostProcessPipeline(aligner *Aligner, histoRef *FITSImage, alignThreshold float32, normalize HistoNormMode, oobMode OutOfBoundsMode, 
+	mask *ExclusionMask, usmSigma, usmGain, usmThresh float32, wavGains []float32, lsEst LSEstimatorMode) *Pipeline {
+	p:=NewPipeline()
+	if normalize==HNMLocScale || normalize==HNMLocBlack { p.Add("histogram", &OpHistogram{Mode: normalize, Estimator: lsEst, Ref: histoRef}) }
+	if mask!=nil                    { p.Add("mask", &OpMask{Mask: mask}) }
+	p.Add("align", &OpAlign{Threshold: alignThreshold, OutOfBounds: oobMode, Aligner: aligner, Ref: histoRef})
+	if usmGain>0                    { p.Add("usm", &OpUSM{Sigma: usmSigma, Gain: usmGain, Thresh: usmThresh, Estimator: lsEst}) }
+	if len(wavGains)>0              { p.Add("wavelet", &OpWavelet{Gains: wavGains, Estimator: lsEst}) }
+	return p
+}
+
+
+// Subtracts a dark frame
+type OpDark struct {
+	File string      `json:"file"`  // Dark frame file, loaded by Init
+	Dark *FITSImage  `json:"-"`     // Dark frame
+}
+
+// Loads the dark frame from file, unless already given
+func (op *OpDark) Init() (err error) {
+	if op.Dark==nil && op.File!="" { op.Dark, err=LoadDark(op.File) }
+	return err
+}
+
+func (op *OpDark) Stage() Stage { return StageCalibrate }
+
+func (op *OpDark) Apply(f *FITSImage) error {
+	if op.Dark==nil || op.Dark.Pixels==0 { return nil }
+	if !EqualInt32Slice(op.Dark.Naxisn, f.Naxisn) { return errors.New("light size differs from dark size") }
+	Subtract(f.Data, f.Data, op.Dark.Data)
+	return nil
+}
+
+
+// Divides by a flat frame, normalized to its mean
+type OpFlat struct {
+	File string      `json:"file"`  // Flat frame file, loaded by Init
+	Flat *FITSImage  `json:"-"`     // Flat frame
+}
+
+// Loads the flat frame from file, unless already given
+func (op *OpFlat) Init() (err error) {
+	if op.Flat==nil && op.File!="" { op.Flat, err=LoadFlat(op.File) }
+	return err
+}
+
+func (op *OpFlat) Stage() Stage { return StageCalibrate }
+
+func (op *OpFlat) Apply(f *FITSImage) error {
+	if op.Flat==nil || op.Flat.Pixels==0 { return nil }
+	if !EqualInt32Slice(op.Flat.Naxisn, f.Naxisn) { return errors.New("light size differs from flat size") }
+	Divide(f.Data, f.Data, op.Flat.Data, op.Flat.Stats.Mean)
+	return nil
+}
+
+
+// Removes bad pixels which deviate from their local median by the given sigmas. Works on the raw color
+// filter array if a debayer channel is given. Keeps the statistics of the deviations for star detection
+type OpBadPixels struct {
+	SigmaLow  float32  `json:"sigmaLow"`   // Low sigma as multiple of standard deviations
+	SigmaHigh float32  `json:"sigmaHigh"`  // High sigma as multiple of standard deviations
+	Debayer   string   `json:"debayer"`    // Channel to be debayered later, one of R, G, B or blank for mono data
+	CFA       string   `json:"cfa"`        // Color filter array type
+}
+
+func (op *OpBadPixels) Stage() Stage { return StageCalibrate }
+
+func (op *OpBadPixels) Apply(f *FITSImage) error {
+	if op.Debayer=="" {
+		var bpm []int32
+		bpm, f.bpStats=BadPixelMap(f.Data, f.Naxisn[0], op.SigmaLow, op.SigmaHigh)
+		mask:=cachedMask(f.Naxisn[0], 1.5)
+		MedianFilterSparse(f.Data, bpm, mask)
+		LogPrintf("%d: Removed %d bad pixels (%.2f%%) with sigma low=%.2f high=%.2f\n", 
+			f.ID, len(bpm), 100.0*float32(len(bpm))/float32(f.Pixels), op.SigmaLow, op.SigmaHigh)
+	} else {
+		numRemoved, err:=CosmeticCorrectionBayer(f.Data, f.Naxisn[0], op.Debayer, op.CFA, op.SigmaLow, op.SigmaHigh)
+		if err!=nil { return err }
+		LogPrintf("%d: Removed %d bad bayer pixels (%.2f%%) with sigma low=%.2f high=%.2f\n", 
+			f.ID, numRemoved, 100.0*float32(numRemoved)/float32(f.Pixels), op.SigmaLow, op.SigmaHigh)
+	}
+	return nil
+}
+
+
+// Debayers the given channel of color filter array data
+type OpDebayer struct {
+	Channel string  `json:"channel"`  // Channel to debayer, one of R, G, B
+	CFA     string  `json:"cfa"`      // Color filter array type, one of RGGB, GRBG, GBRG, BGGR
+}
+
+func (op *OpDebayer) Stage() Stage { return StageCalibrate }
+
+func (op *OpDebayer) Apply(f *FITSImage) (err error) {
+	data, width, err:=DebayerBilinear(f.Data, f.Naxisn[0], op.Channel, op.CFA)
+	if err!=nil { return err }
+	f.releaseData()
+	f.Data, f.Naxisn[0]=data, width
+	f.Pixels=int32(len(f.Data))
+	f.Naxisn[1]=f.Pixels/f.Naxisn[0]
+	LogPrintf("%d: Debayered channel %s from cfa %s, new size %dx%d\n", f.ID, op.Channel, op.CFA, f.Naxisn[0], f.Naxisn[1])
+	return nil
+}
+
+
+// Bins NxN pixels into one
+type OpBin struct {
+	N int32  `json:"n"`  // Binning factor
+}
+
+func (op *OpBin) Stage() Stage { return StageCalibrate }
+
+func (op *OpBin) Apply(f *FITSImage) error {
+	if op.N<=1 { return nil }
+	bpStats:=f.bpStats
+	binned:=BinNxN(f, op.N)
+	f.releaseData()
+	*f=binned
+	f.bpStats=bpStats
+	return nil
+}
+
+
+// Extracts the background on a grid and subtracts it
+type OpBackground struct {
+	Grid    int32    `json:"grid"`     // Grid size in pixels
+	Sigma   float32  `json:"sigma"`    // Sigma for detecting foreground objects
+	Clip    int32    `json:"clip"`     // Number of brightest grid cells to clip and replace with the local median
+	Pattern string   `json:"pattern"`  // If not blank, save the extracted background to a file, plus a false color rendering and cell statistics with the same stem
+}
+
+func (op *OpBackground) Stage() Stage { return StageCalibrate }
+
+func (op *OpBackground) Apply(f *FITSImage) (err error) {
+	bg:=NewBackground(f.Data, f.Naxisn[0], op.Grid, op.Sigma, op.Clip)
+	LogPrintf("%d: %s\n", f.ID, bg)
+
+	if op.Pattern=="" {
+		return bg.Subtract(f.Data)
+	}
+	bgImage:=bg.Render()
+	bgFits:=FITSImage{
+		Header:NewFITSHeader(),
+		Bitpix:-32,
+		Bzero :0,
+		Naxisn:f.Naxisn,
+		Pixels:f.Pixels,
+		Data  :bgImage,
+	}
+	fileName:=fmt.Sprintf(op.Pattern, f.ID)
+	err=bgFits.WriteFile(fileName)
+	if err!=nil { return errors.New(fmt.Sprintf("Error writing file: %s", err)) }
+
+	stem:=strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	err=bg.FalseColor(bgImage).WriteJPGToFile(stem+".jpg", 95, EENone, DINone, nil)
+	if err!=nil { return errors.New(fmt.Sprintf("Error writing file: %s", err)) }
+	err=bg.WriteJSON(stem+".json")
+	if err!=nil { return errors.New(fmt.Sprintf("Error writing file: %s", err)) }
+	Subtract(f.Data, f.Data, bgImage)
+	return nil
+}
+
+
+// Calculates extended statistics, detects stars and records the background level for quality weighting.
+// Star detection is skipped if the sigma is 0, for runs which neither align nor output stars
+type OpStars struct {
+	Sigma     float32          `json:"sigma"`      // Sigma for star detection as multiple of standard deviations. 0=skip star detection
+	BpSigma   float32          `json:"bpSigma"`    // Sigma for star detection bad pixel removal as multiple of standard deviations
+	Radius    int32            `json:"radius"`     // Radius for star detection in pixels
+	Estimator LSEstimatorMode  `json:"estimator"`  // Location and scale estimator
+}
+
+func (op *OpStars) Apply(f *FITSImage) (err error) {
+	f.Stats, err=CalcExtendedStats(f.Data, f.Naxisn[0], op.Estimator)
+	if err!=nil { return err }
+	f.Background=f.Stats.Location
+	if op.Sigma<=0 {
+		LogPrintf("%d: %v\n", f.ID, f.Stats)
+		return nil
+	}
+	f.Stars, _, f.HFR=FindStars(f.Data, f.Naxisn[0], f.Stats.Location, f.Stats.Scale, op.Sigma, op.BpSigma, op.Radius, f.bpStats)
+	ecc, angle, coherence:=StarElongation(f.Stars)
+	LogPrintf("%d: Stars %d HFR %.3g Ecc %.3g Angle %.0f Coherence %.2f %v\n", f.ID, len(f.Stars), f.HFR, ecc, angle, coherence, f.Stats)
+	return nil
+}
+
+
+// Rejects frames whose stars are elongated, e.g. trailed from guiding errors, periodic error or wind.
+// Requires prior star detection. Frames without stars pass
+type OpElongation struct {
+	MaxEcc float32  `json:"maxEcc"`  // Maximum median eccentricity of the stars. 0=no limit
+}
+
+func (op *OpElongation) Apply(f *FITSImage) error {
+	if op.MaxEcc<=0 || len(f.Stars)==0 { return nil }
+	ecc, angle, _:=StarElongation(f.Stars)
+	if ecc>op.MaxEcc {
+		return errors.New(fmt.Sprintf("Rejecting frame as star eccentricity %.3g at angle %.0f is above limit %.3g", ecc, angle, op.MaxEcc))
+	}
+	return nil
+}
+
+
+// Normalizes the value range to [0,1] and updates statistics. Current extended statistics, e.g. from star detection,
+// are scaled along with the data instead of being recalculated
+type OpNormRange struct {
+	Estimator LSEstimatorMode  `json:"estimator"`  // Location and scale estimator
+}
+
+func (op *OpNormRange) Apply(f *FITSImage) (err error) {
+	extended:=f.Stats!=nil
+	if !extended { f.Stats=CalcBasicStats(f.Data) }
+	if f.Stats.Min==f.Stats.Max {
+		LogPrintf("%d: Warning: Image is of uniform intensity %.4g, skipping normalization\n", f.ID, f.Stats.Min)
+		return nil
+	}
+	LogPrintf("%d: Normalizing from [%.4g,%.4g] to [0,1]\n", f.ID, f.Stats.Min, f.Stats.Max)
+	scale:=1.0/(f.Stats.Max-f.Stats.Min)
+	offset:=-f.Stats.Min*scale
+	f.ScaleOffset(scale, offset)
+	if extended {
+		f.Stats.ScaleOffset(scale, offset)
+		return nil
+	}
+	f.Stats, err=CalcExtendedStats(f.Data, f.Naxisn[0], op.Estimator)
+	return err
+}
+
+
+// Normalizes the histogram to match the reference frame
+type OpHistogram struct {
+	Mode      HistoNormMode    `json:"mode"`       // Normalization mode
+	Estimator LSEstimatorMode  `json:"estimator"`  // Location and scale estimator
+	Ref       *FITSImage       `json:"-"`          // Reference frame
+}
+
+func (op *OpHistogram) Stage() Stage { return StageAlign }
+
+func (op *OpHistogram) Apply(f *FITSImage) (err error) {
+	if op.Ref==nil && (op.Mode==HNMLocScale || op.Mode==HNMLocBlack) { return errors.New("No reference frame for histogram normalization") }
+	switch op.Mode {
+		case HNMLocScale:
+			f.MatchHistogram(op.Ref.Stats)
+			LogPrintf("%d: %s\n", f.ID, f.Stats)
+		case HNMLocBlack:
+	    	f.ShiftBlackToMove(f.Stats.Location, op.Ref.Stats.Location)
+	    	f.Stats, err=CalcExtendedStats(f.Data, f.Naxisn[0], op.Estimator)
+	    	if err!=nil { return err }
+			LogPrintf("%d: %s\n", f.ID, f.Stats)
+	}
+	return nil
+}
+
+
+// Excludes masked regions by replacing them with NaN. Resampling and stacking propagate the NaNs,
+// so the stack fills them from other frames
+type OpMask struct {
+	File   string          `json:"file"`    // Mask file, loaded by Init
+	Frames string          `json:"frames"`  // Comma-separated IDs and ranges of the frames to apply the mask to, blank=all
+	Mask   *ExclusionMask  `json:"-"`       // Exclusion mask
+}
+
+// Loads the exclusion mask from file, unless already given
+func (op *OpMask) Init() (err error) {
+	if op.Mask==nil && op.File!="" { op.Mask, err=LoadExclusionMask(op.File, op.Frames) }
+	return err
+}
+
+func (op *OpMask) Stage() Stage { return StageAlign }
+
+func (op *OpMask) Apply(f *FITSImage) error {
+	if op.Mask==nil { return nil }
+	numExcluded, err:=op.Mask.Apply(f)
+	if err!=nil { return err }
+	if numExcluded>0 { LogPrintf("%d: Excluded %d masked pixels\n", f.ID, numExcluded) }
+	return nil
+}
+
+
+// Aligns the image to the reference frame and resamples it into the reference frame. Without
+// aligner, or for the reference frame itself, sets the identity transformation
+type OpAlign struct {
+	K           int32            `json:"k"`            // Number of brightest stars forming triangles for initial alignment
+	Threshold   float32          `json:"threshold"`    // Fail if the alignment residual is greater than this
+	OutOfBounds OutOfBoundsMode  `json:"outOfBounds"`  // Replacement mode for out of bounds values
+	Aligner     *Aligner         `json:"-"`            // Aligner for the reference frame
+	Ref         *FITSImage       `json:"-"`            // Reference frame for out of bounds values
+}
+
+// Sets the reference frame, and creates the aligner for its stars
+func (op *OpAlign) SetReference(ref *FITSImage) {
+	op.Ref, op.Aligner=ref, NewAligner(ref.Naxisn, ref.Stars, op.K)
+}
+
+func (op *OpAlign) Stage() Stage { return StageAlign }
+
+func (op *OpAlign) Apply(f *FITSImage) error {
+	aligner:=op.Aligner
+	if aligner==nil || aligner.RefStars==nil || len(aligner.RefStars)==0 {
+		// Generally not required
+		f.Trans=IdentityTransform2D()
+		return nil
+	} else if len(aligner.RefStars)==len(f.Stars) && (&aligner.RefStars[0]==&f.Stars[0]) {
+		// Not required for reference frame itself
+		f.Trans=IdentityTransform2D()
+		return nil
+	} else if f.Stars==nil || len(f.Stars)==0 {
+		// No stars - skip alignment and warn
+		LogPrintf("%d: warning: no stars found, skipping alignment", f.ID)
+		f.Trans=IdentityTransform2D()
+		return nil
+	}
+
+	// determine out of bounds fill value
+	var outOfBounds float32
+	switch(op.OutOfBounds) {
+		case OOBModeNaN:         outOfBounds=float32(math.NaN())
+		case OOBModeRefLocation:
+			if op.Ref==nil { return errors.New("No reference frame for out of bounds values") }
+			outOfBounds=op.Ref.Stats.Location
+		case OOBModeOwnLocation: outOfBounds=f.Stats.Location
+	}
+
+	// Determine alignment of the image to the reference frame
+	trans, residual:=aligner.Align(f.Naxisn, f.Stars, f.ID)
+	if residual>op.Threshold {
+		return errors.New(fmt.Sprintf("%d:Skipping image as residual %g is above limit %g", f.ID, residual, op.Threshold))
+	}
+	f.Trans, f.Residual=trans, residual
+	LogPrintf("%d: Transform %v; oob %.3g residual %.3g\n", f.ID, f.Trans, outOfBounds, f.Residual)
+
+	// Project image into reference frame
+	projected, err:=f.Project(aligner.Naxisn, trans, outOfBounds)
+	if err!=nil { return err }
+	f.releaseData()
+	*f=*projected
+	return nil
+}
+
+
+// Applies unsharp masking to values above the given threshold
+type OpUSM struct {
+	Sigma     float32          `json:"sigma"`      // Gaussian sigma, ~1/3 radius
+	Gain      float32          `json:"gain"`       // Gain
+	Thresh    float32          `json:"thresh"`     // Threshold in standard deviations above background
+	Estimator LSEstimatorMode  `json:"estimator"`  // Location and scale estimator
+}
+
+func (op *OpUSM) Stage() Stage { return StageAlign }
+
+func (op *OpUSM) Apply(f *FITSImage) (err error) {
+	f.Stats, err=CalcExtendedStats(f.Data, f.Naxisn[0], op.Estimator)
+	if err!=nil { return err }
+	absThresh:=f.Stats.Location + f.Stats.Scale*op.Thresh
+	LogPrintf("%d: Unsharp masking with sigma %.3g gain %.3g thresh %.3g absThresh %.3g\n", f.ID, op.Sigma, op.Gain, op.Thresh, absThresh)
+	f.Data=UnsharpMask(f.Data, int(f.Naxisn[0]), op.Sigma, op.Gain, f.Stats.Min, f.Stats.Max, absThresh)
+	f.Stats=CalcBasicStats(f.Data)
+	return nil
+}
+
+
+// Applies multi-scale wavelet sharpening
+type OpWavelet struct {
+	Gains     []float32        `json:"gains"`      // Gains for wavelet layers of 1, 2, 4... pixels
+	Estimator LSEstimatorMode  `json:"estimator"`  // Location and scale estimator
+}
+
+func (op *OpWavelet) Stage() Stage { return StageAlign }
+
+func (op *OpWavelet) Apply(f *FITSImage) (err error) {
+	f.Stats=CalcBasicStats(f.Data)
+	LogPrintf("%d: Wavelet sharpening with layer gains %v\n", f.ID, op.Gains)
+	f.Data=WaveletSharpen(f.Data, int(f.Naxisn[0]), op.Gains, f.Stats.Min, f.Stats.Max)
+	f.Stats, err=CalcExtendedStats(f.Data, f.Naxisn[0], op.Estimator)
+	return err
+}
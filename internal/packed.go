@@ -0,0 +1,210 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+
+// In-memory storage format for registered light frames awaiting stacking
+type FrameStorage int
+
+const (
+	FSFloat32 FrameStorage = iota  // Full precision 32-bit floating point
+	FSFloat16                      // Half precision 16-bit floating point, offset by the minimum and prescaled by a power of two
+	FSUint16                       // 16-bit unsigned integers, scaled linearly from the minimum to the maximum value
+)
+
+// Marker for NaN values in scaled uint16 storage
+const packedUint16NaN=0xffff
+
+// Returns the number of bytes per pixel for the given storage format
+func (fs FrameStorage) BytesPerPixel() int64 {
+	if fs==FSFloat16 || fs==FSUint16 { return 2 }
+	return 4
+}
+
+// Image data packed into 16 bits per pixel. Unpacked values are Offset+Scale*v, where v is the 
+// half precision value for float16, or the integer value for uint16
+type PackedPixels struct {
+	Format FrameStorage  // Storage format
+	Scale  float32       // Scale factor for unpacking
+	Offset float32       // Offset for unpacking
+	Data   []uint16      // The packed image data
+}
+
+// Lookup table from half precision to single precision floating point values
+var float16Table [1<<16]float32
+
+func init() {
+	for i:=range float16Table {
+		float16Table[i]=float16ToFloat32Slow(uint16(i))
+	}
+}
+
+// Converts a single precision floating point value to half precision, rounding to nearest even.
+// Overflows to infinity, underflows to subnormals or zero, and preserves NaN
+func Float32ToFloat16(f float32) uint16 {
+	b:=math.Float32bits(f)
+	sign:=uint16((b>>16)&0x8000)
+	exp :=int32((b>>23)&0xff)
+	mant:=b&0x7fffff
+	if exp==0xff { // infinity or NaN
+		if mant!=0 { return sign|0x7e00 }
+		return sign|0x7c00
+	}
+	exp-=127-15
+	if exp>=0x1f { return sign|0x7c00 }  // overflow to infinity
+	if exp<=0 {    // subnormal or zero
+		if exp< -10 { return sign }
+		mant|=0x800000
+		shift:=uint32(14-exp)
+		half, rem, halfway:=mant>>shift, mant&((1<<shift)-1), uint32(1)<<(shift-1)
+		if rem>halfway || (rem==halfway && half&1!=0) { half++ }
+		return sign|uint16(half)
+	}
+	half, rem:=uint32(exp)<<10 | mant>>13, mant&0x1fff
+	if rem>0x1000 || (rem==0x1000 && half&1!=0) { half++ }  // carry into the exponent rounds up to infinity correctly
+	return sign|uint16(half)
+}
+
+// Converts a half precision floating point value to single precision. Exact
+func Float16ToFloat32(h uint16) float32 {
+	return float16Table[h]
+}
+
+// Converts a half precision floating point value to single precision, without the lookup table
+func float16ToFloat32Slow(h uint16) float32 {
+	sign:=uint32(h&0x8000)<<16
+	exp :=uint32(h>>10)&0x1f
+	mant:=uint32(h&0x3ff)
+	switch exp {
+	case 0x1f: // infinity or NaN
+		return math.Float32frombits(sign|0x7f800000|mant<<13)
+	case 0:    // subnormal or zero, value is mant*2^-24
+		return math.Float32frombits(sign|math.Float32bits(float32(mant)*(1.0/(1<<24))))
+	default:
+		return math.Float32frombits(sign|(exp+127-15)<<23|mant<<13)
+	}
+}
+
+// Packs the image data into the given storage format, freeing the floating point data. Both formats
+// subtract the minimum first, so values near the background level retain the most precision. Float16 then
+// prescales by a power of two to fit the half precision range, and uint16 scales to the integer range linearly
+func (f *FITSImage) Pack(format FrameStorage) error {
+	if format==FSFloat32 || f.Packed!=nil { return nil }
+	if format!=FSFloat16 && format!=FSUint16 {
+		return errors.New(fmt.Sprintf("%d: Unknown frame storage format %d", f.ID, format))
+	}
+
+	min, max:=float32(math.MaxFloat32), float32(-math.MaxFloat32)
+	for _, d:=range f.Data {
+		if math.IsNaN(float64(d)) || math.IsInf(float64(d), 0) { continue }
+		if d<min { min=d }
+		if d>max { max=d }
+	}
+	if min>max { min, max=0, 0 }  // no valid values
+
+	p:=&PackedPixels{Format: format, Scale: 1, Offset: min, Data: make([]uint16, len(f.Data))}
+	if format==FSFloat16 {
+		exp:=0
+		if max>min { _, exp=math.Frexp(float64(max-min)) }
+		factor:=float32(math.Ldexp(1, 15-exp))  // maps the range into [2^14, 2^15)
+		p.Scale=float32(math.Ldexp(1, exp-15))
+		for i, d:=range f.Data {
+			p.Data[i]=Float32ToFloat16((d-min)*factor)
+		}
+	} else {
+		if max>min { p.Scale=(max-min)/(packedUint16NaN-1) }
+		factor:=1/p.Scale
+		for i, d:=range f.Data {
+			if math.IsNaN(float64(d)) {
+				p.Data[i]=packedUint16NaN
+				continue
+			}
+			v:=(d-min)*factor+0.5
+			if v<0 { v=0 } else if v>packedUint16NaN-1 { v=packedUint16NaN-1 }
+			p.Data[i]=uint16(v)
+		}
+	}
+
+	f.Packed=p
+	f.Data  =nil
+	return nil
+}
+
+// Unpacks the packed values starting at index lower into dst, filling all of dst
+func (p *PackedPixels) Unpack(lower int, dst []float32) {
+	p.unpackValues(p.Data[lower:lower+len(dst)], dst)
+}
+
+// Unpacks the given packed values into dst, which must have the same length
+func (p *PackedPixels) unpackValues(src []uint16, dst []float32) {
+	if p.Format==FSFloat16 {
+		for i, s:=range src {
+			dst[i]=p.Offset+float16Table[s]*p.Scale
+		}
+	} else {
+		nan:=float32(math.NaN())
+		for i, s:=range src {
+			if s==packedUint16NaN {
+				dst[i]=nan
+			} else {
+				dst[i]=p.Offset+float32(s)*p.Scale
+			}
+		}
+	}
+}
+
+// Returns the number of pixel values of the image, whether packed or not
+func (f *FITSImage) numValues() int {
+	if f.Data==nil && f.Compressed!=nil { return f.Compressed.Len }
+	if f.Data==nil && f.Packed!=nil { return len(f.Packed.Data) }
+	return len(f.Data)
+}
+
+// Returns the pixel values of the given lights from lower to upper, for stacking. Uses the floating point
+// data directly where available, else unpacks or decompresses into temporary arrays. Call release once done with the values.
+// Returns an error if a frame fails to decompress, after releasing the temporary arrays
+func gatherLights(lights []*FITSImage, lower, upper int) (ldBatch [][]float32, release func(), err error) {
+	ldBatch=make([][]float32, len(lights))
+	var temps [][]float32
+	release=func() {
+		for _, t:=range temps { PutArrayF32(t) }
+	}
+	for i, l:=range lights {
+		if l.Data!=nil || (l.Packed==nil && l.Compressed==nil) {
+			ldBatch[i]=l.Data[lower:upper]
+			continue
+		}
+		temp:=GetArrayF32(upper-lower)
+		temps=append(temps, temp)
+		if l.Compressed!=nil {
+			if err:=l.Compressed.Unpack(l.Packed, lower, temp); err!=nil {
+				release()
+				return nil, nil, errors.New(fmt.Sprintf("%d: Error decompressing frame: %s", l.ID, err.Error()))
+			}
+		} else {
+			l.Packed.Unpack(lower, temp)
+		}
+		ldBatch[i]=temp
+	}
+	return ldBatch, release, nil
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestFloat16(t *testing.T) {
+	cases:=[]struct{ F float32; H uint16 }{
+		{0, 0x0000}, {1, 0x3c00}, {-2, 0xc000}, {65504, 0x7bff}, {65520, 0x7c00}, {1.0/(1<<24), 0x0001},
+		{1.0/(1<<14), 0x0400}, {1+1.0/2048, 0x3c00}, {1+3.0/2048, 0x3c02}, {float32(math.Inf(-1)), 0xfc00},
+	}
+	for _, c:=range cases {
+		if h:=Float32ToFloat16(c.F); h!=c.H { t.Errorf("Float32ToFloat16(%g)=%#04x; want %#04x", c.F, h, c.H) }
+	}
+	for h:=0; h<1<<16; h++ {
+		f:=Float16ToFloat32(uint16(h))
+		if math.IsNaN(float64(f)) { continue }
+		if back:=Float32ToFloat16(f); back!=uint16(h) { t.Errorf("round trip %#04x -> %g -> %#04x", h, f, back) }
+	}
+	if !math.IsNaN(float64(Float16ToFloat32(Float32ToFloat16(float32(math.NaN()))))) { t.Errorf("NaN not preserved") }
+}
+
+func TestStackPacked(t *testing.T) {
+	nan:=float32(math.NaN())
+	newLights:=func() (lights []*FITSImage) {
+		for i:=0; i<5; i++ {
+			data:=make([]float32, 256)
+			for p:=range data { data[p]=1000+float32(i)*3+float32(p)*0.25 }
+			data[i]=nan
+			lights=append(lights, &FITSImage{ID:i, Naxisn:[]int32{16,16}, Pixels:256, Data:data})
+		}
+		return lights
+	}
+	want, _, _, err:=Stack(context.Background(), newLights(), StMean, nil, 0, 0, 0, 0, 0, false, 32, LSESCMedianQn)
+	if err!=nil { t.Fatal(err) }
+
+	for _, format:=range []FrameStorage{FSFloat16, FSUint16} {
+		lights:=newLights()
+		for _, l:=range lights {
+			if err:=l.Pack(format); err!=nil { t.Fatal(err) }
+			if l.Data!=nil || len(l.Packed.Data)!=256 { t.Fatalf("format %d: frame %d not packed", format, l.ID) }
+		}
+		got, _, _, err:=Stack(context.Background(), lights, StMean, nil, 0, 0, 0, 0, 0, false, 32, LSESCMedianQn)
+		if err!=nil { t.Fatal(err) }
+		for p, w:=range want.Data {
+			if math.Abs(float64(got.Data[p]-w))>0.5 { t.Errorf("format %d: res[%d]=%f; want %f", format, p, got.Data[p], w) }
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	nan:=float32(math.NaN())
+	pixels:=2*compressBlockLen+123 // spans partial blocks
+	newLights:=func() (lights []*FITSImage) {
+		for i:=0; i<3; i++ {
+			data:=make([]float32, pixels)
+			for p:=range data { data[p]=1000+float32(i)*3+float32(p%977)*0.37 }
+			data[i*1000]=nan
+			lights=append(lights, &FITSImage{ID:i, Naxisn:[]int32{int32(pixels),1}, Pixels:int32(pixels), Data:data})
+		}
+		return lights
+	}
+	want, _, _, err:=Stack(context.Background(), newLights(), StMedian, nil, 0, 0, 0, 0, 0, false, 32, LSESCMedianQn)
+	if err!=nil { t.Fatal(err) }
+
+	for _, format:=range []FrameStorage{FSFloat32, FSUint16} {
+		lights, orig:=newLights(), newLights()
+		for _, l:=range lights {
+			if err:=l.Pack(format); err!=nil { t.Fatal(err) }
+			n, err:=l.Compress()
+			if err!=nil { t.Fatal(err) }
+			if l.Data!=nil || (l.Packed!=nil && l.Packed.Data!=nil) || n<=0 { t.Fatalf("format %d: frame %d not compressed", format, l.ID) }
+		}
+
+		// unpack a range crossing a block boundary
+		dst:=make([]float32, 100)
+		if err:=lights[0].Compressed.Unpack(lights[0].Packed, compressBlockLen-50, dst); err!=nil { t.Fatal(err) }
+		for i, d:=range dst {
+			o:=orig[0].Data[compressBlockLen-50+i]
+			if format==FSFloat32 && math.Float32bits(d)!=math.Float32bits(o) { t.Errorf("res[%d]=%f; want %f", i, d, o) }
+			if format==FSUint16  && math.Abs(float64(d-o))>0.5 { t.Errorf("res[%d]=%f; want %f", i, d, o) }
+		}
+
+		got, _, _, err:=Stack(context.Background(), lights, StMedian, nil, 0, 0, 0, 0, 0, false, 32, LSESCMedianQn)
+		if err!=nil { t.Fatal(err) }
+		for p, w:=range want.Data {
+			if format==FSFloat32 && got.Data[p]!=w { t.Fatalf("format %d: res[%d]=%f; want %f", format, p, got.Data[p], w) }
+			if math.Abs(float64(got.Data[p]-w))>0.5 { t.Fatalf("format %d: res[%d]=%f; want %f", format, p, got.Data[p], w) }
+		}
+	}
+}
+
+func TestStackCorruptCompressed(t *testing.T) {
+	lights:=[]*FITSImage{}
+	for i:=0; i<3; i++ {
+		data:=make([]float32, compressBlockLen+10)
+		for p:=range data { data[p]=float32(i+p%100) }
+		l:=&FITSImage{ID:i, Naxisn:[]int32{int32(len(data)),1}, Pixels:int32(len(data)), Data:data}
+		if _, err:=l.Compress(); err!=nil { t.Fatal(err) }
+		lights=append(lights, l)
+	}
+	lights[1].Compressed.Blocks[1]=[]byte{0xff, 0xff, 0xff}
+
+	if _, _, _, err:=Stack(context.Background(), lights, StMean, nil, 0, 0, 0, 0, 0, false, 32, LSESCMedianQn); err==nil {
+		t.Errorf("expected error stacking corrupt compressed frame")
+	}
+	if _, err:=Dispersion(lights, DMStdDev, 32, LSESCMedianQn, nil); err==nil {
+		t.Errorf("expected error for dispersion of corrupt compressed frame")
+	}
+}
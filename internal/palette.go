@@ -0,0 +1,71 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+
+// Indices of narrowband input channels for palette mapping
+const (
+	NBHa   = 0  // Hydrogen alpha
+	NBOIII = 1  // Doubly ionized oxygen
+	NBSII  = 2  // Ionized sulfur
+)
+
+// A narrowband palette. Maps the narrowband channels Ha, OIII and SII to red, green and blue.
+// Each output channel is a weighted sum of the input channels
+type Palette struct {
+	Name string          // Name of the palette, for log output
+	Mix  [3][3]float32   // Weights per output channel R,G,B (rows) and input channel Ha,OIII,SII (columns)
+}
+
+// Returns the named palette preset: SHO (Hubble), HSO, HOS, OHS, or the bicolor HOO. For the bicolor preset,
+// the synthetic green is greenHa*Ha+(1-greenHa)*OIII
+func NewPalette(name string, greenHa float32) (p Palette, err error) {
+	p.Name=strings.ToUpper(name)
+	switch p.Name {
+	case "SHO": p.Mix=[3][3]float32{{0,0,1}, {1,0,0}, {0,1,0}}
+	case "HSO": p.Mix=[3][3]float32{{1,0,0}, {0,0,1}, {0,1,0}}
+	case "HOS": p.Mix=[3][3]float32{{1,0,0}, {0,1,0}, {0,0,1}}
+	case "OHS": p.Mix=[3][3]float32{{0,1,0}, {1,0,0}, {0,0,1}}
+	case "HOO": p.Mix=[3][3]float32{{1,0,0}, {greenHa,1-greenHa,0}, {0,1,0}}
+	default:    return p, errors.New(fmt.Sprintf("Unknown palette '%s', expecting SHO, HSO, HOS, OHS or HOO", name))
+	}
+	return p, nil
+}
+
+// Returns true if the palette uses the SII channel
+func (p Palette) NeedsSII() bool {
+	return p.Mix[0][NBSII]!=0 || p.Mix[1][NBSII]!=0 || p.Mix[2][NBSII]!=0
+}
+
+// Maps the given narrowband channels Ha, OIII and SII to red, green and blue channels with the palette,
+// scaling each output channel with the given weight. The SII channel may be nil if the palette does not use it
+func (p Palette) Apply(channels []*FITSImage, weights [3]float32) (rgb []*FITSImage) {
+	matrix:=make([][]float32, 3)
+	for c:=0; c<3; c++ {
+		matrix[c]=make([]float32, 3)
+		for k:=0; k<3; k++ {
+			matrix[c][k]=p.Mix[c][k]*weights[c]
+		}
+	}
+	return MixChannels(channels, matrix)
+}
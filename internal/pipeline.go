@@ -0,0 +1,186 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+
+// A processing step which modifies a single image in place, e.g. dark subtraction or star detection.
+// Operators are combined into pipelines. Apply may be called concurrently for different images
+type Operator interface {
+	Apply(f *FITSImage) error
+}
+
+// Optional interface for operators which prepare before first use, e.g. by loading a calibration frame.
+// Called once after an operator was created from its JSON parameters
+type OperatorInitializer interface {
+	Init() error
+}
+
+// Optional interface for operators which count towards a stage of the timing telemetry
+type StagedOperator interface {
+	Stage() Stage
+}
+
+// Creates a new operator of a given type with default parameters, to be overwritten from JSON
+type OperatorFactory func() Operator
+
+// Factories for all registered operators, by name
+var operatorFactories=map[string]OperatorFactory{}
+
+// Registers an operator type under the given name, so pipelines can refer to it in JSON. Third parties
+// can add their own operators this way, typically from an init function. Not safe for concurrent use
+func RegisterOperator(name string, factory OperatorFactory) error {
+	if _, ok:=operatorFactories[name]; ok { return errors.New(fmt.Sprintf("Operator '%s' already registered", name)) }
+	operatorFactories[name]=factory
+	return nil
+}
+
+// Returns the names of all registered operators in alphabetical order
+func RegisteredOperators() (names []string) {
+	for name:=range operatorFactories { names=append(names, name) }
+	sort.Strings(names)
+	return names
+}
+
+
+// A step of a pipeline, with the name of the operator type and the operator with its parameters
+type PipelineStep struct {
+	Op       string    // Name of the operator type, as registered
+	Operator Operator  // The operator with its parameters
+}
+
+// JSON representation of a pipeline step
+type pipelineStepJSON struct {
+	Op     string          `json:"op"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Writes the step as JSON object with operator name and parameters
+func (s PipelineStep) MarshalJSON() ([]byte, error) {
+	params, err:=json.Marshal(s.Operator)
+	if err!=nil { return nil, err }
+	return json.Marshal(pipelineStepJSON{Op: s.Op, Params: params})
+}
+
+// Reads the step from a JSON object with operator name and parameters. Creates the operator with the
+// registered factory, overwrites its defaults with the given parameters and initializes it if needed
+func (s *PipelineStep) UnmarshalJSON(bytes []byte) error {
+	var sj pipelineStepJSON
+	if err:=json.Unmarshal(bytes, &sj); err!=nil { return err }
+	factory, ok:=operatorFactories[sj.Op]
+	if !ok { return errors.New(fmt.Sprintf("Unknown operator '%s'", sj.Op)) }
+	op:=factory()
+	if len(sj.Params)>0 {
+		if err:=json.Unmarshal(sj.Params, op); err!=nil {
+			return errors.New(fmt.Sprintf("Invalid parameters for operator '%s': %s", sj.Op, err.Error()))
+		}
+	}
+	if init, ok:=op.(OperatorInitializer); ok {
+		if err:=init.Init(); err!=nil { return err }
+	}
+	s.Op, s.Operator=sj.Op, op
+	return nil
+}
+
+
+// A pipeline of operators, applied to an image in sequence. Steps can be declared in code, reordered,
+// and read from or written to JSON. For example:
+//   { "steps": [ { "op": "dark", "params": { "file": "dark.fits" } },
+//                { "op": "badPixels", "params": { "sigmaLow": 3, "sigmaHigh": 5 } },
+//                { "op": "stars", "params": { "sigma": 10, "bpSigma": 5, "radius": 16 } } ] }
+type Pipeline struct {
+	Steps []PipelineStep `json:"steps"`
+}
+
+// Creates a new, empty pipeline
+func NewPipeline() *Pipeline {
+	return &Pipeline{}
+}
+
+// Appends an operator with the given name to the pipeline. Returns the pipeline, so calls can be chained
+func (p *Pipeline) Add(name string, op Operator) *Pipeline {
+	p.Steps=append(p.Steps, PipelineStep{Op: name, Operator: op})
+	return p
+}
+
+// Returns the index of the first step with the given operator name, or -1 if there is none
+func (p *Pipeline) Find(name string) int {
+	for i, s:=range p.Steps {
+		if s.Op==name { return i }
+	}
+	return -1
+}
+
+// Removes all steps with the given operator name. Returns the number of steps removed
+func (p *Pipeline) Remove(name string) (numRemoved int) {
+	kept:=p.Steps[:0]
+	for _, s:=range p.Steps {
+		if s.Op==name { numRemoved++ } else { kept=append(kept, s) }
+	}
+	p.Steps=kept
+	return numRemoved
+}
+
+// Applies all steps of the pipeline to the given image in sequence. Stops at the first error.
+// Consecutive steps of the same telemetry stage are timed together
+func (p *Pipeline) Apply(f *FITSImage) error {
+	current, stop:=Stage(-1), func() {}
+	defer func() { stop() }()
+	for _, s:=range p.Steps {
+		stage:=Stage(-1)
+		if so, ok:=s.Operator.(StagedOperator); ok { stage=so.Stage() }
+		if stage!=current {
+			stop()
+			current, stop=stage, func() {}
+			if stage>=0 { stop=StartStage(stage) }
+		}
+		if err:=s.Operator.Apply(f); err!=nil { return err }
+	}
+	return nil
+}
+
+// Returns the operator names of the pipeline steps, for log output
+func (p *Pipeline) String() string {
+	names:=make([]string, len(p.Steps))
+	for i, s:=range p.Steps { names[i]=s.Op }
+	return fmt.Sprintf("%v", names)
+}
+
+// Loads a pipeline from the given JSON file, creating and initializing its operators
+func LoadPipeline(fileName string) (p *Pipeline, err error) {
+	bytes, err:=ioutil.ReadFile(fileName)
+	if err!=nil { return nil, err }
+	p=&Pipeline{}
+	if err=json.Unmarshal(bytes, p); err!=nil {
+		return nil, errors.New(fmt.Sprintf("Error parsing pipeline %s: %s", fileName, err.Error()))
+	}
+	return p, nil
+}
+
+// Writes the pipeline to the given JSON file
+func (p *Pipeline) WriteFile(fileName string) error {
+	bytes, err:=json.MarshalIndent(p, "", "  ")
+	if err!=nil { return err }
+	return WriteBytesAtomic(fileName, append(bytes, '\n'))
+}
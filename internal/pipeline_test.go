@@ -0,0 +1,90 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Test operator which adds a constant to all pixels
+type opAddTest struct {
+	Value float32 `json:"value"`
+}
+
+func (op *opAddTest) Apply(f *FITSImage) error {
+	for i:=range f.Data { f.Data[i]+=op.Value }
+	return nil
+}
+
+func TestPipelineJSON(t *testing.T) {
+	if err:=RegisterOperator("addTest", func() Operator { return &opAddTest{} }); err!=nil { t.Fatal(err) }
+	if err:=RegisterOperator("addTest", func() Operator { return &opAddTest{} }); err==nil { t.Errorf("expected error for duplicate registration") }
+
+	p:=NewPipeline().Add("addTest", &opAddTest{Value: 2}).Add("bin", &OpBin{N: 2}).Add("addTest", &opAddTest{Value: 1})
+	bytes, err:=json.Marshal(p)
+	if err!=nil { t.Fatal(err) }
+	want:=`{"steps":[{"op":"addTest","params":{"value":2}},{"op":"bin","params":{"n":2}},{"op":"addTest","params":{"value":1}}]}`
+	if string(bytes)!=want { t.Errorf("got %s, want %s", bytes, want) }
+
+	p2:=&Pipeline{}
+	if err=json.Unmarshal(bytes, p2); err!=nil { t.Fatal(err) }
+	if len(p2.Steps)!=3 || p2.Find("bin")!=1 { t.Fatalf("unexpected steps %v", p2) }
+	if op, ok:=p2.Steps[1].Operator.(*OpBin); !ok || op.N!=2 { t.Errorf("unexpected bin operator %#v", p2.Steps[1].Operator) }
+
+	f:=FITSImage{ Naxisn: []int32{4, 2}, Pixels: 8, Data: []float32{0, 0, 2, 2, 0, 0, 2, 2} }
+	if err=p2.Apply(&f); err!=nil { t.Fatal(err) }
+	if f.Pixels!=2 || f.Data[0]!=3 || f.Data[1]!=5 { t.Errorf("got %d pixels %v, want [3 5]", f.Pixels, f.Data) }
+
+	if n:=p2.Remove("addTest"); n!=2 || len(p2.Steps)!=1 { t.Errorf("removed %d steps, %d left", n, len(p2.Steps)) }
+
+	// defaults apply for parameters not given, and unknown operators are rejected
+	if err=json.Unmarshal([]byte(`{"steps":[{"op":"stars"}]}`), p2); err!=nil { t.Fatal(err) }
+	if op:=p2.Steps[0].Operator.(*OpStars); op.Sigma!=10 || op.Radius!=16 { t.Errorf("unexpected defaults %#v", op) }
+	if err=json.Unmarshal([]byte(`{"steps":[{"op":"nonesuch"}]}`), p2); err==nil { t.Errorf("expected error for unknown operator") }
+}
+
+func TestOpStarsSkip(t *testing.T) {
+	width, height:=int32(128), int32(128)
+	rng:=NewRNG(0)
+	stars:=[]Star{}
+	for y:=float32(24); y<float32(height)-24; y+=40 {
+		for x:=float32(24); x<float32(width)-24; x+=40 { stars=append(stars, Star{X: x+0.3, Y: y+0.6, Value: 10000}) }
+	}
+	f:=SyntheticFrame(0, width, height, stars, 0, 0, syntheticDark(width, height), syntheticFlat(width, height), &rng)
+
+	if err:=(&OpStars{Sigma: 0, Radius: 16, Estimator: LSESCMedianQn}).Apply(f); err!=nil { t.Fatal(err) }
+	if f.Stats==nil || f.Background!=f.Stats.Location || f.Stars!=nil { t.Errorf("sigma 0 should calculate stats only, got stats %v and %d stars", f.Stats, len(f.Stars)) }
+	if err:=(&OpStars{Sigma: 10, BpSigma: 5, Radius: 16, Estimator: LSESCMedianQn}).Apply(f); err!=nil { t.Fatal(err) }
+	if len(f.Stars)==0 { t.Errorf("no stars detected") }
+}
+
+func TestOpElongation(t *testing.T) {
+	// moments of a star trailed diagonally, with major and minor axis variances 7 and 1
+	ecc, angle:=elongationFromMoments(8, 8, 6, 2)
+	if ecc<0.925 || ecc>0.927 || angle<0.785 || angle>0.786 { t.Errorf("ecc %f angle %f; want 0.926 and pi/4", ecc, angle) }
+
+	trailed:=[]Star{{Ecc: 0.9, Angle: 0.785398}, {Ecc: 0.8, Angle: 0.785398}, {Ecc: 0.7, Angle: -2.356194}}
+	ecc, deg, coherence:=StarElongation(trailed)
+	if ecc!=0.8 || deg<44.9 || deg>45.1 || coherence<0.999 { t.Errorf("ecc %f angle %f coherence %f; want 0.8, 45 and 1", ecc, deg, coherence) }
+	crossed:=[]Star{{Ecc: 0.5, Angle: 0}, {Ecc: 0.5, Angle: 1.570796}}
+	if _, _, coherence=StarElongation(crossed); coherence>0.001 { t.Errorf("coherence %f; want 0", coherence) }
+
+	op:=&OpElongation{MaxEcc: 0.6}
+	if err:=op.Apply(&FITSImage{Stars: trailed}); err==nil { t.Errorf("trailed frame accepted; want error") }
+	if err:=op.Apply(&FITSImage{Stars: crossed}); err!=nil { t.Errorf("round frame rejected: %s", err) }
+	if err:=op.Apply(&FITSImage{}); err!=nil { t.Errorf("frame without stars rejected: %s", err) }
+}
@@ -17,6 +17,7 @@
 package internal
 
 import (
+	"context"
 	colorful "github.com/lucasb-eyer/go-colorful"
 	"math"
 	"runtime"
@@ -34,80 +35,62 @@ type PixelFunction func(data []float32, params interface{})
 type PixelFunction3Chan func(c0,c1,c2 []float32, params interface{}) 
 
 
-// Apply given pixel function to the image. Uses thead parallelism across all available CPUs. Operates in-place. 
+// Apply given pixel function to the image. Uses the shared worker pool across all available CPUs. Operates in-place. 
 func (f* FITSImage) ApplyPixelFunction(pf PixelFunction, args interface{}) {
 	data:=f.Data
 
-	// split into 8*NumCPU() work packages, limit parallelism to NumCPUS()
+	// split into 8*NumCPU() work packages on the shared worker pool
 	numBatches:=8*runtime.NumCPU()
 	batchSize :=(len(data)+numBatches-1)/(numBatches)
-	sem       :=make(chan bool, runtime.NumCPU())
+	group     :=DefaultPool.NewGroup(context.Background(), 0)
 	for lower:=0; lower<len(data); lower+=batchSize {
 		upper:=lower+batchSize
 		if upper>len(data) { upper=len(data) }
 
-		sem <- true 
-		go func(data []float32) {
-			pf(data, args)
-			<-sem
-		}(data[lower:upper])
-	}
-
-	for i:=0; i<cap(sem); i++ {  // wait for goroutines to finish
-		sem <- true
+		batch:=data[lower:upper]
+		group.Go(func() { pf(batch, args) })
 	}
+	group.Wait()
 }
 
 
-// Apply given pixel function to given channel of the image. Uses thead parallelism across all available CPUs. Operates in-place. 
+// Apply given pixel function to given channel of the image. Uses the shared worker pool across all available CPUs. Operates in-place. 
 func (f* FITSImage) ApplyPixelFunction1Chan(chanID int, pf PixelFunction, args interface{}) {
 	l   :=len(f.Data)/3
 	data:=f.Data[chanID*l:(chanID+1)*l]
 
-	// split into 8*NumCPU() work packages, limit parallelism to NumCPUS()
+	// split into 8*NumCPU() work packages on the shared worker pool
 	numBatches:=8*runtime.NumCPU()
 	batchSize :=(len(data)+numBatches-1)/(numBatches)
-	sem       :=make(chan bool, runtime.NumCPU())
+	group     :=DefaultPool.NewGroup(context.Background(), 0)
 	for lower:=0; lower<len(data); lower+=batchSize {
 		upper:=lower+batchSize
 		if upper>len(data) { upper=len(data) }
 
-		sem <- true 
-		go func(data []float32) {
-			pf(data, args)
-			<-sem
-		}(data[lower:upper])
-	}
-
-	for i:=0; i<cap(sem); i++ {  // wait for goroutines to finish
-		sem <- true
+		batch:=data[lower:upper]
+		group.Go(func() { pf(batch, args) })
 	}
+	group.Wait()
 }
 
 
-// Apply given pixel function to all channels of the image. Uses thead parallelism across all available CPUs. Data must be normalized to [0,1]. Operates in-place. 
+// Apply given pixel function to all channels of the image. Uses the shared worker pool across all available CPUs. Data must be normalized to [0,1]. Operates in-place. 
 func (f* FITSImage) ApplyPixelFunction3Chan(pf PixelFunction3Chan, args interface{}) {
 	data:=f.Data
 	l   :=len(data)/3
 
-	// split into 8*NumCPU() work packages, limit parallelism to NumCPUS()
+	// split into 8*NumCPU() work packages on the shared worker pool
 	numBatches:=8*runtime.NumCPU()
 	batchSize :=(l+numBatches-1)/(numBatches)
-	sem       :=make(chan bool, runtime.NumCPU())
+	group     :=DefaultPool.NewGroup(context.Background(), 0)
 	for lower:=0; lower<l; lower+=batchSize {
 		upper:=lower+batchSize
 		if upper>l { upper=l }
 
-		sem <- true 
-		go func(c0,c1,c2 []float32) {
-			pf(c0,c1,c2, args)
-			<-sem
-		}(data[lower:upper], data[lower+l:upper+l], data[lower+2*l:upper+2*l])
-	}
-
-	for i:=0; i<cap(sem); i++ {  // wait for goroutines to finish
-		sem <- true
+		c0, c1, c2:=data[lower:upper], data[lower+l:upper+l], data[lower+2*l:upper+2*l]
+		group.Go(func() { pf(c0,c1,c2, args) })
 	}
+	group.Wait()
 }
 
 
@@ -189,6 +172,34 @@ func (f* FITSImage) ApplyPartialGammaToChannel(chanID int, from, to, g float32)
 }
 
 
+// Arguments for the pixel function to apply an arcsinh stretch
+type pfArcsinhArgs struct {
+	Strength float32
+	Black    float32
+}
+
+// Pixel function to apply an arcsinh stretch with given strength to values above the given black point, 
+// mapping [black,1] to [0,1]. Data must be normalized to [0,1]. 2nd parameter must be a pfArcsinhArgs. Operates in-place. 
+func pfArcsinh(data []float32, params interface{}) {
+	strength, black:=float64(params.(pfArcsinhArgs).Strength), params.(pfArcsinhArgs).Black
+	scaler:=1.0/(1.0-black)
+	norm  :=1.0/math.Asinh(strength)
+	for i, d:=range data {
+		if d<=black {
+			data[i]=0
+		} else {
+			data[i]=float32(math.Asinh(strength*float64((d-black)*scaler))*norm)
+		}
+	}
+}
+
+// Apply arcsinh stretch to given channel of given image. Stretching luminance only preserves star color. 
+// Data must be normalized to [0,1]. Operates in-place. 
+func (f* FITSImage) ApplyArcsinhToChannel(chanID int, strength, black float32) {
+	f.ApplyPixelFunction1Chan(chanID, pfArcsinh, pfArcsinhArgs{strength, black})
+}
+
+
 // Arguments for the RGB pixel function to adjust midtones
 type pfMidtonesArgs struct {
 	Mid    float32
@@ -401,6 +412,41 @@ func (f* FITSImage) AdjustChromaForHues(from, to, factor float32) {
 }
 
 
+// Arguments for the RGB pixel function to adjust chroma for a range of luminances
+type pf3ChanChromaForLumsArgs struct {
+	From    float32
+	To      float32
+	Factor  float32
+	Feather float32
+}
+
+// RGB pixel function to adjust chroma for a given range of luminances. Data must be HCL. 2nd parameter must be a pf3ChanChromaForLumsArgs
+func pf3ChanChromaForLums(hs,cs,ls []float32, params interface{}) {
+	args:=params.(pf3ChanChromaForLumsArgs)
+	from, to, factor, feather:=args.From, args.To, args.Factor, args.Feather
+	for i, l:=range ls {
+		// weight is 1 within the range, and ramps down linearly to 0 over the feather width outside it
+		w:=float32(1)
+		if l<from {
+			if feather<=0 || l<=from-feather { continue }
+			w=1-(from-l)/feather
+		} else if l>to {
+			if feather<=0 || l>=to+feather { continue }
+			w=1-(l-to)/feather
+		}
+		c:=cs[i]*(1+w*(factor-1))
+		cs[i]=float32(math.Max(0.0, math.Min(1.0, float64(c))))
+	}
+}
+
+// Selectively adjusts CIE HCL chroma for luminances in given range by multiplying with given factor, 
+// with linear transitions of the given feather width outside the range. Data must be HCL.
+// Useful for boosting nebula color without saturating star cores or amplifying background noise
+func (f* FITSImage) AdjustChromaForLums(from, to, factor, feather float32) {
+	f.ApplyPixelFunction3Chan(pf3ChanChromaForLums, pf3ChanChromaForLumsArgs{from, to, factor, feather})
+}
+
+
 // Arguments for the RGB pixel function to selectively rotate hues in a given range
 type pf3ChanRotateColorsArgs struct {
 	From   float32
@@ -427,17 +473,43 @@ func (f* FITSImage) RotateColors(from, to, offset float32) {
 }
 
 
-// RGB pixel function for subtractive chroma noise reduction on the green color channel. Data must be HCL. 2nd parameter must be a float32
-// Uses average neutral masking method with luminance protection
+// Protection method for subtractive chroma noise reduction
+type SCNRMethod int
+
+const (
+	SCNRAverageNeutral SCNRMethod = iota  // Limit green to the average of red and blue
+	SCNRMaximumNeutral                    // Limit green to the maximum of red and blue. Gentler, preserves more green
+)
+
+// Arguments for the RGB pixel function for subtractive chroma noise reduction
+type pf3ChanSCNRArgs struct {
+	Factor  float32
+	Method  SCNRMethod
+	LumMask float32
+}
+
+// RGB pixel function for subtractive chroma noise reduction on the green color channel. Data must be HCL. 2nd parameter must be a pf3ChanSCNRArgs
+// Uses the given neutral protection method with luminance protection. If the luminance mask exponent is nonzero,
+// the strength is scaled by luminance raised to that exponent, concentrating the correction on bright areas
 func pf3ChanSCNR(hs,cs,ls []float32, params interface{}) {
-	factor:=params.(float32)
+	args:=params.(pf3ChanSCNRArgs)
 	for i:=0; i<len(hs); i++ {
 		h,c,l:=hs[i], cs[i], ls[i]
 		col  :=colorful.Hcl(float64(h), float64(c), float64(l)).Clamped()
 		r,g,b:=col.LinearRgb()
 
-		correctedG:=0.5*(r+b)
-		g2:=float32(math.Min(g, correctedG)) // average neutral SCNR
+		var correctedG float64
+		if args.Method==SCNRMaximumNeutral {
+			correctedG=math.Max(r, b)      // maximum neutral SCNR
+		} else {
+			correctedG=0.5*(r+b)           // average neutral SCNR
+		}
+		g2:=float32(math.Min(g, correctedG))
+
+		factor:=args.Factor
+		if args.LumMask!=0 {
+			factor*=float32(math.Pow(math.Max(0, math.Min(1, float64(l))), float64(args.LumMask)))
+		}
 		weightedG:=factor*g2+(1-factor)*float32(g)
 
 		// reassemble with luminance protection
@@ -448,9 +520,10 @@ func pf3ChanSCNR(hs,cs,ls []float32, params interface{}) {
 }
 
 // Apply subtractive chroma noise reduction to the green channel. Data must be normalized to [0,1]. 
-// Uses average neutral masking method with luminance protection. Typically used to reduce green cast in narrowband immages when creating Hubble palette images
-func (f* FITSImage) SCNR(factor float32) {
-	f.ApplyPixelFunction3Chan(pf3ChanSCNR, factor)
+// Uses the given neutral masking method with luminance protection, and optionally scales the strength with
+// a luminance mask with the given exponent, 0=off. Typically used to reduce green cast in narrowband immages when creating Hubble palette images
+func (f* FITSImage) SCNR(factor float32, method SCNRMethod, lumMask float32) {
+	f.ApplyPixelFunction3Chan(pf3ChanSCNR, pf3ChanSCNRArgs{factor, method, lumMask})
 }
 
 
@@ -0,0 +1,258 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"fmt"
+	"math/bits"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+
+// Array pools for scratch buffers which are needed temporarily for each frame, like star candidates or
+// background cell samples. Reusing them across frames reduces GC pressure. Arrays are binned into
+// power-of-two size classes, so a request can be served by any array at least as large
+const (
+	poolMinClass = 6   // Smaller arrays are cheap to allocate and not pooled
+	poolClasses  = 48  // Number of size classes
+)
+
+// A pool of arrays of element type T, binned into power-of-two size classes.
+// Counts requests and hits, so the pools can be tuned
+type Pool[T any] struct {
+	gets    int64  // Number of requests for pooled size classes. Accessed atomically
+	hits    int64  // Number of requests served from the pool. Accessed atomically
+	puts    int64  // Number of arrays returned to the pool. Accessed atomically
+	drops   int64  // Number of arrays not pooled because they exceed the capacity limit. Accessed atomically
+
+	Name    string // Name of the element type, for log output
+	MaxCap  int    // Largest capacity of arrays kept in the pool, 0=no limit
+
+	classes [poolClasses]sync.Pool
+}
+
+// Hit rate statistics of an array pool
+type ArrayPoolStats struct {
+	Name  string  `json:"name"`   // Name of the element type
+	Gets  int64   `json:"gets"`   // Number of requests for pooled size classes
+	Hits  int64   `json:"hits"`   // Number of requests served from the pool
+	Puts  int64   `json:"puts"`   // Number of arrays returned to the pool
+	Drops int64   `json:"drops"`  // Number of arrays not pooled because they exceed the capacity limit
+}
+
+// Creates a new array pool for the given element type name, keeping arrays up to the given capacity. 0=no limit
+func NewPool[T any](name string, maxCap int) *Pool[T] {
+	return &Pool[T]{Name: name, MaxCap: maxCap}
+}
+
+// Pools for the scratch arrays of star detection and background extraction, by element type
+var poolF32 =NewPool[float32]("float32", 0)
+var poolStar=NewPool[Star]("Star", 0)
+var poolSLI =NewPool[starListItem]("starListItem", 0)
+
+// All pools with statistics, including the frame pool and the kernel cache
+var statsPools=[]interface{ Stats() ArrayPoolStats }{poolF32, poolStar, poolSLI, framePool, kernelCache}
+
+// Returns the size class of the smallest pooled array which can hold n elements
+func poolClassCeil(n int) int {
+	if n<=1 { return 0 }
+	return bits.Len(uint(n-1))
+}
+
+// Returns the size class of the largest requests an array with the given capacity can serve
+func poolClassFloor(c int) int {
+	if c<=0 { return -1 }
+	return bits.Len(uint(c))-1
+}
+
+// Returns an array of length n from the pool, allocating one if none is available. Pooled size classes
+// allocate the full class capacity of 1<<class elements, others exactly n. The contents are undefined
+func (p *Pool[T]) Get(n int) []T {
+	c:=poolClassCeil(n)
+	if c<poolMinClass || c>=poolClasses || (p.MaxCap>0 && 1<<uint(c)>p.MaxCap) { return make([]T, n) }
+	atomic.AddInt64(&p.gets, 1)
+	if a:=p.classes[c].Get(); a!=nil {
+		atomic.AddInt64(&p.hits, 1)
+		return (*a.(*[]T))[:n]
+	}
+	return make([]T, n, 1<<uint(c))
+}
+
+// Returns an array to the pool, binned by the size class its capacity can serve. The caller must not use it afterwards
+func (p *Pool[T]) Put(a []T) {
+	c:=poolClassFloor(cap(a))
+	if c<poolMinClass || c>=poolClasses { return }
+	if p.MaxCap>0 && cap(a)>p.MaxCap {
+		atomic.AddInt64(&p.drops, 1)
+		return
+	}
+	atomic.AddInt64(&p.puts, 1)
+	a=a[:0]
+	p.classes[c].Put(&a)
+}
+
+// Returns the hit rate statistics of the pool
+func (p *Pool[T]) Stats() ArrayPoolStats {
+	return ArrayPoolStats{
+		Name : p.Name,
+		Gets : atomic.LoadInt64(&p.gets),
+		Hits : atomic.LoadInt64(&p.hits),
+		Puts : atomic.LoadInt64(&p.puts),
+		Drops: atomic.LoadInt64(&p.drops),
+	}
+}
+
+// Returns the statistics of all array pools which were used, and of the kernel cache
+func ArrayPoolsStats() (stats []ArrayPoolStats) {
+	for _, p:=range statsPools {
+		s:=p.Stats()
+		if s.Gets>0 || s.Puts>0 { stats=append(stats, s) }
+	}
+	return stats
+}
+
+// Returns a table of the statistics of all array pools which were used, one line per pool
+func ArrayPoolsString() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%-14s %10s %10s %10s %10s\n", "Pool", "Gets", "Hit rate", "Puts", "Drops"))
+	for _, s:=range ArrayPoolsStats() {
+		rate:=float32(0)
+		if s.Gets>0 { rate=float32(s.Hits)*100/float32(s.Gets) }
+		sb.WriteString(fmt.Sprintf("%-14s %10d %9.1f%% %10d %10d\n", s.Name, s.Gets, rate, s.Puts, s.Drops))
+	}
+	return sb.String()
+}
+
+
+// Returns a float32 array of length n from the pool, allocating one if none is available.
+// The contents are undefined. Return it with PutArrayF32 once done
+func GetArrayF32(n int) []float32 {
+	return poolF32.Get(n)
+}
+
+// Returns a float32 array to the pool. The caller must not use it afterwards
+func PutArrayF32(a []float32) {
+	poolF32.Put(a)
+}
+
+// Returns a star array of length n from the pool, allocating one if none is available.
+// The contents are undefined. Return it with PutArrayStar once done
+func GetArrayStar(n int) []Star {
+	return poolStar.Get(n)
+}
+
+// Returns a star array to the pool. The caller must not use it afterwards
+func PutArrayStar(a []Star) {
+	poolStar.Put(a)
+}
+
+// Returns a star list item array of length n from the pool, allocating one if none is available.
+// The contents are undefined
+func getArraySLI(n int) []starListItem {
+	return poolSLI.Get(n)
+}
+
+// Returns a star list item array to the pool. Clears the first n entries, so the pool does not keep
+// the referenced stars alive
+func putArraySLI(a []starListItem, n int) {
+	for i:=0; i<n; i++ { a[i]=starListItem{} }
+	poolSLI.Put(a)
+}
+
+
+// A pool for the pixel data of whole frames, which typically all have the same size within a run. Unlike the
+// scratch array pools, serves arrays of the exact requested length, so no memory is lost to size classes,
+// and keeps at most MaxFrames arrays, which survive garbage collection. Frame data is usually dropped
+// and reallocated once per frame, e.g. when loading and resampling, so one array per thread suffices
+type FramePool struct {
+	gets      int64  // Number of requests. Accessed atomically
+	hits      int64  // Number of requests served from the pool. Accessed atomically
+	puts      int64  // Number of arrays returned to the pool. Accessed atomically
+	drops     int64  // Number of arrays evicted because the pool was full. Accessed atomically
+
+	MaxFrames int    // Maximum number of arrays kept in the pool
+
+	mutex     sync.Mutex
+	free      [][]float32
+}
+
+// Pool for frame data, keeping one frame per thread
+var framePool=&FramePool{MaxFrames: runtime.GOMAXPROCS(0)}
+
+// Returns a float32 array of length n for frame data from the pool, allocating one if none is available.
+// The contents are undefined. Return it with PutFrameF32 once the frame data is no longer referenced
+func GetFrameF32(n int) []float32 {
+	return framePool.get(n)
+}
+
+// Returns an array of frame data to the pool. The caller must not use it afterwards, and must ensure
+// no other references to it remain
+func PutFrameF32(a []float32) {
+	framePool.put(a)
+}
+
+func (p *FramePool) get(n int) []float32 {
+	atomic.AddInt64(&p.gets, 1)
+	p.mutex.Lock()
+	for i, a:=range p.free {
+		if cap(a)==n {
+			p.free[i]=p.free[len(p.free)-1]
+			p.free[len(p.free)-1]=nil
+			p.free=p.free[:len(p.free)-1]
+			p.mutex.Unlock()
+			atomic.AddInt64(&p.hits, 1)
+			return a[:n]
+		}
+	}
+	p.mutex.Unlock()
+	return make([]float32, n)
+}
+
+func (p *FramePool) put(a []float32) {
+	if cap(a)==0 { return }
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.free)>=p.MaxFrames {
+		// drop the oldest array, as frame sizes may have changed since it was pooled
+		atomic.AddInt64(&p.drops, 1)
+		copy(p.free, p.free[1:])
+		p.free=p.free[:len(p.free)-1]
+	}
+	atomic.AddInt64(&p.puts, 1)
+	p.free=append(p.free, a)
+}
+
+// Returns the hit rate statistics of the pool
+func (p *FramePool) Stats() ArrayPoolStats {
+	return ArrayPoolStats{
+		Name : "frame",
+		Gets : atomic.LoadInt64(&p.gets),
+		Hits : atomic.LoadInt64(&p.hits),
+		Puts : atomic.LoadInt64(&p.puts),
+		Drops: atomic.LoadInt64(&p.drops),
+	}
+}
+
+// Returns the image data to the frame pool if it was taken from there, and clears it. For operators which
+// replace the image data, as no other references to it remain
+func (f *FITSImage) releaseData() {
+	if f.pooled { PutFrameF32(f.Data) }
+	f.Data, f.pooled=nil, false
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestArrayPool(t *testing.T) {
+	for _, n:=range []int{0, 1, 63, 64, 65, 1000, 4096} {
+		a:=GetArrayF32(n)
+		if len(a)!=n { t.Errorf("GetArrayF32(%d) returned length %d", n, len(a)) }
+		PutArrayF32(a)
+		s:=GetArrayStar(n)
+		if len(s)!=n { t.Errorf("GetArrayStar(%d) returned length %d", n, len(s)) }
+		PutArrayStar(s)
+	}
+
+	// arrays grown beyond their size class must serve requests of their floor class only
+	a:=make([]float32, 0, 100)
+	PutArrayF32(a)
+	for i:=0; i<10; i++ {
+		b:=GetArrayF32(128)
+		if len(b)!=128 { t.Errorf("GetArrayF32(128) returned length %d", len(b)) }
+	}
+}
+
+func TestArrayPoolStats(t *testing.T) {
+	p:=NewPool[float32]("test", 256)
+	get, put:=p.Get, p.Put
+
+	// small arrays and arrays above the capacity limit are not counted as requests, and the latter are dropped
+	put(get(10))
+	put(get(1000))
+	a:=get(100)
+	if len(a)!=100 || cap(a)!=128 { t.Errorf("got length %d capacity %d, want 100 128", len(a), cap(a)) }
+	put(a)
+	put(make([]float32, 512))
+
+	s:=p.Stats()
+	if s.Gets!=1 || s.Hits>s.Gets || s.Puts!=1 || s.Drops!=2 { t.Errorf("unexpected stats %+v", s) }
+}
+
+func TestFramePool(t *testing.T) {
+	p:=&FramePool{MaxFrames: 2}
+
+	// arrays are only reused for the exact same length
+	a:=p.get(100)
+	p.put(a)
+	if b:=p.get(99); &b[0]==&a[0] { t.Errorf("array of length 100 reused for length 99") }
+	if b:=p.get(100); &b[0]!=&a[0] || len(b)!=100 { t.Errorf("array of length 100 not reused") }
+
+	// the oldest array is evicted once the pool is full
+	x, y, z:=make([]float32, 10), make([]float32, 20), make([]float32, 30)
+	p.put(x)
+	p.put(y)
+	p.put(z)
+	if b:=p.get(10); &b[0]==&x[0] { t.Errorf("oldest array not evicted") }
+	if b:=p.get(30); &b[0]!=&z[0] { t.Errorf("newest array not reused") }
+
+	s:=p.Stats()
+	if s.Gets!=5 || s.Hits!=2 || s.Puts!=4 || s.Drops!=1 { t.Errorf("unexpected stats %+v", s) }
+}
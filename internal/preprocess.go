@@ -17,192 +17,109 @@
 package internal
 
 import (
+	"context"
 	"errors"
 	"fmt"
 )
 
 
 // Load dark frame from FITS file
-func LoadDark(dark string) *FITSImage {
+func LoadDark(dark string) (*FITSImage, error) {
 	darkF:=NewFITSImage()
 	darkF.ID=-1
 	err:=darkF.ReadFile(dark)
-	if err!=nil { panic(err) }
+	if err!=nil { return nil, err }
 	darkF.Stats=CalcBasicStats(darkF.Data)
-	darkF.Stats.Noise=EstimateNoise(darkF.Data, darkF.Naxisn[0])
+	darkF.Stats.Noise=EstimateNoise(darkF.Data, darkF.Naxisn[0], NEImmerkaer)
 	LogPrintf("Dark %s stats: %v\n", dark, darkF.Stats)
 
 	if darkF.Stats.StdDev<1e-8 {
 		LogPrintf("Warnining: dark file may be degenerate\n")
 	}
-	return &darkF
+	return &darkF, nil
 }
 
 
 // Load flat frame from FITS file
-func LoadFlat(flat string) *FITSImage {
+func LoadFlat(flat string) (*FITSImage, error) {
 	flatF:=NewFITSImage()
 	flatF.ID=-2
 	err:=flatF.ReadFile(flat)
-	if err!=nil { panic(err) }
+	if err!=nil { return nil, err }
 	flatF.Stats=CalcBasicStats(flatF.Data)
-	flatF.Stats.Noise=EstimateNoise(flatF.Data, flatF.Naxisn[0])
+	flatF.Stats.Noise=EstimateNoise(flatF.Data, flatF.Naxisn[0], NEImmerkaer)
 	LogPrintf("Flat %s stats: %v\n", flat, flatF.Stats)
 
 	if (flatF.Stats.Min<=0 && flatF.Stats.Max>=0) || flatF.Stats.StdDev<1e-8 {
 		LogPrintf("Warnining: flat file may be degenerate\n")
 	}
-	return &flatF
+	return &flatF, nil
 }
 
 
-// Preprocess all light frames with given global settings, limiting concurrency to the number of available CPUs
-func PreProcessLights(ids []int, fileNames []string, darkF, flatF *FITSImage, debayer, cfa string, binning, normRange int32, bpSigLow, bpSigHigh, starSig, starBpSig float32, starRadius int32, starsShow string, backGrid int32, backSigma float32, backClip int32, backPattern, preprocessedPattern string, imageLevelParallelism int32) (lights []*FITSImage) {
+// Preprocess all light frames with given global settings, limiting concurrency to the number of available CPUs.
+// Frames which fail to preprocess are logged and left nil. Returns an error if writing an output file fails.
+// Stops starting new frames and returns the context error if the context is cancelled
+func PreProcessLights(ctx context.Context, ids []int, fileNames []string, darkF, flatF *FITSImage, debayer, cfa string, binning, normRange int32, bpSigLow, bpSigHigh, starSig, starBpSig float32, starRadius int32, starsShow string, backGrid int32, backSigma float32, backClip int32, backPattern, preprocessedPattern string, lsEst LSEstimatorMode, imageLevelParallelism int32) (lights []*FITSImage, err error) {
+	p:=NewPreProcessPipeline(darkF, flatF, debayer, cfa, binning, normRange, bpSigLow, bpSigHigh, starSig, starBpSig, starRadius, backGrid, backSigma, backClip, backPattern, lsEst)
+	return PreProcessLightsPipeline(ctx, ids, fileNames, p, starsShow, preprocessedPattern, imageLevelParallelism)
+}
+
+// Preprocess all light frames with the given pipeline on the shared worker pool, at most imageLevelParallelism at a time,
+// with the priority of the context.
+// Frames which fail to preprocess are logged and left nil. Returns an error if writing an output file fails.
+// Stops starting new frames and returns the context error if the context is cancelled
+func PreProcessLightsPipeline(ctx context.Context, ids []int, fileNames []string, p *Pipeline, starsShow, preprocessedPattern string, imageLevelParallelism int32) (lights []*FITSImage, err error) {
 	//LogPrintf("CSV Id,%s\n", (&BasicStats{}).ToCSVHeader())
 
 	lights =make([]*FITSImage, len(fileNames))
-	sem   :=make(chan bool, imageLevelParallelism)
+	errs  :=make([]error, len(fileNames))
+	group :=DefaultPool.NewGroup(ctx, int(imageLevelParallelism))
 	for i, fileName := range(fileNames) {
-		id:=ids[i]
-		sem <- true 
-		go func(i int, id int, fileName string) {
-			defer func() { <-sem }()
-			lightP, err:=PreProcessLight(id, fileName, darkF, flatF, debayer, cfa, binning, normRange, bpSigLow, bpSigHigh, starSig, starBpSig, starRadius, backGrid, backSigma, backClip, backPattern)
+		i, id, fileName:=i, ids[i], fileName
+		group.Go(func() {
+			lightP, err:=PreProcessLightPipeline(id, fileName, p)
 			if err!=nil {
 				LogPrintf("%d: Error: %s\n", id, err.Error())
 			} else {
 				lights[i]=lightP
 				if preprocessedPattern!="" {
 					err=lightP.WriteFile(fmt.Sprintf(preprocessedPattern, id))
-					if err!=nil { LogFatalf("Error writing file: %s\n", err) }
+					if err!=nil { errs[i]=errors.New(fmt.Sprintf("Error writing file: %s", err)); return }
 				}
 				if starsShow!="" {
 					stars:=ShowStars(lightP, 2.0)
-					stars.WriteFile(fmt.Sprintf(starsShow, id))
-					if err!=nil { LogFatalf("Error writing file: %s\n", err) }
+					err=stars.WriteFile(fmt.Sprintf(starsShow, id))
+					if err!=nil { errs[i]=errors.New(fmt.Sprintf("Error writing file: %s", err)); return }
 				}
 			}
-		}(i, id, fileName)
+		})
 	}
-	for i:=0; i<cap(sem); i++ {  // wait for goroutines to finish
-		sem <- true
+	if err:=group.Wait(); err!=nil { return lights, err }
+	for _, err:=range errs {
+		if err!=nil { return lights, err }
 	}
-	return lights	
+	return lights, nil
 }
 
 // Preprocess a single light frame with given settings.
 // Pre-processing includes loading, basic statistics, dark subtraction, flat division, 
 // bad pixel removal, star detection and HFR calculation.
 func PreProcessLight(id int, fileName string, darkF, flatF *FITSImage, debayer, cfa string, binning, normRange int32, bpSigLow, bpSigHigh, 
-	starSig, starBpSig float32, starRadius int32, backGrid int32, backSigma float32, backClip int32, backPattern string) (lightP *FITSImage, err error) {
-	// Load light frame
+	starSig, starBpSig float32, starRadius int32, backGrid int32, backSigma float32, backClip int32, backPattern string, lsEst LSEstimatorMode) (lightP *FITSImage, err error) {
+	p:=NewPreProcessPipeline(darkF, flatF, debayer, cfa, binning, normRange, bpSigLow, bpSigHigh, starSig, starBpSig, starRadius, backGrid, backSigma, backClip, backPattern, lsEst)
+	return PreProcessLightPipeline(id, fileName, p)
+}
+
+// Loads a single light frame and preprocesses it with the given pipeline
+func PreProcessLightPipeline(id int, fileName string, p *Pipeline) (lightP *FITSImage, err error) {
 	light:=NewFITSImage()
 	light.ID=id
 	err=light.ReadFile(fileName)
 	if err!=nil { return nil, err }
 
-	//light.Stats=aim.CalcBasicStats(light.Data)
-	//LogPrintf("%d: Light %v %d bpp, %v\n", id, light.Naxisn, light.Bitpix, light.Stats)
-
-	// apply dark frame if available
-	if darkF!=nil && darkF.Pixels>0 {
-		if !EqualInt32Slice(darkF.Naxisn, light.Naxisn) {
-			return nil, errors.New("light size differs from dark size")
-		}
-		Subtract(light.Data, light.Data, darkF.Data)
-	}
-
-	// apply flat frame if available
-	if flatF!=nil && flatF.Pixels>0 {
-		if !EqualInt32Slice(flatF.Naxisn, light.Naxisn) {
-			return nil, errors.New("light size differs from flat size")
-		}
-		Divide(light.Data, light.Data, flatF.Data, flatF.Stats.Mean)
-	}
-
-	// remove bad pixels if flagged
-	var medianDiffStats *BasicStats
-	if bpSigLow!=0 && bpSigHigh!=0 {
-		if debayer=="" {
-			var bpm []int32
-			bpm, medianDiffStats=BadPixelMap(light.Data, light.Naxisn[0], bpSigLow, bpSigHigh)
-			mask:=CreateMask(light.Naxisn[0], 1.5)
-			MedianFilterSparse(light.Data, bpm, mask)
-			LogPrintf("%d: Removed %d bad pixels (%.2f%%) with sigma low=%.2f high=%.2f\n", 
-				id, len(bpm), 100.0*float32(len(bpm))/float32(light.Pixels), bpSigLow, bpSigHigh)
-			bpm=nil
-		} else {
-			numRemoved,err:=CosmeticCorrectionBayer(light.Data, light.Naxisn[0], debayer, cfa, bpSigLow, bpSigHigh)
-			if err!=nil { return nil, err }
-			LogPrintf("%d: Removed %d bad bayer pixels (%.2f%%) with sigma low=%.2f high=%.2f\n", 
-				id, numRemoved, 100.0*float32(numRemoved)/float32(light.Pixels), bpSigLow, bpSigHigh)
-		}
-	}
-
-	// debayer color filter array data if desired
-	if debayer!="" {
-		light.Data, light.Naxisn[0], err=DebayerBilinear(light.Data, light.Naxisn[0], debayer, cfa)
-		if err!=nil { return nil, err }
-		light.Pixels=int32(len(light.Data))
-		light.Naxisn[1]=light.Pixels/light.Naxisn[0]
-		LogPrintf("%d: Debayered channel %s from cfa %s, new size %dx%d\n", id, debayer, cfa, light.Naxisn[0], light.Naxisn[1])
-	}
-
-	// apply binning if desired
-	if binning>1 {
-		binned:=BinNxN(&light, binning)
- 		light=binned
-	}
-
-	// automatic background extraction, if desired
-	if backGrid>0 {
-		bg:=NewBackground(light.Data, light.Naxisn[0], backGrid, backSigma, backClip)
-		LogPrintf("%d: %s\n", id, bg)
-
-		if backPattern=="" {
-			bg.Subtract(light.Data)
-		} else { 
-			bgImage:=bg.Render()
-			bgFits:=FITSImage{
-				Header:NewFITSHeader(),
-				Bitpix:-32,
-				Bzero :0,
-				Naxisn:light.Naxisn,
-				Pixels:light.Pixels,
-				Data  :bgImage,
-			}
-			err=bgFits.WriteFile(fmt.Sprintf("back%02d.fits", id))
-			if err!=nil { LogFatalf("Error writing file: %s\n", err) }
-			Subtract(light.Data, light.Data, bgImage)
-			bgFits.Data, bgImage=nil, nil
-		}
-
-		// re-do stats and star detection
-		light.Stats, err=CalcExtendedStats(light.Data, light.Naxisn[0])
-		if err!=nil { return nil, err }
-		light.Stars, _, light.HFR=FindStars(light.Data, light.Naxisn[0], light.Stats.Location, light.Stats.Scale, starSig, starBpSig, starRadius, medianDiffStats)
-		LogPrintf("%d: Stars %d HFR %.3g %v\n", id, len(light.Stars), light.HFR, light.Stats)
-	}
-
-	// calculate stats and find stars
-	light.Stats, err=CalcExtendedStats(light.Data, light.Naxisn[0])
-	if err!=nil { return nil, err }
-	light.Stars, _, light.HFR=FindStars(light.Data, light.Naxisn[0], light.Stats.Location, light.Stats.Scale, starSig, starBpSig, starRadius, medianDiffStats)
-	LogPrintf("%d: Stars %d HFR %.3g %v\n", id, len(light.Stars), light.HFR, light.Stats)
-	//LogPrintf("CSV %d,%s\n", id, light.Stats.ToCSVLine())
-
-	// Normalize value range if desired
-	if normRange>0 {
-		if light.Stats.Min==light.Stats.Max {
-			LogPrintf("%d: Warning: Image is of uniform intensity %.4g, skipping normalization\n", id, light.Stats.Min)
-		} else {
-			LogPrintf("%d: Normalizing from [%.4g,%.4g] to [0,1]\n", id, light.Stats.Min, light.Stats.Max)
-	    	light.Normalize()
-			light.Stats, err=CalcExtendedStats(light.Data, light.Naxisn[0])
-			if err!=nil { return nil, err }
-		}
-	}
-
+	if err=p.Apply(&light); err!=nil { return nil, err }
+	light.bpStats=nil
 	return &light, nil
 }
 
@@ -0,0 +1,53 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+
+// A named processing preset with color and tone curve parameters, in JSON format. Parameters are keyed
+// by their command line flag name, with numbers or strings as values. For example:
+//   { "name": "galaxy", "color": { "chromaGamma": 1.4, "scnr": 0.1 }, "tone": { "asinh": 50, "autoLoc": 10 } }
+type Preset struct {
+	Name  string                 `json:"name"`   // Name of the preset, for log output
+	Color map[string]interface{} `json:"color"`  // Color parameters
+	Tone  map[string]interface{} `json:"tone"`   // Tone curve parameters
+}
+
+// Loads a preset from the given JSON file
+func LoadPreset(fileName string) (p *Preset, err error) {
+	bytes, err:=ioutil.ReadFile(fileName)
+	if err!=nil { return nil, err }
+	p=&Preset{}
+	if err=json.Unmarshal(bytes, p); err!=nil {
+		return nil, errors.New(fmt.Sprintf("Error parsing preset %s: %s", fileName, err.Error()))
+	}
+	return p, nil
+}
+
+// Writes the preset to the given JSON file
+func (p *Preset) WriteFile(fileName string) error {
+	bytes, err:=json.MarshalIndent(p, "", "  ")
+	if err!=nil { return err }
+	return WriteBytesAtomic(fileName, append(bytes, '\n'))
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+
+// A built-in processing profile with default parameters for a capture type. Parameters are keyed by
+// their command line flag name, like in presets and configuration files
+type Profile struct {
+	Name   string             // Name of the profile, for selection with -profile
+	Desc   string             // Short description, for help and log output
+	Params map[string]string  // Parameter values by flag name
+}
+
+// The built-in processing profiles
+var Profiles=[]Profile{
+	{"dslr_osc", "one-shot color cameras and DSLRs. Select the color channel with -debayer R, G or B when stacking",
+		map[string]string{
+			"cfa": "RGGB", "backGrid": "256", "backClip": "2", "bpSigLow": "3", "bpSigHigh": "5",
+			"stMode": "5",
+			"rgbBackGrid": "256", "neutSigmaLow": "1", "neutSigmaHigh": "5", "chromaGamma": "1.2", "scnr": "0.1",
+			"autoLoc": "10", "autoScale": "0.4",
+		},
+	},
+	{"mono_lrgb", "monochrome cameras with luminance and RGB filters",
+		map[string]string{
+			"debayer": "", "bpSigLow": "3", "bpSigHigh": "5",
+			"stMode": "5",
+			"neutSigmaLow": "1", "neutSigmaHigh": "5", "chromaGamma": "1.2", "lrgbChromaBlur": "1",
+			"autoLoc": "10", "autoScale": "0.4",
+		},
+	},
+	{"narrowband", "monochrome cameras with Ha, OIII and SII filters, mapped with the Hubble palette",
+		map[string]string{
+			"debayer": "", "bpSigLow": "3", "bpSigHigh": "5",
+			"stMode": "5",
+			"palette": "SHO", "scnr": "0.5", "rotFrom": "100", "rotTo": "190", "rotBy": "-30", "chromaGamma": "1.4",
+			"autoLoc": "10", "autoScale": "0.4",
+		},
+	},
+}
+
+// Returns the built-in profile with the given name
+func FindProfile(name string) (*Profile, error) {
+	names:=[]string{}
+	for i:=range Profiles {
+		if Profiles[i].Name==strings.ToLower(name) { return &Profiles[i], nil }
+		names=append(names, Profiles[i].Name)
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown profile '%s', expecting one of %s", name, strings.Join(names, ", ")))
+}
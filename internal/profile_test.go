@@ -0,0 +1,32 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"testing"
+)
+
+
+func TestFindProfile(t *testing.T) {
+	for _, name:=range []string{"dslr_osc", "mono_lrgb", "NarrowBand"} {
+		p, err:=FindProfile(name)
+		if err!=nil { t.Errorf("%s: unexpected error %s", name, err) ; continue }
+		if len(p.Params)==0 { t.Errorf("%s: no parameters", name) }
+	}
+	if _, err:=FindProfile("unknown"); err==nil {
+		t.Errorf("unknown profile: expected error")
+	}
+}
@@ -37,9 +37,21 @@ func (img *FITSImage) Project(destNaxisn []int32, trans Transform2D, outOfBounds
 		Bzero : 0,
 		Naxisn: []int32{destNaxisn[0], destNaxisn[1]},
 		Pixels: destPixels,
-		Data:   make([]float32,int(destPixels)),
+		Data:   GetFrameF32(int(destPixels)),  // all pixels are overwritten below
 		Exposure: img.Exposure,
+		HFR:    img.HFR,
+		Background: img.Background,
 		Trans:  IdentityTransform2D(),
+		pooled: true,
+	}
+
+	// Carry over star detections, moved into the target coordinate system
+	res.Stars=make([]Star, len(img.Stars))
+	for i, s:=range img.Stars {
+		p:=trans.Apply(Point2D{s.X, s.Y})
+		s.X, s.Y=p.X, p.Y
+		s.Index=int32(p.X+0.5)+destWidth*int32(p.Y+0.5)
+		res.Stars[i]=s
 	}
 
 	// Resample image from the target coordinate system PoV
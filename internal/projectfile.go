@@ -0,0 +1,66 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+
+// A target of a multi-target project, processed with its own inputs, calibration frames and parameters
+type Target struct {
+	Name    string                 `json:"name"`     // Name of the target, for log output
+	Command string                 `json:"command"`  // Command to run for the target, e.g. stack or lrgb. Defaults to stack
+	Out     string                 `json:"out"`      // Output file
+	Dark    string                 `json:"dark"`     // Master dark, if any
+	Flat    string                 `json:"flat"`     // Master flat, if any
+	Inputs  []string               `json:"inputs"`   // Input files for the command. May contain wildcards
+	Params  map[string]interface{} `json:"params"`   // Further parameters keyed by their command line flag name
+}
+
+// A project with multiple targets to process in one invocation, in JSON format. For example:
+//   { "targets": [ { "name": "M42 L", "out": "m42_l.fits", "dark": "d.fits", "flat": "f.fits", "inputs": [ "m42/L_*.fits" ] },
+//                  { "name": "M42", "command": "lrgb", "out": "m42.fits", "inputs": [ "m42_l.fits", "m42_r.fits", "m42_g.fits", "m42_b.fits" ],
+//                    "params": { "chromaGamma": 1.2 } } ] }
+type Project struct {
+	Targets []Target `json:"targets"`
+}
+
+// Loads a project from the given JSON file, and validates it. Sets the default command for targets which have none
+func LoadProject(fileName string) (p *Project, err error) {
+	bytes, err:=ioutil.ReadFile(fileName)
+	if err!=nil { return nil, err }
+	p=&Project{}
+	if err=unmarshalUseNumber(bytes, p); err!=nil {
+		return nil, errors.New(fmt.Sprintf("Error parsing project %s: %s", fileName, err.Error()))
+	}
+	if len(p.Targets)==0 { return nil, errors.New(fmt.Sprintf("Project %s contains no targets", fileName)) }
+	for i:=range p.Targets {
+		t:=&p.Targets[i]
+		if t.Command=="" { t.Command="stack" }
+		if t.Out=="" { return nil, errors.New(fmt.Sprintf("Target %d '%s' in project %s has no output file", i, t.Name, fileName)) }
+		if len(t.Inputs)==0 { return nil, errors.New(fmt.Sprintf("Target %d '%s' in project %s has no inputs", i, t.Name, fileName)) }
+	}
+	return p, nil
+}
+
+// Returns the parameters of the target as strings keyed by flag name
+func (t *Target) ParamStrings() (params map[string]string, err error) {
+	return ConfigValuesToStrings("target '"+t.Name+"'", t.Params)
+}
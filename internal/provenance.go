@@ -0,0 +1,64 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+
+// Returns FITS HISTORY entries recording how an output was produced: program version and command,
+// the given parameters in sorted order, and the given input files with their SHA-256 hashes
+func ProvenanceHistory(version, command string, params map[string]string, inputs []string) (history []string, err error) {
+	history=append(history, fmt.Sprintf("nightlight %s %s %s", version, command, time.Now().UTC().Format("2006-01-02T15:04:05")))
+
+	names:=make([]string, 0, len(params))
+	for name:=range params { names=append(names, name) }
+	sort.Strings(names)
+	for _, name:=range names {
+		history=append(history, fmt.Sprintf("param %s=%s", name, params[name]))
+	}
+
+	for _, input:=range inputs {
+		hash, err:=HashFile(input)
+		if err!=nil { return nil, err }
+		history=append(history, "input "+input, "sha256 "+hash)
+	}
+	return history, nil
+}
+
+// Returns the SHA-256 hash of the contents of the given file as hex string. The file name - hashes the data read from stdin
+func HashFile(fileName string) (string, error) {
+	if fileName==StdioFileName {
+		data, err:=readStdin()
+		if err!=nil { return "", err }
+		sum:=sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	f, err:=os.Open(fileName)
+	if err!=nil { return "", err }
+	defer f.Close()
+	h:=sha256.New()
+	if _, err:=io.Copy(h, f); err!=nil { return "", err }
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,53 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvenanceHistory(t *testing.T) {
+	dir, err:=ioutil.TempDir("", "nlprov")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+
+	input:=filepath.Join(dir, "in.fits")
+	if err:=ioutil.WriteFile(input, []byte("abc"), 0644); err!=nil { t.Fatal(err) }
+	params:=map[string]string{"stMode": "5", "out": "m42.fits", "wavGains": strings.Repeat("1.5,", 30)}
+	history, err:=ProvenanceHistory("0.0.1", "stack", params, []string{input})
+	if err!=nil { t.Fatal(err) }
+	if !strings.HasPrefix(history[0], "nightlight 0.0.1 stack ") { t.Errorf("got '%s'", history[0]) }
+	if history[1]!="param out=m42.fits" || history[2]!="param stMode=5" { t.Errorf("params not sorted: %v", history[1:4]) }
+	if want:="sha256 ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"; history[len(history)-1]!=want {
+		t.Errorf("got '%s' want '%s'", history[len(history)-1], want)
+	}
+
+	// write and read back, long entries wrap across records
+	img:=FITSImage{Header: NewFITSHeader(), Naxisn: []int32{2, 2}, Pixels: 4, Data: make([]float32, 4)}
+	img.Header.History=history
+	fileName:=filepath.Join(dir, "out.fits")
+	if err:=img.WriteFile(fileName); err!=nil { t.Fatal(err) }
+	res:=NewFITSImage()
+	if err:=res.ReadFile(fileName); err!=nil { t.Fatal(err) }
+	if len(res.Header.History)!=len(history)+1 { t.Errorf("got %d history records want %d", len(res.Header.History), len(history)+1) }
+	if joined:=strings.Join(res.Header.History[3:5], ""); !strings.HasPrefix(joined, "param wavGains="+strings.Repeat("1.5,", 30)) {
+		t.Errorf("got '%s'", joined)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+
+// Point spread function of an image, from Gaussian fits to its brightest stars
+type PSF struct {
+	NumStars int      // Number of stars fitted successfully
+	FWHM     float32  // Median full width at half maximum in pixels
+}
+
+// Fits circular Gaussians to the given number of brightest stars within the given radius around each star,
+// skipping stars at or above the saturation level. Returns the median FWHM of the successful fits
+func FitPSF(data []float32, width int32, stars []Star, background, saturation float32, radius int32, maxStars int) (psf PSF) {
+	candidates:=make([]Star, 0, len(stars))
+	for _, s:=range stars {
+		if s.Value<saturation { candidates=append(candidates, s) }
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Mass>candidates[j].Mass })
+	if len(candidates)>maxStars { candidates=candidates[:maxStars] }
+
+	fwhms:=make([]float32, 0, len(candidates))
+	for _, s:=range candidates {
+		if fwhm, ok:=fitGaussianFWHM(data, width, s.X, s.Y, background, radius); ok {
+			fwhms=append(fwhms, fwhm)
+		}
+	}
+	if len(fwhms)==0 { return PSF{} }
+	return PSF{NumStars: len(fwhms), FWHM: QSelectMedianFloat32(fwhms)}
+}
+
+// Fits a circular Gaussian centered on the given position to the pixels within the given radius, returning its FWHM.
+// Uses weighted linear least squares on the logarithm of the values above the background, which ignores the
+// faint wings below a tenth of the peak. Returns false if the fit fails, e.g. for flat or noisy profiles
+func fitGaussianFWHM(data []float32, width int32, x, y, background float32, radius int32) (fwhm float32, ok bool) {
+	height:=int32(len(data))/width
+	cx, cy:=int32(x+0.5), int32(y+0.5)
+	if cx-radius<0 || cy-radius<0 || cx+radius>=width || cy+radius>=height { return 0, false }
+
+	peak:=float32(0)
+	for dy:=-radius; dy<=radius; dy++ {
+		for dx:=-radius; dx<=radius; dx++ {
+			if v:=data[(cy+dy)*width+cx+dx]-background; v>peak { peak=v }
+		}
+	}
+	if peak<=0 { return 0, false }
+
+	// regress log value on squared distance, weighting by value squared to counter the noise amplification of the logarithm
+	var s, st, stt, sy, sty float64
+	num:=0
+	for dy:=-radius; dy<=radius; dy++ {
+		for dx:=-radius; dx<=radius; dx++ {
+			if dx*dx+dy*dy>radius*radius { continue }
+			v:=data[(cy+dy)*width+cx+dx]-background
+			if !(v>0.1*peak) { continue }  // also skips NaNs
+			rx, ry:=float64(cx+dx)-float64(x), float64(cy+dy)-float64(y)
+			t, l, w:=rx*rx+ry*ry, math.Log(float64(v)), float64(v)*float64(v)
+			s  +=w
+			st +=w*t
+			stt+=w*t*t
+			sy +=w*l
+			sty+=w*t*l
+			num++
+		}
+	}
+	denom:=s*stt-st*st
+	if num<5 || denom<=0 { return 0, false }
+	slope:=(s*sty-st*sy)/denom
+	if slope>=0 { return 0, false }
+	sigma:=math.Sqrt(-1/(2*slope))
+	return float32(2*math.Sqrt(2*math.Ln2)*sigma), true
+}
+
+
+// Fits the point spread function of each frame after star detection, and tracks the sharpest frame.
+// Frames without a successful fit pass unchanged
+type OpPSF struct {
+	Stars   int          `json:"stars"`  // Number of brightest stars to fit
+	Radius  int32        `json:"radius"` // Radius around each star in pixels
+	Tracker *PSFTracker  `json:"-"`      // Tracker for the sharpest frame, or nil
+}
+
+func (op *OpPSF) Apply(f *FITSImage) error {
+	if f.Stats==nil { return errors.New("PSF fitting requires prior statistics") }
+	psf:=FitPSF(f.Data, f.Naxisn[0], f.Stars, f.Stats.Location, 0.95*f.Stats.Max, op.Radius, op.Stars)
+	if psf.NumStars==0 { return nil }
+	LogPrintf("%d: PSF FWHM %.3g from %d stars\n", f.ID, psf.FWHM, psf.NumStars)
+	if op.Tracker!=nil { op.Tracker.Add(f, psf) }
+	return nil
+}
+
+// Tracks the frame with the sharpest point spread function. Safe for concurrent use
+type PSFTracker struct {
+	mutex    sync.Mutex
+	ID       int     // ID of the sharpest frame, -1 if none
+	FileName string  // File name of the sharpest frame
+	PSF      PSF     // Point spread function of the sharpest frame
+}
+
+// Creates a new tracker without frames
+func NewPSFTracker() *PSFTracker {
+	return &PSFTracker{ID: -1}
+}
+
+// Records the point spread function of the given frame
+func (t *PSFTracker) Add(f *FITSImage, psf PSF) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.ID<0 || psf.FWHM<t.PSF.FWHM {
+		t.ID, t.FileName, t.PSF=f.ID, f.FileName, psf
+	}
+}
+
+
+// Returns the pixel scale in arcseconds per pixel from the given FITS header. Uses the WCS solution of a
+// plate solver if present, else the focal length in mm and the pixel size in microns
+func PixelScale(h *FITSHeader) (scale float32, err error) {
+	if w, err:=NewWCSFromHeader(h); err==nil {
+		det:=w.CD[0][0]*w.CD[1][1]-w.CD[0][1]*w.CD[1][0]
+		return float32(math.Sqrt(math.Abs(det))*3600), nil
+	}
+	focalLen, ok1:=h.Float("FOCALLEN")
+	pixSize,  ok2:=h.Float("XPIXSZ")
+	if !ok1 || !ok2 || focalLen<=0 || pixSize<=0 {
+		return 0, errors.New("No pixel scale found in header, need a WCS solution or FOCALLEN and XPIXSZ")
+	}
+	return float32(206.264806*pixSize/focalLen), nil
+}
+
+// Pretty print the point spread function, in arcseconds if the pixel scale is nonzero
+func (p PSF) Format(scale float32) string {
+	if scale<=0 { return fmt.Sprintf("FWHM %.3g pixels from %d stars", p.FWHM, p.NumStars) }
+	return fmt.Sprintf("FWHM %.3g pixels (%.3g\") from %d stars", p.FWHM, p.FWHM*scale, p.NumStars)
+}
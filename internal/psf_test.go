@@ -0,0 +1,67 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFitPSF(t *testing.T) {
+	width, height:=int32(64), int32(64)
+	data:=make([]float32, width*height)
+	sigma:=float32(2)
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			dx, dy:=float32(x)-32, float32(y)-32
+			data[y*width+x]=100+1000*float32(math.Exp(float64(-(dx*dx+dy*dy)/(2*sigma*sigma))))
+		}
+	}
+	stars:=[]Star{ {Index: 32*width+32, Value: 1100, X: 32, Y: 32, Mass: 1000} }
+
+	psf:=FitPSF(data, width, stars, 100, 2000, 8, 10)
+	expected:=float32(2*math.Sqrt(2*math.Ln2))*sigma
+	if psf.NumStars!=1 || math.Abs(float64(psf.FWHM-expected))>0.05*float64(expected) {
+		t.Errorf("FitPSF: got %d stars FWHM %.3f, expected 1 star FWHM %.3f", psf.NumStars, psf.FWHM, expected)
+	}
+
+	psf=FitPSF(data, width, stars, 100, 1000, 8, 10)
+	if psf.NumStars!=0 {
+		t.Errorf("FitPSF: expected saturated star to be excluded, got %d stars", psf.NumStars)
+	}
+}
+
+func TestPixelScale(t *testing.T) {
+	h:=NewFITSHeader()
+	if _, err:=PixelScale(&h); err==nil {
+		t.Errorf("PixelScale: expected error for empty header")
+	}
+
+	h.Floats["FOCALLEN"]=1000
+	h.Floats["XPIXSZ"]  =3.76
+	if scale, err:=PixelScale(&h); err!=nil || math.Abs(float64(scale)-0.7756)>0.001 {
+		t.Errorf("PixelScale: got %.4f %v, expected 0.7756 from focal length and pixel size", scale, err)
+	}
+
+	h.Floats["CRPIX1"], h.Floats["CRPIX2"]=100, 100
+	h.Floats["CRVAL1"], h.Floats["CRVAL2"]=10, 20
+	h.Floats["CD1_1"], h.Floats["CD1_2"]=-0.0005, 0
+	h.Floats["CD2_1"], h.Floats["CD2_2"]=0, 0.0005
+	if scale, err:=PixelScale(&h); err!=nil || math.Abs(float64(scale)-1.8)>0.001 {
+		t.Errorf("PixelScale: got %.4f %v, expected 1.8 from WCS solution", scale, err)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+
+// Exponents for the factors of the quality weighting formula. Each factor is relative to the best frame,
+// i.e. in (0,1]. The weight of a frame is the product of all factors raised to their exponents.
+// An exponent of zero disables the respective factor
+type QualityFormula struct {
+	FWHM       float32  // Exponent for smallest FWHM / FWHM of the frame
+	Ecc        float32  // Exponent for (1 - eccentricity of the frame) / (1 - smallest eccentricity)
+	Stars      float32  // Exponent for number of stars in the frame / largest number of stars
+	Background float32  // Exponent for lowest background / background of the frame
+}
+
+// Parses a quality weighting formula from a comma-separated list of key=exponent pairs,
+// with keys fwhm, ecc, stars and bg. Keys not given have exponent zero
+func ParseQualityFormula(s string) (f QualityFormula, err error) {
+	for _, term:=range strings.Split(s, ",") {
+		term=strings.TrimSpace(term)
+		if term=="" { continue }
+		kv:=strings.SplitN(term, "=", 2)
+		if len(kv)!=2 { return f, errors.New(fmt.Sprintf("Invalid term '%s' in quality formula, expecting key=exponent", term)) }
+		exp, err:=strconv.ParseFloat(strings.TrimSpace(kv[1]), 32)
+		if err!=nil { return f, errors.New(fmt.Sprintf("Invalid exponent in quality formula term '%s': %s", term, err.Error())) }
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "fwhm":  f.FWHM      =float32(exp)
+		case "ecc":   f.Ecc       =float32(exp)
+		case "stars": f.Stars     =float32(exp)
+		case "bg":    f.Background=float32(exp)
+		default:      return f, errors.New(fmt.Sprintf("Unknown key in quality formula term '%s', expecting fwhm, ecc, stars or bg", term))
+		}
+	}
+	return f, nil
+}
+
+// Returns the median eccentricity of the given stars, or 0 if there are none
+func MedianEccentricity(stars []Star) float32 {
+	if len(stars)==0 { return 0 }
+	eccs:=make([]float32, len(stars))
+	for i, s:=range stars {
+		eccs[i]=s.Ecc
+	}
+	return QSelectMedianFloat32(eccs)
+}
+
+// Returns the median eccentricity of the given stars, and the dominant orientation of their major axes in degrees
+// within [0,180), from the x axis towards the y axis. Orientations are averaged as axes weighted by eccentricity,
+// so round stars contribute little. The coherence in [0,1] is 1 if all stars are elongated in the same direction,
+// as with trailing from guiding errors, and near 0 for random or radial directions, as with noise or coma
+func StarElongation(stars []Star) (ecc, angle, coherence float32) {
+	if len(stars)==0 { return 0, 0, 0 }
+	sumCos, sumSin, sumWeights:=float64(0), float64(0), float64(0)
+	for _, s:=range stars {
+		sumCos    +=float64(s.Ecc)*math.Cos(2*float64(s.Angle))
+		sumSin    +=float64(s.Ecc)*math.Sin(2*float64(s.Angle))
+		sumWeights+=float64(s.Ecc)
+	}
+	if sumWeights>0 {
+		coherence=float32(math.Sqrt(sumCos*sumCos+sumSin*sumSin)/sumWeights)
+		angle=float32(0.5*math.Atan2(sumSin, sumCos)*180/math.Pi)
+		if angle<0 { angle+=180 }
+	}
+	return MedianEccentricity(stars), angle, coherence
+}
+
+// Calculates per-frame stacking weights from the given quality formula, based on FWHM,
+// eccentricity, number of stars and background level of each frame. Assumes a Gaussian
+// star profile, for which the FWHM is twice the HFR. Frames without stars get weight zero
+// if the formula uses a star-based factor and other frames have stars
+func QualityWeights(lights []*FITSImage, f QualityFormula) (weights []float32) {
+	fwhms, eccs:=make([]float32, len(lights)), make([]float32, len(lights))
+	minFWHM, minEcc, maxStars, minBg:=float32(math.MaxFloat32), float32(1), 0, float32(math.MaxFloat32)
+	for i, l:=range lights {
+		fwhms[i]=2*l.HFR
+		eccs[i] =MedianEccentricity(l.Stars)
+		if fwhms[i]>0 && fwhms[i]<minFWHM { minFWHM=fwhms[i] }
+		if eccs[i]<minEcc                 { minEcc=eccs[i] }
+		if len(l.Stars)>maxStars          { maxStars=len(l.Stars) }
+		if l.Background>0 && l.Background<minBg { minBg=l.Background }
+	}
+
+	starBased:=(f.FWHM!=0 || f.Ecc!=0 || f.Stars!=0) && maxStars>0
+	weights=make([]float32, len(lights))
+	for i, l:=range lights {
+		if starBased && fwhms[i]<=0 {
+			LogPrintf("%d: No stars, quality weight 0\n", l.ID)
+			continue
+		}
+		w:=float64(1)
+		w*=qualityFactor(minFWHM, fwhms[i], f.FWHM)
+		w*=qualityFactor(1-eccs[i], 1-minEcc, f.Ecc)
+		w*=qualityFactor(float32(len(l.Stars)), float32(maxStars), f.Stars)
+		w*=qualityFactor(minBg, l.Background, f.Background)
+		weights[i]=float32(w)
+		LogPrintf("%d: FWHM %.3g ecc %.3g stars %d background %.4g quality weight %.4g\n", l.ID, fwhms[i], eccs[i], len(l.Stars), l.Background, weights[i])
+	}
+	return weights
+}
+
+// Returns (num/denom)^exp, or 1 if the exponent is zero or the ratio is undefined. The ratio is floored
+// at 1%, so a single poor factor never weights a frame with zero
+func qualityFactor(num, denom, exp float32) float64 {
+	if exp==0 || denom<=0 { return 1 }
+	ratio:=num/denom
+	if ratio<0.01 { ratio=0.01 }
+	return math.Pow(float64(ratio), float64(exp))
+}
@@ -18,6 +18,7 @@ package internal
 
 import (
 	"compress/gzip"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -27,13 +28,24 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"unsafe"
 )
 
 var reParser *regexp.Regexp=compileRE() // Regexp parser for FITS header lines
 
-// Read FITS data from the file with the given name. Decompresses gzip if .gz or gzip suffix is present
+// Read FITS data from the file with the given name. Decompresses gzip if .gz or gzip suffix is present.
+// The file name - reads from stdin
 func (fits *FITSImage) ReadFile(fileName string) error {
 	//LogPrintln("Reading from " + fileName + "..." )
+	defer StartStage(StageLoad)()
+	if fileName==StdioFileName {
+		r, err:=stdinFITSReader()
+		if err!=nil { return err }
+		fits.FileName=fileName
+		return fits.Read(r)
+	}
+
 	f, err:=os.Open(fileName)
 	if err!=nil { return err }
 	defer f.Close()
@@ -94,25 +106,25 @@ func (fits *FITSImage) Read(f io.Reader) error {
 func (fits *FITSImage) readData(f io.Reader) (err error) {
 	switch fits.Bitpix {
 	case 8: 
-		return fits.readInt8Data(f)
+		return fits.readConvertedData(f, 1, convertInt8Data)
 
 	case 16:
-		return fits.readInt16Data(f)
+		return fits.readConvertedData(f, 2, convertInt16Data)
 
 	case 32:
 		LogPrintf("Warning: loss of precision converting int%d to float32 values\n", fits.Bitpix)
-		return fits.readInt32Data(f)
+		return fits.readConvertedData(f, 4, convertInt32Data)
 
 	case 64: 
 		LogPrintf("Warning: loss of precision converting int%d to float32 values\n", fits.Bitpix)
-		return fits.readInt64Data(f)
+		return fits.readConvertedData(f, 8, convertInt64Data)
 
 	case -32:
 		return fits.readFloat32Data(f)
 
 	case -64:
 		LogPrintf("Warning: loss of precision converting float%d to float32 values\n", -fits.Bitpix)
-		return fits.readFloat64Data(f)
+		return fits.readConvertedData(f, 8, convertFloat64Data)
 
 	default:
 		return errors.New("Unknown BITPIX value "+strconv.FormatInt(int64(fits.Bitpix),10))
@@ -122,202 +134,86 @@ func (fits *FITSImage) readData(f io.Reader) (err error) {
 }
 
 
-const bufLen int=16*1024  // input buffer length for reading from file
+const bufLen int=16*1024  // buffer length for writing to file
 
-// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bzero
-func (fits *FITSImage) readInt8Data(r io.Reader) error {
-	fits.Data=make([]float32,int(fits.Pixels))
-	buf:=make([]byte,bufLen)
+const readBufLen int=256*1024  // buffer length for converting integer and float64 data read from file
 
-	dataIndex:=0	
-	for ; dataIndex<len(fits.Data) ; {
-		bytesToRead:=(len(fits.Data)-dataIndex)*1
-		if bytesToRead>bufLen {
-			bytesToRead=bufLen
-		}
-		bytesRead, err:=r.Read(buf[:bytesToRead])
-		if err!=nil { return err }
+// Buffers for converting data read from file, reused across files
+var readBufPool=sync.Pool{New: func() interface{} { b:=make([]byte, readBufLen); return &b }}
 
-		for i, val:=range(buf[:bytesRead]) { 
-			fits.Data[dataIndex+i]=float32(val)+fits.Bzero
+// Reads float32 data directly into pooled image data without an intermediate buffer, then converts
+// from network byte order in place and adjusts for Bzero
+func (fits *FITSImage) readFloat32Data(r io.Reader) error {
+	fits.Data, fits.pooled=GetFrameF32(int(fits.Pixels)), true
+	if len(fits.Data)==0 { return nil }
+	if len(fits.Data)>maxMappedPixels { return errors.New(fmt.Sprintf("Image with %d pixels too large", len(fits.Data))) }
+	buf:=(*[maxMappedPixels*4]byte)(unsafe.Pointer(&fits.Data[0]))[:4*len(fits.Data):4*len(fits.Data)] // view as bytes without copying
+	if _, err:=io.ReadFull(r, buf); err!=nil { return err }
+
+	if nativeLittleEndian() {
+		for i:=range fits.Data {
+			fits.Data[i]=math.Float32frombits(binary.BigEndian.Uint32(buf[i<<2:]))
 		}
-		dataIndex+=bytesRead
+	}
+	if fits.Bzero!=0 {
+		for i:=range fits.Data { fits.Data[i]+=fits.Bzero }
 	}
 	fits.Bzero=0 // offset has been adjusted on data values
 	return nil
 }
 
-// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bzero
-func (fits *FITSImage) readInt16Data(r io.Reader) error {
-	fits.Data=make([]float32,int(fits.Pixels))
-	buf     :=make([]byte,bufLen)
-
-	bytesPerValueShift:=uint(1)
-	bytesPerValue:=1<<bytesPerValueShift
-	bytesPerValueMask:=bytesPerValue-1
-	dataIndex:=0	
-	leftoverBytes:=0
-	for ; dataIndex<len(fits.Data) ; {
-		bytesToRead:=(len(fits.Data)-dataIndex)*bytesPerValue-leftoverBytes
-		if bytesToRead>bufLen {
-			bytesToRead=bufLen
-		}
-		bytesRead, err:=r.Read(buf[leftoverBytes:leftoverBytes+bytesToRead])
-		if err!=nil { return err }
-
-		availableBytes:=leftoverBytes+bytesRead
-		for i:=0; i<(availableBytes&^bytesPerValueMask); i+=bytesPerValue { 
-			val:=int16((uint16(buf[i])<<8) | uint16(buf[i+1]))
-			fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)+fits.Bzero
-		}
-		dataIndex   += availableBytes>>bytesPerValueShift
-		leftoverBytes= availableBytes& bytesPerValueMask
-		for i:=0; i<leftoverBytes; i++ {
-			buf[i]=buf[availableBytes-leftoverBytes+i]
-		}
+// Reads data with the given bytes per value chunk-wise through a pooled buffer into pooled image data, converting
+// each chunk from network byte order to float32 with the given function, which also adjusts for Bzero
+func (fits *FITSImage) readConvertedData(r io.Reader, bytesPerValue int, convert func(dst []float32, src []byte, bzero float32)) error {
+	fits.Data, fits.pooled=GetFrameF32(int(fits.Pixels)), true
+	bufP:=readBufPool.Get().(*[]byte)
+	defer readBufPool.Put(bufP)
+	valuesPerChunk:=readBufLen/bytesPerValue
+
+	for lower:=0; lower<len(fits.Data); lower+=valuesPerChunk {
+		upper:=lower+valuesPerChunk
+		if upper>len(fits.Data) { upper=len(fits.Data) }
+		buf:=(*bufP)[:(upper-lower)*bytesPerValue]
+		if _, err:=io.ReadFull(r, buf); err!=nil { return err }
+		convert(fits.Data[lower:upper], buf, fits.Bzero)
 	}
 	fits.Bzero=0 // offset has been adjusted on data values
 	return nil
 }
 
-// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bzero
-func (fits *FITSImage) readInt32Data(r io.Reader) error {
-	fits.Data=make([]float32,int(fits.Pixels))
-	buf     :=make([]byte,bufLen)
-
-	bytesPerValueShift:=uint(2)
-	bytesPerValue:=1<<bytesPerValueShift
-	bytesPerValueMask:=bytesPerValue-1
-	dataIndex:=0	
-	leftoverBytes:=0
-	for ; dataIndex<len(fits.Data) ; {
-		bytesToRead:=(len(fits.Data)-dataIndex)*bytesPerValue-leftoverBytes
-		if bytesToRead>bufLen {
-			bytesToRead=bufLen
-		}
-		bytesRead, err:=r.Read(buf[leftoverBytes:leftoverBytes+bytesToRead])
-		if err!=nil { return err }
-
-		availableBytes:=leftoverBytes+bytesRead
-		for i:=0; i<(availableBytes&^bytesPerValueMask); i+=bytesPerValue { 
-			val:=int32((uint32(buf[i])<<24) | (uint32(buf[i+1])<<16) | (uint32(buf[i+2])<<8) | (uint32(buf[i+3])))
-			fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)+fits.Bzero
-		}
-		dataIndex   += availableBytes>>bytesPerValueShift
-		leftoverBytes= availableBytes& bytesPerValueMask
-		for i:=0; i<leftoverBytes; i++ {
-			buf[i]=buf[availableBytes-leftoverBytes+i]
-		}
+// Converts uint8 values to float32 and adjusts for Bzero
+func convertInt8Data(dst []float32, src []byte, bzero float32) {
+	for i, val:=range src[:len(dst)] {
+		dst[i]=float32(val)+bzero
 	}
-	fits.Bzero=0 // offset has been adjusted on data values
-	return nil
 }
 
-// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bzero
-func (fits *FITSImage) readInt64Data(r io.Reader) error {
-	fits.Data=make([]float32,int(fits.Pixels))
-	buf     :=make([]byte,bufLen)
-
-	bytesPerValueShift:=uint(3)
-	bytesPerValue:=1<<bytesPerValueShift
-	bytesPerValueMask:=bytesPerValue-1
-	dataIndex:=0	
-	leftoverBytes:=0
-	for ; dataIndex<len(fits.Data) ; {
-		bytesToRead:=(len(fits.Data)-dataIndex)*bytesPerValue-leftoverBytes
-		if bytesToRead>bufLen {
-			bytesToRead=bufLen
-		}
-		bytesRead, err:=r.Read(buf[leftoverBytes:leftoverBytes+bytesToRead])
-		if err!=nil { return err }
-
-		availableBytes:=leftoverBytes+bytesRead
-		for i:=0; i<(availableBytes&^bytesPerValueMask); i+=bytesPerValue { 
-			val:=int64((uint64(buf[i  ])<<56) | (uint64(buf[i+1])<<48) | (uint64(buf[i+2])<<40) | (uint64(buf[i+3])<<32) |
-			           (uint64(buf[i+4])<<24) | (uint64(buf[i+5])<<16) | (uint64(buf[i+6])<< 8) | (uint64(buf[i+7])    )   )
-			fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)+fits.Bzero
-		}
-		dataIndex   += availableBytes>>bytesPerValueShift
-		leftoverBytes= availableBytes& bytesPerValueMask
-		for i:=0; i<leftoverBytes; i++ {
-			buf[i]=buf[availableBytes-leftoverBytes+i]
-		}
+// Converts int16 values from network byte order to float32 and adjusts for Bzero
+func convertInt16Data(dst []float32, src []byte, bzero float32) {
+	for i:=range dst {
+		dst[i]=float32(int16(binary.BigEndian.Uint16(src[i<<1:])))+bzero
 	}
-	fits.Bzero=0 // offset has been adjusted on data values
-	return nil
 }
 
-// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bzero
-func (fits *FITSImage) readFloat32Data(r io.Reader) error {
-	fits.Data=make([]float32,int(fits.Pixels))
-	buf     :=make([]byte,bufLen)
-
-	bytesPerValueShift:=uint(2)
-	bytesPerValue:=1<<bytesPerValueShift
-	bytesPerValueMask:=bytesPerValue-1
-	dataIndex:=0	
-	leftoverBytes:=0
-	for ; dataIndex<len(fits.Data) ; {
-		bytesToRead:=(len(fits.Data)-dataIndex)*bytesPerValue-leftoverBytes
-		if bytesToRead>bufLen {
-			bytesToRead=bufLen
-		}
-		//LogPrintf("dataIndex %d bytesToRead %d\n", dataIndex, bytesToRead)
-		bytesRead, err:=r.Read(buf[leftoverBytes:leftoverBytes+bytesToRead])
-		//LogPrintf("bytesRead %d err %d\n", bytesRead, err)
-		if err!=nil { return err }
-
-		availableBytes:=leftoverBytes+bytesRead
-		//LogPrintf("availableBytes %d\n", availableBytes)
-		for i:=0; i<(availableBytes&^bytesPerValueMask); i+=bytesPerValue { 
-			bits:=((uint32(buf[i]))<<24) | (uint32(buf[i+1])<<16) | (uint32(buf[i+2])<<8) | (uint32(buf[i+3]))
-			val:=math.Float32frombits(bits)
-			//LogPrintf("%d: %02x %02x %02x %02x = %08x =%f\n", i, buf[i], buf[i+1], buf[i+2], buf[i+3], bits, val)
-			fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)+fits.Bzero
-		}
-		dataIndex   += availableBytes>>bytesPerValueShift
-		leftoverBytes= availableBytes& bytesPerValueMask
-		for i:=0; i<leftoverBytes; i++ {
-			buf[i]=buf[availableBytes-leftoverBytes+i]
-		}
+// Converts int32 values from network byte order to float32 and adjusts for Bzero
+func convertInt32Data(dst []float32, src []byte, bzero float32) {
+	for i:=range dst {
+		dst[i]=float32(int32(binary.BigEndian.Uint32(src[i<<2:])))+bzero
 	}
-	fits.Bzero=0 // offset has been adjusted on data values
-	return nil
 }
 
-// Batched read of data of the given size and type from the file, converting from network byte order and adjusting for Bzero
-func (fits *FITSImage) readFloat64Data(r io.Reader) error {
-	fits.Data=make([]float32,int(fits.Pixels))
-	buf     :=make([]byte,bufLen)
-
-	bytesPerValueShift:=uint(3)
-	bytesPerValue:=1<<bytesPerValueShift
-	bytesPerValueMask:=bytesPerValue-1
-	dataIndex:=0	
-	leftoverBytes:=0
-	for ; dataIndex<len(fits.Data) ; {
-		bytesToRead:=(len(fits.Data)-dataIndex)*bytesPerValue-leftoverBytes
-		if bytesToRead>bufLen {
-			bytesToRead=bufLen
-		}
-		bytesRead, err:=r.Read(buf[leftoverBytes:leftoverBytes+bytesToRead])
-		if err!=nil { return err }
+// Converts int64 values from network byte order to float32 and adjusts for Bzero
+func convertInt64Data(dst []float32, src []byte, bzero float32) {
+	for i:=range dst {
+		dst[i]=float32(int64(binary.BigEndian.Uint64(src[i<<3:])))+bzero
+	}
+}
 
-		availableBytes:=leftoverBytes+bytesRead
-		for i:=0; i<(availableBytes&^bytesPerValueMask); i+=bytesPerValue { 
-			bits:=((uint64(buf[i  ])<<56) | (uint64(buf[i+1])<<48) | (uint64(buf[i+2])<<40) | (uint64(buf[i+3])<<32) |
-			       (uint64(buf[i+4])<<24) | (uint64(buf[i+5])<<16) | (uint64(buf[i+6])<< 8) | (uint64(buf[i+7])    )   )
-			val:=math.Float64frombits(bits)
-			fits.Data[dataIndex+(i>>bytesPerValueShift)]=float32(val)+fits.Bzero
-		}
-		dataIndex   += availableBytes>>bytesPerValueShift
-		leftoverBytes= availableBytes& bytesPerValueMask
-		for i:=0; i<leftoverBytes; i++ {
-			buf[i]=buf[availableBytes-leftoverBytes+i]
-		}
+// Converts float64 values from network byte order to float32 and adjusts for Bzero
+func convertFloat64Data(dst []float32, src []byte, bzero float32) {
+	for i:=range dst {
+		dst[i]=float32(math.Float64frombits(binary.BigEndian.Uint64(src[i<<3:])))+bzero
 	}
-	fits.Bzero=0 // offset has been adjusted on data values
-	return nil
 }
 
 
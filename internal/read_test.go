@@ -0,0 +1,79 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// Returns an uncompressed FITS file with the given BITPIX, BZERO, size and big endian data
+func makeTestFITS(bitpix int, bzero float32, width, height int, data interface{}) []byte {
+	cards:=[]string{
+		"SIMPLE  =                    T",
+		fmt.Sprintf("BITPIX  = %20d", bitpix),
+		"NAXIS   =                    2",
+		fmt.Sprintf("NAXIS1  = %20d", width),
+		fmt.Sprintf("NAXIS2  = %20d", height),
+		fmt.Sprintf("BZERO   = %20g", bzero),
+		"END",
+	}
+	buf:=bytes.Buffer{}
+	for _, c:=range cards { buf.WriteString(fmt.Sprintf("%-80s", c)) }
+	for buf.Len()%fitsBlockSize!=0 { buf.WriteByte(' ') }
+	binary.Write(&buf, binary.BigEndian, data)
+	for buf.Len()%fitsBlockSize!=0 { buf.WriteByte(0) }
+	return buf.Bytes()
+}
+
+func TestReadBitpix(t *testing.T) {
+	want:=[]float32{-3, -1, 0, 1, 2, 100}
+	cases:=[]struct{ bitpix int; bzero float32; data interface{} }{
+		{   8, -3, []uint8  {0, 2, 3, 4, 5, 103} },
+		{  16,  0, []int16  {-3, -1, 0, 1, 2, 100} },
+		{  16, 10, []int16  {-13, -11, -10, -9, -8, 90} },
+		{  32,  0, []int32  {-3, -1, 0, 1, 2, 100} },
+		{  64,  0, []int64  {-3, -1, 0, 1, 2, 100} },
+		{ -32,  0, []float32{-3, -1, 0, 1, 2, 100} },
+		{ -32,  1, []float32{-4, -2, -1, 0, 1, 99} },
+		{ -64,  0, []float64{-3, -1, 0, 1, 2, 100} },
+	}
+	for _, c:=range cases {
+		f:=NewFITSImage()
+		if err:=f.Read(bytes.NewReader(makeTestFITS(c.bitpix, c.bzero, 3, 2, c.data))); err!=nil { t.Fatalf("bitpix %d: %s", c.bitpix, err) }
+		if f.Bzero!=0 || len(f.Data)!=len(want) { t.Fatalf("bitpix %d: got bzero %g and %d values", c.bitpix, f.Bzero, len(f.Data)) }
+		for i, w:=range want {
+			if f.Data[i]!=w { t.Errorf("bitpix %d: data[%d]=%g; want %g", c.bitpix, i, f.Data[i], w) }
+		}
+	}
+
+	// truncated data is an error
+	b:=makeTestFITS(-32, 0, 3, 1, []float32{1, 2, 3})
+	f:=NewFITSImage()
+	if err:=f.Read(bytes.NewReader(b[:fitsBlockSize+8])); err==nil { t.Errorf("expected error for truncated data") }
+
+	// data spanning several conversion chunks
+	large:=make([]int16, readBufLen+5)
+	for i:=range large { large[i]=int16(i) }
+	f=NewFITSImage()
+	if err:=f.Read(bytes.NewReader(makeTestFITS(16, 0, len(large), 1, large))); err!=nil { t.Fatal(err) }
+	for i, l:=range large {
+		if f.Data[i]!=float32(l) { t.Fatalf("data[%d]=%g; want %d", i, f.Data[i], l) }
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+
+// Status of a light frame in a stacking report
+type FrameStatus int
+
+const (
+	FSPending FrameStatus = iota  // Preprocessed, but not yet aligned
+	FSStacked                     // Aligned and stacked
+	FSFailed                      // Failed to load or preprocess
+	FSSkipped                     // Skipped in alignment
+)
+
+// Names of the frame states, for export
+var frameStatusNames=[]string{"preprocessed", "stacked", "failed", "skipped"}
+
+// Returns the name of the frame status
+func (s FrameStatus) String() string {
+	if s<0 || int(s)>=len(frameStatusNames) { return fmt.Sprintf("FrameStatus(%d)", int(s)) }
+	return frameStatusNames[s]
+}
+
+// Per-frame entry of a stacking report
+type FrameReport struct {
+	ID         int
+	FileName   string
+	Status     FrameStatus
+	Stars      int
+	HFR        float32
+	Ecc        float32     // Median star eccentricity
+	Angle      float32     // Dominant star elongation angle in degrees
+	Noise      float32
+	Background float32     // Background level before normalization
+	Location   float32
+	Scale      float32
+	Residual   float32     // Alignment residual
+	Weight     float32     // Stacking weight relative to the other frames of its batch. 1 if unweighted
+}
+
+// Per-batch entry of a stacking report, with pixel rejection statistics
+type BatchReport struct {
+	Frames   int
+	SigLow   float32
+	SigHigh  float32
+	ClipLow  float32  // Percentage of samples clipped low
+	ClipHigh float32  // Percentage of samples clipped high
+}
+
+// A quality report of a stacking run, written as self-contained HTML file with charts and thumbnails
+type StackReport struct {
+	Title       string
+	Frames      map[int]*FrameReport  // Frames by ID
+	Batches     []BatchReport
+	RefID       int                   // ID of the reference frame, -1 if none
+	RefThumb    []byte                // JPEG thumbnail of the reference frame
+	Stack       *FITSImage            // Final stack, without data
+	StackThumb  []byte                // JPEG thumbnail of the final stack
+	LSEstimator LSEstimatorMode       // Location and scale estimator for stretching the thumbnails
+}
+
+// Maximum width of report thumbnails in pixels
+const reportThumbWidth=480
+
+// Creates a new, empty stacking report with the given title, stretching thumbnails with the given estimator
+func NewStackReport(title string, lsEst LSEstimatorMode) *StackReport {
+	return &StackReport{Title: title, Frames: map[int]*FrameReport{}, RefID: -1, LSEstimator: lsEst}
+}
+
+// Records the outcome of preprocessing for the given frames. Nil lights failed to load or preprocess
+func (r *StackReport) AddPreprocessed(ids []int, fileNames []string, lights []*FITSImage) {
+	for i, l:=range lights {
+		fr:=&FrameReport{ID: ids[i], FileName: fileNames[i], Status: FSFailed}
+		if l!=nil {
+			fr.Status, fr.Stars, fr.HFR=FSPending, len(l.Stars), l.HFR
+			fr.Ecc, fr.Angle, _=StarElongation(l.Stars)
+			fr.Background, fr.Weight=l.Background, 1
+			if l.Stats!=nil { fr.Noise, fr.Location, fr.Scale=l.Stats.Noise, l.Stats.Location, l.Stats.Scale }
+		}
+		r.Frames[ids[i]]=fr
+	}
+}
+
+// Records the outcome of postprocessing. Non-nil lights are stacked, pending frames missing from the
+// lights were skipped in alignment
+func (r *StackReport) AddPostprocessed(lights []*FITSImage) {
+	for _, l:=range lights {
+		if l==nil { continue }
+		if fr, ok:=r.Frames[l.ID]; ok {
+			fr.Status, fr.Residual=FSStacked, l.Residual
+		}
+	}
+	for _, fr:=range r.Frames {
+		if fr.Status==FSPending { fr.Status=FSSkipped }
+	}
+}
+
+// Records the stacking weights of the given lights. Nil weights mean unweighted stacking
+func (r *StackReport) AddWeights(lights []*FITSImage, weights []float32) {
+	if weights==nil { return }
+	for i, l:=range lights {
+		if fr, ok:=r.Frames[l.ID]; ok { fr.Weight=weights[i] }
+	}
+}
+
+// Records the pixel rejection statistics of a stacked batch with the given number of frames and pixels per frame
+func (r *StackReport) AddBatch(frames int, pixels int32, sigLow, sigHigh float32, clippedLow, clippedHigh int32) {
+	samples:=float32(frames)*float32(pixels)
+	if samples==0 { samples=1 }
+	r.Batches=append(r.Batches, BatchReport{frames, sigLow, sigHigh, float32(clippedLow)*100/samples, float32(clippedHigh)*100/samples})
+}
+
+// Records the reference frame and creates its thumbnail
+func (r *StackReport) SetReference(ref *FITSImage) (err error) {
+	r.RefID=ref.ID
+	r.RefThumb, err=Thumbnail(ref, reportThumbWidth, r.LSEstimator)
+	return err
+}
+
+// Records the final stack and creates its thumbnail
+func (r *StackReport) SetStack(stack *FITSImage) (err error) {
+	meta:=*stack
+	meta.Data=nil
+	r.Stack=&meta
+	r.StackThumb, err=Thumbnail(stack, reportThumbWidth, r.LSEstimator)
+	return err
+}
+
+// Creates an automatically stretched JPEG thumbnail of the given image, binned to at most the given width
+func Thumbnail(f *FITSImage, maxWidth int32, lsEst LSEstimatorMode) ([]byte, error) {
+	img:=*f
+	n:=(f.Naxisn[0]+maxWidth-1)/maxWidth
+	if n>1 { img=BinNxN(f, n) }
+	if n>1 || img.Stats==nil {
+		var err error
+		img.Stats, err=CalcExtendedStats(img.Data, img.Naxisn[0], lsEst)
+		if err!=nil { return nil, err }
+	}
+	buf:=&bytes.Buffer{}
+	if err:=img.WritePreviewJPG(buf, 0.1, 90); err!=nil { return nil, err }
+	return buf.Bytes(), nil
+}
+
+// Writes the report to the given HTML file
+func (r *StackReport) WriteHTMLFile(fileName string) error {
+	frames:=r.sortedFrames()
+
+	var rejected []*FrameReport
+	counts:=map[FrameStatus]int{}
+	for _, fr:=range frames {
+		counts[fr.Status]++
+		if fr.Status==FSFailed || fr.Status==FSSkipped { rejected=append(rejected, fr) }
+	}
+
+	data:=map[string]interface{}{
+		"Title"     : r.Title,
+		"Generated" : time.Now().Format("2006-01-02 15:04:05"),
+		"Frames"    : frames,
+		"Rejected"  : rejected,
+		"Batches"   : r.Batches,
+		"NumFrames" : len(frames),
+		"NumStacked": counts[FSStacked],
+		"NumSkipped": counts[FSSkipped],
+		"NumFailed" : counts[FSFailed],
+		"Charts"    : []template.HTML{
+			svgFrameChart("Half-flux radius (pixels)", frames, func(fr *FrameReport) float32 { return fr.HFR }),
+			svgFrameChart("Eccentricity",              frames, func(fr *FrameReport) float32 { return fr.Ecc }),
+			svgFrameChart("Elongation angle (degrees)", frames, func(fr *FrameReport) float32 { return fr.Angle }),
+			svgFrameChart("Stars",                     frames, func(fr *FrameReport) float32 { return float32(fr.Stars) }),
+			svgFrameChart("Noise",                     frames, func(fr *FrameReport) float32 { return fr.Noise }),
+		},
+		"RefID"     : r.RefID,
+		"RefThumb"  : jpegDataURL(r.RefThumb),
+		"Stack"     : r.Stack,
+		"StackThumb": jpegDataURL(r.StackThumb),
+	}
+	return WriteFileAtomic(fileName, func(w io.Writer) error {
+		return reportTemplate.Execute(w, data)
+	})
+}
+
+// Returns the frame reports sorted by ID
+func (r *StackReport) sortedFrames() []*FrameReport {
+	frames:=make([]*FrameReport, 0, len(r.Frames))
+	for _, fr:=range r.Frames { frames=append(frames, fr) }
+	sort.Slice(frames, func(i, j int) bool { return frames[i].ID<frames[j].ID })
+	return frames
+}
+
+// Returns the given JPEG as data URL for embedding, or an empty URL if nil
+func jpegDataURL(jpg []byte) template.URL {
+	if jpg==nil { return "" }
+	return template.URL("data:image/jpeg;base64,"+base64.StdEncoding.EncodeToString(jpg))
+}
+
+// Size of per-frame charts in pixels
+const chartWidth, chartHeight=640, 180
+
+// Renders an SVG chart of the given per-frame value, skipping frames which failed preprocessing.
+// Frames skipped in alignment are marked in orange
+func svgFrameChart(title string, frames []*FrameReport, value func(*FrameReport) float32) template.HTML {
+	const width, height, margin=chartWidth, chartHeight, 40
+	var plotted []*FrameReport
+	min, max:=float32(math.MaxFloat32), float32(-math.MaxFloat32)
+	for _, fr:=range frames {
+		if fr.Status==FSFailed { continue }
+		plotted=append(plotted, fr)
+		v:=value(fr)
+		if v<min { min=v }
+		if v>max { max=v }
+	}
+	sb:=&strings.Builder{}
+	fmt.Fprintf(sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" class="chart">`, width, height)
+	fmt.Fprintf(sb, `<text x="%d" y="16" class="title">%s</text>`, margin, template.HTMLEscapeString(title))
+	if len(plotted)==0 { return template.HTML(sb.String()+"</svg>") }
+	if max<=min { max=min+1 }
+
+	xOf:=func(i int) float32 {
+		if len(plotted)==1 { return float32(width)/2 }
+		return margin+float32(i)*float32(width-2*margin)/float32(len(plotted)-1)
+	}
+	yOf:=func(v float32) float32 { return height-margin/2-(v-min)*float32(height-margin*3/2)/(max-min) }
+
+	fmt.Fprintf(sb, `<line x1="%d" y1="%d" x2="%d" y2="%d" class="axis"/>`, margin, height-margin/2, width-margin, height-margin/2)
+	fmt.Fprintf(sb, `<text x="2" y="%.1f">%.4g</text><text x="2" y="%.1f">%.4g</text>`, yOf(max)+4, max, yOf(min)+4, min)
+	sb.WriteString(`<polyline class="line" points="`)
+	for i, fr:=range plotted { fmt.Fprintf(sb, "%.1f,%.1f ", xOf(i), yOf(value(fr))) }
+	sb.WriteString(`"/>`)
+	for i, fr:=range plotted {
+		class:="stacked"
+		if fr.Status==FSSkipped { class="skipped" }
+		fmt.Fprintf(sb, `<circle cx="%.1f" cy="%.1f" r="3" class="%s"><title>Frame %d: %.4g</title></circle>`, xOf(i), yOf(value(fr)), class, fr.ID, value(fr))
+	}
+	return template.HTML(sb.String()+"</svg>")
+}
+
+// Template for the HTML stacking report
+var reportTemplate=template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { padding: 2px 10px; border-bottom: 1px solid #ddd; text-align: right; }
+th.l, td.l { text-align: left; }
+.chart { display: block; margin-bottom: 1em; font-size: 11px; }
+.chart .title { font-size: 13px; font-weight: bold; }
+.chart .axis { stroke: #888; }
+.chart .line { fill: none; stroke: #59c; }
+.chart .stacked { fill: #396; }
+.chart .skipped, tr.skipped { fill: #e80; color: #c60; }
+tr.failed { color: #c00; }
+figure { display: inline-block; margin: 0 1em 1em 0; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated}}. {{.NumStacked}} of {{.NumFrames}} frames stacked, {{.NumSkipped}} skipped in alignment, {{.NumFailed}} failed to load or preprocess.</p>
+
+<h2>Frames</h2>
+{{range .Charts}}{{.}}{{end}}
+
+<h2>Rejected frames</h2>
+{{if .Rejected}}<table>
+<tr><th>ID</th><th class="l">File</th><th class="l">Reason</th></tr>
+{{range .Rejected}}<tr class="{{if eq .Status 2}}failed{{else}}skipped{{end}}"><td>{{.ID}}</td><td class="l">{{.FileName}}</td><td class="l">{{if eq .Status 2}}failed to load or preprocess, see log{{else}}skipped in alignment, residual above limit or too few stars matched{{end}}</td></tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+
+<h2>Pixel rejection</h2>
+{{if .Batches}}<table>
+<tr><th>Batch</th><th>Frames</th><th>Sigma low</th><th>Sigma high</th><th>Clipped low</th><th>Clipped high</th></tr>
+{{range $i, $b:=.Batches}}<tr><td>{{$i}}</td><td>{{$b.Frames}}</td><td>{{printf "%.3g" $b.SigLow}}</td><td>{{printf "%.3g" $b.SigHigh}}</td><td>{{printf "%.3f%%" $b.ClipLow}}</td><td>{{printf "%.3f%%" $b.ClipHigh}}</td></tr>
+{{end}}</table>{{else}}<p>Not available for this stacking method.</p>{{end}}
+
+<h2>Images</h2>
+{{if .RefThumb}}<figure><img src="{{.RefThumb}}" alt="Reference frame"><figcaption>Reference frame {{.RefID}}</figcaption></figure>{{end}}
+{{if .StackThumb}}<figure><img src="{{.StackThumb}}" alt="Stack"><figcaption>Stack{{with .Stack}}: stars {{len .Stars}}, HFR {{printf "%.2f" .HFR}}, exposure {{.Exposure}}s{{with .Stats}}, noise {{printf "%.4g" .Noise}}{{end}}{{end}}</figcaption></figure>{{end}}
+
+<h2>Frame details</h2>
+<table>
+<tr><th>ID</th><th class="l">File</th><th>Stars</th><th>HFR</th><th>Ecc</th><th>Angle</th><th>Location</th><th>Scale</th><th>Noise</th><th>Residual</th></tr>
+{{range .Frames}}<tr{{if eq .Status 2}} class="failed"{{else if eq .Status 3}} class="skipped"{{end}}><td>{{.ID}}</td><td class="l">{{.FileName}}</td><td>{{.Stars}}</td><td>{{printf "%.2f" .HFR}}</td><td>{{printf "%.3f" .Ecc}}</td><td>{{printf "%.0f" .Angle}}</td><td>{{printf "%.4g" .Location}}</td><td>{{printf "%.4g" .Scale}}</td><td>{{printf "%.4g" .Noise}}</td><td>{{printf "%.3g" .Residual}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
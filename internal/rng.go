@@ -0,0 +1,72 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"github.com/valyala/fastrand"
+	"math"
+	"math/rand"
+)
+
+
+// Fixed seed for random sampling in estimators, so their results are reproducible across runs
+const samplingSeed int64 = 0x2545f491
+
+// Fast xorshift pseudorandom number generator for sampling. Not safe for concurrent use
+type RNG struct {
+	x uint32
+}
+
+// Creates a new random number generator, seeded with the given seed if nonzero, else randomly
+func NewRNG(seed int64) RNG {
+	if seed==0 { return RNG{fastrand.Uint32()|1} }
+	x:=uint32(seed)^uint32(seed>>32)
+	if x==0 { x=0x9e3779b9 }
+	return RNG{x}
+}
+
+// Returns a pseudorandom uint32
+func (r *RNG) Uint32() uint32 {
+	x:=r.x
+	x^=x<<13
+	x^=x>>17
+	x^=x<<5
+	r.x=x
+	return x
+}
+
+// Returns a pseudorandom uint32 in the range [0..maxN)
+func (r *RNG) Uint32n(maxN uint32) uint32 {
+	return uint32((uint64(r.Uint32())*uint64(maxN))>>32)
+}
+
+// Returns a pseudorandom float32 in the range [0..1)
+func (r *RNG) Float32() float32 {
+	return float32(r.Uint32()>>8)*(1.0/(1<<24))
+}
+
+// Returns a normally distributed pseudorandom float32 with mean 0 and standard deviation 1, via the Box-Muller transform
+func (r *RNG) NormFloat32() float32 {
+	u1, u2:=1-r.Float32(), r.Float32()  // u1 in (0..1], so the logarithm is finite
+	return float32(math.Sqrt(-2*math.Log(float64(u1)))*math.Cos(2*math.Pi*float64(u2)))
+}
+
+// Returns a pseudorandom permutation of the integers [0..n), reproducible if the given seed is nonzero
+func RandomPerm(n int, seed int64) []int {
+	if seed==0 { return rand.Perm(n) }
+	return rand.New(rand.NewSource(seed)).Perm(n)
+}
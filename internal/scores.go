@@ -0,0 +1,91 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+
+// A per-frame score for export, with name and value function
+type frameScore struct {
+	Name  string
+	Title string
+	Value func(fr *FrameReport) float32
+}
+
+// Per-frame scores for export, in column order
+var frameScores=[]frameScore{
+	{"stars",      "Stars",                      func(fr *FrameReport) float32 { return float32(fr.Stars) }},
+	{"hfr",        "Half-flux radius (pixels)",  func(fr *FrameReport) float32 { return fr.HFR }},
+	{"fwhm",       "FWHM (pixels)",              func(fr *FrameReport) float32 { return 2*fr.HFR }},
+	{"ecc",        "Eccentricity",               func(fr *FrameReport) float32 { return fr.Ecc }},
+	{"angle",      "Elongation angle (degrees)", func(fr *FrameReport) float32 { return fr.Angle }},
+	{"noise",      "Noise",                      func(fr *FrameReport) float32 { return fr.Noise }},
+	{"background", "Background",                 func(fr *FrameReport) float32 { return fr.Background }},
+	{"location",   "Location",                   func(fr *FrameReport) float32 { return fr.Location }},
+	{"scale",      "Scale",                      func(fr *FrameReport) float32 { return fr.Scale }},
+	{"residual",   "Alignment residual",         func(fr *FrameReport) float32 { return fr.Residual }},
+	{"weight",     "Stacking weight",            func(fr *FrameReport) float32 { return fr.Weight }},
+}
+
+// Writes the per-frame scores of the report to the given CSV file, one row per frame in order of IDs.
+// Frames which failed to load or preprocess have zero scores
+func (r *StackReport) WriteScoresCSV(fileName string) error {
+	return WriteFileAtomic(fileName, func(w io.Writer) error {
+		cw:=csv.NewWriter(w)
+		header:=[]string{"id", "file", "status"}
+		for _, s:=range frameScores { header=append(header, s.Name) }
+		if err:=cw.Write(header); err!=nil { return err }
+		for _, fr:=range r.sortedFrames() {
+			row:=[]string{strconv.Itoa(fr.ID), fr.FileName, fr.Status.String()}
+			for _, s:=range frameScores { row=append(row, strconv.FormatFloat(float64(s.Value(fr)), 'g', 6, 32)) }
+			if err:=cw.Write(row); err!=nil { return err }
+		}
+		cw.Flush()
+		return cw.Error()
+	})
+}
+
+// Writes trend charts of the per-frame scores of the report to the given standalone SVG file, one chart
+// per score in order of frame IDs, showing how quality evolved over the session
+func (r *StackReport) WriteScoresSVG(fileName string) error {
+	frames:=r.sortedFrames()
+	return WriteFileAtomic(fileName, func(w io.Writer) error {
+		sb:=&strings.Builder{}
+		fmt.Fprintf(sb, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"sans-serif\">\n", chartWidth, chartHeight*len(frameScores))
+		sb.WriteString(`<style>
+.chart { font-size: 11px; }
+.chart .title { font-size: 13px; font-weight: bold; }
+.chart .axis { stroke: #888; }
+.chart .line { fill: none; stroke: #59c; }
+.chart .stacked { fill: #396; }
+.chart .skipped { fill: #e80; }
+</style>
+`)
+		for i, s:=range frameScores {
+			fmt.Fprintf(sb, "<g transform=\"translate(0,%d)\">%s</g>\n", i*chartHeight, svgFrameChart(s.Title, frames, s.Value))
+		}
+		sb.WriteString("</svg>\n")
+		_, err:=io.WriteString(w, sb.String())
+		return err
+	})
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteScores(t *testing.T) {
+	dir, err:=ioutil.TempDir("", "nlscores")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+
+	lights:=[]*FITSImage{
+		{ID: 0, HFR: 2, Background: 100, Stars: []Star{{Ecc: 0.5}}, Stats: &BasicStats{Noise: 3}},
+		nil,
+		{ID: 2, HFR: 3, Background: 120, Stats: &BasicStats{Noise: 4}},
+	}
+	r:=NewStackReport("test", LSEMeanStdDev)
+	r.AddPreprocessed([]int{0, 1, 2}, []string{"a,1.fits", "b.fits", "c.fits"}, lights)
+	r.AddPostprocessed([]*FITSImage{lights[0]})
+	r.AddWeights([]*FITSImage{lights[0]}, []float32{0.5})
+
+	csvName:=filepath.Join(dir, "scores.csv")
+	if err:=r.WriteScoresCSV(csvName); err!=nil { t.Fatal(err) }
+	bytes, err:=ioutil.ReadFile(csvName)
+	if err!=nil { t.Fatal(err) }
+	want:=`id,file,status,stars,hfr,fwhm,ecc,angle,noise,background,location,scale,residual,weight
+0,"a,1.fits",stacked,1,2,4,0.5,0,3,100,0,0,0,0.5
+1,b.fits,failed,0,0,0,0,0,0,0,0,0,0,0
+2,c.fits,skipped,0,3,6,0,0,4,120,0,0,0,1
+`
+	if string(bytes)!=want { t.Errorf("got\n%s\nwant\n%s", bytes, want) }
+
+	svgName:=filepath.Join(dir, "scores.svg")
+	if err:=r.WriteScoresSVG(svgName); err!=nil { t.Fatal(err) }
+	bytes, err=ioutil.ReadFile(svgName)
+	if err!=nil { t.Fatal(err) }
+	if n:=strings.Count(string(bytes), `class="chart"`); n!=len(frameScores) { t.Errorf("%d charts; want %d", n, len(frameScores)) }
+}
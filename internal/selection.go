@@ -0,0 +1,250 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+
+// A frame selection criteria expression, like "hfr<3.2 && stars>300 && noise<0.002". Consists of comparisons
+// of a frame metric with a number, combined with && and ||, optionally grouped with parentheses
+type Criteria struct {
+	Expr string       // The original expression
+	root *critNode    // Root of the parsed expression tree
+}
+
+// Node of a parsed criteria expression. Either a logical operator with two children, or a comparison
+type critNode struct {
+	op     string     // "&&", "||", or a comparison operator
+	left   *critNode
+	right  *critNode
+	metric string     // Metric name for comparisons
+	value  float32    // Value for comparisons
+}
+
+// Returns the frame metrics available for selection criteria, by name
+func FrameMetrics(f *FITSImage) map[string]float32 {
+	m:=map[string]float32{
+		"id":       float32(f.ID),
+		"stars":    float32(len(f.Stars)),
+		"hfr":      f.HFR,
+		"fwhm":     2*f.HFR,
+		"ecc":      MedianEccentricity(f.Stars),
+		"bg":       f.Background,
+		"exposure": f.Exposure,
+		"width":    float32(f.Naxisn[0]),
+		"height":   float32(f.Pixels/f.Naxisn[0]),
+	}
+	if f.Stats!=nil {
+		m["min"], m["max"], m["mean"], m["stddev"]=f.Stats.Min, f.Stats.Max, f.Stats.Mean, f.Stats.StdDev
+		m["location"], m["scale"], m["noise"]=f.Stats.Location, f.Stats.Scale, f.Stats.Noise
+	}
+	return m
+}
+
+// Returns the sorted names of the frame metrics available for selection criteria
+func FrameMetricNames() []string {
+	f:=&FITSImage{Naxisn: []int32{1,1}, Pixels: 1, Stats: &BasicStats{}}
+	names:=[]string{}
+	for name:=range FrameMetrics(f) {
+		names=append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parses a frame selection criteria expression
+func ParseCriteria(expr string) (c *Criteria, err error) {
+	tokens, err:=critTokenize(expr)
+	if err!=nil { return nil, err }
+	if len(tokens)==0 { return nil, errors.New("Empty selection criteria") }
+	p:=&critParser{tokens: tokens}
+	root, err:=p.parseOr()
+	if err!=nil { return nil, err }
+	if p.pos<len(p.tokens) {
+		return nil, errors.New(fmt.Sprintf("Unexpected '%s' in selection criteria '%s'", p.tokens[p.pos], expr))
+	}
+	return &Criteria{Expr: expr, root: root}, nil
+}
+
+// Returns true if the given frame matches the criteria
+func (c *Criteria) Match(f *FITSImage) bool {
+	return c.root.eval(FrameMetrics(f))
+}
+
+func (n *critNode) eval(m map[string]float32) bool {
+	switch n.op {
+	case "&&": return n.left.eval(m) && n.right.eval(m)
+	case "||": return n.left.eval(m) || n.right.eval(m)
+	}
+	v:=m[n.metric]
+	switch n.op {
+	case "<":  return v< n.value
+	case "<=": return v<=n.value
+	case ">":  return v> n.value
+	case ">=": return v>=n.value
+	case "==": return v==n.value
+	case "!=": return v!=n.value
+	}
+	return false
+}
+
+// Splits a criteria expression into identifiers, numbers, operators and parentheses
+func critTokenize(expr string) (tokens []string, err error) {
+	r:=[]rune(expr)
+	for i:=0; i<len(r); {
+		c:=r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c=='(' || c==')':
+			tokens=append(tokens, string(c))
+			i++
+		case unicode.IsLetter(c):
+			j:=i+1
+			for j<len(r) && (unicode.IsLetter(r[j]) || unicode.IsDigit(r[j]) || r[j]=='_') { j++ }
+			tokens=append(tokens, strings.ToLower(string(r[i:j])))
+			i=j
+		case unicode.IsDigit(c) || c=='.' || c=='-' || c=='+':
+			j:=i+1
+			for j<len(r) && (unicode.IsDigit(r[j]) || r[j]=='.' || r[j]=='e' || r[j]=='E' ||
+			                 ((r[j]=='-' || r[j]=='+') && (r[j-1]=='e' || r[j-1]=='E'))) { j++ }
+			tokens=append(tokens, string(r[i:j]))
+			i=j
+		default:
+			j:=i+1
+			if j<len(r) && strings.ContainsRune("=&|", r[j]) { j++ }
+			op:=string(r[i:j])
+			switch op {
+			case "<", "<=", ">", ">=", "==", "!=", "&&", "||":
+			case "=": op="=="
+			default:  return nil, errors.New(fmt.Sprintf("Invalid operator '%s' in selection criteria '%s'", op, expr))
+			}
+			tokens=append(tokens, op)
+			i=j
+		}
+	}
+	return tokens, nil
+}
+
+// Recursive descent parser for criteria expressions. && binds more tightly than ||
+type critParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *critParser) peek() string {
+	if p.pos<len(p.tokens) { return p.tokens[p.pos] }
+	return ""
+}
+
+func (p *critParser) next() string {
+	t:=p.peek()
+	p.pos++
+	return t
+}
+
+func (p *critParser) parseOr() (n *critNode, err error) {
+	if n, err=p.parseAnd(); err!=nil { return nil, err }
+	for p.peek()=="||" {
+		p.next()
+		right, err:=p.parseAnd()
+		if err!=nil { return nil, err }
+		n=&critNode{op: "||", left: n, right: right}
+	}
+	return n, nil
+}
+
+func (p *critParser) parseAnd() (n *critNode, err error) {
+	if n, err=p.parseTerm(); err!=nil { return nil, err }
+	for p.peek()=="&&" {
+		p.next()
+		right, err:=p.parseTerm()
+		if err!=nil { return nil, err }
+		n=&critNode{op: "&&", left: n, right: right}
+	}
+	return n, nil
+}
+
+// Parses a parenthesized expression, or a comparison of a metric with a number in either order
+func (p *critParser) parseTerm() (n *critNode, err error) {
+	if p.peek()=="(" {
+		p.next()
+		if n, err=p.parseOr(); err!=nil { return nil, err }
+		if t:=p.next(); t!=")" { return nil, errors.New(fmt.Sprintf("Expected ')' in selection criteria, got '%s'", t)) }
+		return n, nil
+	}
+
+	a, op, b:=p.next(), p.next(), p.next()
+	switch op {
+	case "<", "<=", ">", ">=", "==", "!=":
+	default: return nil, errors.New(fmt.Sprintf("Expected comparison operator in selection criteria after '%s', got '%s'", a, op))
+	}
+	metric, value:=a, b
+	if _, err:=strconv.ParseFloat(a, 32); err==nil {
+		// number on the left, mirror the comparison
+		metric, value=b, a
+		switch op {
+		case "<":  op=">"
+		case "<=": op=">="
+		case ">":  op="<"
+		case ">=": op="<="
+		}
+	}
+	if !critIsMetric(metric) {
+		return nil, errors.New(fmt.Sprintf("Unknown metric '%s' in selection criteria, expecting one of %s", metric, strings.Join(FrameMetricNames(), ", ")))
+	}
+	v, err:=strconv.ParseFloat(value, 32)
+	if err!=nil { return nil, errors.New(fmt.Sprintf("Invalid number '%s' in selection criteria", value)) }
+	return &critNode{op: op, metric: metric, value: float32(v)}, nil
+}
+
+func critIsMetric(name string) bool {
+	for _, n:=range FrameMetricNames() {
+		if n==name { return true }
+	}
+	return false
+}
+
+
+// Copies the given file into the destination directory, or creates a symbolic link to it if link is set.
+// Returns the name of the new file
+func CopyOrLinkFile(fileName, destDir string, link bool) (destName string, err error) {
+	destName=filepath.Join(destDir, filepath.Base(fileName))
+	if link {
+		absName, err:=filepath.Abs(fileName)
+		if err!=nil { return "", err }
+		return destName, os.Symlink(absName, destName)
+	}
+
+	in, err:=os.Open(fileName)
+	if err!=nil { return "", err }
+	defer in.Close()
+	return destName, WriteFileAtomic(destName, func(w io.Writer) error {
+		_, err:=io.Copy(w, in)
+		return err
+	})
+}
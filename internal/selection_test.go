@@ -0,0 +1,42 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestCriteriaMatch(t *testing.T) {
+	f:=&FITSImage{ID: 3, Naxisn: []int32{10, 10}, Pixels: 100, HFR: 2.5, Stars: make([]Star, 400), Stats: &BasicStats{Noise: 0.001}}
+	cases:=map[string]bool{
+		"hfr<3.2 && stars>300 && noise<0.002": true,
+		"hfr<2 || stars>=400":                 true,
+		"hfr<2 || stars>400":                  false,
+		"(hfr<2 || id==3) && width=10":        true,
+		"hfr<2 || id==3 && width!=10":         false,
+		"3 > HFR":                             true,
+		"fwhm>=5 && height==1e1":              true,
+	}
+	for expr, want:=range cases {
+		c, err:=ParseCriteria(expr)
+		if err!=nil { t.Errorf("%s: %s", expr, err); continue }
+		if got:=c.Match(f); got!=want { t.Errorf("%s: got %t want %t", expr, got, want) }
+	}
+
+	for _, expr:=range []string{"", "hfr", "hfr<", "hfr<x", "foo>1", "(hfr<1", "hfr<1 &&", "hfr<1 & stars>2", "hfr<1 stars>2"} {
+		if _, err:=ParseCriteria(expr); err==nil { t.Errorf("%s: expected error", expr) }
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+
+// Calculates a signal-to-noise map of the given stack. The signal of each pixel is its value above the background
+// location. The noise is modeled per region of gridSize x gridSize pixels, estimated from the high-frequency
+// component of the stack within that region. This includes the shot noise of bright structures, which a global
+// estimate misses. Regions without a valid estimate, e.g. with NaNs, fall back to the global noise of the stack
+func SNRMap(stack *FITSImage, gridSize int32, lsEst LSEstimatorMode) (res *FITSImage, err error) {
+	if stack.Stats==nil { return nil, errors.New("Stack has no statistics for the SNR map") }
+	if gridSize<3 { return nil, errors.New(fmt.Sprintf("Invalid SNR grid size %d, must be at least 3", gridSize)) }
+	width, height:=stack.Naxisn[0], stack.Pixels/stack.Naxisn[0]
+	background:=stack.Stats.Location
+	globalNoise:=stack.Stats.Noise
+	if !validNoise(globalNoise) { globalNoise=stack.Stats.Scale }
+	if !validNoise(globalNoise) { return nil, errors.New("Stack has no valid noise estimate for the SNR map") }
+
+	data:=make([]float32, len(stack.Data))
+	buffer:=make([]float32, int(gridSize)*int(gridSize))
+	for y0:=int32(0); y0<height; y0+=gridSize {
+		y1:=y0+gridSize
+		if y1>height { y1=height }
+		for x0:=int32(0); x0<width; x0+=gridSize {
+			x1:=x0+gridSize
+			if x1>width { x1=width }
+
+			// estimate noise in this region, if it is large enough for the 3x3 estimator
+			noise:=globalNoise
+			if x1-x0>=3 && y1-y0>=3 {
+				cell:=buffer[:(x1-x0)*(y1-y0)]
+				for y:=y0; y<y1; y++ {
+					copy(cell[(y-y0)*(x1-x0):], stack.Data[y*width+x0 : y*width+x1])
+				}
+				if n:=EstimateNoise(cell, x1-x0, NEImmerkaer); validNoise(n) { noise=n }
+			}
+
+			// divide signal by noise
+			factor:=1/noise
+			for y:=y0; y<y1; y++ {
+				for x:=x0; x<x1; x++ {
+					i:=y*width+x
+					data[i]=(stack.Data[i]-background)*factor
+				}
+			}
+		}
+	}
+
+	res=&FITSImage{
+		Header: NewFITSHeader(),
+		Bitpix: -32,
+		Bzero : 0,
+		Naxisn: append([]int32(nil), stack.Naxisn...), // clone slice
+		Pixels: stack.Pixels,
+		Data  : data,
+		Trans : IdentityTransform2D(),
+	}
+	res.Stats, err=CalcExtendedStats(data, width, lsEst)
+	return res, err
+}
+
+// Returns true if the given noise estimate is usable as divisor
+func validNoise(n float32) bool {
+	return n>0 && !math.IsInf(float64(n), 0)
+}
+
+
+// Minimum SNR for a pixel to count as detected signal rather than noise
+const SNRDetection = 3
+
+// Summary of a signal-to-noise map, to judge whether more integration time is needed
+type SNRSummary struct {
+	Target      float32  // Target SNR
+	FracSignal  float32  // Fraction of pixels with detected signal, i.e. an SNR of at least SNRDetection
+	FracTarget  float32  // Fraction of pixels reaching the target SNR
+	FaintMedian float32  // Median SNR of the faint signal, i.e. detected pixels below the target SNR. 0 if none
+	Factor      float32  // Factor of integration time for the faint median to reach the target, as the SNR grows with its square root
+}
+
+// Summarizes the given signal-to-noise map with regards to the given target SNR. Skips NaNs
+func SummarizeSNR(snr []float32, target float32) (s SNRSummary) {
+	s.Target=target
+	faint:=[]float32{}
+	numValid, numSignal, numTarget:=0, 0, 0
+	for _, v:=range snr {
+		if math.IsNaN(float64(v)) { continue }
+		numValid++
+		if v<SNRDetection { continue }
+		numSignal++
+		if v>=target {
+			numTarget++
+		} else {
+			faint=append(faint, v)
+		}
+	}
+	if numValid==0 { return s }
+	s.FracSignal=float32(numSignal)/float32(numValid)
+	s.FracTarget=float32(numTarget)/float32(numValid)
+	if len(faint)>0 {
+		s.FaintMedian=QSelectMedianFloat32(faint)
+		s.Factor=(target/s.FaintMedian)*(target/s.FaintMedian)
+	} else {
+		s.Factor=1
+	}
+	return s
+}
+
+// Pretty print SNR summary to string
+func (s SNRSummary) String() string {
+	return fmt.Sprintf("%.1f%% of pixels have detected signal, %.1f%% reach SNR %.3g. Faint signal has median SNR %.3g, needs %.2fx the integration time to reach SNR %.3g",
+		s.FracSignal*100, s.FracTarget*100, s.Target, s.FaintMedian, s.Factor, s.Target)
+}
+
+// Returns a copy of the given signal-to-noise map for 8-bit export, mapping SNR 0 to black,
+// the target SNR to middle gray and twice the target SNR and above to white
+func (f *FITSImage) SNRPreview(target float32) *FITSImage {
+	preview:=*f
+	preview.Data=make([]float32, len(f.Data))
+	factor:=0.5/target
+	for i, d:=range f.Data {
+		v:=d*factor
+		if math.IsNaN(float64(v)) || v<0 { v=0 } else if v>1 { v=1 }
+		preview.Data[i]=v
+	}
+	return &preview
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestSNRMap(t *testing.T) {
+	// background 100 with unit noise, and a bright region with four times the noise on the right quarter
+	width, height:=int32(128), int32(64)
+	rng:=RNG{42}
+	data:=make([]float32, width*height)
+	for i:=range data {
+		if int32(i)%width<width*3/4 {
+			data[i]=100+rng.NormFloat32()
+		} else {
+			data[i]=200+4*rng.NormFloat32()
+		}
+	}
+	stack:=&FITSImage{Naxisn: []int32{width, height}, Pixels: width*height, Data: data}
+	var err error
+	stack.Stats, err=CalcExtendedStats(data, width, LSEMedianMAD)
+	if err!=nil { t.Fatal(err) }
+
+	snr, err:=SNRMap(stack, 32, LSEMedianMAD)
+	if err!=nil { t.Fatal(err) }
+	left, right:=float32(0), float32(0)
+	for y:=int32(0); y<height; y++ {
+		left +=snr.Data[y*width+10]
+		right+=snr.Data[y*width+110]
+	}
+	left/=float32(height)
+	right/=float32(height)
+
+	// the background location is dominated by the left three quarters, the bright region has SNR of about (200-100)/4
+	if left< -1 || left>1 { t.Errorf("background SNR %f; want about 0", left) }
+	if right<20 || right>30 { t.Errorf("bright region SNR %f; want about 25", right) }
+
+	s:=SummarizeSNR([]float32{0, 1, 2, 4, 4, 4, 10, 20}, 8)
+	if s.FracSignal!=0.625 || s.FracTarget!=0.25 || s.FaintMedian!=4 || s.Factor!=4 {
+		t.Errorf("got %+v; want FracSignal 0.625 FracTarget 0.25 FaintMedian 4 Factor 4", s)
+	}
+
+	if _, err=SNRMap(stack, 2, LSEMedianMAD); err==nil { t.Errorf("grid size 2 accepted; want error") }
+}
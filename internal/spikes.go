@@ -0,0 +1,91 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+)
+
+
+// Renders cosmetic diffraction spikes on the stars of an RGB image, like the spider vanes of a reflector produce.
+// Stars with a mass above threshold times the mass of the brightest star receive four spikes at the given angle
+// in degrees. Spike length scales with the square root of relative star mass, reaching length pixels for the
+// brightest star. Spikes take the color of the star center and are blended in with the given intensity in [0,1].
+// Expects a stretched image normalized to [0,1]. Returns the number of stars rendered
+func (f *FITSImage) RenderSpikes(stars []Star, threshold, length, angle, intensity float32) (numRendered int) {
+	if len(stars)==0 || len(f.Naxisn)!=3 || f.Naxisn[2]!=3 { return 0 }
+	width, height:=f.Naxisn[0], f.Naxisn[1]
+	l:=int(width*height)
+
+	maxMass:=float32(0)
+	for _, s:=range stars {
+		if s.Mass>maxMass { maxMass=s.Mass }
+	}
+	if maxMass<=0 { return 0 }
+
+	sin, cos:=math.Sincos(float64(angle)*math.Pi/180)
+	sinA, cosA:=float32(sin), float32(cos)
+	for _, s:=range stars {
+		rel:=s.Mass/maxMass
+		if rel<threshold { continue }
+		spikeLen:=length*float32(math.Sqrt(float64(rel)))
+		spikeWidth:=0.5+0.25*s.HFR
+		if spikeLen<=2*spikeWidth { continue }
+
+		// color of the star center, normalized so the brightest channel is 1
+		xc, yc:=int32(s.X+0.5), int32(s.Y+0.5)
+		if xc<0 || yc<0 || xc>=width || yc>=height { continue }
+		var color [3]float32
+		colorMax:=float32(0)
+		for c:=0; c<3; c++ {
+			color[c]=f.Data[c*l+int(yc*width+xc)]
+			if color[c]>colorMax { colorMax=color[c] }
+		}
+		if colorMax<=0 { continue }
+		for c:=0; c<3; c++ { color[c]/=colorMax }
+
+		// blend both crossing spikes into the bounding box of the star
+		r:=int32(spikeLen+1)
+		for y:=yc-r; y<=yc+r; y++ {
+			if y<0 || y>=height { continue }
+			for x:=xc-r; x<=xc+r; x++ {
+				if x<0 || x>=width { continue }
+				dx, dy:=float32(x)-s.X, float32(y)-s.Y
+				p:=float32(0)
+				for arm:=0; arm<2; arm++ {
+					along :=dx*cosA+dy*sinA
+					across:=dy*cosA-dx*sinA
+					if arm==1 { along, across=across, along }
+					if along<0 { along=-along }
+					if along>=spikeLen { continue }
+					falloff:=1-along/spikeLen
+					q:=falloff*falloff*float32(math.Exp(float64(-across*across/(2*spikeWidth*spikeWidth))))
+					if q>p { p=q }
+				}
+				if p<1e-3 { continue }
+				p*=intensity
+				offset:=int(y*width+x)
+				for c:=0; c<3; c++ {
+					v:=f.Data[c*l+offset]
+					f.Data[c*l+offset]=1-(1-v)*(1-p*color[c])  // screen blend
+				}
+			}
+		}
+		numRendered++
+	}
+	return numRendered
+}
@@ -17,6 +17,7 @@
 package internal
 
 import (
+	"context"
 	"errors"
 	"math"
 	"runtime"
@@ -32,119 +33,249 @@ const (
 	StWinsorSigma
 	StLinearFit
 	StAuto
+	StPercentile
+	StSum
+	StIntAverage
+	StMax
+	StMin
 )
 
+// Returns true if the given stacking mode clips outliers based on sigmaLow and sigmaHigh
+func isClippingMode(mode StackMode) bool {
+	return (mode>=StSigma && mode<=StPercentile)
+}
+
 
-// Auto-select stacking mode based on number of frames
-func autoSelectStackingMode(l int) StackMode {
-	if l>=25 {
-		return StLinearFit   
-    } else if l>=15 {
-    	return StWinsorSigma 
-    } else if l>= 6 {
-    	return StSigma       
-    } else {
-    	return StMean      
-    }
+// Returns true if a clipping stacker should stop iterating on the current pixel. This is the case
+// if the fraction of values clipped in the last iteration is at or below the convergence threshold,
+// or if the maximum number of iterations has been reached
+func clippingConverged(clipped, before int, iter, maxIter int32, convergence float32) bool {
+	return float32(clipped)<=convergence*float32(before) || iter+1>=maxIter
 }
 
 
-// Stack a set of light frames. Limits parallelism to the number of available cores
-func Stack(lights []*FITSImage, mode StackMode, weights []float32, refMedian, sigmaLow, sigmaHigh float32) (result *FITSImage, numClippedLow, numClippedHigh int32, err error) {
+// Calculate mean and standard deviation of the given values, with 64-bit accumulation if precision is 64
+func stackMeanStdDev(xs []float32, precision int32) (mean, stdDev float32) {
+	if precision!=64 { return calcMeanStdDev(xs) }
+	xmean:=float64(0)
+	for _,x:=range(xs) { xmean+=float64(x) }
+	xmean/=float64(len(xs))
+	xvar:=float64(0)
+	for _,x:=range(xs) { diff:=float64(x)-xmean; xvar+=diff*diff }
+	xvar/=float64(len(xs))
+	return float32(xmean), float32(math.Sqrt(xvar))
+}
+
+// Calculate the weighted mean of the given values, with 64-bit accumulation if precision is 64.
+// Falls back to the unweighted mean if all weights are zero
+func stackWeightedMean(xs, weights []float32, precision int32) float32 {
+	if precision!=64 {
+		weightedSum, weightsSum:=float32(0), float32(0)
+		for i,x:=range xs {
+			weightedSum+=x * weights[i]
+			weightsSum +=weights[i]
+		}
+		if weightsSum==0 { mean, _:=MeanStdDev(xs); return mean }
+		return weightedSum/weightsSum
+	}
+	ws, wsSum:=float64(0), float64(0)
+	for i,x:=range xs {
+		ws   +=float64(x) * float64(weights[i])
+		wsSum+=float64(weights[i])
+	}
+	if wsSum==0 { mean, _:=stackMeanStdDev(xs, precision); return mean }
+	return float32(ws/wsSum)
+}
+
+
+// Target size in bytes of one band across all frames when stacking, so the band fits into the per-core cache
+const stackBandBytes=256*1024
+
+// Splits an image with the given number of pixels and row width into horizontal bands of whole rows, sized
+// so one band across the given number of frames fits into the per-core cache. Returns the number of rows per band
+func stackBandRows(pixels, width, numFrames int) int {
+	if width<=0 || width>pixels { width=pixels }
+	rows:=stackBandBytes/(4*width*numFrames)
+	if rows<1 { rows=1 }
+	return rows
+}
+
+// Calls work for each horizontal band [lower, upper) of an image with the given number of pixels and row width,
+// where bands are sized for the given number of frames. Runs each band as a task on the shared worker pool with the
+// priority of the context, at most one per available core. The worker index passed to work allows for per-worker
+// state, and is below runtime.NumCPU(). Skips bands not yet started once the context is cancelled, 
+// and returns after all bands are done
+func forEachBand(ctx context.Context, pixels, width, numFrames int, work func(worker, lower, upper int)) {
+	if width<=0 || width>pixels { width=pixels }
+	bandSize:=stackBandRows(pixels, width, numFrames)*width
+	numWorkers:=runtime.NumCPU()
+
+	// hand out worker indices for per-worker state. The group limit ensures one is always free
+	workers:=make(chan int, numWorkers)
+	for w:=0; w<numWorkers; w++ { workers<-w }
+
+	group:=DefaultPool.NewGroup(ctx, numWorkers)
+	for lower:=0; lower<pixels; lower+=bandSize {
+		upper:=lower+bandSize
+		if upper>pixels { upper=pixels }
+		lower:=lower
+		group.Go(func() {
+			w:=<-workers
+			work(w, lower, upper)
+			workers<-w
+		})
+	}
+	group.Wait()
+}
+
+
+// Stack a set of light frames. Processes horizontal bands across all frames in parallel, one worker per core.
+// Clipping modes iterate at most maxIter times per pixel (0=unlimited), and stop once
+// the fraction of values clipped in an iteration is at or below convergence. Stats use the given estimator.
+// Sum stacking rescales pixels missing in some frames to the full number of frames if rescale is set.
+// Sums accumulate with the given precision, 32 or 64 bits, and are converted back to float32 per pixel.
+// Lights may be packed, and are unpacked on the fly per band. Stops early and returns the context error if the context is cancelled,
+// or the error if a frame fails to unpack
+func Stack(ctx context.Context, lights []*FITSImage, mode StackMode, weights []float32, refMedian, sigmaLow, sigmaHigh float32, maxIter int32, convergence float32, rescale bool, precision int32, lsEst LSEstimatorMode) (result *FITSImage, numClippedLow, numClippedHigh int32, err error) {
+	defer StartStage(StageStack)()
+
 	// validate stacking modes and perform automatic mode selection if necesssary
-	if mode<StMedian || mode>StAuto {
+	if mode<StMedian || mode>StMin {
 		return nil, -1, -1, errors.New("invalid stacking mode")
 	}
-	if mode==StAuto { 
-		mode=autoSelectStackingMode(len(lights))
-		LogPrintf("Auto-selected stacking mode %d based on %d frames\n", mode, len(lights))
-	}
 
 	// create return value array
-	data:=make([]float32,len(lights[0].Data))
-
-	// split into 8 MB work packages, no fewer than 8*NumCPU()
-	numBatches:=4*len(lights)*len(lights[0].Data)/(8192*1024)
-	if numBatches < 8*runtime.NumCPU() { numBatches=8*runtime.NumCPU() }
-	batchSize:=(len(data)+numBatches-1)/(numBatches)
-	sem   :=make(chan bool, runtime.NumCPU()) // limit parallelism to NumCPUs()
-
-	numClippedLock, numClippedLow, numClippedHigh:=sync.Mutex{}, int32(0), int32(0)
-	progressLock, progress:=sync.Mutex{}, float32(0)
-	for lower:=0; lower<len(data); lower+=batchSize {
-		upper:=lower+batchSize
-		if upper>len(data) { upper=len(data) }
-
-		sem <- true 
-		go func(lower, upper int) {
-			defer func() { <-sem }()
-
-			// subslice lightsData elements for given batch
-			ldBatch:=make([][]float32, len(lights))
-			for i, l:=range lights { ldBatch[i]=l.Data[lower:upper] }
-
-			// run stacking for the given batch
-			switch mode {
-			case StMedian:
-				StackMedian(ldBatch, refMedian, data[lower:upper])
-
-			case StMean: 
-				if weights==nil {
-					StackMean(ldBatch, refMedian, data[lower:upper])
-				} else {
-					StackMeanWeighted(ldBatch, weights, refMedian, data[lower:upper])
-				}
-
-			case StSigma:
-				var clipLow, clipHigh int32
-				if weights==nil {
-					clipLow, clipHigh=StackSigma(ldBatch, refMedian, sigmaLow, sigmaHigh, data[lower:upper])
-				} else {
-					clipLow, clipHigh=StackSigmaWeighted(ldBatch, weights, refMedian, sigmaLow, sigmaHigh, data[lower:upper])
-				}
-				numClippedLock.Lock()
-				numClippedLow+=clipLow
-				numClippedHigh+=clipHigh
-				numClippedLock.Unlock()
-
-			case StWinsorSigma:
-				var clipLow, clipHigh int32
-				if weights==nil {
-					clipLow, clipHigh=StackWinsorSigma(ldBatch, refMedian, sigmaLow, sigmaHigh, data[lower:upper])
-				} else {
-					clipLow, clipHigh=StackWinsorSigmaWeighted(ldBatch, weights, refMedian, sigmaLow, sigmaHigh, data[lower:upper])
-				}
-				numClippedLock.Lock()
-				numClippedLow+=clipLow
-				numClippedHigh+=clipHigh
-				numClippedLock.Unlock()
-
-			case StLinearFit:
-				clipLow, clipHigh:=StackLinearFit(ldBatch, refMedian, sigmaLow, sigmaHigh, data[lower:upper])
-				numClippedLock.Lock()
-				numClippedLow+=clipLow
-				numClippedHigh+=clipHigh
-				numClippedLock.Unlock()
-			} 
-
-			// display progress indicator
-			progressLock.Lock()
-			progress+=float32(batchSize)/float32(len(data))
-			LogPrintf("\r%d%%", int(progress*100))
-			progressLock.Unlock()
-
-		}(lower, upper)
-	}
-	for i:=0; i<cap(sem); i++ {  // wait for goroutines to finish
-		sem <- true
+	data:=make([]float32,lights[0].numValues())
+
+	// iterations cannot exceed the number of frames, as each iteration but the last clips at least one value
+	if maxIter<=0 || maxIter>int32(len(lights)) { maxIter=int32(len(lights)) }
+
+	// per-worker clipping statistics, merged after stacking, and per-worker scratch space for clipping per band
+	numWorkers:=runtime.NumCPU()
+	workerClippedLow, workerClippedHigh:=make([]int32, numWorkers), make([]int32, numWorkers)
+	workerIterLow, workerIterHigh, workerModeCounts:=make([][]int32, numWorkers), make([][]int32, numWorkers), make([][]int32, numWorkers)
+	clipLowIter, clipHighIter:=make([][]int32, numWorkers), make([][]int32, numWorkers)
+	for w:=0; w<numWorkers; w++ {
+		workerIterLow[w], workerIterHigh[w], workerModeCounts[w]=make([]int32, maxIter), make([]int32, maxIter), make([]int32, StMin+1)
+		clipLowIter[w], clipHighIter[w]=make([]int32, maxIter), make([]int32, maxIter)
 	}
+	progressLock, progress, lastPercent:=sync.Mutex{}, 0, -1
+
+	// the first error unpacking frames cancels the remaining bands
+	bandCtx, cancel:=context.WithCancel(ctx)
+	defer cancel()
+	errLock, bandErr:=sync.Mutex{}, error(nil)
+
+	forEachBand(bandCtx, len(data), bandWidth(lights), len(lights), func(w, lower, upper int) {
+		// subslice lightsData elements for given band, unpacking packed frames
+		ldBatch, release, err:=gatherLights(lights, lower, upper)
+		if err!=nil {
+			errLock.Lock()
+			if bandErr==nil { bandErr=err }
+			errLock.Unlock()
+			cancel()
+			return
+		}
+		defer release()
+		for i:=range clipLowIter[w] { clipLowIter[w][i], clipHighIter[w][i]=0, 0 }
+		clipLow, clipHigh:=int32(0), int32(0)
+
+		// run stacking for the given band
+		switch mode {
+		case StMedian:
+			StackMedian(ldBatch, refMedian, data[lower:upper])
+
+		case StMean: 
+			if weights==nil {
+				StackMean(ldBatch, refMedian, precision, data[lower:upper])
+			} else {
+				StackMeanWeighted(ldBatch, weights, refMedian, precision, data[lower:upper])
+			}
+
+		case StSigma:
+			if weights==nil {
+				clipLow, clipHigh=StackSigma(ldBatch, refMedian, sigmaLow, sigmaHigh, maxIter, convergence, precision, data[lower:upper], clipLowIter[w], clipHighIter[w])
+			} else {
+				clipLow, clipHigh=StackSigmaWeighted(ldBatch, weights, refMedian, sigmaLow, sigmaHigh, maxIter, convergence, precision, data[lower:upper], clipLowIter[w], clipHighIter[w])
+			}
+
+		case StWinsorSigma:
+			if weights==nil {
+				clipLow, clipHigh=StackWinsorSigma(ldBatch, refMedian, sigmaLow, sigmaHigh, maxIter, convergence, precision, data[lower:upper], clipLowIter[w], clipHighIter[w])
+			} else {
+				clipLow, clipHigh=StackWinsorSigmaWeighted(ldBatch, weights, refMedian, sigmaLow, sigmaHigh, maxIter, convergence, precision, data[lower:upper], clipLowIter[w], clipHighIter[w])
+			}
+
+		case StLinearFit:
+			clipLow, clipHigh=StackLinearFit(ldBatch, refMedian, sigmaLow, sigmaHigh, maxIter, convergence, precision, data[lower:upper], clipLowIter[w], clipHighIter[w])
+
+		case StAuto:
+			clipLow, clipHigh=StackAdaptive(ldBatch, weights, refMedian, sigmaLow, sigmaHigh, maxIter, convergence, precision, data[lower:upper], clipLowIter[w], clipHighIter[w], workerModeCounts[w])
+
+		case StPercentile:
+			clipLow, clipHigh=StackPercentile(ldBatch, refMedian, sigmaLow, sigmaHigh, precision, data[lower:upper])
+			clipLowIter[w][0], clipHighIter[w][0]=clipLow, clipHigh  // single pass
+
+		case StSum:
+			StackSum(ldBatch, refMedian, false, rescale, data[lower:upper])
+
+		case StIntAverage:
+			StackSum(ldBatch, refMedian, true, false, data[lower:upper])
+
+		case StMax:
+			StackMaxMin(ldBatch, refMedian, true, data[lower:upper])
+
+		case StMin:
+			StackMaxMin(ldBatch, refMedian, false, data[lower:upper])
+		} 
+
+		// accumulate clipping statistics for this worker
+		workerClippedLow[w]+=clipLow
+		workerClippedHigh[w]+=clipHigh
+		addInt32Slice(workerIterLow[w],  clipLowIter[w])
+		addInt32Slice(workerIterHigh[w], clipHighIter[w])
+
+		// display progress indicator when the percentage changes
+		progressLock.Lock()
+		progress+=upper-lower
+		if percent:=progress*100/len(data); percent!=lastPercent {
+			LogPrintf("\r%d%%", percent)
+			lastPercent=percent
+		}
+		progressLock.Unlock()
+	})
 	LogPrint("\r")
+	if bandErr!=nil { return nil, -1, -1, bandErr }
+	if err=ctx.Err(); err!=nil { return nil, -1, -1, err }
+
+	// merge clipping statistics of all workers
+	iterClippedLow, iterClippedHigh:=make([]int32, maxIter), make([]int32, maxIter)
+	modeCounts:=make([]int32, StMin+1)
+	for w:=0; w<numWorkers; w++ {
+		numClippedLow +=workerClippedLow[w]
+		numClippedHigh+=workerClippedHigh[w]
+		addInt32Slice(iterClippedLow,  workerIterLow[w])
+		addInt32Slice(iterClippedHigh, workerIterHigh[w])
+		addInt32Slice(modeCounts,      workerModeCounts[w])
+	}
 
-	// report back on clipping for modes that apply clipping
-	if mode>=StSigma {
+	// report back on per-pixel mode selection for adaptive stacking
+	if mode==StAuto {
+		LogPrintf("Adaptive rejection: mean %d percentile %d sigma %d winsorized sigma %d linear fit %d pixels\n",
+			modeCounts[StMean], modeCounts[StPercentile], modeCounts[StSigma], modeCounts[StWinsorSigma], modeCounts[StLinearFit])
+	}
+
+	// report back on clipping for modes that apply clipping, overall and per iteration
+	if isClippingMode(mode) {
 		LogPrintf("Clipped low %d (%.2f%%) high %d (%.2f%%)\n", 
 			numClippedLow,  float32(numClippedLow )*100.0/(float32(len(data)*len(lights))),
 			numClippedHigh, float32(numClippedHigh)*100.0/(float32(len(data)*len(lights))) )
+		for i:=0; i<len(iterClippedLow) && (numClippedLow+numClippedHigh)>0; i++ {
+			if iterClippedLow[i]==0 && iterClippedHigh[i]==0 { break }
+			LogPrintf("  Iteration %d clipped low %d (%.2f%%) high %d (%.2f%%)\n", i, 
+				iterClippedLow[i],  float32(iterClippedLow[i] )*100.0/(float32(len(data)*len(lights))),
+				iterClippedHigh[i], float32(iterClippedHigh[i])*100.0/(float32(len(data)*len(lights))) )
+		}
 	}
 
 	exposureSum:=float32(0)
@@ -164,10 +295,10 @@ func Stack(lights []*FITSImage, mode StackMode, weights []float32, refMedian, si
 		Residual: 0,
 	}
 
-	stack.Stats, err=CalcExtendedStats(data, lights[0].Naxisn[0])
+	stack.Stats, err=CalcExtendedStats(data, lights[0].Naxisn[0], lsEst)
 	if err!=nil { return nil, -1, -1, err }
 
-	if mode>=StSigma {
+	if isClippingMode(mode) {
 		return &stack, numClippedLow, numClippedHigh, nil
 	}
 	return &stack, -1, -1, nil
@@ -178,6 +309,15 @@ func Stack(lights []*FITSImage, mode StackMode, weights []float32, refMedian, si
 func StackMedian(lightsData [][]float32, refMedian float32, res []float32) {
 	gatheredFull:=make([]float32,len(lightsData))
 
+	// For small odd numbers of lights, apply a median selection network to all pixels at once.
+	// Pixels with NaNs are recalculated below
+	network:=medianNetwork(len(lightsData))
+	if network!=nil {
+		scratch:=GetArrayF32(len(lightsData)*len(res))
+		medianRowsNetwork(lightsData, network, res, scratch)
+		PutArrayF32(scratch)
+	}
+
 	// for all pixels
 	for i, _:=range lightsData[0] {
 		// gather data for this pixel across all lights, skipping NaNs
@@ -189,6 +329,7 @@ func StackMedian(lightsData [][]float32, refMedian float32, res []float32) {
 				numGathered++
 			}
 		}
+		if network!=nil && numGathered==len(lightsData) { continue }
 		if numGathered==0 {
 			// If no valid data points available, replace with overall mean.
 			// This is subobptimal, but NaN would break subsequent processing,
@@ -201,24 +342,38 @@ func StackMedian(lightsData [][]float32, refMedian float32, res []float32) {
 		}
 		gatheredCur:=gatheredFull[:numGathered]
 
-		res[i]=QSelectMedianFloat32(gatheredCur)
+		res[i]=MedianFloat32(gatheredCur)
 	}
 	gatheredFull=nil
 }
 
 
 // Stacking with mean function
-func StackMean(lightsData [][]float32, refMedian float32, res []float32) {
+func StackMean(lightsData [][]float32, refMedian float32, precision int32, res []float32) {
+	// With 32-bit precision, accumulate frame by frame with vectorized kernels. Sums are built
+	// in the same order as below, so results are identical
+	if precision!=64 {
+		counts:=make([]float32, len(res))
+		for i:=range res { res[i]=0 }
+		for _, ld:=range lightsData {
+			accumulateValid(res, counts, ld[:len(res)])
+		}
+		for i, c:=range counts {
+			if c==0 { res[i]=refMedian } else { res[i]/=c } // see below for missing data
+		}
+		return
+	}
+
 	// for all pixels
 	for i, _:=range res {
 
 		// gather data for this pixel across all lights, skipping NaNs
 		numGathered:=0
-		sum:=float32(0)
+		sum, sum64:=float32(0), float64(0)
 		for li, _:=range lightsData {
 			value:=lightsData[li][i]
 			if !math.IsNaN(float64(value)) {
-				sum+=value
+				if precision==64 { sum64+=float64(value) } else { sum+=value }
 				numGathered++
 			}
 		}
@@ -232,13 +387,30 @@ func StackMean(lightsData [][]float32, refMedian float32, res []float32) {
 			res[i]=refMedian 
 			continue	
 		}
-		res[i]=sum/float32(numGathered)
+		if precision==64 {
+			res[i]=float32(sum64/float64(numGathered))
+		} else {
+			res[i]=sum/float32(numGathered)
+		}
 	}
 }
 
 
 // Stacking with mean function and weights
-func StackMeanWeighted(lightsData [][]float32, weights []float32, refMedian float32, res []float32) {
+func StackMeanWeighted(lightsData [][]float32, weights []float32, refMedian float32, precision int32, res []float32) {
+	// With 32-bit precision, accumulate frame by frame with vectorized kernels, see StackMean()
+	if precision!=64 {
+		weightSums:=make([]float32, len(res))
+		for i:=range res { res[i]=0 }
+		for li, ld:=range lightsData {
+			accumulateValidWeighted(res, weightSums, ld[:len(res)], weights[li])
+		}
+		for i, w:=range weightSums {
+			if w==0 { res[i]=refMedian } else { res[i]/=w }
+		}
+		return
+	}
+
 	// for all pixels
 	for i, _:=range res {
 
@@ -246,17 +418,23 @@ func StackMeanWeighted(lightsData [][]float32, weights []float32, refMedian floa
 		numGathered:=0
 		sum:=float32(0)
 		weightSum:=float32(0)
+		sum64, weightSum64:=float64(0), float64(0)
 		for li, _:=range lightsData {
 			value:=lightsData[li][i]
 			if !math.IsNaN(float64(value)) {
 				weight:=weights[li]
-				sum+=value*weight
-				weightSum+=weight
+				if precision==64 {
+					sum64      +=float64(value)*float64(weight)
+					weightSum64+=float64(weight)
+				} else {
+					sum+=value*weight
+					weightSum+=weight
+				}
 				numGathered++
 			}
 		}
-		if numGathered==0 {
-			// If no valid data points available, replace with overall mean.
+		if numGathered==0 || (weightSum==0 && weightSum64==0) {
+			// If no valid data points with nonzero weight available, replace with overall mean.
 			// This is subobptimal, but NaN would break subsequent processing,
 			// unless all operations are made NaN-proof. As IEEE NaN does not
 			// compare equal to itself, this would require a full reimplementation
@@ -265,15 +443,55 @@ func StackMeanWeighted(lightsData [][]float32, weights []float32, refMedian floa
 			res[i]=refMedian 
 			continue	
 		}
-		res[i]=sum/float32(weightSum)
+		if precision==64 {
+			res[i]=float32(sum64/weightSum64)
+		} else {
+			res[i]=sum/float32(weightSum)
+		}
+	}
+}
+
+
+// Adds the valid values of data to the sums and counts them, skipping NaNs. Pure Go implementation
+func accumulateValidPureGo(sums, counts, data []float32) {
+	for i, v:=range data {
+		if !math.IsNaN(float64(v)) {
+			sums[i]+=v
+			counts[i]++
+		}
+	}
+}
+
+// Adds the valid values of data times the weight to the sums, and the weight to the weight sums, skipping NaNs.
+// Pure Go implementation
+func accumulateValidWeightedPureGo(sums, weightSums, data []float32, weight float32) {
+	for i, v:=range data {
+		if !math.IsNaN(float64(v)) {
+			sums[i]      +=v*weight
+			weightSums[i]+=weight
+		}
 	}
 }
 
+// Replaces values below the low bound with the low bound, and values above the high bound with the high bound.
+// Returns the number of values replaced. Pure go implementation
+func winsorizePureGo(xs []float32, low, high float32) (changed int) {
+	for i, x:=range xs {
+		if x<low {
+			xs[i]=low
+			changed++
+		} else if x>high {
+			xs[i]=high
+			changed++
+		}
+	}
+	return changed
+}
 
 // Mean stacking with sigma clipping. Values which are more than sigmaLow/sigmaHigh
 // standard deviations away from the mean are excluded from the average calculation.
 // The standard deviation is calculated w.r.t the mean for robustness.
-func StackSigma(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float32, res []float32) (clipLow, clipHigh int32) {
+func StackSigma(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float32, maxIter int32, convergence float32, precision int32, res []float32, clipLowIter, clipHighIter []int32) (clipLow, clipHigh int32) {
 	gatheredFull:=make([]float32,len(lightsData))
 	numClippedLow, numClippedHigh:=int32(0), int32(0)
 
@@ -301,17 +519,17 @@ func StackSigma(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float32,
 		}
 		gatheredCur:=gatheredFull[:numGathered]
 
-		// repeat until results for this pixelare stable
-		for {
+		// repeat until results for this pixel are stable, or the iteration limit is reached
+		for iter:=int32(0); ; iter++ {
 
 			// calculate median, mean, standard deviation and variance across gathered data
 			median:=QSelectMedianFloat32(gatheredCur)
-			mean, stdDev:=MeanStdDev(gatheredCur)
+			mean, stdDev:=stackMeanStdDev(gatheredCur, precision)
 
 			// remove out-of-bounds values
 			lowBound :=median - sigmaLow *stdDev
 			highBound:=median + sigmaHigh*stdDev
-			prevClipped:=numClippedLow+numClippedHigh
+			prevLen, prevClippedLow, prevClippedHigh:=len(gatheredCur), numClippedLow, numClippedHigh
 			for j:=0; j<len(gatheredCur); j++ {
 				g:=gatheredCur[j]
 				if g<lowBound {
@@ -327,8 +545,17 @@ func StackSigma(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float32,
 				}
 			}
 
-			// terminate if no more values are out of bounds, or all but one value consumed
-            if (numClippedLow+numClippedHigh)==prevClipped || len(gatheredCur)<=1 {
+			clipLowIter [iter]+=numClippedLow -prevClippedLow
+			clipHighIter[iter]+=numClippedHigh-prevClippedHigh
+
+			// terminate if all but one value consumed
+            if len(gatheredCur)<=1 {
+				res[i]=mean
+            	break
+            }
+			// terminate if converged or iteration limit reached, updating the mean if values were clipped
+            if clippingConverged(prevLen-len(gatheredCur), prevLen, iter, maxIter, convergence) {
+            	if len(gatheredCur)<prevLen { mean, _=stackMeanStdDev(gatheredCur, precision) }
 				res[i]=mean
             	break
             }
@@ -343,7 +570,7 @@ func StackSigma(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float32,
 // Weighted mean stacking with sigma clipping. Values which are more than sigmaLow/sigmaHigh
 // standard deviations away from the mean are excluded from the average calculation.
 // The standard deviation is calculated w.r.t the mean for robustness.
-func StackSigmaWeighted(lightsData [][]float32, weights []float32, refMedian, sigmaLow, sigmaHigh float32, res []float32) (clipLow, clipHigh int32) {
+func StackSigmaWeighted(lightsData [][]float32, weights []float32, refMedian, sigmaLow, sigmaHigh float32, maxIter int32, convergence float32, precision int32, res []float32, clipLowIter, clipHighIter []int32) (clipLow, clipHigh int32) {
 	gatheredFull:=make([]float32,len(lightsData))
 	weightsFull :=make([]float32,len(weights))
 	numClippedLow, numClippedHigh:=int32(0), int32(0)
@@ -384,17 +611,17 @@ func StackSigmaWeighted(lightsData [][]float32, weights []float32, refMedian, si
 		weightsCur :=weightsFull
 		*/
 
-		// repeat until results for this pixelare stable
-		for {
+		// repeat until results for this pixel are stable, or the iteration limit is reached
+		for iter:=int32(0); ; iter++ {
 
 			// calculate median, mean, standard deviation and variance across gathered data
 			median:=QSelectMedianFloat32(gatheredCur)
-			_, stdDev:=MeanStdDev(gatheredCur)
+			_, stdDev:=stackMeanStdDev(gatheredCur, precision)
 
 			// remove out-of-bounds values
 			lowBound :=median - sigmaLow *stdDev
 			highBound:=median + sigmaHigh*stdDev
-			prevClipped:=numClippedLow+numClippedHigh
+			prevLen, prevClippedLow, prevClippedHigh:=len(gatheredCur), numClippedLow, numClippedHigh
 			for j:=0; j<len(gatheredCur); j++ {
 				g:=gatheredCur[j]
 				if g<lowBound {
@@ -414,15 +641,13 @@ func StackSigmaWeighted(lightsData [][]float32, weights []float32, refMedian, si
 				}
 			}
 
-			// terminate if no more values are out of bounds, or all but one value consumed
-            if (numClippedLow+numClippedHigh)==prevClipped || len(gatheredCur)<=1 {
+			clipLowIter [iter]+=numClippedLow -prevClippedLow
+			clipHighIter[iter]+=numClippedHigh-prevClippedHigh
+
+			// terminate if converged, iteration limit reached, or all but one value consumed
+            if len(gatheredCur)<=1 || clippingConverged(prevLen-len(gatheredCur), prevLen, iter, maxIter, convergence) {
             	// calculate weighted mean
-            	weightedSum, weightsSum:=float32(0), float32(0)
-            	for i,_:=range gatheredCur {
-            		weightedSum+=gatheredCur[i] * weightsCur[i]
-            		weightsSum +=weightsCur[i]
-            	}
-				res[i]=weightedSum/weightsSum
+            	res[i]=stackWeightedMean(gatheredCur, weightsCur, precision)
             	break
             }
 		}
@@ -437,7 +662,7 @@ func StackSigmaWeighted(lightsData [][]float32, weights []float32, refMedian, si
 
 // Weighted mean stacking with sigma clipping. Values which are more than sigmaLow/sigmaHigh
 // standard deviations away from the mean are replaced with the lowest/highest valid value.
-func StackWinsorSigma(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float32, res []float32) (clipLow, clipHigh int32) {
+func StackWinsorSigma(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float32, maxIter int32, convergence float32, precision int32, res []float32, clipLowIter, clipHighIter []int32) (clipLow, clipHigh int32) {
 	gatheredFull  :=make([]float32,len(lightsData))
 	winsorizedFull:=make([]float32,len(lightsData))
 	numClippedLow, numClippedHigh:=int32(0), int32(0)
@@ -466,11 +691,11 @@ func StackWinsorSigma(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh flo
 		}
 		gatheredCur:=gatheredFull[:numGathered]
 
-		// repeat until results for this pixel are stable
-		for {
+		// repeat until results for this pixel are stable, or the iteration limit is reached
+		for iter:=int32(0); ; iter++ {
 			// calculate median and standard deviation across all frames
 			median:=QSelectMedianFloat32(gatheredCur)
-			mean, stdDev:=MeanStdDev(gatheredCur)
+			mean, stdDev:=stackMeanStdDev(gatheredCur, precision)
 
 			// calculate winsorized standard deviation (removes outliers/tighter)
 			winsorized:=winsorizedFull[0:len(gatheredCur)]
@@ -479,19 +704,10 @@ func StackWinsorSigma(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh flo
 				// replace outliers with low/high bound
 				lowBound :=median - 1.5*stdDev
 				highBound:=median + 1.5*stdDev
-				changed:=0
-				for i, w :=range winsorized {
-					if w<lowBound { 
-						winsorized[i]=lowBound
-						changed++
-					} else if w>highBound {
-						winsorized[i]=highBound
-						changed++
-					}
-				}
+				changed:=winsorize(winsorized, lowBound, highBound)
 				// median is invariant to outlier substitution, no need to recompute
 				oldStdDev:=stdDev
-				_, stdDev=MeanStdDev(winsorized) // also keep original mean
+				_, stdDev=stackMeanStdDev(winsorized, precision) // also keep original mean
 				stdDev=1.134*stdDev
 
 				factor:=float32(math.Abs(float64(stdDev-oldStdDev)))/oldStdDev
@@ -503,7 +719,7 @@ func StackWinsorSigma(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh flo
 			// remove out-of-bounds values
 			lowBound :=median - sigmaLow *stdDev
 			highBound:=median + sigmaHigh*stdDev
-			prevClipped:=numClippedLow+numClippedHigh
+			prevLen, prevClippedLow, prevClippedHigh:=len(gatheredCur), numClippedLow, numClippedHigh
 			for j:=0; j<len(gatheredCur); j++ {
 				g:=gatheredCur[j]
 				if g<lowBound {
@@ -519,8 +735,17 @@ func StackWinsorSigma(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh flo
 				}
 			}
 
-			// terminate if no more values are out of bounds, or all but one value consumed
-            if (numClippedLow+numClippedHigh)==prevClipped || len(gatheredCur)<=1 {
+			clipLowIter [iter]+=numClippedLow -prevClippedLow
+			clipHighIter[iter]+=numClippedHigh-prevClippedHigh
+
+			// terminate if all but one value consumed
+            if len(gatheredCur)<=1 {
+				res[i]=mean
+            	break
+            }
+			// terminate if converged or iteration limit reached, updating the mean if values were clipped
+            if clippingConverged(prevLen-len(gatheredCur), prevLen, iter, maxIter, convergence) {
+            	if len(gatheredCur)<prevLen { mean, _=stackMeanStdDev(gatheredCur, precision) }
 				res[i]=mean
             	break
             }
@@ -536,7 +761,7 @@ func StackWinsorSigma(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh flo
 
 // Weighted mean stacking with sigma clipping. Values which are more than sigmaLow/sigmaHigh
 // standard deviations away from the mean are replaced with the lowest/highest valid value.
-func StackWinsorSigmaWeighted(lightsData [][]float32, weights []float32, refMedian, sigmaLow, sigmaHigh float32, res []float32) (clipLow, clipHigh int32) {
+func StackWinsorSigmaWeighted(lightsData [][]float32, weights []float32, refMedian, sigmaLow, sigmaHigh float32, maxIter int32, convergence float32, precision int32, res []float32, clipLowIter, clipHighIter []int32) (clipLow, clipHigh int32) {
 	gatheredFull  :=make([]float32,len(lightsData))
 	weightsFull   :=make([]float32,len(weights))
 	winsorizedFull:=make([]float32,len(lightsData))
@@ -578,12 +803,12 @@ func StackWinsorSigmaWeighted(lightsData [][]float32, weights []float32, refMedi
 		weightsCur :=weightsFull
 		*/
 
-		// repeat until results for this pixel are stable
-		for {
+		// repeat until results for this pixel are stable, or the iteration limit is reached
+		for iter:=int32(0); ; iter++ {
 
 			// calculate median and standard deviation across all frames
 			median:=QSelectMedianFloat32(gatheredCur)
-			_, stdDev:=MeanStdDev(gatheredCur)
+			_, stdDev:=stackMeanStdDev(gatheredCur, precision)
 
 			// calculate winsorized standard deviation (removes outliers/tighter)
 			winsorized:=winsorizedFull[0:len(gatheredCur)]
@@ -592,19 +817,10 @@ func StackWinsorSigmaWeighted(lightsData [][]float32, weights []float32, refMedi
 				// replace outliers with low/high bound
 				lowBound :=median - 1.5*stdDev
 				highBound:=median + 1.5*stdDev
-				changed:=0
-				for i, w :=range winsorized {
-					if w<lowBound { 
-						winsorized[i]=lowBound
-						changed++
-					} else if w>highBound {
-						winsorized[i]=highBound
-						changed++
-					}
-				}
+				changed:=winsorize(winsorized, lowBound, highBound)
 				// median is invariant to outlier substitution, no need to recompute
 				oldStdDev:=stdDev
-				_, stdDev=MeanStdDev(winsorized) // also keep original mean
+				_, stdDev=stackMeanStdDev(winsorized, precision) // also keep original mean
 				stdDev=1.134*stdDev
 
 				factor:=float32(math.Abs(float64(stdDev-oldStdDev)))/oldStdDev
@@ -616,7 +832,7 @@ func StackWinsorSigmaWeighted(lightsData [][]float32, weights []float32, refMedi
 			// remove out-of-bounds values
 			lowBound :=median - sigmaLow *stdDev
 			highBound:=median + sigmaHigh*stdDev
-			prevClipped:=numClippedLow+numClippedHigh
+			prevLen, prevClippedLow, prevClippedHigh:=len(gatheredCur), numClippedLow, numClippedHigh
 			for j:=0; j<len(gatheredCur); j++ {
 				g:=gatheredCur[j]
 				if g<lowBound {
@@ -636,15 +852,13 @@ func StackWinsorSigmaWeighted(lightsData [][]float32, weights []float32, refMedi
 				}
 			}
 
-			// terminate if no more values are out of bounds, or all but one value consumed
-            if (numClippedLow+numClippedHigh)==prevClipped || len(gatheredCur)<=1 {
+			clipLowIter [iter]+=numClippedLow -prevClippedLow
+			clipHighIter[iter]+=numClippedHigh-prevClippedHigh
+
+			// terminate if converged, iteration limit reached, or all but one value consumed
+            if len(gatheredCur)<=1 || clippingConverged(prevLen-len(gatheredCur), prevLen, iter, maxIter, convergence) {
             	// calculate weighted mean
-            	weightedSum, weightsSum:=float32(0), float32(0)
-            	for i,_:=range gatheredCur {
-            		weightedSum+=gatheredCur[i] * weightsCur[i]
-            		weightsSum +=weightsCur[i]
-            	}
-				res[i]=weightedSum/weightsSum
+            	res[i]=stackWeightedMean(gatheredCur, weightsCur, precision)
             	break
             }
         }
@@ -660,7 +874,7 @@ func StackWinsorSigmaWeighted(lightsData [][]float32, weights []float32, refMedi
 
 // Stacking with linear regression fit. Values which are more than sigmaLow/sigmaHigh
 // standard deviations away from linear fit  are excluded from the average calculation.
-func StackLinearFit(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float32, res []float32) (clipLow, clipHigh int32) {
+func StackLinearFit(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float32, maxIter int32, convergence float32, precision int32, res []float32, clipLowIter, clipHighIter []int32) (clipLow, clipHigh int32) {
 	gatheredFull:=make([]float32,len(lightsData))
 	xs:=make([]float32,len(lightsData))
 	for i, _:=range(xs) {
@@ -694,9 +908,9 @@ func StackLinearFit(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float
 		}
 		gatheredCur:=gatheredFull[:numGathered]
 
-		// reject outliers until none left
+		// reject outliers until none left, or the iteration limit is reached
 		mean:=float32(0)
-		for {
+		for iter:=int32(0); ; iter++ {
 			// sort the data
 			QSortFloat32(gatheredCur)
 
@@ -716,6 +930,7 @@ func StackLinearFit(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float
 			//sigma=float32(math.Sqrt(float64(sigma)))
 
 			// reject outliers
+			prevClippedLow, prevClippedHigh:=numClippedLow, numClippedHigh
 			left     :=0
 			lowBound :=sigmaLow *sigma
 			highBound:=sigmaHigh*sigma
@@ -732,10 +947,19 @@ func StackLinearFit(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float
 				}				
 			}
 
+			clipLowIter [iter]+=numClippedLow -prevClippedLow
+			clipHighIter[iter]+=numClippedHigh-prevClippedHigh
+
 			if left==0 || len(gatheredCur)<3{
+				if precision==64 { mean, _=stackMeanStdDev(gatheredCur, precision) }
             	break
             }
+			prevLen:=len(gatheredCur)
 			gatheredCur=gatheredCur[left:]
+			if clippingConverged(left, prevLen, iter, maxIter, convergence) {
+				mean, _=stackMeanStdDev(gatheredCur, precision)
+				break
+			}
 		}
 		res[i]=mean
 	}
@@ -747,6 +971,137 @@ func StackLinearFit(lightsData [][]float32, refMedian, sigmaLow, sigmaHigh float
 }
 
 
+// Stacking by summing up values with 64-bit accumulation, for photometric workflows. If rescale is set, pixels
+// which are missing in some frames (NaN, e.g. after alignment) are rescaled to the full number of frames, so absolute
+// flux relationships hold across the image. If average is set, the sum is divided by the number of frames
+// and rounded to the nearest integer, to yield an average in the original integer units without float32
+// accumulation error. Pixels without any valid value are set to refMedian in every frame
+func StackSum(lightsData [][]float32, refMedian float32, average, rescale bool, res []float32) {
+	numFrames:=float64(len(lightsData))
+
+	// for all pixels
+	for i, _:=range res {
+
+		// sum up data for this pixel across all lights, skipping NaNs
+		numGathered:=0
+		sum:=float64(0)
+		for li, _:=range lightsData {
+			value:=lightsData[li][i]
+			if !math.IsNaN(float64(value)) {
+				sum+=float64(value)
+				numGathered++
+			}
+		}
+		if numGathered==0 {
+			// If no valid data points available, replace with overall mean.
+			// This is subobptimal, but NaN would break subsequent processing,
+			// unless all operations are made NaN-proof. As IEEE NaN does not
+			// compare equal to itself, this would require a full reimplementation
+			// of basic partitioning and sorting primitives on float32. 
+			// Not going down that rabbit hole for now. 
+			sum, numGathered=float64(refMedian)*numFrames, len(lightsData)
+		}
+
+		if average {
+			res[i]=float32(math.Round(sum/float64(numGathered)))
+		} else if rescale {
+			res[i]=float32(sum*numFrames/float64(numGathered))
+		} else {
+			res[i]=float32(sum)
+		}
+	}
+}
+
+
+// Stacking by taking the maximum value, e.g. for star trails, or the minimum value, e.g. for
+// inspecting artifacts. NaN values are skipped
+func StackMaxMin(lightsData [][]float32, refMedian float32, max bool, res []float32) {
+	// for all pixels
+	for i, _:=range res {
+
+		// find extreme value for this pixel across all lights, skipping NaNs
+		numGathered:=0
+		extreme:=float32(0)
+		for li, _:=range lightsData {
+			value:=lightsData[li][i]
+			if math.IsNaN(float64(value)) { continue }
+			if numGathered==0 || (max && value>extreme) || (!max && value<extreme) {
+				extreme=value
+			}
+			numGathered++
+		}
+		if numGathered==0 {
+			// If no valid data points available, replace with overall mean.
+			extreme=refMedian
+		}
+		res[i]=extreme
+	}
+}
+
+
+// Mean stacking with percentile clipping. Values which deviate from the median by more than
+// the fraction percLow/percHigh of the median are excluded from the average calculation.
+// Single pass, does not require a scale estimate, so it remains robust for very small stacks.
+func StackPercentile(lightsData [][]float32, refMedian, percLow, percHigh float32, precision int32, res []float32) (clipLow, clipHigh int32) {
+	gatheredFull:=make([]float32,len(lightsData))
+	numClippedLow, numClippedHigh:=int32(0), int32(0)
+
+	// for all pixels
+	for i, _:=range lightsData[0] {
+
+		// gather data for this pixel across all lights, skipping NaNs
+		numGathered:=0
+		for li, _:=range lightsData {
+			value:=lightsData[li][i]
+			if !math.IsNaN(float64(value)) {
+				gatheredFull[numGathered]=value
+				numGathered++
+			}
+		}
+		if numGathered==0 {
+			// If no valid data points available, replace with overall mean.
+			// This is subobptimal, but NaN would break subsequent processing,
+			// unless all operations are made NaN-proof. As IEEE NaN does not
+			// compare equal to itself, this would require a full reimplementation
+			// of basic partitioning and sorting primitives on float32. 
+			// Not going down that rabbit hole for now. 
+			res[i]=refMedian 
+			continue	
+		}
+		gatheredCur:=gatheredFull[:numGathered]
+
+		// calculate bounds relative to the median
+		median:=QSelectMedianFloat32(gatheredCur)
+		absMedian:=float32(math.Abs(float64(median)))
+		lowBound :=median - percLow *absMedian
+		highBound:=median + percHigh*absMedian
+
+		// average over values within bounds. The median itself is always within bounds
+		sum, sum64, num:=float32(0), float64(0), 0
+		for _,g:=range gatheredCur {
+			if g<lowBound {
+				numClippedLow++
+			} else if g>highBound {
+				numClippedHigh++
+			} else {
+				if precision==64 { sum64+=float64(g) } else { sum+=g }
+				num++
+			}
+		}
+		if num==0 {
+			res[i]=median
+		} else if precision==64 {
+			res[i]=float32(sum64/float64(num))
+		} else {
+			res[i]=sum/float32(num)
+		}
+	}
+
+	gatheredFull=nil
+	return numClippedLow, numClippedHigh
+}
+
+
 // Incrementally stacks the light onto the given stack, weighted by the given weight. 
 // Creates a new stack with same dimensions as light if stack is nil. 
 // Returns the modified or created stack. Does not calculate statistics, run star detections etc.
@@ -776,10 +1131,103 @@ func StackIncremental(stack, light *FITSImage, weight float32) *FITSImage {
 	return stack
 }
 
-// Finalizes an incremental stack. Divides pixel values by weight sum, and calculates extended stats
-func StackIncrementalFinalize(stack *FITSImage, weightSum float32) (err error) {
+// Incrementally combines the light with the given stack element-wise, keeping the maximum if max is set, else the minimum.
+// Creates a new stack with same dimensions as light if stack is nil. Returns the modified or created stack
+func StackIncrementalMaxMin(stack, light *FITSImage, max bool) *FITSImage {
+	if stack==nil { return StackIncremental(nil, light, 1) }
+	stack.Exposure+=light.Exposure
+	for i,d:=range light.Data {
+		if (max && d>stack.Data[i]) || (!max && d<stack.Data[i]) { stack.Data[i]=d }
+	}
+	return stack
+}
+
+// Returns the weight for combining a batch stack with the given mode into a stack of stacks. Sums add up
+// unweighted, and integer averages are weighted by their number of frames. For all other modes this is the
+// inverse variance of the measured batch noise, so cleaner batches count more. Falls back to the number
+// of frames in the batch if no noise measurement is available
+func BatchWeight(mode StackMode, frames int64, noise float32) float32 {
+	if mode==StSum        { return 1 }
+	if mode==StIntAverage { return float32(frames) }
+	if noise<=0 || math.IsNaN(float64(noise)) { return float32(frames) }
+	return 1/(noise*noise)
+}
+
+// Finalizes an incremental stack. Divides pixel values by weight sum, and calculates extended stats with the given estimator
+func StackIncrementalFinalize(stack *FITSImage, weightSum float32, lsEst LSEstimatorMode) (err error) {
 	factor:=1.0/weightSum
 	for i,d:=range stack.Data { stack.Data[i]=d*factor }
-	stack.Stats, err=CalcExtendedStats(stack.Data, stack.Naxisn[0])
+	stack.Stats, err=CalcExtendedStats(stack.Data, stack.Naxisn[0], lsEst)
 	return err
+}
+
+
+// Combines batch stacks into a stack of stacks, according to the stacking mode of the batches. Maxima and minima
+// combine element-wise. Other modes weight batches with BatchWeight, and normalize by the sum of weights unless summing.
+// Weighted sums accumulate in 64 bits with 64-bit precision
+type BatchStacker struct {
+	Mode       StackMode    // Stacking mode of the batches
+	Precision  int32        // Precision for accumulating weighted sums, 32 or 64 bits
+	Stack      *FITSImage   // Combined stack, nil until the first batch is added. Complete after finalizing
+	Sum64      []float64    // Weighted sum per pixel, used instead of the stack data with 64-bit precision
+	WeightSum  float32      // Sum of batch weights
+	NoiseVar   float64      // Sum of squared weighted batch noise, for the expected noise of the combination
+}
+
+// Creates a new batch stacker for batches stacked with the given mode, accumulating with the given precision
+func NewBatchStacker(mode StackMode, precision int32) *BatchStacker {
+	return &BatchStacker{Mode: mode, Precision: precision}
+}
+
+// Adds a batch stack with the given number of frames to the combination
+func (b *BatchStacker) Add(batch *FITSImage, frames int64) {
+	if b.Mode==StMax || b.Mode==StMin {
+		b.Stack=StackIncrementalMaxMin(b.Stack, batch, b.Mode==StMax)
+		return
+	}
+	w:=BatchWeight(b.Mode, frames, batch.Stats.Noise)
+	if b.Precision!=64 {
+		b.Stack=StackIncremental(b.Stack, batch, w)
+	} else {
+		if b.Stack==nil {
+			b.Stack=StackIncremental(nil, batch, 1)  // clone header, data is set from the sums when finalizing
+			b.Sum64=make([]float64, len(batch.Data))
+		} else {
+			b.Stack.Exposure+=batch.Exposure
+		}
+		for i,d:=range batch.Data { b.Sum64[i]+=float64(d)*float64(w) }
+	}
+	b.WeightSum+=w
+	b.NoiseVar +=float64(w)*float64(w)*float64(batch.Stats.Noise)*float64(batch.Stats.Noise)
+}
+
+// Finalizes the combined stack, and calculates extended stats with the given estimator.
+// Integer averages are rounded again after combining the rounded batch averages
+func (b *BatchStacker) Finalize(lsEst LSEstimatorMode) (*FITSImage, error) {
+	norm:=b.norm()
+	if b.Sum64!=nil {
+		factor:=1/float64(norm)
+		for i,s:=range b.Sum64 { b.Stack.Data[i]=float32(s*factor) }
+		b.Sum64, norm=nil, 1
+	}
+	if b.Mode==StIntAverage {
+		factor:=1/norm
+		for i,d:=range b.Stack.Data { b.Stack.Data[i]=float32(math.Round(float64(d*factor))) }
+		norm=1
+	}
+	err:=StackIncrementalFinalize(b.Stack, norm, lsEst)
+	return b.Stack, err
+}
+
+// Returns the expected noise of the combined stack, propagated from the measured noise of the batches.
+// Zero for maxima and minima, which do not propagate noise like weighted sums
+func (b *BatchStacker) ExpectedNoise() float32 {
+	return float32(math.Sqrt(b.NoiseVar))/b.norm()
+}
+
+// Returns the normalization factor for the combination. Sums of batches are the overall sum,
+// and extremes of batches the overall extremes
+func (b *BatchStacker) norm() float32 {
+	if b.Mode==StSum || b.Mode==StMax || b.Mode==StMin { return 1 }
+	return b.WeightSum
 }
\ No newline at end of file
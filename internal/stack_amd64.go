@@ -0,0 +1,76 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// +build amd64
+
+package internal
+
+import (
+    "github.com/klauspost/cpuid"
+)
+
+// Adds the valid values of data to the sums and counts them, skipping NaNs
+func accumulateValid(sums, counts, data []float32) {
+    if cpuid.CPU.AVX2() {
+        n:=len(data)&^7
+        accumulateValidAVX2(sums[:n], counts[:n], data[:n])
+        accumulateValidPureGo(sums[n:], counts[n:], data[n:])
+        return
+    }
+    accumulateValidPureGo(sums, counts, data)
+}
+
+// Adds the valid values of data to the sums and counts them, skipping NaNs. AVX2 implementation for multiples of 8 values
+func accumulateValidAVX2(sums, counts, data []float32)
+
+// Adds the valid values of data times the weight to the sums, and the weight to the weight sums, skipping NaNs
+func accumulateValidWeighted(sums, weightSums, data []float32, weight float32) {
+    if cpuid.CPU.AVX2() {
+        n:=len(data)&^7
+        accumulateValidWeightedAVX2(sums[:n], weightSums[:n], data[:n], weight)
+        accumulateValidWeightedPureGo(sums[n:], weightSums[n:], data[n:], weight)
+        return
+    }
+    accumulateValidWeightedPureGo(sums, weightSums, data, weight)
+}
+
+// Adds the valid values of data times the weight to the sums, and the weight to the weight sums, skipping NaNs.
+// AVX2 implementation for multiples of 8 values
+func accumulateValidWeightedAVX2(sums, weightSums, data []float32, weight float32)
+
+// Calculate mean and standard deviation of the given values
+func calcMeanStdDev(xs []float32) (mean, stdDev float32) {
+    if cpuid.CPU.AVX2() && len(xs)>=8 {
+        return calcMeanStdDevAVX2(xs)
+    }
+    return MeanStdDev(xs)
+}
+
+// Calculate mean and standard deviation of the given values. AVX2 implementation, summing in eight lanes
+func calcMeanStdDevAVX2(xs []float32) (mean, stdDev float32)
+
+// Replaces values below the low bound with the low bound, and values above the high bound with the high bound.
+// Returns the number of values replaced
+func winsorize(xs []float32, low, high float32) (changed int) {
+    if cpuid.CPU.AVX2() && cpuid.CPU.Popcnt() {
+        n:=len(xs)&^7
+        return winsorizeAVX2(xs[:n], low, high) + winsorizePureGo(xs[n:], low, high)
+    }
+    return winsorizePureGo(xs, low, high)
+}
+
+// Replaces values below the low bound with the low bound, and values above the high bound with the high bound.
+// Returns the number of values replaced. AVX2 implementation for multiples of 8 values
+func winsorizeAVX2(xs []float32, low, high float32) (changed int)
@@ -0,0 +1,228 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// +build amd64
+
+
+#include "textflag.h"
+
+DATA one<>+0x00(SB)/4, $0x3f800000
+GLOBL one<>(SB), RODATA|NOPTR, $4
+
+// func accumulateValidAVX2(sums, counts, data []float32)
+//    0(FP) 8 byte sums pointer
+//    8(FP) 8 byte sums length
+//   16(FP) 8 byte sums capacity
+//   24(FP) 8 byte counts pointer
+//   32(FP) 8 byte counts length
+//   40(FP) 8 byte counts capacity
+//   48(FP) 8 byte data pointer
+//   56(FP) 8 byte data length, multiple of 8
+//   64(FP) 8 byte data capacity
+TEXT ·accumulateValidAVX2(SB),(NOSPLIT|NOFRAME),$0-72
+    MOVQ sums_base+0(FP),DI                 // load sums pointer in DI, counts pointer in BX
+    MOVQ counts_base+24(FP),BX
+    MOVQ data_base+48(FP),SI                // load data pointer in SI, and end pointer in DX
+    MOVQ data_len+56(FP),DX
+    SHLQ $2,DX
+    ADDQ SI,DX
+
+    VBROADCASTSS one<>+0x00(SB),Y3          // broadcast 1.0 into all lanes of Y3
+
+    JMP avLoopCond
+avLoopStart:
+    VMOVUPS (SI),Y0                         // load next 8 data values
+    VCMPPS $7,Y0,Y0,Y1                      // mask of ordered, i.e. non-NaN, values in Y1
+    VANDPS Y1,Y0,Y0                         // replace NaNs with zero
+    VANDPS Y1,Y3,Y2                         // one for each valid value, zero otherwise
+    VADDPS (DI),Y0,Y0                       // update sums
+    VMOVUPS Y0,(DI)
+    VADDPS (BX),Y2,Y2                       // update counts
+    VMOVUPS Y2,(BX)
+    ADDQ $32,SI
+    ADDQ $32,DI
+    ADDQ $32,BX
+avLoopCond:
+    CMPQ SI,DX
+    JL   avLoopStart
+
+    VZEROUPPER
+    RET
+
+
+// func accumulateValidWeightedAVX2(sums, weightSums, data []float32, weight float32)
+//    0(FP) 8 byte sums pointer
+//    8(FP) 8 byte sums length
+//   16(FP) 8 byte sums capacity
+//   24(FP) 8 byte weight sums pointer
+//   32(FP) 8 byte weight sums length
+//   40(FP) 8 byte weight sums capacity
+//   48(FP) 8 byte data pointer
+//   56(FP) 8 byte data length, multiple of 8
+//   64(FP) 8 byte data capacity
+//   72(FP) 4 byte weight
+TEXT ·accumulateValidWeightedAVX2(SB),(NOSPLIT|NOFRAME),$0-76
+    MOVQ sums_base+0(FP),DI                 // load sums pointer in DI, weight sums pointer in BX
+    MOVQ weightSums_base+24(FP),BX
+    MOVQ data_base+48(FP),SI                // load data pointer in SI, and end pointer in DX
+    MOVQ data_len+56(FP),DX
+    SHLQ $2,DX
+    ADDQ SI,DX
+
+    VBROADCASTSS weight+72(FP),Y3           // broadcast weight into all lanes of Y3
+
+    JMP awLoopCond
+awLoopStart:
+    VMOVUPS (SI),Y0                         // load next 8 data values
+    VCMPPS $7,Y0,Y0,Y1                      // mask of ordered, i.e. non-NaN, values in Y1
+    VANDPS Y1,Y0,Y0                         // replace NaNs with zero
+    VMULPS Y3,Y0,Y0                         // multiply with weight
+    VANDPS Y1,Y3,Y2                         // weight for each valid value, zero otherwise
+    VADDPS (DI),Y0,Y0                       // update sums
+    VMOVUPS Y0,(DI)
+    VADDPS (BX),Y2,Y2                       // update weight sums
+    VMOVUPS Y2,(BX)
+    ADDQ $32,SI
+    ADDQ $32,DI
+    ADDQ $32,BX
+awLoopCond:
+    CMPQ SI,DX
+    JL   awLoopStart
+
+    VZEROUPPER
+    RET
+
+
+// func calcMeanStdDevAVX2(xs []float32) (mean, stdDev float32)
+//    0(FP) 8 byte xs pointer
+//    8(FP) 8 byte xs length, at least 1
+//   16(FP) 8 byte xs capacity
+//   24(FP) 4 byte return value mean
+//   28(FP) 4 byte return value standard deviation
+TEXT ·calcMeanStdDevAVX2(SB),(NOSPLIT|NOFRAME),$0-32
+    MOVQ xs_base+0(FP),SI                 // load data pointer in SI, length in CX
+    MOVQ xs_len+8(FP),CX
+    MOVQ CX,AX                              // load end pointer of multiples of 8 values in DX, and end pointer in R8
+    ANDQ $-8,AX
+    LEAQ (SI)(AX*4),DX
+    LEAQ (SI)(CX*4),R8
+    VCVTSI2SSQ CX,X2,X2                     // number of values as float in X2
+
+    // sum up values, eight lanes at a time
+    VXORPS Y0,Y0,Y0
+    MOVQ SI,DI
+    JMP msSumCond
+msSumStart:
+    VADDPS (DI),Y0,Y0
+    ADDQ $32,DI
+msSumCond:
+    CMPQ DI,DX
+    JL   msSumStart
+
+    // reduce the lanes to a scalar in X0, then add the remaining values
+    VEXTRACTF128 $1,Y0,X1
+    VADDPS X1,X0,X0
+    VMOVHLPS X0,X0,X1
+    VADDPS X1,X0,X0
+    VMOVSHDUP X0,X1
+    VADDSS X1,X0,X0
+    JMP msSumTailCond
+msSumTailStart:
+    VADDSS (DI),X0,X0
+    ADDQ $4,DI
+msSumTailCond:
+    CMPQ DI,R8
+    JL   msSumTailStart
+
+    VDIVSS X2,X0,X0                         // mean in X0, broadcast into all lanes of Y3
+    VMOVSS X0,mean+24(FP)
+    VBROADCASTSS X0,Y3
+
+    // sum up squared differences from the mean, eight lanes at a time
+    VXORPS Y4,Y4,Y4
+    MOVQ SI,DI
+    JMP msVarCond
+msVarStart:
+    VMOVUPS (DI),Y1
+    VSUBPS Y3,Y1,Y1
+    VMULPS Y1,Y1,Y1
+    VADDPS Y1,Y4,Y4
+    ADDQ $32,DI
+msVarCond:
+    CMPQ DI,DX
+    JL   msVarStart
+
+    // reduce the lanes to a scalar in X4, then add the remaining values
+    VEXTRACTF128 $1,Y4,X1
+    VADDPS X1,X4,X4
+    VMOVHLPS X4,X4,X1
+    VADDPS X1,X4,X4
+    VMOVSHDUP X4,X1
+    VADDSS X1,X4,X4
+    JMP msVarTailCond
+msVarTailStart:
+    VMOVSS (DI),X1
+    VSUBSS X3,X1,X1
+    VMULSS X1,X1,X1
+    VADDSS X1,X4,X4
+    ADDQ $4,DI
+msVarTailCond:
+    CMPQ DI,R8
+    JL   msVarTailStart
+
+    VDIVSS X2,X4,X4                         // standard deviation is the root of the variance
+    VSQRTSS X4,X4,X4
+    VMOVSS X4,stdDev+28(FP)
+
+    VZEROUPPER
+    RET
+
+
+// func winsorizeAVX2(xs []float32, low, high float32) (changed int)
+//    0(FP) 8 byte xs pointer
+//    8(FP) 8 byte xs length, multiple of 8
+//   16(FP) 8 byte xs capacity
+//   24(FP) 4 byte low bound
+//   28(FP) 4 byte high bound
+//   32(FP) 8 byte return value number of changed values
+TEXT ·winsorizeAVX2(SB),(NOSPLIT|NOFRAME),$0-40
+    MOVQ xs_base+0(FP),SI                 // load data pointer in SI, and end pointer in DX
+    MOVQ xs_len+8(FP),DX
+    SHLQ $2,DX
+    ADDQ SI,DX
+    VBROADCASTSS low+24(FP),Y2              // broadcast bounds into all lanes of Y2 and Y3
+    VBROADCASTSS high+28(FP),Y3
+    XORQ AX,AX                              // number of changed values in AX
+
+    JMP wsLoopCond
+wsLoopStart:
+    VMOVUPS (SI),Y0                         // load next 8 values
+    VCMPPS $1,Y2,Y0,Y1                      // mask of values below the low bound
+    VCMPPS $14,Y3,Y0,Y4                     // mask of values above the high bound
+    VORPS Y4,Y1,Y1
+    VMOVMSKPS Y1,BX                         // count changed values
+    POPCNTL BX,BX
+    ADDQ BX,AX
+    VMAXPS Y2,Y0,Y0                         // clamp to the bounds and store
+    VMINPS Y3,Y0,Y0
+    VMOVUPS Y0,(SI)
+    ADDQ $32,SI
+wsLoopCond:
+    CMPQ SI,DX
+    JL   wsLoopStart
+
+    MOVQ AX,changed+32(FP)
+    VZEROUPPER
+    RET
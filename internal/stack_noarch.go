@@ -0,0 +1,40 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// +build !amd64
+
+package internal
+
+
+// Adds the valid values of data to the sums and counts them, skipping NaNs
+func accumulateValid(sums, counts, data []float32) {
+	accumulateValidPureGo(sums, counts, data)
+}
+
+// Adds the valid values of data times the weight to the sums, and the weight to the weight sums, skipping NaNs
+func accumulateValidWeighted(sums, weightSums, data []float32, weight float32) {
+	accumulateValidWeightedPureGo(sums, weightSums, data, weight)
+}
+
+// Calculate mean and standard deviation of the given values
+func calcMeanStdDev(xs []float32) (mean, stdDev float32) {
+	return MeanStdDev(xs)
+}
+
+// Replaces values below the low bound with the low bound, and values above the high bound with the high bound.
+// Returns the number of values replaced
+func winsorize(xs []float32, low, high float32) (changed int) {
+	return winsorizePureGo(xs, low, high)
+}
@@ -0,0 +1,364 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"testing"
+)
+
+type stackPercentileTestCase struct {
+	Values    []float32
+	PercLow   float32
+	PercHigh  float32
+	Result    float32
+	ClipLow   int32
+	ClipHigh  int32
+}
+
+func TestStackPercentile(t *testing.T) {
+	epsilon:=1e-5
+	nan:=float32(math.NaN())
+	tcs:=[]stackPercentileTestCase{
+		stackPercentileTestCase{[]float32{1.0, 1.1, 0.9},             0.2, 0.2, 1.0,  0, 0},
+		stackPercentileTestCase{[]float32{1.0, 1.1, 0.9, 5.0},        0.2, 0.2, 1.0,  0, 1},
+		stackPercentileTestCase{[]float32{0.1, 1.0, 1.1, 0.9, 5.0},   0.2, 0.2, 1.0,  1, 1},
+		stackPercentileTestCase{[]float32{1.0, nan, 1.5, nan, 0.98},  0.1, 0.1, 0.99, 0, 1},
+		stackPercentileTestCase{[]float32{nan, nan, nan},             0.1, 0.1, 0.5,  0, 0},
+	}
+
+	for _,tc:=range tcs {
+		lightsData:=make([][]float32, len(tc.Values))
+		for i,v:=range tc.Values {
+			lightsData[i]=[]float32{v}
+		}
+		res:=make([]float32, 1)
+		clipLow, clipHigh:=StackPercentile(lightsData, 0.5, tc.PercLow, tc.PercHigh, 32, res)
+		if math.Abs(float64(res[0]-tc.Result))>epsilon { t.Errorf("values=%v res=%f; want %f", tc.Values, res[0], tc.Result) }
+		if clipLow !=tc.ClipLow  { t.Errorf("values=%v clipLow=%d; want %d",  tc.Values, clipLow,  tc.ClipLow ) }
+		if clipHigh!=tc.ClipHigh { t.Errorf("values=%v clipHigh=%d; want %d", tc.Values, clipHigh, tc.ClipHigh) }
+	}
+}
+
+func TestStackSigmaIterations(t *testing.T) {
+	epsilon:=1e-5
+	values:=[]float32{1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 2.0, 100.0}
+	lightsData:=make([][]float32, len(values))
+	for i,v:=range values {
+		lightsData[i]=[]float32{v}
+	}
+
+	// first iteration clips the far outlier, second iteration the near one
+	res:=make([]float32, 1)
+	clipLowIter, clipHighIter:=make([]int32, len(values)), make([]int32, len(values))
+	clipLow, clipHigh:=StackSigma(lightsData, 0, 2, 2, int32(len(values)), 0, 32, res, clipLowIter, clipHighIter)
+	if clipLow!=0 || clipHigh!=2 { t.Errorf("clipLow=%d clipHigh=%d; want 0 2", clipLow, clipHigh) }
+	if clipHighIter[0]!=1 || clipHighIter[1]!=1 { t.Errorf("clipHighIter=%v; want [1 1 ...]", clipHighIter) }
+	if math.Abs(float64(res[0]-1))>epsilon { t.Errorf("res=%f; want 1", res[0]) }
+
+	// with a limit of one iteration, the near outlier remains in the average
+	clipLowIter, clipHighIter=make([]int32, 1), make([]int32, 1)
+	clipLow, clipHigh=StackSigma(lightsData, 0, 2, 2, 1, 0, 32, res, clipLowIter, clipHighIter)
+	if clipLow!=0 || clipHigh!=1 { t.Errorf("maxIter=1 clipLow=%d clipHigh=%d; want 0 1", clipLow, clipHigh) }
+	if math.Abs(float64(res[0]-14.0/13.0))>epsilon { t.Errorf("maxIter=1 res=%f; want %f", res[0], 14.0/13.0) }
+}
+
+func TestStackAdaptive(t *testing.T) {
+	epsilon:=1e-5
+	nan:=float32(math.NaN())
+	// pixel 0 has all samples and gets sigma clipped, pixel 1 has five and gets percentile clipped,
+	// pixel 2 has two and gets the mean
+	lightsData:=[][]float32{
+		[]float32{1.0, 1.0,   2.0},
+		[]float32{1.0, 1.2,   4.0},
+		[]float32{1.0, 100.0, nan},
+		[]float32{1.0, 0.8,   nan},
+		[]float32{1.0, 0.9,   nan},
+		[]float32{1.0, nan,   nan},
+		[]float32{1.0, nan,   nan},
+		[]float32{50.0, nan,  nan},
+	}
+	res:=make([]float32, 3)
+	clipLowIter, clipHighIter, modeCounts:=make([]int32, 8), make([]int32, 8), make([]int32, StMin+1)
+	clipLow, clipHigh:=StackAdaptive(lightsData, nil, 0, 2, 2, 8, 0, 32, res, clipLowIter, clipHighIter, modeCounts)
+	want:=[]float32{1.0, 0.9, 3.0}
+	for i, w:=range want {
+		if math.Abs(float64(res[i]-w))>epsilon { t.Errorf("res[%d]=%f; want %f", i, res[i], w) }
+	}
+	// percentile clipping of pixel 1 does not count towards the clipping statistics
+	if clipLow!=0 || clipHigh!=1 { t.Errorf("clipLow=%d clipHigh=%d; want 0 1", clipLow, clipHigh) }
+	if modeCounts[StSigma]!=1 || modeCounts[StPercentile]!=1 || modeCounts[StMean]!=1 {
+		t.Errorf("modeCounts=%v; want one pixel each for sigma, percentile and mean", modeCounts)
+	}
+
+	// large samples get linear fit clipping, and sigma bounds only apply from six frames on
+	if m:=adaptiveSelectStackingMode(25); m!=StLinearFit { t.Errorf("mode for 25 samples=%d; want %d", m, StLinearFit) }
+	if adaptiveUsesSigmas(5) || !adaptiveUsesSigmas(6) { t.Errorf("sigmas used for 5 and 6 frames=%v %v; want false true", adaptiveUsesSigmas(5), adaptiveUsesSigmas(6)) }
+
+	// only the eight values of sigma clipped pixel 0 count for the sigma search
+	lights:=make([]*FITSImage, len(lightsData))
+	for i, ld:=range lightsData { lights[i]=&FITSImage{ID: i, Naxisn: []int32{3, 1}, Pixels: 3, Data: ld} }
+	counts, numSigmaValues, err:=AdaptiveModeCounts(context.Background(), lights)
+	if err!=nil { t.Fatal(err) }
+	if numSigmaValues!=8 || counts[StSigma]!=1 || counts[StPercentile]!=1 || counts[StMean]!=1 {
+		t.Errorf("counts=%v numSigmaValues=%d; want one pixel each for sigma, percentile and mean, and 8", counts, numSigmaValues)
+	}
+	counts[StLinearFit]=2
+	if m:=adaptiveDominantMode(counts); m!=StLinearFit { t.Errorf("dominant mode=%d; want %d", m, StLinearFit) }
+}
+
+func TestStackSum(t *testing.T) {
+	epsilon:=1e-5
+	nan:=float32(math.NaN())
+	lightsData:=[][]float32{ {1.0, 2.0, nan}, {2.0, nan, nan}, {4.0, 2.0, nan}, {8.0, 4.0, nan} }
+	res:=make([]float32, 3)
+
+	// missing values are rescaled to the full number of frames
+	StackSum(lightsData, 0.5, false, true, res)
+	want:=[]float32{15.0, 32.0/3.0, 2.0}
+	for i:=range want {
+		if math.Abs(float64(res[i]-want[i]))>epsilon { t.Errorf("sum res[%d]=%f; want %f", i, res[i], want[i]) }
+	}
+
+	// without rescaling, only the valid values are summed up, and empty pixels hold refMedian in every frame
+	StackSum(lightsData, 0.5, false, false, res)
+	want=[]float32{15.0, 8.0, 2.0}
+	for i:=range want {
+		if math.Abs(float64(res[i]-want[i]))>epsilon { t.Errorf("unscaled sum res[%d]=%f; want %f", i, res[i], want[i]) }
+	}
+
+	// averages are rounded to integer units
+	StackSum(lightsData, 0.5, true, false, res)
+	want=[]float32{4.0, 3.0, 1.0}
+	for i:=range want {
+		if math.Abs(float64(res[i]-want[i]))>epsilon { t.Errorf("average res[%d]=%f; want %f", i, res[i], want[i]) }
+	}
+}
+
+// Returns a single-row batch stack with the given data and measured noise
+func newTestBatch(data []float32, noise float32) *FITSImage {
+	return &FITSImage{Naxisn: []int32{int32(len(data)), 1}, Pixels: int32(len(data)), Data: data, Stats: &BasicStats{Noise: noise}}
+}
+
+func TestBatchStackerSum(t *testing.T) {
+	epsilon:=1e-5
+
+	// batch sums add up to the overall sum, regardless of batch noise
+	b:=NewBatchStacker(StSum, 32)
+	b.Add(newTestBatch([]float32{10, 20}, 1), 4)
+	b.Add(newTestBatch([]float32{ 5,  6}, 2), 2)
+	stack, err:=b.Finalize(LSESCMedianQn)
+	if err!=nil { t.Fatal(err) }
+	if math.Abs(float64(stack.Data[0]-15))>epsilon || math.Abs(float64(stack.Data[1]-26))>epsilon {
+		t.Errorf("sum=%v; want [15 26]", stack.Data)
+	}
+
+	// batch averages are weighted by their number of frames, and rounded to integer units
+	b=NewBatchStacker(StIntAverage, 32)
+	b.Add(newTestBatch([]float32{10, 20}, 1), 3)
+	b.Add(newTestBatch([]float32{ 3,  4}, 2), 1)
+	stack, err=b.Finalize(LSESCMedianQn)
+	if err!=nil { t.Fatal(err) }
+	if math.Abs(float64(stack.Data[0]-8))>epsilon || math.Abs(float64(stack.Data[1]-16))>epsilon {
+		t.Errorf("average=%v; want [8 16]", stack.Data)
+	}
+}
+
+func TestBatchStackerPrecision64(t *testing.T) {
+	// many small batch values on a large offset lose their contribution in 32-bit accumulation
+	b:=NewBatchStacker(StMean, 64)
+	for i:=0; i<1000; i++ {
+		v:=float32(1)
+		if i==0 { v=1e8 }
+		b.Add(newTestBatch([]float32{v, 1}, 1), 1)
+	}
+	stack, err:=b.Finalize(LSESCMedianQn)
+	if err!=nil { t.Fatal(err) }
+	if want:=float32((1e8+999)/1000.0); stack.Data[0]!=want || stack.Data[1]!=1 {
+		t.Errorf("res=%v; want [%f 1]", stack.Data, want)
+	}
+}
+
+func TestBatchStackerMaxMin(t *testing.T) {
+	// batch extremes combine element-wise, regardless of batch noise and size
+	for _, max:=range []bool{true, false} {
+		mode, want:=StMin, []float32{1, 2}
+		if max { mode, want=StMax, []float32{3, 9} }
+		b:=NewBatchStacker(mode, 32)
+		b.Add(newTestBatch([]float32{3, 2}, 1), 10)
+		b.Add(newTestBatch([]float32{1, 9}, 5),  1)
+		stack, err:=b.Finalize(LSESCMedianQn)
+		if err!=nil { t.Fatal(err) }
+		if stack.Data[0]!=want[0] || stack.Data[1]!=want[1] { t.Errorf("mode %d res=%v; want %v", mode, stack.Data, want) }
+	}
+}
+
+func TestStackMaxMin(t *testing.T) {
+	nan:=float32(math.NaN())
+	lightsData:=[][]float32{ {1.0, nan, nan}, {3.0, -2.0, nan}, {2.0, 5.0, nan} }
+	res:=make([]float32, 3)
+
+	StackMaxMin(lightsData, 0.5, true, res)
+	if res[0]!=3.0 || res[1]!=5.0 || res[2]!=0.5 { t.Errorf("max res=%v; want [3 5 0.5]", res) }
+
+	StackMaxMin(lightsData, 0.5, false, res)
+	if res[0]!=1.0 || res[1]!=-2.0 || res[2]!=0.5 { t.Errorf("min res=%v; want [1 -2 0.5]", res) }
+}
+
+func TestStreamStacker(t *testing.T) {
+	epsilon:=1e-5
+	values:=[]float32{1.0, 1.1, 0.9, 50.0, 1.0, 1.05, -40.0, 0.95}
+	s:=NewStreamStacker(4, 3, 3, 0.5, 32, LSESCMedianQn)
+	for i,v:=range values {
+		data:=make([]float32, 256)
+		for p:=range data { data[p]=v+0.001*float32(p) }
+		light:=&FITSImage{ID:i, Naxisn:[]int32{16,16}, Pixels:256, Data:data}
+		if err:=s.Add(light); err!=nil { t.Fatal(err) }
+	}
+	if s.NumClippedLow!=256 || s.NumClippedHigh!=256 { t.Errorf("clipped low %d high %d; want 256 256", s.NumClippedLow, s.NumClippedHigh) }
+
+	// outliers are rejected in the reservoir and in the stream, the mean covers the rest
+	stack, err:=s.Finalize()
+	if err!=nil { t.Fatal(err) }
+	for _,p:=range []int{0, 255} {
+		want:=1.0+0.001*float32(p)
+		if math.Abs(float64(stack.Data[p]-want))>epsilon { t.Errorf("res[%d]=%f; want %f", p, stack.Data[p], want) }
+	}
+}
+
+func TestStreamStackerFixedBounds(t *testing.T) {
+	// bounds from the reservoir stay fixed, so a value within them is accepted after many identical frames
+	s:=NewStreamStacker(4, 3, 3, 0, 32, LSESCMedianQn)
+	values:=[]float32{1.0, 1.1, 0.9, 1.0}
+	for i:=0; i<20; i++ { values=append(values, 1.0) }
+	values=append(values, 1.2)
+	for i,v:=range values {
+		light:=&FITSImage{ID:i, Naxisn:[]int32{1,1}, Pixels:1, Data:[]float32{v}}
+		if err:=s.Add(light); err!=nil { t.Fatal(err) }
+	}
+	if s.NumClippedLow!=0 || s.NumClippedHigh!=0 || s.Count[0]!=int32(len(values)) {
+		t.Errorf("clipped low %d high %d accepted %d; want 0 0 %d", s.NumClippedLow, s.NumClippedHigh, s.Count[0], len(values))
+	}
+}
+
+func TestStackMeanPrecision64(t *testing.T) {
+	// adding ones to 2^24 is lost with float32 accumulation
+	lightsData:=[][]float32{ {16777216} }
+	for i:=0; i<10; i++ { lightsData=append(lightsData, []float32{1}) }
+	res:=make([]float32, 1)
+	StackMean(lightsData, 0, 64, res)
+	want:=float32((16777216.0+10.0)/11.0)
+	if res[0]!=want { t.Errorf("res=%f; want %f", res[0], want) }
+}
+
+func TestStackMeanVectorized(t *testing.T) {
+	// lengths not divisible by 8 exercise the scalar tail of the vectorized kernels
+	nan:=float32(math.NaN())
+	rng:=NewRNG(0)
+	lightsData:=make([][]float32, 5)
+	for li:=range lightsData {
+		lightsData[li]=make([]float32, 37)
+		for i:=range lightsData[li] {
+			lightsData[li][i]=float32(rng.Uint32n(1000))
+			if (i+li)%7==0 || i==36 { lightsData[li][i]=nan }
+		}
+	}
+	weights:=[]float32{1, 0.5, 2, 1.5, 0.25}
+
+	res, resW:=make([]float32, 37), make([]float32, 37)
+	StackMean(lightsData, -1, 32, res)
+	StackMeanWeighted(lightsData, weights, -1, 32, resW)
+	for i:=range res {
+		sum, count, sumW, weightSum:=float32(0), float32(0), float32(0), float32(0)
+		for li:=range lightsData {
+			v:=lightsData[li][i]
+			if math.IsNaN(float64(v)) { continue }
+			sum+=v; count++
+			sumW+=v*weights[li]; weightSum+=weights[li]
+		}
+		want, wantW:=float32(-1), float32(-1)
+		if count>0 { want, wantW=sum/count, sumW/weightSum }
+		if res [i]!=want  { t.Errorf("mean %d: got %g want %g", i, res[i], want) }
+		if resW[i]!=wantW { t.Errorf("weighted mean %d: got %g want %g", i, resW[i], wantW) }
+	}
+}
+
+func TestSigmaKernelsVectorized(t *testing.T) {
+	// lengths not divisible by 8 exercise the scalar tail of the vectorized kernels
+	rng:=NewRNG(0)
+	for n:=1; n<=41; n++ {
+		xs:=make([]float32, n)
+		for i:=range xs { xs[i]=1000+20*rng.NormFloat32() }
+
+		mean, stdDev:=calcMeanStdDev(xs)
+		wantMean, wantStdDev:=MeanStdDev(xs)
+		if math.Abs(float64(mean-wantMean))>1e-3 || math.Abs(float64(stdDev-wantStdDev))>1e-3 {
+			t.Errorf("n=%d: mean %g stdDev %g; want %g %g", n, mean, stdDev, wantMean, wantStdDev)
+		}
+
+		ws, want:=append([]float32(nil), xs...), append([]float32(nil), xs...)
+		changed, wantChanged:=winsorize(ws, 990, 1010), winsorizePureGo(want, 990, 1010)
+		if changed!=wantChanged { t.Errorf("n=%d: changed %d; want %d", n, changed, wantChanged) }
+		for i:=range ws {
+			if ws[i]!=want[i] { t.Errorf("n=%d: winsorized[%d]=%g; want %g", n, i, ws[i], want[i]) }
+		}
+	}
+}
+
+func TestQualityWeightsNoStars(t *testing.T) {
+	lights:=[]*FITSImage{
+		{ID: 0, HFR: 1.5, Stars: []Star{{Ecc: 0.2}, {Ecc: 0.3}}, Background: 100},
+		{ID: 1, HFR: 3.0, Stars: []Star{{Ecc: 0.4}}, Background: 100},
+		{ID: 2, HFR: 0,   Stars: nil, Background: 100},
+	}
+	weights:=QualityWeights(lights, QualityFormula{FWHM: 2})
+	if weights[0]!=1 || weights[1]!=0.25 || weights[2]!=0 { t.Errorf("weights %v; want [1 0.25 0]", weights) }
+	weights=QualityWeights(lights, QualityFormula{Background: 1})
+	if weights[2]!=1 { t.Errorf("weight without stars %f; want 1 for background-only formula", weights[2]) }
+
+	// a pixel where only zero-weight frames survive clipping falls back to their unweighted mean
+	lightsData:=[][]float32{ {1000}, {10}, {11}, {12}, {10}, {11}, {12}, {10}, {11}, {12} }
+	w:=[]float32{1, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	for _, precision:=range []int32{32, 64} {
+		res:=make([]float32, 1)
+		StackSigmaWeighted(lightsData, w, 0, 2, 2, 10, 0, precision, res, make([]int32, 10), make([]int32, 10))
+		if !(res[0]>=10 && res[0]<=12) { t.Errorf("precision %d: res=%f; want unweighted mean of unclipped values", precision, res[0]) }
+	}
+}
+
+func TestForEachBand(t *testing.T) {
+	if rows:=stackBandRows(1000*100, 1000, 8); rows!=8 { t.Errorf("rows=%d; want 8", rows) }
+	if rows:=stackBandRows(100000*10, 100000, 8); rows!=1 { t.Errorf("rows=%d; want 1", rows) }
+
+	// every pixel is covered by exactly one band of whole rows
+	width, height:=37, 1001
+	covered:=make([]int32, width*height)
+	forEachBand(context.Background(), len(covered), width, 64, func(w, lower, upper int) {
+		if lower%width!=0 || (upper%width!=0 && upper!=len(covered)) { t.Errorf("band [%d,%d) not aligned to rows", lower, upper) }
+		for i:=lower; i<upper; i++ { atomic.AddInt32(&covered[i], 1) }
+	})
+	for i, c:=range covered {
+		if c!=1 { t.Fatalf("pixel %d covered %d times", i, c) }
+	}
+
+	// a cancelled context hands out no bands
+	ctx, cancel:=context.WithCancel(context.Background())
+	cancel()
+	forEachBand(ctx, len(covered), width, 64, func(w, lower, upper int) { t.Errorf("band [%d,%d) processed after cancel", lower, upper) })
+}
@@ -0,0 +1,176 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"sync"
+)
+
+
+// Fractions of the median below and above which percentile clipping rejects values, for pixels with
+// too few samples to estimate a standard deviation. The sigma bounds do not apply to these pixels
+const adaptivePercLow, adaptivePercHigh = float32(0.2), float32(0.1)
+
+
+// Select the rejection algorithm for a single pixel based on its number of valid samples, i.e. the number
+// of frames covering the pixel after alignment, minus bad pixels.
+// Few samples cannot support a standard deviation estimate, so they use mean or percentile clipping.
+// Larger samples use sigma clipping, winsorized sigma clipping once there are enough samples for the
+// winsorized standard deviation to be robust against multiple outliers, and linear fit clipping
+// once there are enough samples to fit a line robustly
+func adaptiveSelectStackingMode(numValid int) StackMode {
+	if numValid>=25 {
+		return StLinearFit
+	} else if numValid>=15 {
+		return StWinsorSigma
+	} else if numValid>=6 {
+		return StSigma
+	} else if numValid>=3 {
+		return StPercentile
+	} else {
+		return StMean
+	}
+}
+
+
+// Returns true if adaptive stacking of the given number of frames clips any pixel based on sigma bounds.
+// Pixels never have more valid samples than there are frames
+func adaptiveUsesSigmas(numFrames int) bool {
+	return adaptiveModeUsesSigmas(adaptiveSelectStackingMode(numFrames))
+}
+
+
+// Returns true if the given mode selected by adaptive stacking clips values based on sigma bounds
+func adaptiveModeUsesSigmas(mode StackMode) bool {
+	return mode==StSigma || mode==StWinsorSigma || mode==StLinearFit
+}
+
+
+// Returns the mode which adaptive stacking selects for most pixels, given the number of pixels per mode
+func adaptiveDominantMode(modeCounts []int32) StackMode {
+	dominant:=StMean
+	for m, c:=range modeCounts {
+		if c>modeCounts[dominant] { dominant=StackMode(m) }
+	}
+	return dominant
+}
+
+
+// Counts the pixels for which adaptive stacking selects each mode into modeCounts, indexed by StackMode, and the
+// number of valid values in pixels clipped based on sigma bounds. Lights may be packed. Returns the context error
+// if the context is cancelled, or the error if a frame fails to unpack
+func AdaptiveModeCounts(ctx context.Context, lights []*FITSImage) (modeCounts []int32, numSigmaValues int64, err error) {
+	numWorkers:=runtime.NumCPU()
+	workerCounts, workerValues:=make([][]int32, numWorkers), make([]int64, numWorkers)
+	for w:=range workerCounts { workerCounts[w]=make([]int32, StMin+1) }
+
+	// the first error unpacking frames cancels the remaining bands
+	bandCtx, cancel:=context.WithCancel(ctx)
+	defer cancel()
+	errLock, bandErr:=sync.Mutex{}, error(nil)
+
+	forEachBand(bandCtx, lights[0].numValues(), bandWidth(lights), len(lights), func(w, lower, upper int) {
+		ldBatch, release, err:=gatherLights(lights, lower, upper)
+		if err!=nil {
+			errLock.Lock()
+			if bandErr==nil { bandErr=err }
+			errLock.Unlock()
+			cancel()
+			return
+		}
+		defer release()
+		for i:=0; i<upper-lower; i++ {
+			numValid:=0
+			for _, ld:=range ldBatch {
+				if !math.IsNaN(float64(ld[i])) { numValid++ }
+			}
+			mode:=adaptiveSelectStackingMode(numValid)
+			workerCounts[w][mode]++
+			if adaptiveModeUsesSigmas(mode) { workerValues[w]+=int64(numValid) }
+		}
+	})
+	if bandErr!=nil { return nil, 0, bandErr }
+	if err=ctx.Err(); err!=nil { return nil, 0, err }
+
+	modeCounts=make([]int32, StMin+1)
+	for w:=0; w<numWorkers; w++ {
+		addInt32Slice(modeCounts, workerCounts[w])
+		numSigmaValues+=workerValues[w]
+	}
+	return modeCounts, numSigmaValues, nil
+}
+
+
+// Stacking with per-pixel adaptive rejection. Counts the valid samples of each pixel, for instance
+// fewer in the borders of aligned frames, and selects the rejection algorithm for each pixel accordingly.
+// Runs of adjacent pixels with the same algorithm are stacked together with the respective kernel.
+// Accumulates the number of pixels stacked with each mode into modeCounts, which is indexed by StackMode.
+// Returns and accumulates clipping statistics for sigma-based modes only, as percentile clipping reads
+// its bounds as fractions of the median, so its clipped values do not count towards the sigma search
+func StackAdaptive(lightsData [][]float32, weights []float32, refMedian, sigmaLow, sigmaHigh float32, maxIter int32, convergence float32, precision int32, res []float32, clipLowIter, clipHighIter []int32, modeCounts []int32) (clipLow, clipHigh int32) {
+	// select mode for each pixel
+	modes:=make([]StackMode, len(res))
+	for i, _:=range res {
+		numValid:=0
+		for li, _:=range lightsData {
+			if !math.IsNaN(float64(lightsData[li][i])) { numValid++ }
+		}
+		modes[i]=adaptiveSelectStackingMode(numValid)
+		modeCounts[modes[i]]++
+	}
+
+	// stack runs of pixels with the same mode
+	ldRun:=make([][]float32, len(lightsData))
+	for lower:=0; lower<len(res); {
+		upper:=lower+1
+		for upper<len(res) && modes[upper]==modes[lower] { upper++ }
+		for li, ld:=range lightsData { ldRun[li]=ld[lower:upper] }
+
+		var cl, ch int32
+		switch modes[lower] {
+		case StMean:
+			if weights==nil {
+				StackMean(ldRun, refMedian, precision, res[lower:upper])
+			} else {
+				StackMeanWeighted(ldRun, weights, refMedian, precision, res[lower:upper])
+			}
+		case StPercentile:
+			StackPercentile(ldRun, refMedian, adaptivePercLow, adaptivePercHigh, precision, res[lower:upper])
+		case StSigma:
+			if weights==nil {
+				cl, ch=StackSigma(ldRun, refMedian, sigmaLow, sigmaHigh, maxIter, convergence, precision, res[lower:upper], clipLowIter, clipHighIter)
+			} else {
+				cl, ch=StackSigmaWeighted(ldRun, weights, refMedian, sigmaLow, sigmaHigh, maxIter, convergence, precision, res[lower:upper], clipLowIter, clipHighIter)
+			}
+		case StWinsorSigma:
+			if weights==nil {
+				cl, ch=StackWinsorSigma(ldRun, refMedian, sigmaLow, sigmaHigh, maxIter, convergence, precision, res[lower:upper], clipLowIter, clipHighIter)
+			} else {
+				cl, ch=StackWinsorSigmaWeighted(ldRun, weights, refMedian, sigmaLow, sigmaHigh, maxIter, convergence, precision, res[lower:upper], clipLowIter, clipHighIter)
+			}
+		case StLinearFit:
+			cl, ch=StackLinearFit(ldRun, refMedian, sigmaLow, sigmaHigh, maxIter, convergence, precision, res[lower:upper], clipLowIter, clipHighIter)
+		}
+		clipLow+=cl
+		clipHigh+=ch
+		lower=upper
+	}
+	return clipLow, clipHigh
+}
@@ -17,35 +17,65 @@
 package internal
 
 import (
+	"context"
 	"runtime/debug"
 )
 
 
-// Find lower and upper sigma bounds given desired clipping percentages, and stack using these values
-func FindSigmasAndStack(lights []*FITSImage, mode StackMode, weights []float32, refMedian, stClipPercLow, stClipPercHigh float32) (result *FITSImage, numClippedLow, numClippedHigh int32, sigmaLow, sigmaHigh float32, err error) {
-	// If desired, auto-select stacking mode based on number of frames    
-	if mode==StAuto { 
-		mode=autoSelectStackingMode(len(lights))
-		LogPrintf("Auto-selected stacking mode %d based on %d frames\n", mode, len(lights))
+// Find lower and upper sigma bounds given desired clipping percentages, and stack using these values.
+// Iteration limit, convergence threshold, sum rescaling and precision are passed through to Stack().
+// In auto mode, the percentages refer to the values of pixels clipped with sigma bounds only, and the
+// search method follows the mode which covers most pixels
+func FindSigmasAndStack(ctx context.Context, lights []*FITSImage, mode StackMode, weights []float32, refMedian, stClipPercLow, stClipPercHigh float32, maxIter int32, convergence float32, rescale bool, precision int32, lsEst LSEstimatorMode) (result *FITSImage, numClippedLow, numClippedHigh int32, sigmaLow, sigmaHigh float32, err error) {
+	// Sigma bounds apply to no pixel of small stacks in auto mode, so there is nothing to search for.
+	// Report no sigmas, so later batches search again
+	if mode==StAuto && !adaptiveUsesSigmas(len(lights)) {
+		LogPrintf("Auto mode does not clip any pixel of %d frames with sigmas, proceeding with normal stack.\n", len(lights))
+		result, numClippedLow, numClippedHigh, err = Stack(ctx, lights, mode, weights, refMedian, 0.0, 0.0, maxIter, convergence, rescale, precision, lsEst)
+		return result, numClippedLow, numClippedHigh, -1, -1, err
+	}
+
+	// Clipping percentages refer to all values, except in auto mode. There, percentile clipping reads the bounds
+	// as fractions of the median and mean stacking clips nothing, so only values of pixels clipped with sigmas count
+	numValues:=float32(lights[0].numValues())*float32(len(lights))
+	searchMode:=mode
+	if mode==StAuto {
+		modeCounts, numSigmaValues, err:=AdaptiveModeCounts(ctx, lights)
+		if err!=nil { return nil, -1, -1, -1, -1, err }
+		if numSigmaValues==0 {
+			LogPrintf("Auto mode does not clip any pixel with sigmas, proceeding with normal stack.\n")
+			result, numClippedLow, numClippedHigh, err = Stack(ctx, lights, mode, weights, refMedian, 0.0, 0.0, maxIter, convergence, rescale, precision, lsEst)
+			return result, numClippedLow, numClippedHigh, -1, -1, err
+		}
+		numValues=float32(numSigmaValues)
+		searchMode=adaptiveDominantMode(modeCounts)
+		if searchMode==StLinearFit {
+			LogPrintf("Auto mode clips %d values with sigmas, mostly with linear fit. Using Newton's method\n", numSigmaValues)
+		} else {
+			LogPrintf("Auto mode clips %d values with sigmas. Using binary search\n", numSigmaValues)
+		}
 	}
 
     // Binary search does not work for linear fit stacking, as changing one bound has an impact on the other.
     // However, Newton search in two dimensions is slower than dual binary search.
-	if mode==StLinearFit {
-		return newtonMethodAndStack(lights, mode, weights, refMedian, stClipPercLow, stClipPercHigh)
-	} else if mode==StWinsorSigma || mode==StSigma {
-		return binarySearchAndStack(lights, mode, weights, refMedian, stClipPercLow, stClipPercHigh) 
+	if searchMode==StLinearFit {
+		return newtonMethodAndStack(ctx, lights, mode, weights, refMedian, stClipPercLow, stClipPercHigh, maxIter, convergence, rescale, precision, lsEst, numValues)
+	} else if mode==StWinsorSigma || mode==StSigma || mode==StPercentile || mode==StAuto {
+		return binarySearchAndStack(ctx, lights, mode, weights, refMedian, stClipPercLow, stClipPercHigh, maxIter, convergence, rescale, precision, lsEst, numValues)
 	} else {
 		LogPrintf("Stacking mode %d does not support sigmas, proceeding with normal stack.\n", mode)
-		result, numClippedLow, numClippedHigh, err = Stack(lights, mode, weights, refMedian, 0.0, 0.0)
+		result, numClippedLow, numClippedHigh, err = Stack(ctx, lights, mode, weights, refMedian, 0.0, 0.0, maxIter, convergence, rescale, precision, lsEst)
 		return result, numClippedLow, numClippedHigh, 0.0, 0.0, err
 	}
 }
 
-// With binary search, find lower and upper sigma bounds given desired clipping percentages, and stack using these values
-func binarySearchAndStack(lights []*FITSImage, mode StackMode, weights []float32, refMedian, stClipPercLow, stClipPercHigh float32) (result *FITSImage, numClippedLow, numClippedHigh int32, sigmaLow, sigmaHigh float32, err error) {
-	// initialize binary search intervals
+// With binary search, find lower and upper sigma bounds given desired clipping percentages of numValues, and stack using these values
+func binarySearchAndStack(ctx context.Context, lights []*FITSImage, mode StackMode, weights []float32, refMedian, stClipPercLow, stClipPercHigh float32, maxIter int32, convergence float32, rescale bool, precision int32, lsEst LSEstimatorMode, numValues float32) (result *FITSImage, numClippedLow, numClippedHigh int32, sigmaLow, sigmaHigh float32, err error) {
+	// initialize binary search intervals. Percentile clipping uses fractions of the median instead of sigmas
 	initialLeft, initialRight:=float32(1.0), float32(11.0)
+	if mode==StPercentile {
+		initialLeft, initialRight=float32(0.0), float32(1.0)
+	}
 	lowLeft, lowRight:=initialLeft, initialRight
 	lowMid:=0.5*(lowLeft+lowRight)
 	highLeft, highRight:=initialLeft, initialRight
@@ -56,10 +86,10 @@ func binarySearchAndStack(lights []*FITSImage, mode StackMode, weights []float32
 		LogPrintf("Step %d: stSigLow %.2f stSigHigh %.2f\n", i, lowMid, highMid)
 		var numClippedLow, numClippedHigh int32
 		var err error
-		stack, numClippedLow, numClippedHigh, err:=Stack(lights, mode, weights, refMedian, lowMid, highMid)
+		stack, numClippedLow, numClippedHigh, err:=Stack(ctx, lights, mode, weights, refMedian, lowMid, highMid, maxIter, convergence, rescale, precision, lsEst)
 		if err!=nil { return stack, numClippedLow, numClippedHigh, -1, -1, err }
-		percL:=float32(numClippedLow )*100.0/float32(len(stack.Data)*len(lights))
-		percH:=float32(numClippedHigh)*100.0/float32(len(stack.Data)*len(lights))
+		percL:=float32(numClippedLow )*100.0/numValues
+		percH:=float32(numClippedHigh)*100.0/numValues
 		deltaL:=int(100*percL+0.5)-int(100*stClipPercLow)
 		deltaH:=int(100*percH+0.5)-int(100*stClipPercHigh)
 		// Test completion and abort criteria
@@ -95,8 +125,8 @@ func binarySearchAndStack(lights []*FITSImage, mode StackMode, weights []float32
 	}
 }
 
-// With Newton's method, find lower and upper sigma bounds given desired clipping percentages, and stack using these values
-func newtonMethodAndStack(lights []*FITSImage, mode StackMode, weights []float32, refMedian, stClipPercLow, stClipPercHigh float32) (result *FITSImage, numClippedLow, numClippedHigh int32, sigmaLow, sigmaHigh float32, err error) {
+// With Newton's method, find lower and upper sigma bounds given desired clipping percentages of numValues, and stack using these values
+func newtonMethodAndStack(ctx context.Context, lights []*FITSImage, mode StackMode, weights []float32, refMedian, stClipPercLow, stClipPercHigh float32, maxIter int32, convergence float32, rescale bool, precision int32, lsEst LSEstimatorMode, numValues float32) (result *FITSImage, numClippedLow, numClippedHigh int32, sigmaLow, sigmaHigh float32, err error) {
 	sigLow, sigHigh, epsilon :=float32(6.0), float32(6.0), float32(0.005)
 
 	for i:=0; ; i++ {
@@ -104,10 +134,10 @@ func newtonMethodAndStack(lights []*FITSImage, mode StackMode, weights []float32
 		LogPrintf("Step %d: stSigLow %.2f stSigHigh %.2f\n", i, sigLow, sigHigh)
 		var numClippedLow, numClippedHigh int32
 		var err error
-		stack, numClippedLow, numClippedHigh, err:=Stack(lights, mode, weights, refMedian, sigLow, sigHigh)
+		stack, numClippedLow, numClippedHigh, err:=Stack(ctx, lights, mode, weights, refMedian, sigLow, sigHigh, maxIter, convergence, rescale, precision, lsEst)
 		if err!=nil { return stack, numClippedLow, numClippedHigh, stClipPercLow, stClipPercHigh, err }
-		percL:=float32(numClippedLow )*100.0/float32(len(stack.Data)*len(lights))
-		percH:=float32(numClippedHigh)*100.0/float32(len(stack.Data)*len(lights))
+		percL:=float32(numClippedLow )*100.0/numValues
+		percH:=float32(numClippedHigh)*100.0/numValues
 		deltaL:=percL-stClipPercLow
 		deltaH:=percH-stClipPercLow
 
@@ -129,9 +159,9 @@ func newtonMethodAndStack(lights []*FITSImage, mode StackMode, weights []float32
 		// Vary sigmaLow by epsilon, and compute new value via Newton's rule x_n+1 = x_n - f(x_n)/f'(x_n)
 		i++
 		LogPrintf("Step %d: stSigLow+eps %.2f, stSigHigh %.2f\n", i, sigLow+epsilon, sigHigh)
-		stack2, numClippedLow2, numClippedHigh2, err:=Stack(lights, mode, weights, refMedian, sigLow+epsilon, sigHigh)
+		stack2, numClippedLow2, numClippedHigh2, err:=Stack(ctx, lights, mode, weights, refMedian, sigLow+epsilon, sigHigh, maxIter, convergence, rescale, precision, lsEst)
 		if err!=nil { return stack2, numClippedLow2, numClippedHigh2, sigLow+epsilon, sigHigh, err }
-		percL2:=float32(numClippedLow2 )*100.0/float32(len(stack2.Data)*len(lights))
+		percL2:=float32(numClippedLow2 )*100.0/numValues
 		deltaL2:=percL2-stClipPercLow
 		deltaLDiff:=(deltaL2-deltaL)/epsilon
 		if deltaLDiff==0 {
@@ -147,9 +177,9 @@ func newtonMethodAndStack(lights []*FITSImage, mode StackMode, weights []float32
 		// Vary sigmaHigh by epsilon, and compute new value via Newton's rule x_n+1 = x_n - f(x_n)/f'(x_n)
 		i++
 		LogPrintf("Step %d: stSigLow %.2f, stSigHigh+eps %.2f\n", i, sigLow, sigHigh+epsilon)
-		stack3, numClippedLow3, numClippedHigh3, err:=Stack(lights, mode, weights, refMedian, sigLow, sigHigh+epsilon)
+		stack3, numClippedLow3, numClippedHigh3, err:=Stack(ctx, lights, mode, weights, refMedian, sigLow, sigHigh+epsilon, maxIter, convergence, rescale, precision, lsEst)
 		if err!=nil { return stack3, numClippedLow3, numClippedHigh3, sigLow, sigHigh+epsilon, err }
-		percH3:=float32(numClippedHigh3)*100.0/float32(len(stack3.Data)*len(lights))
+		percH3:=float32(numClippedHigh3)*100.0/numValues
 		deltaH3:=percH3-stClipPercLow
 		deltaHDiff:=(deltaH3-deltaH)/epsilon
 		if deltaHDiff==0 {
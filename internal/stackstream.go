@@ -0,0 +1,253 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+
+// Online one-pass stacker. Holds a running mean and variance per pixel, so frames can be streamed through
+// without keeping them in memory. The first frames are collected in a small reservoir, which seeds the
+// per-pixel statistics with a robust median/MAD rejection. Subsequent frames are rejected against the
+// bounds from the reservoir, with the given low and high sigmas. The bounds stay fixed, as bounds from the
+// running statistics would tighten as accepted values accumulate, and reject ever more of the later frames
+type StreamStacker struct {
+	ReservoirSize  int             // Number of frames to collect before seeding the running statistics
+	SigmaLow       float32         // Reject values more than this many standard deviations below the mean
+	SigmaHigh      float32         // Reject values more than this many standard deviations above the mean
+	RefMedian      float32         // Fallback value for pixels without any valid data
+	Precision      int32           // Precision for accumulating the running statistics, 32 or 64 bits
+	LSEstimator    LSEstimatorMode // Location and scale estimator for the stats of the results
+
+	Mean           []float32       // Running mean per pixel
+	M2             []float32       // Running sum of squared differences from the mean per pixel
+	Mean64         []float64       // Running mean per pixel, used instead of Mean with 64-bit Precision
+	M2x64          []float64       // Running sum of squared differences, used instead of M2 with 64-bit Precision
+	Count          []int32         // Number of accepted values per pixel
+	LowBound       []float32       // Per-pixel lower rejection bound from the reservoir
+	HighBound      []float32       // Per-pixel upper rejection bound from the reservoir
+
+	NumFrames      int32           // Number of frames added so far
+	NumClippedLow  int64           // Number of values rejected below the mean
+	NumClippedHigh int64           // Number of values rejected above the mean
+
+	naxisn         []int32         // Dimensions of the stacked frames
+	exposure       float32         // Sum of exposures of the stacked frames
+	reservoir      []*FITSImage    // Frames collected before seeding
+}
+
+// Creates a new streaming stacker with the given reservoir size, rejection sigmas, fallback value, precision and estimator
+func NewStreamStacker(reservoirSize int, sigmaLow, sigmaHigh, refMedian float32, precision int32, lsEst LSEstimatorMode) *StreamStacker {
+	if reservoirSize<1 { reservoirSize=1 }
+	return &StreamStacker{
+		ReservoirSize: reservoirSize,
+		SigmaLow     : sigmaLow,
+		SigmaHigh    : sigmaHigh,
+		RefMedian    : refMedian,
+		Precision    : precision,
+		LSEstimator  : lsEst,
+	}
+}
+
+// Adds a light frame to the stack. Frames in the reservoir are retained until it is full,
+// all later frames are integrated immediately and can be freed by the caller
+func (s *StreamStacker) Add(light *FITSImage) error {
+	defer StartStage(StageStack)()
+	if s.naxisn==nil {
+		s.naxisn=append([]int32(nil), light.Naxisn...) // clone slice
+	} else if !EqualInt32Slice(s.naxisn, light.Naxisn) {
+		return errors.New(fmt.Sprintf("%d: Frame size %v differs from stream size %v", light.ID, light.Naxisn, s.naxisn))
+	}
+	s.NumFrames++
+	s.exposure+=light.Exposure
+
+	if s.Count==nil {
+		s.reservoir=append(s.reservoir, light)
+		if len(s.reservoir)>=s.ReservoirSize { s.seed() }
+		return nil
+	}
+
+	for i, v:=range light.Data {
+		if math.IsNaN(float64(v)) { continue }
+		if v<s.LowBound[i] {
+			s.NumClippedLow++
+		} else if v>s.HighBound[i] {
+			s.NumClippedHigh++
+		} else {
+			s.accept(i, v)
+		}
+	}
+	return nil
+}
+
+// Seeds the running statistics and the rejection bounds from the frames in the reservoir, rejecting
+// outliers based on median and MAD, then frees the reservoir. Pixels without valid values or without
+// deviations in the reservoir have no bounds
+func (s *StreamStacker) seed() {
+	numPixels:=len(s.reservoir[0].Data)
+	if s.Precision==64 {
+		s.Mean64=make([]float64, numPixels)
+		s.M2x64 =make([]float64, numPixels)
+	} else {
+		s.Mean  =make([]float32, numPixels)
+		s.M2    =make([]float32, numPixels)
+	}
+	s.Count    =make([]int32,   numPixels)
+	s.LowBound =make([]float32, numPixels)
+	s.HighBound=make([]float32, numPixels)
+
+	gathered  :=make([]float32, len(s.reservoir))
+	deviations:=make([]float32, len(s.reservoir))
+	for i:=0; i<numPixels; i++ {
+		// gather valid values for this pixel across the reservoir
+		num:=0
+		for _, r:=range s.reservoir {
+			v:=r.Data[i]
+			if !math.IsNaN(float64(v)) {
+				gathered[num]=v
+				num++
+			}
+		}
+		s.LowBound[i], s.HighBound[i]=-math.MaxFloat32, math.MaxFloat32
+		if num==0 { continue }
+
+		// estimate location and scale robustly, as the reservoir may contain outliers
+		median:=QSelectMedianFloat32(gathered[:num])
+		for j, g:=range gathered[:num] {
+			deviations[j]=float32(math.Abs(float64(g-median)))
+		}
+		scale:=1.4826*QSelectMedianFloat32(deviations[:num])
+		if scale>0 {
+			s.LowBound[i] =median-s.SigmaLow *scale
+			s.HighBound[i]=median+s.SigmaHigh*scale
+		}
+
+		for _, g:=range gathered[:num] {
+			if g<s.LowBound[i] {
+				s.NumClippedLow++
+			} else if g>s.HighBound[i] {
+				s.NumClippedHigh++
+			} else {
+				s.accept(i, g)
+			}
+		}
+	}
+	s.reservoir=nil
+}
+
+// Accepts a value into the running mean and variance of the given pixel, using Welford's algorithm
+func (s *StreamStacker) accept(i int, v float32) {
+	s.Count[i]++
+	if s.Mean64!=nil {
+		delta:=float64(v)-s.Mean64[i]
+		s.Mean64[i]+=delta/float64(s.Count[i])
+		s.M2x64[i]+=delta*(float64(v)-s.Mean64[i])
+		return
+	}
+	delta:=v-s.Mean[i]
+	s.Mean[i]+=delta/float32(s.Count[i])
+	s.M2[i]+=delta*(v-s.Mean[i])
+}
+
+// Returns the running mean and sample standard deviation of the given pixel
+func (s *StreamStacker) meanStdDev(i int) (mean, stdDev float32) {
+	if s.Mean64!=nil {
+		return float32(s.Mean64[i]), float32(math.Sqrt(s.M2x64[i]/float64(s.Count[i]-1)))
+	}
+	return s.Mean[i], float32(math.Sqrt(float64(s.M2[i]/float32(s.Count[i]-1))))
+}
+
+// Returns the current state of the stack as a new image with extended statistics, without finalizing it.
+// Before the reservoir is full, this is the plain mean of the frames in the reservoir
+func (s *StreamStacker) Current() (stack *FITSImage, err error) {
+	if s.NumFrames==0 { return nil, errors.New("No frames to stack") }
+
+	data:=make([]float32, int(s.naxisn[0])*int(s.naxisn[1]))
+	if s.Count==nil {
+		lightsData:=make([][]float32, len(s.reservoir))
+		for i, r:=range s.reservoir { lightsData[i]=r.Data }
+		StackMean(lightsData, s.RefMedian, s.Precision, data)
+	} else {
+		for i, c:=range s.Count {
+			if c==0 {
+				// If no valid data points available, replace with reference median, see StackMean()
+				data[i]=s.RefMedian
+			} else if s.Mean64!=nil {
+				data[i]=float32(s.Mean64[i])  // convert back to float32 if accumulated with 64 bits
+			} else {
+				data[i]=s.Mean[i]
+			}
+		}
+	}
+
+	stack=&FITSImage{
+		Header: NewFITSHeader(),
+		Bitpix: -32,
+		Bzero : 0,
+		Naxisn: append([]int32(nil), s.naxisn...), // clone slice
+		Pixels: int32(len(data)),
+		Data  : data,
+		Exposure : s.exposure,
+		Stats : nil,
+		Trans : IdentityTransform2D(),
+		Residual: 0,
+	}
+	stack.Stats, err=CalcExtendedStats(stack.Data, stack.Naxisn[0], s.LSEstimator)
+	return stack, err
+}
+
+// Returns the current per-pixel standard deviation of the accepted values as a new image with extended statistics.
+// Pixels with fewer than two accepted values have zero dispersion. Seeds from the reservoir if necessary
+func (s *StreamStacker) StdDev() (disp *FITSImage, err error) {
+	if s.NumFrames==0 { return nil, errors.New("No frames to stack") }
+	if s.Count==nil { s.seed() }
+
+	data:=make([]float32, len(s.Count))
+	for i, c:=range s.Count {
+		if c>=2 { _, data[i]=s.meanStdDev(i) }
+	}
+	disp=&FITSImage{
+		Header: NewFITSHeader(),
+		Bitpix: -32,
+		Bzero : 0,
+		Naxisn: append([]int32(nil), s.naxisn...), // clone slice
+		Pixels: int32(len(data)),
+		Data  : data,
+		Trans : IdentityTransform2D(),
+	}
+	disp.Stats, err=CalcExtendedStats(disp.Data, disp.Naxisn[0], s.LSEstimator)
+	return disp, err
+}
+
+// Finalizes the stack and returns the resulting image with extended statistics.
+// Seeds from the reservoir if fewer frames than the reservoir size were added
+func (s *StreamStacker) Finalize() (stack *FITSImage, err error) {
+	defer StartStage(StageStack)()
+	if s.NumFrames==0 { return nil, errors.New("No frames to stack") }
+	if s.Count==nil { s.seed() }
+
+	numValues:=float32(len(s.Count))*float32(s.NumFrames)
+	LogPrintf("Streamed %d frames. Clipped low %d (%.2f%%) high %d (%.2f%%)\n", s.NumFrames,
+		s.NumClippedLow, float32(s.NumClippedLow)*100.0/numValues, s.NumClippedHigh, float32(s.NumClippedHigh)*100.0/numValues)
+
+	stack, err=s.Current()
+	s.Mean, s.M2, s.Mean64, s.M2x64, s.Count, s.LowBound, s.HighBound=nil, nil, nil, nil, nil, nil, nil
+	return stack, err
+}
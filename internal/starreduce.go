@@ -0,0 +1,89 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+
+package internal
+
+import (
+	"math"
+)
+
+
+// Creates a feathered mask of the given stars for an image of the given size. The mask is 1 in the center
+// of each star and falls off linearly to 0 at radiusFactor times its half-flux radius, but at least minRadius pixels
+func StarMaskFeathered(width, height int32, stars []Star, radiusFactor, minRadius float32) (mask []float32) {
+	mask=make([]float32, width*height)
+	for _, s:=range stars {
+		radius:=radiusFactor*s.HFR
+		if radius<minRadius { radius=minRadius }
+		r:=int32(radius+1)
+		xc, yc:=int32(s.X+0.5), int32(s.Y+0.5)
+		for y:=yc-r; y<=yc+r; y++ {
+			if y<0 || y>=height { continue }
+			for x:=xc-r; x<=xc+r; x++ {
+				if x<0 || x>=width { continue }
+				dx, dy:=float32(x)-s.X, float32(y)-s.Y
+				d2:=dx*dx+dy*dy
+				if d2>=radius*radius { continue }
+				m:=1-float32(math.Sqrt(float64(d2)))/radius
+				if m>mask[y*width+x] { mask[y*width+x]=m }
+			}
+		}
+	}
+	return mask
+}
+
+// Reduces the size of the given stars in the given channel with a morphological minimum filter.
+// Erodes the channel with a 3x3 minimum filter for the given number of iterations, and blends the
+// eroded data into the original with the given strength, modulated by a feathered star mask,
+// so the background and extended structures stay untouched
+func (f *FITSImage) ReduceStars(chanID int, stars []Star, radiusFactor, strength float32, iterations int) {
+	width:=f.Naxisn[0]
+	height:=f.Naxisn[1]
+	l:=int(width*height)
+	data:=f.Data[chanID*l : (chanID+1)*l]
+
+	mask:=StarMaskFeathered(width, height, stars, radiusFactor, 3)
+	eroded:=make([]float32, l)
+	copy(eroded, data)
+	tmp:=make([]float32, l)
+	for i:=0; i<iterations; i++ {
+		minFilter3x3(tmp, eroded, width, height)
+		eroded, tmp=tmp, eroded
+	}
+
+	for i, m:=range mask {
+		if m==0 { continue }
+		data[i]+=strength*m*(eroded[i]-data[i])
+	}
+}
+
+// Applies a 3x3 minimum filter to the data, writing results into res. Clamps at the image borders
+func minFilter3x3(res, data []float32, width, height int32) {
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			min:=data[y*width+x]
+			for yy:=y-1; yy<=y+1; yy++ {
+				if yy<0 || yy>=height { continue }
+				for xx:=x-1; xx<=x+1; xx++ {
+					if xx<0 || xx>=width { continue }
+					if v:=data[yy*width+xx]; v<min { min=v }
+				}
+			}
+			res[y*width+x]=min
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+
+package internal
+
+
+// Creates a mask of the given stars for an image of the given size. Pixels within radiusFactor times
+// the half-flux radius of a star are 1, all others 0. The radius is at least minRadius pixels
+func StarMask(width, height int32, stars []Star, radiusFactor, minRadius float32) (mask []float32) {
+	mask=make([]float32, width*height)
+	for _, s:=range stars {
+		radius:=radiusFactor*s.HFR
+		if radius<minRadius { radius=minRadius }
+		r:=int32(radius+1)
+		xc, yc:=int32(s.X+0.5), int32(s.Y+0.5)
+		for y:=yc-r; y<=yc+r; y++ {
+			if y<0 || y>=height { continue }
+			for x:=xc-r; x<=xc+r; x++ {
+				if x<0 || x>=width { continue }
+				dx, dy:=float32(x)-s.X, float32(y)-s.Y
+				if dx*dx+dy*dy<=radius*radius { mask[y*width+x]=1 }
+			}
+		}
+	}
+	return mask
+}
+
+
+// Removes the given stars from the image. Masks each star within radiusFactor times its half-flux radius,
+// and inpaints the masked areas from their surroundings with a multi-scale push-pull fill, followed by
+// a few diffusion passes to blend the seams. Returns the starless image, and the star-only image as
+// the positive difference of the original and the starless image
+func RemoveStars(img *FITSImage, stars []Star, radiusFactor float32, lsEst LSEstimatorMode) (starless, starsOnly *FITSImage, err error) {
+	width, height:=img.Naxisn[0], img.Naxisn[1]
+	mask:=StarMask(width, height, stars, radiusFactor, 2)
+
+	data:=make([]float32, len(img.Data))
+	copy(data, img.Data)
+	inpaintPushPull(data, mask, width, height)
+	inpaintDiffuse(data, mask, width, height, 16)
+
+	starData:=make([]float32, len(img.Data))
+	for i, d:=range img.Data {
+		diff:=d-data[i]
+		if diff>0 { starData[i]=diff }
+	}
+
+	starless =newImageLike(img, data)
+	starsOnly=newImageLike(img, starData)
+	if starless.Stats, err=CalcExtendedStats(data, width, lsEst); err!=nil { return nil, nil, err }
+	if starsOnly.Stats, err=CalcExtendedStats(starData, width, lsEst); err!=nil { return nil, nil, err }
+	return starless, starsOnly, nil
+}
+
+// Creates a new image with the given data and the metadata of the given image
+func newImageLike(img *FITSImage, data []float32) *FITSImage {
+	return &FITSImage{
+		ID      : img.ID,
+		Header  : NewFITSHeader(),
+		Bitpix  : -32,
+		Naxisn  : append([]int32(nil), img.Naxisn...), // clone slice
+		Pixels  : img.Pixels,
+		Data    : data,
+		Exposure: img.Exposure,
+		Stars   : img.Stars,
+		HFR     : img.HFR,
+		Trans   : img.Trans,
+	}
+}
+
+// Fills the masked pixels of the data from their unmasked surroundings. Recursively averages the data
+// into half resolution ignoring masked pixels until no holes remain, then fills the holes of each
+// level with bilinear interpolation from the next coarser level
+func inpaintPushPull(data, mask []float32, width, height int32) {
+	holes:=false
+	for _, m:=range mask {
+		if m!=0 { holes=true; break }
+	}
+	if !holes { return }
+	if width<=1 && height<=1 { return } // fully masked, nothing to fill from
+
+	// push: average unmasked pixels into half resolution
+	cw, ch:=(width+1)/2, (height+1)/2
+	coarse, coarseMask:=make([]float32, cw*ch), make([]float32, cw*ch)
+	for cy:=int32(0); cy<ch; cy++ {
+		for cx:=int32(0); cx<cw; cx++ {
+			sum, num:=float32(0), 0
+			for y:=2*cy; y<2*cy+2 && y<height; y++ {
+				for x:=2*cx; x<2*cx+2 && x<width; x++ {
+					if mask[y*width+x]==0 { sum+=data[y*width+x]; num++ }
+				}
+			}
+			if num>0 {
+				coarse[cy*cw+cx]=sum/float32(num)
+			} else {
+				coarseMask[cy*cw+cx]=1
+			}
+		}
+	}
+	inpaintPushPull(coarse, coarseMask, cw, ch)
+
+	// pull: fill holes with bilinear interpolation from the coarser level
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			if mask[y*width+x]==0 { continue }
+			fx, fy:=float32(x)*0.5-0.25, float32(y)*0.5-0.25
+			if fx<0 { fx=0 }
+			if fy<0 { fy=0 }
+			x0, y0:=int32(fx), int32(fy)
+			x1, y1:=x0+1, y0+1
+			if x1>=cw { x1=cw-1 }
+			if y1>=ch { y1=ch-1 }
+			ax, ay:=fx-float32(x0), fy-float32(y0)
+			top   :=coarse[y0*cw+x0]*(1-ax)+coarse[y0*cw+x1]*ax
+			bottom:=coarse[y1*cw+x0]*(1-ax)+coarse[y1*cw+x1]*ax
+			data[y*width+x]=top*(1-ay)+bottom*ay
+		}
+	}
+}
+
+// Smoothes the masked pixels of the data by averaging each with its four neighbors, for the given number
+// of passes. Unmasked pixels are kept, so the fill blends seamlessly into its surroundings
+func inpaintDiffuse(data, mask []float32, width, height int32, passes int) {
+	for p:=0; p<passes; p++ {
+		for y:=int32(0); y<height; y++ {
+			for x:=int32(0); x<width; x++ {
+				i:=y*width+x
+				if mask[i]==0 { continue }
+				sum, num:=float32(0), 0
+				if x>0        { sum+=data[i-1];     num++ }
+				if x<width-1  { sum+=data[i+1];     num++ }
+				if y>0        { sum+=data[i-width]; num++ }
+				if y<height-1 { sum+=data[i+width]; num++ }
+				if num>0 { data[i]=sum/float32(num) }
+			}
+		}
+	}
+}
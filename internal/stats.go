@@ -19,7 +19,6 @@ package internal
 import (
 	"fmt"
 	"math"
-	"github.com/valyala/fastrand"
 	//"time"
 )
 
@@ -46,9 +45,6 @@ const (
 	LSESCMedianQn
 )
 
-// Global mode selection for location and scale estimation
-var LSEstimator LSEstimatorMode = LSESCMedianQn
-
 
 // Pretty print basic stats to string
 func (s *BasicStats) String() string {
@@ -81,12 +77,12 @@ func CalcBasicStats(data []float32) (s *BasicStats) {
 }
 
 
-// Calculates extended statistics and stores in f.Stats 
-func CalcExtendedStats(data []float32, width int32) (s *BasicStats, err error) {
+// Calculates extended statistics, with location and scale from the given estimator, and noise from the standard estimator
+func CalcExtendedStats(data []float32, width int32, lsEst LSEstimatorMode) (s *BasicStats, err error) {
 	s=CalcBasicStats(data)
 	numSamples:=128*1024
 
-	switch LSEstimator {
+	switch lsEst {
 	case LSEMeanStdDev:
 		s.Location, s.Scale=s.Mean, s.StdDev
 	case LSEMedianMAD:
@@ -100,12 +96,25 @@ func CalcExtendedStats(data []float32, width int32) (s *BasicStats, err error) {
 		s.Location,   s.Scale=FastApproxSigmaClippedMedianAndQn(data, 2, 2, (s.Max-s.Min)/(65535.0), numSamples)
 	}
 
-	s.Noise=EstimateNoise(data, width)
+	s.Noise=EstimateNoise(data, width, NEImmerkaer)
 
 	return s, nil
 }	
 
 
+// Updates the statistics for data scaled by the given positive factor and offset, avoiding a recalculation.
+// Location and dispersion measures transform linearly
+func (s *BasicStats) ScaleOffset(scale, offset float32) {
+	s.Min     =s.Min     *scale+offset
+	s.Max     =s.Max     *scale+offset
+	s.Mean    =s.Mean    *scale+offset
+	s.StdDev  =s.StdDev  *scale
+	s.Location=s.Location*scale+offset
+	s.Scale   =s.Scale   *scale
+	s.Noise   =s.Noise   *scale
+}
+
+
 func MeanStdDev(xs []float32) (mean, stdDev float32) {
 	// calculate base statistics for xs
 	xmean:=float32(0)
@@ -202,7 +211,7 @@ func SigmaClippedMedianAndMAD(data []float32, sigmaLow, sigmaHigh float32) (medi
 // Uses provided samples array as scratchpad
 func FastApproxMedian(data []float32, samples []float32) float32 {
 	max:=uint32(len(data))
-	rng:=fastrand.RNG{}
+	rng:=NewRNG(samplingSeed)
 	for i,_:=range samples {
 		index:=rng.Uint32n(max)
 		samples[i]=data[index]
@@ -215,7 +224,7 @@ func FastApproxMedian(data []float32, samples []float32) float32 {
 // Uses provided samples array as scratchpad
 func FastApproxBoundedMedian(data []float32, lowBound, highBound float32, samples []float32) float32 {
 	max:=uint32(len(data))
-	rng:=fastrand.RNG{}
+	rng:=NewRNG(samplingSeed)
 	for i,_:=range samples {
 		var d float32
 		for {
@@ -233,7 +242,7 @@ func FastApproxBoundedMedian(data []float32, lowBound, highBound float32, sample
 // Calculates fast approximate median of the (presumably large) data by subsampling the given number of values and taking the median of that. 
 func FastApproxStdDev(data []float32, location float32, numSamples int) float32 {
 	max:=uint32(len(data))
-	rng:=fastrand.RNG{}
+	rng:=NewRNG(samplingSeed)
 	sumSqDiff:=float32(0)
 	for i:=0; i<numSamples; i++ {
 		index:=rng.Uint32n(max)
@@ -248,7 +257,7 @@ func FastApproxStdDev(data []float32, location float32, numSamples int) float32
 // Calculates fast approximate median of the (presumably large) data by subsampling the given number of values and taking the median of that. 
 func FastApproxBoundedStdDev(data []float32, location float32, lowBound, highBound float32, numSamples int) float32 {
 	max:=uint32(len(data))
-	rng:=fastrand.RNG{}
+	rng:=NewRNG(samplingSeed)
 	sumSqDiff:=float32(0)
 	for i:=0; i<numSamples; i++ {
 		var d float32
@@ -267,7 +276,7 @@ func FastApproxBoundedStdDev(data []float32, location float32, lowBound, highBou
 // Calculates fast approximate median of absolute differences of the (presumably large) data by subsampling the given number of values and taking the MAD of that. 
 func FastApproxMAD(data []float32, location float32, samples []float32) float32 {
 	max:=uint32(len(data))
-	rng:=fastrand.RNG{}
+	rng:=NewRNG(samplingSeed)
 	for i,_:=range samples {
 		index:=rng.Uint32n(max)
 		samples[i]=float32(math.Abs(float64(data[index]-location)))
@@ -280,7 +289,7 @@ func FastApproxMAD(data []float32, location float32, samples []float32) float32
 func FastApproxBoundedMAD(data []float32, location float32, lowBound, highBound float32, numSamples int) float32 {
 	samples:=make([]float32,numSamples)
 	max:=uint32(len(data))
-	rng:=fastrand.RNG{}
+	rng:=NewRNG(samplingSeed)
 	for i,_:=range samples {
 		var d float32
 		for {
@@ -301,7 +310,7 @@ func FastApproxBoundedMAD(data []float32, location float32, lowBound, highBound
 // Sampling approach appears to be mine
 func FastApproxQn(data []float32, samples []float32) float32 {
 	max:=uint32(len(data))
-	rng:=fastrand.RNG{}
+	rng:=NewRNG(samplingSeed)
 	for i,_:=range samples {
 		index1:=1+rng.Uint32n(max-1)
 		index2:=rng.Uint32n(index1)
@@ -316,7 +325,7 @@ func FastApproxQn(data []float32, samples []float32) float32 {
 // Calculates fast approximate Qn scale estimate of the (presumably large) data by subsampling the given number of pairs and taking the first quartile of that. 
 func FastApproxBoundedQn(data []float32, lowBound, highBound float32, samples []float32) float32 {
 	max:=uint32(len(data))
-	rng:=fastrand.RNG{}
+	rng:=NewRNG(samplingSeed)
 	for i,_:=range samples {
 		var d1, d2 float32
 		for {
@@ -497,13 +506,13 @@ func HalfSampleModeSorted(data []float32) float32 {
 }
 
 // Returns greyscale location and scale for given RGB image
-func RGBGreyLocScale(data []float32, width int32) (loc, scale float32, err error) {
+func RGBGreyLocScale(data []float32, width int32, lsEst LSEstimatorMode) (loc, scale float32, err error) {
 	l:=len(data)/3
-	rStats,err:=CalcExtendedStats(data[0*l:1*l], width)
+	rStats,err:=CalcExtendedStats(data[0*l:1*l], width, lsEst)
    	if err!=nil { return 0,0, err }
-	gStats,err:=CalcExtendedStats(data[1*l:2*l], width)
+	gStats,err:=CalcExtendedStats(data[1*l:2*l], width, lsEst)
    	if err!=nil { return 0,0, err }
-	bStats,err:=CalcExtendedStats(data[2*l:3*l], width)
+	bStats,err:=CalcExtendedStats(data[2*l:3*l], width, lsEst)
    	if err!=nil { return 0,0, err }
 	loc  =0.299*rStats.Location +0.587*gStats.Location +0.114*bStats.Location
 	scale=0.299*rStats.Scale    +0.587*gStats.Scale    +0.114*bStats.Scale
@@ -512,9 +521,9 @@ func RGBGreyLocScale(data []float32, width int32) (loc, scale float32, err error
 
 
 // Returns greyscale location and scale for given HCL image
-func HCLLumLocScale(data []float32, width int32) (loc, scale float32, err error) {
+func HCLLumLocScale(data []float32, width int32, lsEst LSEstimatorMode) (loc, scale float32, err error) {
 	l:=len(data)/3
-	lumStats,err:=CalcExtendedStats(data[2*l:3*l], width)
+	lumStats,err:=CalcExtendedStats(data[2*l:3*l], width, lsEst)
    	if err!=nil { return 0,0, err }
 	return lumStats.Location, lumStats.Scale, nil
 }
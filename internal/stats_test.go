@@ -0,0 +1,62 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestCalcExtendedStatsEstimator(t *testing.T) {
+	width:=int32(64)
+	data:=make([]float32, width*width)
+	for i:=range data {
+		data[i]=100+float32(i%7)
+		if i%10==0 { data[i]=1000 } // bright outliers
+	}
+
+	// estimators are selected per call, so concurrent calls with different settings must not interfere
+	results:=make([]*BasicStats, 2)
+	done:=make(chan bool)
+	for i, lsEst:=range []LSEstimatorMode{LSEMeanStdDev, LSEMedianMAD} {
+		go func(i int, lsEst LSEstimatorMode) {
+			s, err:=CalcExtendedStats(data, width, lsEst)
+			if err!=nil { t.Error(err) }
+			results[i]=s
+			done <- true
+		}(i, lsEst)
+	}
+	<-done
+	<-done
+
+	if results[0].Location!=results[0].Mean { t.Errorf("mean/stddev location=%f; want mean %f", results[0].Location, results[0].Mean) }
+	if results[1].Location<100 || results[1].Location>=107 { t.Errorf("median/MAD location=%f; want within [100,107)", results[1].Location) }
+}
+
+func TestBasicStatsScaleOffset(t *testing.T) {
+	width:=int32(64)
+	data:=make([]float32, width*width)
+	for i:=range data { data[i]=100+float32(i%7)+float32(i%13)*0.5 }
+	s, _:=CalcExtendedStats(data, width, LSEMeanStdDev)
+	for i:=range data { data[i]=data[i]*0.01-1 }
+	want, _:=CalcExtendedStats(data, width, LSEMeanStdDev)
+	s.ScaleOffset(0.01, -1)
+
+	near:=func(a, b float32) bool { return a-b<1e-4 && b-a<1e-4 }
+	if !near(s.Min, want.Min) || !near(s.Max, want.Max) || !near(s.Mean, want.Mean) || !near(s.StdDev, want.StdDev) ||
+	   !near(s.Location, want.Location) || !near(s.Scale, want.Scale) || !near(s.Noise, want.Noise) {
+		t.Errorf("got %v, want %v", s, want)
+	}
+}
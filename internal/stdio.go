@@ -0,0 +1,62 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+
+// File name for reading input from stdin, or writing output to stdout
+const StdioFileName="-"
+
+// Data read from stdin. Stdin is read completely on first use, so it can be read repeatedly,
+// e.g. for estimating memory needs before loading the frame
+var stdinData  []byte
+var stdinErr   error
+var stdinOnce  sync.Once
+
+// Returns the data read from stdin
+func readStdin() ([]byte, error) {
+	stdinOnce.Do(func() {
+		stdinData, stdinErr=ioutil.ReadAll(os.Stdin)
+	})
+	return stdinData, stdinErr
+}
+
+// Returns a reader for a FITS stream on stdin. Decompresses gzip if the stream starts with the gzip magic number
+func stdinFITSReader() (io.Reader, error) {
+	data, err:=readStdin()
+	if err!=nil { return nil, err }
+	if len(data)>=2 && data[0]==0x1f && data[1]==0x8b {
+		return gzip.NewReader(bytes.NewReader(data))
+	}
+	return bytes.NewReader(data), nil
+}
+
+// Writes to stdout with the given write function, buffered
+func writeStdout(write func(w io.Writer) error) error {
+	writer:=bufio.NewWriter(os.Stdout)
+	if err:=write(writer); err!=nil { return err }
+	return writer.Flush()
+}
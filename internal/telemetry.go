@@ -0,0 +1,190 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// Processing stages for timing telemetry
+type Stage int
+
+const (
+	StageLoad Stage = iota  // Loading input files
+	StageCalibrate          // Dark and flat calibration, bad pixel removal, debayering, binning and background extraction
+	StageStars              // Star detection
+	StageAlign              // Normalization, alignment and resampling into the reference frame
+	StageStack              // Stacking
+	StageColor              // Color processing of composites
+	StageOutput             // Writing output files
+	numStages
+)
+
+var stageNames=[numStages]string{"load", "calibrate", "stars", "align", "stack", "color", "output"}
+
+// Returns the name of the stage
+func (s Stage) String() string {
+	return stageNames[s]
+}
+
+// Timing of a processing stage
+type StageTiming struct {
+	Name        string         `json:"name"`         // Name of the stage
+	Calls       int64          `json:"calls"`        // Number of times the stage was entered
+	Wall        time.Duration  `json:"-"`            // Wall time during which the stage was active
+	WallSeconds float64        `json:"wallSeconds"`  // Wall time in seconds, for JSON output
+	PeakMiB     float64        `json:"peakMiB"`      // Peak heap memory in use when entering or leaving the stage
+}
+
+// Timing telemetry per processing stage. Stages can be active in several goroutines at once, and can be
+// nested, e.g. star detection within calibration. Wall time counts the time a stage was active in any
+// goroutine, so concurrent frames are not double counted, and the sum across stages can exceed the total
+type Telemetry struct {
+	mutex  sync.Mutex
+	active [numStages]int
+	since  [numStages]time.Time
+	wall   [numStages]time.Duration
+	calls  [numStages]int64
+	peak   [numStages]uint64
+}
+
+// Global timing telemetry for the current run
+var Timings=&Telemetry{}
+
+// Enters the given stage of the global timing telemetry. Returns the function to call when leaving it
+func StartStage(s Stage) (stop func()) {
+	return Timings.Start(s)
+}
+
+// Enters the given stage. Returns the function to call when leaving it. Calling it more than once has no effect,
+// so it can be deferred and also called early
+func (t *Telemetry) Start(s Stage) (stop func()) {
+	t.enter(s, HeapInUse())
+	stopped:=false
+	return func() {
+		if stopped { return }
+		stopped=true
+		t.leave(s, HeapInUse())
+	}
+}
+
+func (t *Telemetry) enter(s Stage, mem uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.active[s]==0 { t.since[s]=time.Now() }
+	t.active[s]++
+	t.calls[s]++
+	if mem>t.peak[s] { t.peak[s]=mem }
+}
+
+func (t *Telemetry) leave(s Stage, mem uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.active[s]--
+	if t.active[s]==0 { t.wall[s]+=time.Since(t.since[s]) }
+	if mem>t.peak[s] { t.peak[s]=mem }
+}
+
+// Returns the heap memory currently in use, in bytes
+func HeapInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapInuse
+}
+
+// Returns the timings of all stages entered so far, in stage order. Includes the time of stages still active
+func (t *Telemetry) Stages() (timings []StageTiming) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for s:=Stage(0); s<numStages; s++ {
+		if t.calls[s]==0 { continue }
+		wall:=t.wall[s]
+		if t.active[s]>0 { wall+=time.Since(t.since[s]) }
+		timings=append(timings, StageTiming{
+			Name       : s.String(),
+			Calls      : t.calls[s],
+			Wall       : wall,
+			WallSeconds: wall.Seconds(),
+			PeakMiB    : float64(t.peak[s])/(1024*1024),
+		})
+	}
+	return timings
+}
+
+// Returns the stage timings as a table, for log output
+func (t *Telemetry) String() string {
+	sb:=strings.Builder{}
+	sb.WriteString(fmt.Sprintf("%-10s %8s %12s %10s\n", "Stage", "Calls", "Wall time", "Peak MiB"))
+	for _, st:=range t.Stages() {
+		sb.WriteString(fmt.Sprintf("%-10s %8d %12s %10.1f\n", st.Name, st.Calls, st.Wall.Round(time.Millisecond), st.PeakMiB))
+	}
+	return sb.String()
+}
+
+// Writes the stage timings and the given total wall time to a JSON file, for performance tuning
+func (t *Telemetry) WriteJSONFile(fileName string, total time.Duration) error {
+	summary:=struct {
+		TotalSeconds float64        `json:"totalSeconds"`
+		Stages       []StageTiming  `json:"stages"`
+	}{total.Seconds(), t.Stages()}
+	bytes, err:=json.MarshalIndent(summary, "", "  ")
+	if err!=nil { return err }
+	return WriteBytesAtomic(fileName, bytes)
+}
+
+// Monitors the peak heap memory in use by sampling it periodically in the background
+type MemoryMonitor struct {
+	baseline uint64
+	peak     uint64
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Starts monitoring heap memory with the given sampling interval. Records the current heap in use as baseline
+func StartMemoryMonitor(interval time.Duration) *MemoryMonitor {
+	m:=&MemoryMonitor{stop: make(chan struct{}), done: make(chan struct{})}
+	m.baseline=HeapInUse()
+	m.peak=m.baseline
+	go func() {
+		defer close(m.done)
+		ticker:=time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				if mem:=HeapInUse(); mem>m.peak { m.peak=mem }
+			}
+		}
+	}()
+	return m
+}
+
+// Stops monitoring. Returns the baseline and the peak heap memory in use while monitoring, in bytes
+func (m *MemoryMonitor) Stop() (baseline, peak uint64) {
+	close(m.stop)
+	<-m.done
+	if mem:=HeapInUse(); mem>m.peak { m.peak=mem }
+	return m.baseline, m.peak
+}
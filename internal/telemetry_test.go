@@ -0,0 +1,50 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTelemetry(t *testing.T) {
+	tm:=&Telemetry{}
+	outer:=tm.Start(StageStack)
+	inner:=tm.Start(StageStack) // nested or concurrent, must not double count
+	time.Sleep(20*time.Millisecond)
+	inner()
+	inner()                     // repeated stop has no effect
+	outer()
+	tm.Start(StageLoad)()
+
+	stages:=tm.Stages()
+	if len(stages)!=2 || stages[0].Name!="load" || stages[1].Name!="stack" {
+		t.Fatalf("got %v want load and stack", stages)
+	}
+	st:=stages[1]
+	if st.Calls!=2 { t.Errorf("got %d calls want 2", st.Calls) }
+	if st.Wall<20*time.Millisecond || st.Wall>time.Second { t.Errorf("got wall time %v", st.Wall) }
+	if st.PeakMiB<=0 { t.Errorf("got peak %g MiB", st.PeakMiB) }
+}
+
+func TestMemoryMonitor(t *testing.T) {
+	m:=StartMemoryMonitor(time.Millisecond)
+	buf:=make([]byte, 64*1024*1024)
+	for i:=range buf { buf[i]=byte(i) }
+	time.Sleep(20*time.Millisecond)
+	baseline, peak:=m.Stop()
+	if buf[1]!=1 || peak<baseline+32*1024*1024 { t.Errorf("got baseline %d peak %d, want at least 32 MiB difference", baseline, peak) }
+}
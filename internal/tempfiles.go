@@ -0,0 +1,95 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+
+// Temporary files and directories currently in use, to be removed when aborting
+var tempPaths     =map[string]bool{}
+var tempPathsMutex sync.Mutex
+
+// Registers a temporary file or directory for removal when aborting
+func registerTempPath(p string) {
+	tempPathsMutex.Lock()
+	tempPaths[p]=true
+	tempPathsMutex.Unlock()
+}
+
+// Unregisters a temporary file or directory which was removed or renamed
+func unregisterTempPath(p string) {
+	tempPathsMutex.Lock()
+	delete(tempPaths, p)
+	tempPathsMutex.Unlock()
+}
+
+// Removes all temporary files and directories still in use. Called when aborting on fatal errors or interrupts
+func RemoveTempFiles() {
+	tempPathsMutex.Lock()
+	defer tempPathsMutex.Unlock()
+	for p:=range tempPaths {
+		os.RemoveAll(p)
+		delete(tempPaths, p)
+	}
+}
+
+// Writes a file with the given write function. Writes to a temporary file in the same directory first,
+// and renames it to the given name only on success, so an interrupted run or a full disk never leaves
+// a truncated file behind. Keeps the permissions of an existing file. The file name - writes to stdout
+func WriteFileAtomic(fileName string, write func(w io.Writer) error) (err error) {
+	defer StartStage(StageOutput)()
+	if fileName==StdioFileName { return writeStdout(write) }
+
+	mode:=os.FileMode(0644)
+	if info, err:=os.Stat(fileName); err==nil { mode=info.Mode().Perm() }
+
+	dir, base:=filepath.Split(fileName)
+	if dir=="" { dir="." }
+	tmp, err:=ioutil.TempFile(dir, "."+base+".tmp")
+	if err!=nil { return err }
+	registerTempPath(tmp.Name())
+	defer func() {
+		if err!=nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+		unregisterTempPath(tmp.Name())
+	}()
+
+	writer:=bufio.NewWriter(tmp)
+	if err=write(writer); err!=nil { return err }
+	if err=writer.Flush(); err!=nil { return err }
+	if err=tmp.Sync(); err!=nil { return err }
+	if err=tmp.Chmod(mode); err!=nil { return err }
+	if err=tmp.Close(); err!=nil { return err }
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// Writes the given bytes to a file via a temporary file, see WriteFileAtomic
+func WriteBytesAtomic(fileName string, data []byte) error {
+	return WriteFileAtomic(fileName, func(w io.Writer) error {
+		_, err:=w.Write(data)
+		return err
+	})
+}
@@ -0,0 +1,46 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err:=ioutil.TempDir("", "nlatomic")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+
+	fileName:=filepath.Join(dir, "a.fits")
+	if err:=WriteBytesAtomic(fileName, []byte("first")); err!=nil { t.Fatal(err) }
+
+	// a failing write must leave the original file and no temporary files
+	err=WriteFileAtomic(fileName, func(w io.Writer) error {
+		w.Write([]byte("trunc"))
+		return errors.New("disk full")
+	})
+	if err==nil { t.Errorf("expected error") }
+	if data, _:=ioutil.ReadFile(fileName); string(data)!="first" { t.Errorf("got '%s' want 'first'", string(data)) }
+	if files, _:=ioutil.ReadDir(dir); len(files)!=1 { t.Errorf("got %d files want 1", len(files)) }
+
+	if err:=WriteBytesAtomic(fileName, []byte("second")); err!=nil { t.Fatal(err) }
+	if data, _:=ioutil.ReadFile(fileName); string(data)!="second" { t.Errorf("got '%s' want 'second'", string(data)) }
+}
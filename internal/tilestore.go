@@ -0,0 +1,180 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+
+// Temporary on-disk storage for registered light frames. Pixel data is stored as raw little-endian
+// float32 rows, one file per frame, so stacking can proceed in horizontal bands reading only the
+// rows needed, or map whole frames into memory. Frame metadata like stats and stars is retained in memory, pixel data is not
+type TileStore struct {
+	Dir       string        // Temporary directory holding the frame files
+	Naxisn    []int32       // Dimensions of the stored frames
+	Frames    []*FITSImage  // Metadata of the stored frames, without pixel data
+	fileNames []string      // Names of the frame files, same order as Frames
+	mapped    [][]byte      // Memory mappings of the frame files, if mapped
+}
+
+// Creates a new tile store in a fresh temporary directory within the given directory.
+// Uses the default directory for temporary files if dir is empty
+func NewTileStore(dir string) (ts *TileStore, err error) {
+	tmpDir, err:=ioutil.TempDir(dir, "nightlight")
+	if err!=nil { return nil, err }
+	registerTempPath(tmpDir)
+	return &TileStore{Dir: tmpDir}, nil
+}
+
+// Writes the pixel data of the light frame to disk, and retains its metadata
+func (ts *TileStore) Add(light *FITSImage) error {
+	if ts.Naxisn==nil {
+		ts.Naxisn=append([]int32(nil), light.Naxisn...) // clone slice
+	} else if !EqualInt32Slice(ts.Naxisn, light.Naxisn) {
+		return errors.New(fmt.Sprintf("%d: Frame size %v differs from stored size %v", light.ID, light.Naxisn, ts.Naxisn))
+	}
+
+	fileName:=filepath.Join(ts.Dir, fmt.Sprintf("frame%05d.raw", len(ts.fileNames)))
+	f, err:=os.Create(fileName)
+	if err!=nil { return err }
+	defer f.Close()
+
+	// write out row by row to limit the size of the conversion buffer
+	width:=int(light.Naxisn[0])
+	buf:=make([]byte, 4*width)
+	for lower:=0; lower<len(light.Data); lower+=width {
+		for i, d:=range light.Data[lower:lower+width] {
+			binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(d))
+		}
+		if _, err=f.Write(buf); err!=nil { return err }
+	}
+
+	meta:=*light
+	meta.Data=nil
+	ts.Frames   =append(ts.Frames, &meta)
+	ts.fileNames=append(ts.fileNames, fileName)
+	return nil
+}
+
+// Reads rows [lower, upper) of all stored frames. Returns a list of band images,
+// each with the metadata of the original frame and the dimensions of the band
+func (ts *TileStore) ReadBand(lower, upper int32) (bands []*FITSImage, err error) {
+	width:=ts.Naxisn[0]
+	buf:=make([]byte, 4*int(width)*int(upper-lower))
+	bands=make([]*FITSImage, len(ts.Frames))
+	for i, fileName:=range ts.fileNames {
+		f, err:=os.Open(fileName)
+		if err!=nil { return nil, err }
+		_, err=f.ReadAt(buf, 4*int64(width)*int64(lower))
+		f.Close()
+		if err!=nil { return nil, err }
+
+		band:=*ts.Frames[i]
+		band.Naxisn=[]int32{width, upper-lower}
+		band.Pixels=width*(upper-lower)
+		band.Data  =make([]float32, band.Pixels)
+		for j, _:=range band.Data {
+			band.Data[j]=math.Float32frombits(binary.LittleEndian.Uint32(buf[4*j:]))
+		}
+		bands[i]=&band
+	}
+	return bands, nil
+}
+
+// Reads the given rows of all stored frames, e.g. a sample spread across the whole frame. Returns a list of
+// images, each with the metadata of the original frame and the given rows one below the other
+func (ts *TileStore) ReadRows(rows []int32) (samples []*FITSImage, err error) {
+	width:=ts.Naxisn[0]
+	buf:=make([]byte, 4*int(width))
+	samples=make([]*FITSImage, len(ts.Frames))
+	for i, fileName:=range ts.fileNames {
+		f, err:=os.Open(fileName)
+		if err!=nil { return nil, err }
+
+		sample:=*ts.Frames[i]
+		sample.Naxisn=[]int32{width, int32(len(rows))}
+		sample.Pixels=width*int32(len(rows))
+		sample.Data  =make([]float32, sample.Pixels)
+		for r, row:=range rows {
+			_, err=f.ReadAt(buf, 4*int64(width)*int64(row))
+			if err!=nil { f.Close(); return nil, err }
+			rowData:=sample.Data[r*int(width):(r+1)*int(width)]
+			for j, _:=range rowData {
+				rowData[j]=math.Float32frombits(binary.LittleEndian.Uint32(buf[4*j:]))
+			}
+		}
+		f.Close()
+		samples[i]=&sample
+	}
+	return samples, nil
+}
+
+// Maximum number of pixels of a memory-mapped frame, for viewing the mapped bytes as float32 values
+const maxMappedPixels=1<<28
+
+// Maps the pixel data of all stored frames into memory. Returns frames with the metadata of the originals,
+// whose data views the mapped files. The operating system pages the data in and out as needed, so the frames
+// need not fit into physical memory. Writes to the data are private. The data remains valid until the store is closed
+func (ts *TileStore) Map() (frames []*FITSImage, err error) {
+	if !nativeLittleEndian() { return nil, errors.New("Memory-mapped frames require a little-endian CPU") }
+	frames=make([]*FITSImage, len(ts.Frames))
+	for i, fileName:=range ts.fileNames {
+		f, err:=os.Open(fileName)
+		if err!=nil { return nil, err }
+		fi, err:=f.Stat()
+		if err!=nil { f.Close(); return nil, err }
+		pixels:=int(fi.Size()/4)
+		if pixels==0 || pixels>maxMappedPixels { 
+			f.Close()
+			return nil, errors.New(fmt.Sprintf("%d: Cannot map temporary file %s with %d pixels", ts.Frames[i].ID, fileName, pixels))
+		}
+		b, err:=mmapFile(f, 4*pixels)
+		f.Close()
+		if err!=nil { return nil, err }
+		ts.mapped=append(ts.mapped, b)
+
+		frame:=*ts.Frames[i]
+		frame.Data=(*[maxMappedPixels]float32)(unsafe.Pointer(&b[0]))[:pixels:pixels] // view as float32 without copying
+		frames[i]=&frame
+	}
+	return frames, nil
+}
+
+// Returns true if the CPU stores multi-byte values in little-endian byte order, like the stored frames
+func nativeLittleEndian() bool {
+	x:=uint16(1)
+	return *(*byte)(unsafe.Pointer(&x))==1
+}
+
+// Removes the temporary directory and all stored frames. Unmaps frames mapped into memory, 
+// so their data must not be used afterwards
+func (ts *TileStore) Close() error {
+	for _, b:=range ts.mapped {
+		munmapFile(b)
+	}
+	ts.mapped=nil
+	unregisterTempPath(ts.Dir)
+	return os.RemoveAll(ts.Dir)
+}
@@ -0,0 +1,65 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestTileStoreMap(t *testing.T) {
+	if !MmapSupported { t.Skip("memory-mapped files not supported") }
+	ts, err:=NewTileStore("")
+	if err!=nil { t.Fatal(err) }
+	defer ts.Close()
+
+	for i:=0; i<3; i++ {
+		data:=make([]float32, 64)
+		for p:=range data { data[p]=float32(i*100+p) }
+		if err:=ts.Add(&FITSImage{ID:i, Naxisn:[]int32{8,8}, Pixels:64, Data:data}); err!=nil { t.Fatal(err) }
+	}
+	frames, err:=ts.Map()
+	if err!=nil { t.Fatal(err) }
+	if len(frames)!=3 { t.Fatalf("mapped %d frames; want 3", len(frames)) }
+	for i, f:=range frames {
+		if f.ID!=i || len(f.Data)!=64 { t.Fatalf("frame %d: ID %d with %d values", i, f.ID, len(f.Data)) }
+		if f.Data[0]!=float32(i*100) || f.Data[63]!=float32(i*100+63) { t.Errorf("frame %d: data %v", i, f.Data) }
+	}
+
+	// writes are private to the mapping
+	frames[0].Data[0]=-1
+	bands, err:=ts.ReadBand(0, 1)
+	if err!=nil { t.Fatal(err) }
+	if bands[0].Data[0]!=0 { t.Errorf("write to mapped frame reached the file: %f", bands[0].Data[0]) }
+}
+
+func TestTileStoreReadRows(t *testing.T) {
+	ts, err:=NewTileStore("")
+	if err!=nil { t.Fatal(err) }
+	defer ts.Close()
+
+	for i:=0; i<2; i++ {
+		data:=make([]float32, 32)
+		for p:=range data { data[p]=float32(i*100+p) }
+		if err:=ts.Add(&FITSImage{ID:i, Naxisn:[]int32{4,8}, Pixels:32, Data:data}); err!=nil { t.Fatal(err) }
+	}
+	samples, err:=ts.ReadRows([]int32{1, 6})
+	if err!=nil { t.Fatal(err) }
+	for i, s:=range samples {
+		if s.ID!=i || s.Naxisn[0]!=4 || s.Naxisn[1]!=2 || len(s.Data)!=8 { t.Fatalf("sample %d: ID %d size %v with %d values", i, s.ID, s.Naxisn, len(s.Data)) }
+		if s.Data[0]!=float32(i*100+4) || s.Data[4]!=float32(i*100+24) || s.Data[7]!=float32(i*100+27) { t.Errorf("sample %d: data %v", i, s.Data) }
+	}
+}
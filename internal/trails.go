@@ -0,0 +1,227 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Parameters of the Hough transform for trail detection
+const trailThetaBins    = 360  // Number of angle bins over [0,pi), i.e. 0.5 degree resolution
+const trailContrastDist = 5    // Distance in pixels to the neighbors a trail pixel must be brighter than
+const trailMaxGap       = 16   // Maximum gap in pixels along a trail, e.g. between blinking plane lights
+const trailMinFill      = 0.5  // Minimum fraction of bright pixels along a trail
+const trailMaxPeaks     = 64   // Maximum number of Hough peaks to verify per frame
+const trailMaxTrails    = 8    // Maximum number of trails to detect per frame
+const trailMaxStarEcc   = 0.5  // Maximum eccentricity of stars excluded from trail detection
+
+// A linear trail of a satellite or plane, in Hesse normal form x*cos(Theta) + y*sin(Theta) = Rho
+type Trail struct {
+	Theta  float32  // Angle of the normal in radians within [0,pi)
+	Rho    float32  // Signed distance of the line from the origin in pixels
+	Length int32    // Length of the longest run of bright pixels along the line
+}
+
+// Pretty print the trail with the angle of its direction in degrees
+func (t Trail) String() string {
+	angle:=math.Mod(float64(t.Theta)*180/math.Pi+90, 180)
+	return fmt.Sprintf("angle %.1f rho %.1f length %d", angle, t.Rho, t.Length)
+}
+
+// Detects linear trails in the given image with a Hough transform. Trail pixels must exceed the background location
+// by sigma times the scale, and be brighter by as much than their neighbors on either side horizontally or vertically,
+// which excludes smooth nebulosity. Pixels of the given round stars are excluded. Each Hough peak is verified by walking
+// along its line, which must contain a run of at least minLength pixels that is mostly bright, so chance alignments
+// of stars and noise are ignored
+func DetectTrails(data []float32, width int32, stars []Star, location, scale, sigma float32, minLength int32) (trails []Trail) {
+	height:=int32(len(data))/width
+	threshold, contrast:=location+sigma*scale, sigma*scale
+
+	// Find candidate pixels which are bright and thin
+	bright:=make([]bool, len(data))
+	d:=int32(trailContrastDist)
+	for y:=d; y<height-d; y++ {
+		for x:=d; x<width-d; x++ {
+			i:=y*width+x
+			v:=data[i]
+			if !(v>threshold) { continue }  // also skips NaNs
+			h:=v-contrast>data[i-d] && v-contrast>data[i+d]
+			w:=v-contrast>data[i-d*width] && v-contrast>data[i+d*width]
+			if !h && !w { continue }
+			bright[i]=true
+		}
+	}
+
+	// Exclude round stars. Elongated detections may be fragments of a trail
+	for _, st:=range stars {
+		if st.Ecc>trailMaxStarEcc { continue }
+		r:=3*st.HFR+2
+		for y:=int32(st.Y-r); y<=int32(st.Y+r+1); y++ {
+			for x:=int32(st.X-r); x<=int32(st.X+r+1); x++ {
+				if x<0 || y<0 || x>=width || y>=height { continue }
+				dx, dy:=float32(x)-st.X, float32(y)-st.Y
+				if dx*dx+dy*dy<=r*r { bright[y*width+x]=false }
+			}
+		}
+	}
+
+	xs, ys:=[]int32{}, []int32{}
+	for i, b:=range bright {
+		if b { xs, ys=append(xs, int32(i)%width), append(ys, int32(i)/width) }
+	}
+	if int32(len(xs))<minLength/2 { return nil }
+
+	// Accumulate votes of all candidate pixels for the lines through them
+	diag:=int32(math.Ceil(math.Sqrt(float64(width)*float64(width)+float64(height)*float64(height))))
+	numRho:=2*diag+1
+	cos, sin:=make([]float32, trailThetaBins), make([]float32, trailThetaBins)
+	for t:=range cos {
+		theta:=float64(t)*math.Pi/trailThetaBins
+		cos[t], sin[t]=float32(math.Cos(theta)), float32(math.Sin(theta))
+	}
+	acc:=make([]int32, trailThetaBins*int(numRho))
+	for i:=range xs {
+		x, y:=float32(xs[i]), float32(ys[i])
+		for t:=0; t<trailThetaBins; t++ {
+			r:=int32(x*cos[t]+y*sin[t]+float32(diag)+0.5)
+			acc[t*int(numRho)+int(r)]++
+		}
+	}
+
+	// Collect local maxima with enough votes, strongest first
+	type peak struct { votes, t, r int32 }
+	peaks:=[]peak{}
+	minVotes:=int32(float32(minLength)*trailMinFill)
+	for t:=int32(0); t<trailThetaBins; t++ {
+		for r:=int32(1); r<numRho-1; r++ {
+			v:=acc[t*numRho+r]
+			if v<minVotes { continue }
+			isMax:=true
+			for dt:=int32(-1); dt<=1 && isMax; dt++ {
+				t2:=t+dt
+				if t2<0 || t2>=trailThetaBins { continue }
+				for dr:=int32(-1); dr<=1; dr++ {
+					if (dt!=0 || dr!=0) && acc[t2*numRho+r+dr]>v { isMax=false; break }
+				}
+			}
+			if isMax { peaks=append(peaks, peak{v, t, r}) }
+		}
+	}
+	sort.Slice(peaks, func(i, j int) bool { return peaks[i].votes>peaks[j].votes })
+	if len(peaks)>trailMaxPeaks { peaks=peaks[:trailMaxPeaks] }
+
+	// Verify peaks along their lines, and clear the pixels of each trail found so duplicates fail
+	for _, p:=range peaks {
+		theta:=float32(p.t)*math.Pi/trailThetaBins
+		rho:=float32(p.r-diag)
+		length:=trailRun(bright, width, height, theta, rho)
+		if length<minLength { continue }
+		trail:=Trail{Theta: theta, Rho: rho, Length: length}
+		trails=append(trails, trail)
+		maskTrail(bright, nil, width, height, trail, 4)
+		if len(trails)>=trailMaxTrails { break }
+	}
+	return trails
+}
+
+// Walks along the given line through the bright pixel map, and returns the length of the longest run
+// of bright pixels with gaps of at most trailMaxGap and a fill factor of at least trailMinFill
+func trailRun(bright []bool, width, height int32, theta, rho float32) (best int32) {
+	c, s:=float32(math.Cos(float64(theta))), float32(math.Sin(float64(theta)))
+	x0, y0:=rho*c, rho*s
+	diag:=float32(math.Sqrt(float64(width)*float64(width)+float64(height)*float64(height)))
+
+	isBright:=func(x, y float32) bool {
+		xi, yi:=int32(x+0.5), int32(y+0.5)
+		if x< -0.5 || y< -0.5 || xi>=width || yi>=height { return false }
+		return bright[yi*width+xi]
+	}
+
+	start, last, hits, inRun:=int32(0), int32(0), int32(0), false
+	for t:=int32(-diag); t<=int32(diag); t++ {
+		x, y:=x0-float32(t)*s, y0+float32(t)*c
+		if !isBright(x, y) && !isBright(x+c, y+s) && !isBright(x-c, y-s) { continue }
+		if !inRun || t-last>trailMaxGap {
+			start, hits, inRun=t, 0, true
+		}
+		last=t
+		hits++
+		if length:=last-start+1; length>best && float32(hits)>=trailMinFill*float32(length) { best=length }
+	}
+	return best
+}
+
+// Masks all pixels within the given distance of the trail, setting them to false in the boolean map if given,
+// and to NaN in the data if given. Returns the number of pixels masked
+func maskTrail(bright []bool, data []float32, width, height int32, trail Trail, halfWidth float32) (numMasked int) {
+	c, s:=float32(math.Cos(float64(trail.Theta))), float32(math.Sin(float64(trail.Theta)))
+	nan:=float32(math.NaN())
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			dist:=float32(x)*c+float32(y)*s-trail.Rho
+			if dist< -halfWidth || dist>halfWidth { continue }
+			i:=y*width+x
+			if bright!=nil { bright[i]=false }
+			if data!=nil   { data[i]=nan }
+			numMasked++
+		}
+	}
+	return numMasked
+}
+
+// Masks the given trails in all channels of the image with NaN, so the stacker ignores them. The mask extends
+// halfWidth pixels to either side of each trail. Returns the number of pixels masked per channel
+func (f *FITSImage) MaskTrails(trails []Trail, halfWidth float32) (numMasked int) {
+	width, height:=f.Naxisn[0], f.Naxisn[1]
+	size:=int(width)*int(height)
+	for c:=0; (c+1)*size<=len(f.Data); c++ {
+		numMasked=0
+		for _, t:=range trails {
+			numMasked+=maskTrail(nil, f.Data[c*size:(c+1)*size], width, height, t, halfWidth)
+		}
+	}
+	return numMasked
+}
+
+
+// Detects satellite and plane trails after star detection, and masks them with NaN so the stacker ignores
+// the affected pixels. Alternatively rejects frames with trails altogether
+type OpTrails struct {
+	Sigma     float32  `json:"sigma"`      // Threshold for trail pixels in multiples of the scale above the background
+	MinLength int32    `json:"minLength"`  // Minimum length of a trail in pixels
+	Reject    bool     `json:"reject"`     // Reject frames with trails instead of masking them
+}
+
+func (op *OpTrails) Apply(f *FITSImage) error {
+	if f.Stats==nil { return errors.New("Trail detection requires prior statistics") }
+	size:=int(f.Naxisn[0])*int(f.Naxisn[1])
+	trails:=DetectTrails(f.Data[:size], f.Naxisn[0], f.Stars, f.Stats.Location, f.Stats.Scale, op.Sigma, op.MinLength)
+	if len(trails)==0 { return nil }
+	if op.Reject {
+		return errors.New(fmt.Sprintf("Rejecting frame with %d trails %v", len(trails), trails))
+	}
+
+	// Mask about 1.5 times the star FWHM to either side of the trail
+	halfWidth:=float32(4)
+	if f.HFR>0 { halfWidth=3*f.HFR+1 }
+	numMasked:=f.MaskTrails(trails, halfWidth)
+	LogPrintf("%d: Masked %d pixels of %d trails %v\n", f.ID, numMasked, len(trails), trails)
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+// Creates a synthetic frame with noise, stars and a broad nebula, and optionally a faint trail along the given line.
+// Returns the data and the stars
+func trailTestFrame(width, height int32, trail *Trail) (data []float32, stars []Star) {
+	data=make([]float32, width*height)
+	rng:=RNG{42}
+	for y:=int32(0); y<height; y++ {
+		for x:=int32(0); x<width; x++ {
+			dx, dy:=float64(x-width/3), float64(y-height/3)
+			nebula:=200*math.Exp(-(dx*dx+dy*dy)/(2*40*40))
+			data[y*width+x]=1000+float32(nebula)+10*rng.NormFloat32()
+		}
+	}
+	for s:=0; s<40; s++ {
+		sx, sy:=float32(rng.Uint32n(uint32(width))), float32(rng.Uint32n(uint32(height)))
+		stars=append(stars, Star{X: sx, Y: sy, HFR: 1.8, Ecc: 0.1})
+		for y:=int32(0); y<height; y++ {
+			for x:=int32(0); x<width; x++ {
+				dx, dy:=float32(x)-sx, float32(y)-sy
+				if r2:=dx*dx+dy*dy; r2<64 { data[y*width+x]+=2000*float32(math.Exp(float64(-r2/(2*1.5*1.5)))) }
+			}
+		}
+	}
+	if trail!=nil {
+		c, s:=float32(math.Cos(float64(trail.Theta))), float32(math.Sin(float64(trail.Theta)))
+		for y:=int32(0); y<height; y++ {
+			for x:=int32(0); x<width; x++ {
+				dist:=float32(x)*c+float32(y)*s-trail.Rho
+				data[y*width+x]+=80*float32(math.Exp(float64(-dist*dist/(2*1.2*1.2))))
+			}
+		}
+	}
+	return data, stars
+}
+
+func TestDetectTrails(t *testing.T) {
+	width, height:=int32(256), int32(200)
+	for _, theta:=range []float32{0.3, 1.2, 2.5} {
+		trail:=Trail{Theta: theta, Rho: 100}
+		if theta>math.Pi/2 { trail.Rho=-20 }
+		data, stars:=trailTestFrame(width, height, &trail)
+		trails:=DetectTrails(data, width, stars, 1000, 10, 3, 100)
+		if len(trails)!=1 || math.Abs(float64(trails[0].Theta-theta))>0.02 || math.Abs(float64(trails[0].Rho-trail.Rho))>2 {
+			t.Errorf("DetectTrails: got %v, expected one trail with theta %.2f rho %.1f", trails, theta, trail.Rho)
+		}
+
+		f:=&FITSImage{Naxisn: []int32{width, height}, Data: data}
+		numMasked:=f.MaskTrails(trails, 4)
+		y:=height/2
+		x:=int32((trail.Rho-float32(y)*float32(math.Sin(float64(theta))))/float32(math.Cos(float64(theta)))+0.5)
+		if numMasked<8*int(height) || !math.IsNaN(float64(data[y*width+x])) {
+			t.Errorf("MaskTrails: masked %d pixels, pixel %d,%d on the trail is %f", numMasked, x, y, data[y*width+x])
+		}
+	}
+
+	data, stars:=trailTestFrame(width, height, nil)
+	if trails:=DetectTrails(data, width, stars, 1000, 10, 3, 100); len(trails)!=0 {
+		t.Errorf("DetectTrails: got %v, expected no trails in frame with stars and nebulosity only", trails)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+
+package internal
+
+import (
+	"math"
+)
+
+
+// B3 spline kernel for the a trous wavelet transform
+var waveletKernelB3=[]float32{1.0/16, 4.0/16, 6.0/16, 4.0/16, 1.0/16}
+
+// Decomposes the 2D image given by data and width into the given number of wavelet layers with the a trous
+// algorithm, using a B3 spline kernel whose holes double with each layer. Layer j holds the detail at scales
+// of about 2^j pixels. The layers plus the residual sum up to the original data
+func WaveletDecompose(data []float32, width int, numLayers int) (layers [][]float32, residual []float32) {
+	layers=make([][]float32, numLayers)
+	current:=make([]float32, len(data))
+	copy(current, data)
+	tmp:=make([]float32, len(data))
+	for j:=0; j<numLayers; j++ {
+		smoothed:=make([]float32, len(data))
+		step:=1<<uint(j)
+		convolveAtrousX(tmp, current, width, step)
+		convolveAtrousY(smoothed, tmp, width, step)
+		layer:=current  // reuse buffer, current is no longer needed after this layer
+		for i, s:=range smoothed {
+			layer[i]-=s
+		}
+		layers[j]=layer
+		current=smoothed
+	}
+	return layers, current
+}
+
+// Reconstructs an image from the given wavelet layers and residual, scaling each layer with the given gain.
+// Missing gains default to 1. Results are clipped to min..max and returned in a newly allocated array
+func WaveletReconstruct(layers [][]float32, residual []float32, gains []float32, min, max float32) []float32 {
+	res:=make([]float32, len(residual))
+	copy(res, residual)
+	for j, layer:=range layers {
+		gain:=float32(1)
+		if j<len(gains) { gain=gains[j] }
+		for i, l:=range layer {
+			res[i]+=gain*l
+		}
+	}
+	for i, r:=range res {
+		if r<min { res[i]=min } else if r>max { res[i]=max }
+	}
+	return res
+}
+
+// Applies multi-scale sharpening to the 2D image given by data and width. Decomposes into one wavelet layer
+// per gain, and scales each layer by its gain, e.g. 1.5 to boost fine detail, 1 to keep it, or below 1 to soften.
+// Results are clipped to min..max. Returns results in a newly allocated array
+func WaveletSharpen(data []float32, width int, gains []float32, min, max float32) []float32 {
+	layers, residual:=WaveletDecompose(data, width, len(gains))
+	return WaveletReconstruct(layers, residual, gains, min, max)
+}
+
+// Reflect out of bounds coordinates back into [0, size-1]. Unlike reflect, also handles coordinates
+// more than one size out of bounds, as occur with the large holes of coarse wavelet layers
+func reflectPeriodic(size, x int) int {
+	period:=2*size
+	x%=period
+	if x<0 { x+=period }
+	if x>=size { x=period-x-1 }
+	return x
+}
+
+// Standard deviation of each wavelet layer of the B3 spline a trous transform for gaussian white noise of unit standard deviation
+var waveletNoiseB3=[]float32{0.889, 0.200, 0.086, 0.041, 0.020, 0.010, 0.005}
+
+// Applies multi-scale noise reduction to the 2D image given by data and width. Decomposes into one wavelet layer
+// per threshold, and soft-thresholds the coefficients of each layer at the given multiple of its noise level,
+// which is estimated from the finest layer. A threshold of 0 keeps a layer unchanged. If lumMask is nonzero,
+// the noise reduction is attenuated in bright areas by a mask of the normalized large-scale luminance raised to
+// this exponent, so faint background is smoothed while structures are kept. Results are clipped to min..max.
+// Returns results in a newly allocated array, and the estimated noise level
+func WaveletDenoise(data []float32, width int, thresholds []float32, lumMask float32, min, max float32) (res []float32, noise float32) {
+	layers, residual:=WaveletDecompose(data, width, len(thresholds))
+
+	// Estimate noise from median absolute deviation of the finest layer
+	abs:=make([]float32, len(layers[0]))
+	for i, l:=range layers[0] { abs[i]=float32(math.Abs(float64(l))) }
+	noise=QSelectMedianFloat32(abs)/(0.6745*waveletNoiseB3[0])
+	abs=nil
+
+	// Soft-threshold coefficients of each layer
+	for j, layer:=range layers {
+		if thresholds[j]==0 { continue }
+		layerNoise:=waveletNoiseB3[len(waveletNoiseB3)-1]
+		if j<len(waveletNoiseB3) {
+			layerNoise=waveletNoiseB3[j]
+		} else {
+			layerNoise/=float32(int(1)<<uint(j-len(waveletNoiseB3)+1))  // halves with each further layer
+		}
+		t:=thresholds[j]*layerNoise*noise
+		for i, l:=range layer {
+			if l>t {
+				layer[i]=l-t
+			} else if l< -t {
+				layer[i]=l+t
+			} else {
+				layer[i]=0
+			}
+		}
+	}
+	res=WaveletReconstruct(layers, residual, nil, min, max)
+
+	// Attenuate noise reduction in bright areas with a mask from the large-scale luminance
+	if lumMask!=0 && max>min {
+		for i, r:=range residual {
+			lum:=(r-min)/(max-min)
+			if lum<0 { lum=0 } else if lum>1 { lum=1 }
+			w:=float32(math.Pow(float64(lum), float64(lumMask)))
+			res[i]+=w*(data[i]-res[i])
+		}
+	}
+	return res, noise
+}
+
+// Convolve the given 2D image with the B3 spline kernel with holes of the given step along the x axis, and store the result in res
+func convolveAtrousX(res, data []float32, width int, step int) {
+	height:=len(data)/width
+	k:=len(waveletKernelB3)/2
+	for y:=0; y<height; y++ {
+		for x:=0; x<width; x++ {
+			sum:=float32(0)
+			for i:=-k; i<=k; i++ {
+				x1:=reflectPeriodic(width, x+i*step)
+				sum+=data[y*width+x1]*waveletKernelB3[i+k]
+			}
+			res[y*width+x]=sum
+		}
+	}
+}
+
+// Convolve the given 2D image with the B3 spline kernel with holes of the given step along the y axis, and store the result in res
+func convolveAtrousY(res, data []float32, width int, step int) {
+	height:=len(data)/width
+	k:=len(waveletKernelB3)/2
+	for y:=0; y<height; y++ {
+		for x:=0; x<width; x++ {
+			sum:=float32(0)
+			for i:=-k; i<=k; i++ {
+				y1:=reflectPeriodic(height, y+i*step)
+				sum+=data[y1*width+x]*waveletKernelB3[i+k]
+			}
+			res[y*width+x]=sum
+		}
+	}
+}
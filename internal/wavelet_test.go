@@ -0,0 +1,36 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWaveletDecomposeReconstruct(t *testing.T) {
+	width, height:=17, 11
+	data:=make([]float32, width*height)
+	for i:=range data {
+		data[i]=float32(math.Sin(float64(i)*0.37))*100+float32(i%width)
+	}
+
+	// more layers than the image is wide, to exercise coordinate reflection with large holes
+	layers, residual:=WaveletDecompose(data, width, 6)
+	res:=WaveletReconstruct(layers, residual, nil, -1e9, 1e9)
+	for i, d:=range data {
+		if math.Abs(float64(res[i]-d))>1e-3 { t.Errorf("pixel %d=%f; want %f", i, res[i], d) }
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+
+// A world coordinate system solution with gnomonic (TAN) projection, as written by plate solvers.
+// Maps pixel coordinates to right ascension and declination. Distortion terms are ignored
+type WCS struct {
+	CRPix1, CRPix2 float64     // Reference pixel, 1-based FITS convention
+	CRVal1, CRVal2 float64     // Right ascension and declination of the reference pixel, in degrees
+	CD     [2][2]float64       // Linear transformation from pixel offsets to intermediate world coordinates, in degrees
+	CDInv  [2][2]float64       // Inverse of the CD matrix
+}
+
+// Reads the header of a FITS file, e.g. a WCS solution file without image data
+func ReadFITSHeaderFile(fileName string) (h FITSHeader, err error) {
+	f, err:=os.Open(fileName)
+	if err!=nil { return h, err }
+	defer f.Close()
+	h=NewFITSHeader()
+	err=h.read(f)
+	return h, err
+}
+
+// Returns the numeric value of the given header key, whether it was parsed as integer or floating point
+func (h *FITSHeader) Float(key string) (val float64, ok bool) {
+	if v, ok:=h.Floats[key]; ok { return float64(v), true }
+	if v, ok:=h.Ints[key];   ok { return float64(v), true }
+	return 0, false
+}
+
+// Extracts a TAN world coordinate system from the given FITS header. Supports the CD matrix,
+// as well as CDELT with either a PC matrix or a CROTA2 rotation angle
+func NewWCSFromHeader(h *FITSHeader) (w *WCS, err error) {
+	if ctype, ok:=h.Strings["CTYPE1"]; ok && !strings.Contains(ctype, "-TAN") {
+		return nil, errors.New(fmt.Sprintf("Unsupported WCS projection '%s', need TAN", ctype))
+	}
+	w=&WCS{}
+	var ok1, ok2, ok3, ok4 bool
+	w.CRPix1, ok1=h.Float("CRPIX1")
+	w.CRPix2, ok2=h.Float("CRPIX2")
+	w.CRVal1, ok3=h.Float("CRVAL1")
+	w.CRVal2, ok4=h.Float("CRVAL2")
+	if !ok1 || !ok2 || !ok3 || !ok4 { return nil, errors.New("No WCS solution found in header") }
+
+	if cd11, ok:=h.Float("CD1_1"); ok {
+		cd12, _:=h.Float("CD1_2")
+		cd21, _:=h.Float("CD2_1")
+		cd22, _:=h.Float("CD2_2")
+		w.CD=[2][2]float64{{cd11, cd12}, {cd21, cd22}}
+	} else {
+		cdelt1, ok1:=h.Float("CDELT1")
+		cdelt2, ok2:=h.Float("CDELT2")
+		if !ok1 || !ok2 { return nil, errors.New("No WCS scale found in header, need CD or CDELT") }
+		if pc11, ok:=h.Float("PC1_1"); ok {
+			pc12, _:=h.Float("PC1_2")
+			pc21, _:=h.Float("PC2_1")
+			pc22, _:=h.Float("PC2_2")
+			w.CD=[2][2]float64{{cdelt1*pc11, cdelt1*pc12}, {cdelt2*pc21, cdelt2*pc22}}
+		} else {
+			crota2, _:=h.Float("CROTA2")
+			sin, cos:=math.Sincos(crota2*math.Pi/180)
+			w.CD=[2][2]float64{{cdelt1*cos, -cdelt2*sin}, {cdelt1*sin, cdelt2*cos}}
+		}
+	}
+
+	det:=w.CD[0][0]*w.CD[1][1]-w.CD[0][1]*w.CD[1][0]
+	if det==0 { return nil, errors.New("Singular WCS transformation matrix") }
+	w.CDInv=[2][2]float64{{w.CD[1][1]/det, -w.CD[0][1]/det}, {-w.CD[1][0]/det, w.CD[0][0]/det}}
+	return w, nil
+}
+
+// Projects the given right ascension and declination in degrees to 0-based pixel coordinates.
+// Returns false if the position is on the far side of the sky
+func (w *WCS) WorldToPixel(ra, dec float64) (x, y float64, ok bool) {
+	const d2r=math.Pi/180
+	ra0, dec0:=w.CRVal1*d2r, w.CRVal2*d2r
+	ra, dec=ra*d2r, dec*d2r
+	sinDec, cosDec:=math.Sincos(dec)
+	sinDec0, cosDec0:=math.Sincos(dec0)
+	sinDRA, cosDRA:=math.Sincos(ra-ra0)
+
+	cosC:=sinDec0*sinDec+cosDec0*cosDec*cosDRA
+	if cosC<=0 { return 0, 0, false }
+	xi :=cosDec*sinDRA/cosC/d2r
+	eta:=(cosDec0*sinDec-sinDec0*cosDec*cosDRA)/cosC/d2r
+
+	x=w.CDInv[0][0]*xi+w.CDInv[0][1]*eta+w.CRPix1-1
+	y=w.CDInv[1][0]*xi+w.CDInv[1][1]*eta+w.CRPix2-1
+	return x, y, true
+}
+
+// Returns the right ascension and declination in degrees for the given 0-based pixel coordinates
+func (w *WCS) PixelToWorld(x, y float64) (ra, dec float64) {
+	const d2r=math.Pi/180
+	dx, dy:=x+1-w.CRPix1, y+1-w.CRPix2
+	xi :=(w.CD[0][0]*dx+w.CD[0][1]*dy)*d2r
+	eta:=(w.CD[1][0]*dx+w.CD[1][1]*dy)*d2r
+
+	ra0, dec0:=w.CRVal1*d2r, w.CRVal2*d2r
+	sinDec0, cosDec0:=math.Sincos(dec0)
+	denom:=cosDec0-eta*sinDec0
+	ra =ra0+math.Atan2(xi, denom)
+	dec=math.Atan2(sinDec0+eta*cosDec0, math.Sqrt(xi*xi+denom*denom))
+	ra, dec=ra/d2r, dec/d2r
+	if ra<0 { ra+=360 } else if ra>=360 { ra-=360 }
+	return ra, dec
+}
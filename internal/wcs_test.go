@@ -0,0 +1,64 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestWCSRoundtrip(t *testing.T) {
+	h:=NewFITSHeader()
+	h.Strings["CTYPE1"]="RA---TAN"
+	h.Strings["CTYPE2"]="DEC--TAN"
+	h.Floats["CRPIX1"]=1024.5
+	h.Floats["CRPIX2"]=768.5
+	h.Floats["CRVAL1"]=83.82
+	h.Floats["CRVAL2"]=-5.39
+	h.Floats["CDELT1"]=-0.0004
+	h.Floats["CDELT2"]=0.0004
+	h.Floats["CROTA2"]=12.5
+	w, err:=NewWCSFromHeader(&h)
+	if err!=nil { t.Fatal(err) }
+
+	x, y, ok:=w.WorldToPixel(float64(h.Floats["CRVAL1"]), float64(h.Floats["CRVAL2"]))
+	if !ok || math.Abs(x-1023.5)>1e-6 || math.Abs(y-767.5)>1e-6 {
+		t.Errorf("reference pixel: got %g,%g,%v want 1023.5,767.5,true", x, y, ok)
+	}
+
+	for _, p:=range [][2]float64{{0,0}, {2047,0}, {0,1535}, {2047,1535}, {300.25,1200.75}} {
+		ra, dec:=w.PixelToWorld(p[0], p[1])
+		x, y, ok:=w.WorldToPixel(ra, dec)
+		if !ok || math.Abs(x-p[0])>1e-6 || math.Abs(y-p[1])>1e-6 {
+			t.Errorf("roundtrip of %v: got %g,%g,%v", p, x, y, ok)
+		}
+	}
+
+	if _, _, ok:=w.WorldToPixel(83.82+180, 5.39); ok {
+		t.Errorf("antipode should not project")
+	}
+}
+
+func TestWCSMissing(t *testing.T) {
+	h:=NewFITSHeader()
+	if _, err:=NewWCSFromHeader(&h); err==nil {
+		t.Errorf("expected error for header without WCS")
+	}
+	h.Strings["CTYPE1"]="RA---SIN"
+	if _, err:=NewWCSFromHeader(&h); err==nil {
+		t.Errorf("expected error for unsupported projection")
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+
+// Priority of work submitted to a worker pool. Higher priorities run first
+type Priority int
+
+const (
+	PriorityBatch       Priority = iota  // Bulk processing, like preprocessing and stacking many frames
+	PriorityInteractive                  // Interactive requests like previews, which should not wait behind bulk processing
+	numPriorities
+)
+
+// A task queued in a worker pool
+type poolTask struct {
+	group *TaskGroup  // Group the task belongs to
+	run   func()      // Function to run
+}
+
+// A pool of workers shared by all parallel processing. Limits the number of concurrently running tasks to
+// its size, which can change while tasks are running. Among queued tasks, higher priorities run first,
+// and tasks of the same priority run in submission order
+type WorkerPool struct {
+	mutex   sync.Mutex
+	size    int                       // Maximum number of concurrently running tasks
+	running int                       // Number of tasks running on pool workers
+	queues  [numPriorities][]poolTask // Queued tasks per priority
+}
+
+// The worker pool shared by all parallel processing, sized to the number of available CPU threads
+var DefaultPool=NewWorkerPool(runtime.GOMAXPROCS(0))
+
+// Creates a new worker pool running at most the given number of tasks concurrently
+func NewWorkerPool(size int) *WorkerPool {
+	if size<1 { size=1 }
+	return &WorkerPool{size: size}
+}
+
+// Returns the maximum number of concurrently running tasks
+func (p *WorkerPool) Size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.size
+}
+
+// Changes the maximum number of concurrently running tasks. Growing starts queued tasks immediately, 
+// shrinking takes effect as running tasks complete
+func (p *WorkerPool) SetSize(size int) {
+	if size<1 { size=1 }
+	p.mutex.Lock()
+	p.size=size
+	p.dispatchLocked()
+	p.mutex.Unlock()
+}
+
+// Starts queued tasks on new workers while the pool has capacity. Caller must hold the mutex
+func (p *WorkerPool) dispatchLocked() {
+	for p.running<p.size {
+		t, ok:=p.nextLocked(nil, 0)
+		if !ok { return }
+		p.running++
+		go func(t poolTask) {
+			defer func() {
+				p.mutex.Lock()
+				p.running--
+				p.dispatchLocked()
+				p.mutex.Unlock()
+			}()
+			p.exec(t)
+		}(t)
+	}
+}
+
+// Removes and returns the next task to run with at least the given priority, by priority and submission order,
+// skipping tasks whose group is at its limit. Restricted to the given group if not nil. Caller must hold the mutex
+func (p *WorkerPool) nextLocked(g *TaskGroup, minPrio Priority) (t poolTask, ok bool) {
+	for prio:=numPriorities-1; prio>=minPrio; prio-- {
+		q:=p.queues[prio]
+		for i, t:=range q {
+			if g!=nil && t.group!=g { continue }
+			if t.group.limit>0 && t.group.running>=t.group.limit { continue }
+			copy(q[i:], q[i+1:])
+			q[len(q)-1]=poolTask{}
+			p.queues[prio]=q[:len(q)-1]
+			t.group.running++
+			return t, true
+		}
+	}
+	return poolTask{}, false
+}
+
+// Runs the given task unless its group was cancelled, and marks it complete, even if the task panics
+func (p *WorkerPool) exec(t poolTask) {
+	defer func() {
+		p.mutex.Lock()
+		t.group.running--
+		t.group.pending--
+		t.group.done.Broadcast()
+		p.mutex.Unlock()
+	}()
+	if t.group.ctx.Err()==nil { t.run() }
+}
+
+
+// A group of related tasks submitted to a worker pool, which can be waited for together
+type TaskGroup struct {
+	pool     *WorkerPool
+	ctx      context.Context
+	priority Priority    // Priority of the tasks, from the context
+	limit    int         // Maximum number of concurrently running tasks of this group, 0=pool size
+	running  int         // Number of running tasks
+	pending  int         // Number of queued or running tasks
+	done     *sync.Cond  // Signalled whenever a task completes
+}
+
+// Creates a new task group running at most limit tasks concurrently, or up to the pool size if limit is 0.
+// Tasks run at the priority of the given context, and tasks not yet started are skipped once it is cancelled
+func (p *WorkerPool) NewGroup(ctx context.Context, limit int) *TaskGroup {
+	if limit<0 { limit=0 }
+	return &TaskGroup{pool: p, ctx: ctx, priority: ContextPriority(ctx), limit: limit, done: sync.NewCond(&p.mutex)}
+}
+
+// Submits a task to the group
+func (g *TaskGroup) Go(task func()) {
+	p:=g.pool
+	p.mutex.Lock()
+	g.pending++
+	p.queues[g.priority]=append(p.queues[g.priority], poolTask{group: g, run: task})
+	p.dispatchLocked()
+	p.mutex.Unlock()
+}
+
+// Waits for all tasks of the group to complete. Returns the context error if the group was cancelled.
+// While waiting, the calling goroutine runs queued tasks itself instead of blocking: tasks of higher priority
+// than the group first, then tasks of the group. Queued tasks remain only while all pool workers are busy,
+// so this takes the place of a waiting pool task, and groups submitted from within pool tasks cannot deadlock
+func (g *TaskGroup) Wait() error {
+	p:=g.pool
+	p.mutex.Lock()
+	for g.pending>0 {
+		t, ok:=p.nextLocked(nil, g.priority+1)
+		if !ok { t, ok=p.nextLocked(g, g.priority) }
+		if ok {
+			p.mutex.Unlock()
+			p.exec(t)
+			p.mutex.Lock()
+			p.dispatchLocked()
+			continue
+		}
+		g.done.Wait()
+	}
+	p.mutex.Unlock()
+	return g.ctx.Err()
+}
+
+
+// Context key for work priorities
+type priorityKey struct{}
+
+// Returns a copy of the context whose work runs at the given priority in worker pools
+func WithPriority(ctx context.Context, prio Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, prio)
+}
+
+// Returns the priority for work with the given context. Defaults to PriorityBatch
+func ContextPriority(ctx context.Context) Priority {
+	if prio, ok:=ctx.Value(priorityKey{}).(Priority); ok && prio>=0 && prio<numPriorities { return prio }
+	return PriorityBatch
+}
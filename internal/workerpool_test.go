@@ -0,0 +1,105 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+package internal
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestWorkerPoolPriority(t *testing.T) {
+	p:=NewWorkerPool(1)
+	block:=make(chan bool)
+	blocker:=p.NewGroup(context.Background(), 0)
+	blocker.Go(func() { <-block })
+
+	// with the only worker busy, queued interactive tasks run before earlier batch tasks. Waits
+	// without helping, so the single worker runs all tasks in order
+	order, wg:=[]string{}, sync.WaitGroup{}
+	record:=func(s string) func() { return func() { order=append(order, s); wg.Done() } }
+	wg.Add(3)
+	batch:=p.NewGroup(context.Background(), 0)
+	batch.Go(record("b1"))
+	batch.Go(record("b2"))
+	inter:=p.NewGroup(WithPriority(context.Background(), PriorityInteractive), 0)
+	inter.Go(record("i1"))
+	close(block)
+	wg.Wait()
+	if len(order)!=3 || order[0]!="i1" || order[1]!="b1" { t.Errorf("order=%v; want [i1 b1 b2]", order) }
+}
+
+func TestWorkerPoolLimitAndNesting(t *testing.T) {
+	p:=NewWorkerPool(2)
+	g:=p.NewGroup(context.Background(), 1)
+	running, maxRunning, lock:=0, 0, sync.Mutex{}
+	for i:=0; i<8; i++ {
+		g.Go(func() {
+			lock.Lock(); running++; if running>maxRunning { maxRunning=running }; lock.Unlock()
+
+			// nested groups from within pool tasks complete even if the pool is saturated
+			inner:=p.NewGroup(context.Background(), 0)
+			for j:=0; j<4; j++ { inner.Go(func() {}) }
+			inner.Wait()
+
+			lock.Lock(); running--; lock.Unlock()
+		})
+	}
+	if err:=g.Wait(); err!=nil { t.Fatal(err) }
+	if maxRunning!=1 { t.Errorf("maxRunning=%d; want 1", maxRunning) }
+
+	p.SetSize(4)
+	if p.Size()!=4 { t.Errorf("size=%d; want 4", p.Size()) }
+
+	// tasks not yet started are skipped once the context is cancelled
+	ctx, cancel:=context.WithCancel(context.Background())
+	cancel()
+	g=p.NewGroup(ctx, 0)
+	ran:=false
+	g.Go(func() { ran=true })
+	if err:=g.Wait(); err!=context.Canceled || ran { t.Errorf("err=%v ran=%v; want canceled without running", err, ran) }
+}
+
+func TestWorkerPoolWaitPriority(t *testing.T) {
+	p:=NewWorkerPool(1)
+	block:=make(chan bool)
+	blocker:=p.NewGroup(context.Background(), 0)
+	blocker.Go(func() { <-block })
+
+	// with the only worker busy, a waiting batch group runs queued interactive tasks before its own
+	order:=[]string{}
+	batch:=p.NewGroup(context.Background(), 0)
+	batch.Go(func() { order=append(order, "b1") })
+	inter:=p.NewGroup(WithPriority(context.Background(), PriorityInteractive), 0)
+	inter.Go(func() { order=append(order, "i1") })
+	if err:=batch.Wait(); err!=nil { t.Fatal(err) }
+	if len(order)!=2 || order[0]!="i1" || order[1]!="b1" { t.Errorf("order=%v; want [i1 b1]", order) }
+	close(block)
+	blocker.Wait()
+
+	// a panicking task run by the waiting goroutine still completes, so the group can be waited for again
+	g:=p.NewGroup(context.Background(), 0)
+	block=make(chan bool)
+	blocker.Go(func() { <-block })
+	g.Go(func() { panic("task") })
+	func() {
+		defer func() { recover() }()
+		g.Wait()
+	}()
+	close(block)
+	if err:=g.Wait(); err!=nil { t.Fatal(err) }
+}
@@ -21,32 +21,28 @@ import (
 	"fmt"
 	"io"
 	"math"
-	"os"
 	"path"
 	"strings"
 )
 
 // Writes an in-memory FITS image to a file with given filename.
-// Creates/overwrites the file if necessary.
+// Creates/overwrites the file if necessary, via a temporary file which is renamed on success.
 // Compresses with gzip if .gz or gzip suffix is present.
 func (fits *FITSImage) WriteFile(fileName string) error {
-	//fmt.Println("Reading from " + fileName + "..." )
-	f, err:=os.OpenFile(fileName, os.O_WRONLY |os.O_CREATE, 0644)
-	if err!=nil { return err }
-	defer f.Close()
-
-	var w io.Writer=f
-
-	// Compress gzip if .gz or .gzip suffix is present
-	ext:=path.Ext(fileName)
-	lExt:=strings.ToLower(ext)
-	if lExt==".gz" || lExt==".gzip" {
-		gw:=gzip.NewWriter(f)
-		defer gw.Close()
-		w=gw
-	} 
-
-	return fits.Write(w)
+	return WriteFileAtomic(fileName, func(w io.Writer) error {
+		// Compress gzip if .gz or .gzip suffix is present
+		ext:=path.Ext(fileName)
+		lExt:=strings.ToLower(ext)
+		if lExt==".gz" || lExt==".gzip" {
+			gw:=gzip.NewWriter(w)
+			if err:=fits.Write(gw); err!=nil {
+				gw.Close()
+				return err
+			}
+			return gw.Close()
+		}
+		return fits.Write(w)
+	})
 }
 
 
@@ -64,7 +60,10 @@ func (fits *FITSImage) Write(f io.Writer) error {
 	if fits.Exposure!=0 {
 		writeFloat32(&sb, "EXPOSURE", fits.Exposure, "[s] Exposure duration")
 	}
-	// FIXME: currently omitting all other FITS header entries
+	// FIXME: currently omitting all other FITS header entries except history
+	for _, h:=range fits.Header.History {
+		writeHistory(&sb, h)
+	}
 	writeEnd(&sb)
 
 	// Pad current header block with spaces if necessary
@@ -157,6 +156,23 @@ func writeString(w io.Writer, key, value, comment string) {
 }
 
 
+// Writes a FITS header history entry, wrapped across several records if necessary.
+// Replaces characters outside of printable ASCII with '?'
+func writeHistory(w io.Writer, history string) {
+	b:=[]byte(history)
+	for i, c:=range b {
+		if c<32 || c>126 { b[i]='?' }
+	}
+	for {
+		n:=len(b)
+		if n>72 { n=72 }
+		fmt.Fprintf(w, "HISTORY %-72s", string(b[:n]))
+		b=b[n:]
+		if len(b)==0 { break }
+	}
+}
+
+
 // Writes a FITS header end record 
 func writeEnd(w io.Writer) {
 	fmt.Fprintf(w, "END%s", strings.Repeat(" ", 80-3))
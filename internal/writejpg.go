@@ -17,46 +17,175 @@
 package internal
 
 import (
+	"bytes"
 	"image"
 	"image/color"
 	"image/jpeg"
 	"io"
 	"math"
-	"os"
-	"bufio"
 )
 
-// Write a FITS image to JPG. Image must be normalized to [0,1]
-func (f *FITSImage) WriteJPGToFile(fileName string, quality int) error {
-	file, err:=os.Create(fileName)
-	if err!=nil { return err }
-	defer file.Close()
+// Transfer encodings for 8-bit export
+type ExportEncoding int
+
+const (
+	EENone ExportEncoding = iota  // Write values as they are
+	EESRGB                        // Apply the sRGB transfer function to linear values
+)
+
+// Dithering modes for reducing bit depth on export
+type DitherMode int
 
-	writer:=bufio.NewWriter(file)
-	defer writer.Flush()
+const (
+	DINone           DitherMode = iota  // Round to nearest value
+	DIOrdered                           // Ordered dithering with an 8x8 Bayer matrix
+	DIFloydSteinberg                    // Floyd-Steinberg error diffusion
+)
 
-	return f.WriteJPG(writer, quality)
+// 8x8 Bayer matrix for ordered dithering
+var bayer8x8=[8][8]float32{
+	{ 0, 32,  8, 40,  2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44,  4, 36, 14, 46,  6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{ 3, 35, 11, 43,  1, 33,  9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47,  7, 39, 13, 45,  5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
 }
 
 // Write a FITS image to JPG. Image must be normalized to [0,1]
-func (f *FITSImage) WriteJPG(writer io.Writer, quality int) error {
-	// convert pixels into Golang Image
+func (f *FITSImage) WriteJPGToFile(fileName string, quality int, encoding ExportEncoding, dither DitherMode, iccProfile []byte) error {
+	return WriteFileAtomic(fileName, func(writer io.Writer) error {
+		return f.WriteJPG(writer, quality, encoding, dither, iccProfile)
+	})
+}
+
+// Write a FITS image to JPG. Image must be normalized to [0,1]. Monochrome images are written as gray.
+// Applies the given transfer encoding and dithering, and embeds the given ICC profile unless it is nil
+func (f *FITSImage) WriteJPG(writer io.Writer, quality int, encoding ExportEncoding, dither DitherMode, iccProfile []byte) error {
+	// quantize channels to 8 bits
 	width, height:=int(f.Naxisn[0]), int(f.Naxisn[1])
 	size:=width*height
+	mono:=len(f.Data)<3*size
+	planes:=make([][]uint8, 3)
+	for c:=0; c<3; c++ {
+		if mono && c>0 { planes[c]=planes[0]; continue } // monochrome, read all channels from the same plane
+		plane:=make([]float32, size)
+		for i:=range plane {
+			v:=f.Data[i+c*size]
+			if math.IsNaN(float64(v)) { v=0 }  // replace NaNs with zeros for export, else JPG output breaks
+			if encoding==EESRGB { v=SRGBEncode(v) }
+			plane[i]=v
+		}
+		planes[c]=quantize8(plane, width, height, dither)
+	}
+
+	// convert pixels into Golang Image
 	img:=image.NewRGBA(image.Rectangle{image.Point{0,0}, image.Point{width, height}})
 	for y:=0; y<height; y++ {
 		yoffset:=y*width
 		for x:=0; x<width; x++ {
-			r:=f.Data[yoffset+x]
-			g:=f.Data[yoffset+x + size]
-			b:=f.Data[yoffset+x + size*2]
-			if math.IsNaN(float64(r)) { r=0 }  // replace NaNs with zeros for export, else JPG output breaks
-			if math.IsNaN(float64(g)) { g=0 }
-			if math.IsNaN(float64(b)) { b=0 }
-			c:=color.RGBA{uint8(r*255.0+0.5), uint8(g*255.0+0.5), uint8(b*255.0+0.5), 255}
-			img.SetRGBA(x, y, c)
+			i:=yoffset+x
+			img.SetRGBA(x, y, color.RGBA{planes[0][i], planes[1][i], planes[2][i], 255})
+		}
+	}
+
+	if iccProfile==nil {
+		return jpeg.Encode(writer, img, &jpeg.Options{Quality:quality})
+	}
+	buf:=bytes.Buffer{}
+	if err:=jpeg.Encode(&buf, img, &jpeg.Options{Quality:quality}); err!=nil { return err }
+	_, err:=writer.Write(embedICCProfileJPG(buf.Bytes(), iccProfile))
+	return err
+}
+
+// Quantizes the given 2D image with values in [0,1] to 8 bits with the given dithering mode. Dithering
+// trades posterization bands in smooth gradients for fine noise. Overwrites the data for error diffusion
+func quantize8(data []float32, width, height int, dither DitherMode) []uint8 {
+	res:=make([]uint8, len(data))
+	for y:=0; y<height; y++ {
+		for x:=0; x<width; x++ {
+			i:=y*width+x
+			v:=data[i]*255
+			var q float32
+			switch dither {
+			case DIOrdered:
+				q=float32(math.Floor(float64(v + (bayer8x8[y&7][x&7]+0.5)/64)))
+			case DIFloydSteinberg:
+				q=float32(math.Floor(float64(v+0.5)))
+				if q<0 { q=0 } else if q>255 { q=255 }
+				e:=(v-q)/255
+				if x+1<width                 { data[i+1]      +=e*7/16 }
+				if y+1<height {
+					if x>0                   { data[i+width-1]+=e*3/16 }
+					                           data[i+width]  +=e*5/16
+					if x+1<width             { data[i+width+1]+=e*1/16 }
+				}
+			default:
+				q=float32(math.Floor(float64(v+0.5)))
+			}
+			if q<0 { q=0 } else if q>255 { q=255 }
+			res[i]=uint8(q)
 		}
 	}
+	return res
+}
+
+// Applies the sRGB transfer function to a linear value in [0,1]. Values outside are clamped
+func SRGBEncode(v float32) float32 {
+	if v<=0 { return 0 }
+	if v>=1 { return 1 }
+	if v<=0.0031308 { return 12.92*v }
+	return float32(1.055*math.Pow(float64(v), 1/2.4)-0.055)
+}
+
+// Embeds the given ICC profile into the given JPG data, as a sequence of APP2 ICC_PROFILE segments
+// right after the start of image marker. Returns the new JPG data
+func embedICCProfileJPG(jpg, icc []byte) []byte {
+	const maxChunk=65519 // maximum segment length 65535, minus 2 length bytes, 12 identifier bytes and 2 sequence bytes
+	numChunks:=(len(icc)+maxChunk-1)/maxChunk
+	res:=make([]byte, 0, len(jpg)+len(icc)+numChunks*18)
+	res=append(res, jpg[:2]...)  // start of image marker
+	for i:=0; i<numChunks; i++ {
+		chunk:=icc[i*maxChunk:]
+		if len(chunk)>maxChunk { chunk=chunk[:maxChunk] }
+		segLen:=2+12+2+len(chunk)
+		res=append(res, 0xFF, 0xE2, byte(segLen>>8), byte(segLen))
+		res=append(res, "ICC_PROFILE\x00"...)
+		res=append(res, byte(i+1), byte(numChunks))
+		res=append(res, chunk...)
+	}
+	return append(res, jpg[2:]...)
+}
+
+// Write an automatically stretched 8-bit preview of a linear image to JPG, leaving the image unchanged.
+// Maps the background location minus two scales to black and the maximum to white, then applies a
+// midtones transfer function which moves the background location to the given target in [0,1]
+func (f *FITSImage) WritePreviewJPGToFile(fileName string, targetBg float32, quality int) error {
+	return f.Preview(targetBg).WriteJPGToFile(fileName, quality, EENone, DINone, nil)
+}
 
-	return jpeg.Encode(writer, img, &jpeg.Options{Quality:quality})
+// Write an automatically stretched 8-bit preview of a linear image to JPG, leaving the image unchanged.
+// See WritePreviewJPGToFile
+func (f *FITSImage) WritePreviewJPG(writer io.Writer, targetBg float32, quality int) error {
+	return f.Preview(targetBg).WriteJPG(writer, quality, EENone, DINone, nil)
+}
+
+// Returns an automatically stretched copy of a linear image, normalized to [0,1]. See WritePreviewJPGToFile
+func (f *FITSImage) Preview(targetBg float32) *FITSImage {
+	black:=f.Stats.Location-2*f.Stats.Scale
+	white:=f.Stats.Max
+	if white<=black { white=black+1 }
+	bg:=(f.Stats.Location-black)/(white-black)
+	mid:=bg*(targetBg-1) / ((2*targetBg-1)*bg - targetBg)
+
+	preview:=*f
+	preview.Data=make([]float32, len(f.Data))
+	for i, d:=range f.Data {
+		v:=(d-black)/(white-black)
+		if math.IsNaN(float64(v)) || v<0 { v=0 } else if v>1 { v=1 }
+		preview.Data[i]=v*(mid-1) / ((2*mid-1)*v - mid)
+	}
+	return &preview
 }
\ No newline at end of file
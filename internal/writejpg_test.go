@@ -0,0 +1,37 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"image/jpeg"
+	"testing"
+)
+
+func TestWriteJPGWithICCProfile(t *testing.T) {
+	f:=FITSImage{Naxisn:[]int32{4, 4}, Data:make([]float32, 16)}
+	for i:=range f.Data { f.Data[i]=float32(i)/16 }
+	icc:=make([]byte, 70000) // needs two segments
+	for i:=range icc { icc[i]=byte(i) }
+
+	buf:=bytes.Buffer{}
+	if err:=f.WriteJPG(&buf, 95, EESRGB, DIFloydSteinberg, icc); err!=nil { t.Fatal(err) }
+	data:=buf.Bytes()
+	if !bytes.Contains(data, []byte("ICC_PROFILE\x00\x01\x02")) || !bytes.Contains(data, []byte("ICC_PROFILE\x00\x02\x02")) {
+		t.Errorf("ICC profile segments not found")
+	}
+	if _, err:=jpeg.Decode(bytes.NewReader(data)); err!=nil { t.Errorf("Unable to decode JPG with ICC profile: %s", err) }
+}
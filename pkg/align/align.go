@@ -0,0 +1,123 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+// Package align detects stars in images, and aligns images to a reference frame by matching star
+// triangles. Aligned images are resampled into the coordinate system of the reference frame, and
+// their histograms can be normalized to it. Functions return errors instead of exiting the process.
+package align
+
+import (
+	"context"
+	"errors"
+	nl "github.com/mlnoga/nightlight/internal"
+	"github.com/mlnoga/nightlight/pkg/fits"
+	"github.com/mlnoga/nightlight/pkg/pipeline"
+	"runtime"
+)
+
+
+// Histogram normalization mode, matching images to the reference frame
+type Normalization = nl.HistoNormMode
+
+const (
+	NormNone     = nl.HNMNone      // Do not normalize
+	NormLocScale = nl.HNMLocScale  // Match location and scale of the reference frame. Good for stacking
+	NormLocBlack = nl.HNMLocBlack  // Match the location of the reference frame by shifting the black point. Good for RGB
+)
+
+// Fill mode for pixels which fall outside the source image when resampling
+type OutOfBounds = nl.OutOfBoundsMode
+
+const (
+	OOBNaN         OutOfBounds = nl.OOBModeNaN          // Fill with NaN, which stacking ignores
+	OOBRefLocation OutOfBounds = nl.OOBModeRefLocation  // Fill with the location of the reference frame
+	OOBOwnLocation OutOfBounds = nl.OOBModeOwnLocation  // Fill with the location of the image itself
+)
+
+// Settings for alignment
+type Options struct {
+	K           int32          // Number of brightest stars to form triangles from for initial matching
+	Threshold   float32        // Skip images whose alignment residual exceeds this many pixels
+	Normalize   Normalization  // Histogram normalization mode
+	OutOfBounds OutOfBounds    // Fill mode for pixels outside the source image
+	Estimator   fits.Estimator // Location and scale estimator for the statistics of the results
+	Parallelism int32          // Number of images to process in parallel, 0=number of CPUs
+}
+
+// Returns the default alignment settings, matching the command line defaults for stacking
+func DefaultOptions() Options {
+	return Options{
+		K          : 20,
+		Threshold  : 1,
+		Normalize  : NormLocScale,
+		OutOfBounds: OOBNaN,
+		Estimator  : fits.EstDefault,
+	}
+}
+
+
+// Detects stars in the given image, which must have statistics, and stores them in img.Stars and img.HFR.
+// Stars are pixels more than sigma times the scale above the location. Candidates which differ from their
+// local median by more than bpSigma are rejected as bad pixels, 0=off
+func FindStars(img *fits.Image, sigma, bpSigma float32, radius int32) error {
+	if img.Stats==nil { return errors.New("Image has no statistics") }
+	img.Stars, _, img.HFR=nl.FindStars(img.Data, img.Naxisn[0], img.Stats.Location, img.Stats.Scale, sigma, bpSigma, radius, nil)
+	return nil
+}
+
+// Selects the reference frame with the most stars relative to their half-flux radius. Nil images are skipped.
+// Returns nil if no image has stars
+func SelectReference(images []*fits.Image) (ref *fits.Image) {
+	ref, _=nl.SelectReferenceFrame(images)
+	return ref
+}
+
+// Returns the alignment pipeline for the given reference frame and settings: histogram normalization,
+// alignment and resampling into the reference frame. Steps can be added, e.g. for sharpening
+func Pipeline(ref *fits.Image, opts Options) (*pipeline.Pipeline, error) {
+	if ref==nil { return nil, errors.New("No reference frame") }
+	if len(ref.Stars)==0 { return nil, errors.New("Unable to align without star detections in reference frame") }
+	aligner:=nl.NewAligner(ref.Naxisn, ref.Stars, opts.K)
+	return nl.NewPostProcessPipeline(aligner, ref, opts.Threshold, opts.Normalize, opts.OutOfBounds, nil, 0, 0, 0, nil, opts.Estimator), nil
+}
+
+// Aligns the given images to the reference frame, replacing each with its aligned version. Images which
+// cannot be aligned are replaced with nil. Returns the number of images which failed to align.
+// Stops early and returns the context error if the context is cancelled
+func Align(ctx context.Context, ref *fits.Image, images []*fits.Image, opts Options) (numFailed int, err error) {
+	p, err:=Pipeline(ref, opts)
+	if err!=nil { return 0, err }
+	return AlignWith(ctx, images, p, opts.Parallelism)
+}
+
+// Applies the given alignment pipeline to the images, replacing each with its processed version. Images
+// which fail are replaced with nil. Processes the given number of images in parallel, 0=number of CPUs.
+// Returns the number of images which failed. Stops early and returns the context error if the context is cancelled
+func AlignWith(ctx context.Context, images []*fits.Image, p *pipeline.Pipeline, parallelism int32) (numFailed int, err error) {
+	if parallelism<=0 { parallelism=int32(runtime.NumCPU()) }
+	in:=make([]*fits.Image, 0, len(images))
+	idx:=make([]int, 0, len(images))
+	for i, img:=range images {
+		if img==nil { continue }
+		in, idx=append(in, img), append(idx, i)
+	}
+	numFailed, err=nl.PostProcessLightsPipeline(ctx, in, p, "", parallelism)
+	if err!=nil { return numFailed, err }
+	for j, i:=range idx {
+		images[i]=in[j]
+	}
+	return numFailed, nil
+}
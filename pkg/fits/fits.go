@@ -0,0 +1,76 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+// Package fits provides the image type of the nightlight processing pipeline, and reads and writes
+// it from and to FITS files. Images carry their header, pixel data, statistics and detected stars.
+//
+// The types are aliases of the implementation types, so images can be passed between the fits,
+// stack, align and post packages without conversion. Functions return errors instead of exiting
+// the process.
+package fits
+
+import (
+	nl "github.com/mlnoga/nightlight/internal"
+)
+
+
+// A FITS image with header, pixel data in float32, statistics and detected stars.
+// Naxisn holds the dimensions, Data holds the pixels in row-major order, one plane per channel
+type Image = nl.FITSImage
+
+// Header of a FITS image, with well-known keys parsed and other cards retained
+type Header = nl.FITSHeader
+
+// Basic statistics of an image: min, max, mean, standard deviation, location, scale and noise
+type Stats = nl.BasicStats
+
+// A star detected in an image, with its position, mass and half-flux radius
+type Star = nl.Star
+
+// Estimator for location and scale of the image background
+type Estimator = nl.LSEstimatorMode
+
+const (
+	EstMeanStdDev = nl.LSEMeanStdDev  // Mean and standard deviation
+	EstMedianMAD  = nl.LSEMedianMAD   // Median and median absolute deviation
+	EstIKSS       = nl.LSEIKSS        // Iterative k-sigma location and biweight midvariance scale
+	EstDefault    = nl.LSESCMedianQn  // Sigma-clipped median and Qn, sampled. Robust default
+)
+
+
+// Creates a new, empty image
+func New() *Image {
+	img:=nl.NewFITSImage()
+	return &img
+}
+
+// Reads an image from the given FITS file, which may be gzip-compressed. Does not calculate statistics
+func Read(fileName string) (*Image, error) {
+	img:=New()
+	if err:=img.ReadFile(fileName); err!=nil { return nil, err }
+	return img, nil
+}
+
+// Writes the given image to a FITS file. The file is replaced atomically
+func Write(img *Image, fileName string) error {
+	return img.WriteFile(fileName)
+}
+
+// Calculates the statistics of the given image with the given location and scale estimator, and stores them in img.Stats
+func CalcStats(img *Image, est Estimator) (err error) {
+	img.Stats, err=nl.CalcExtendedStats(img.Data, img.Naxisn[0], est)
+	return err
+}
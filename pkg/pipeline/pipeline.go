@@ -0,0 +1,83 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+// Package pipeline composes processing steps for single images into pipelines. Each step is an Operator,
+// which modifies an image in place. Pipelines can be declared in code, reordered, and read from or written
+// to JSON. Third parties can add their own operators with Register, so JSON pipelines can refer to them.
+//
+// The stack and align packages build their default pipelines from options, and accept custom ones.
+package pipeline
+
+import (
+	nl "github.com/mlnoga/nightlight/internal"
+)
+
+
+// A processing step which modifies a single image in place. Apply may be called concurrently for different images
+type Operator = nl.Operator
+
+// Optional interface for operators which prepare before first use, e.g. by loading a calibration frame.
+// Called once after an operator was created from its JSON parameters
+type Initializer = nl.OperatorInitializer
+
+// Creates a new operator of a given type with default parameters, to be overwritten from JSON
+type Factory = nl.OperatorFactory
+
+// A pipeline of operators, applied to an image in sequence
+type Pipeline = nl.Pipeline
+
+// A step of a pipeline, with the name of the operator type and the operator with its parameters
+type Step = nl.PipelineStep
+
+// Built-in operators, registered under the names given in brackets
+type (
+	Dark       = nl.OpDark        // Dark subtraction [dark]
+	Flat       = nl.OpFlat        // Flat division [flat]
+	BadPixels  = nl.OpBadPixels   // Bad pixel removal [badPixels]
+	Debayer    = nl.OpDebayer     // Debayering of color filter array data [debayer]
+	Bin        = nl.OpBin         // NxN binning [bin]
+	Background = nl.OpBackground  // Background extraction [background]
+	Stars      = nl.OpStars       // Statistics and star detection [stars]
+	Trails     = nl.OpTrails      // Satellite and plane trail masking or rejection [trails]
+	Elongation = nl.OpElongation  // Rejection of frames with elongated stars [elongation]
+	PSF        = nl.OpPSF         // Point spread function fitting [psf]
+	NormRange  = nl.OpNormRange   // Value range normalization [normRange]
+	Histogram  = nl.OpHistogram   // Histogram normalization to a reference frame [histogram]
+	Mask       = nl.OpMask        // Exclusion of masked regions [mask]
+	Align      = nl.OpAlign       // Alignment and resampling into a reference frame [align]
+	USM        = nl.OpUSM         // Unsharp masking [usm]
+	Wavelet    = nl.OpWavelet     // Multi-scale wavelet sharpening [wavelet]
+)
+
+
+// Creates a new, empty pipeline
+func New() *Pipeline {
+	return nl.NewPipeline()
+}
+
+// Loads a pipeline from the given JSON file, creating and initializing its operators
+func Load(fileName string) (*Pipeline, error) {
+	return nl.LoadPipeline(fileName)
+}
+
+// Registers an operator type under the given name, so pipelines can refer to it in JSON.
+// Call from an init function. Returns an error if the name is already taken
+func Register(name string, factory Factory) error {
+	return nl.RegisterOperator(name, factory)
+}
+
+// Returns the names of all registered operators in alphabetical order
+func Registered() []string {
+	return nl.RegisteredOperators()
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+// Package post finishes stacked images: background extraction, noise reduction, color combination,
+// black point and tone adjustments. Further pixel operations like ApplyGamma are available as methods
+// of fits.Image. Functions return errors instead of exiting the process.
+package post
+
+import (
+	"errors"
+	"fmt"
+	nl "github.com/mlnoga/nightlight/internal"
+	"github.com/mlnoga/nightlight/pkg/fits"
+)
+
+
+// Removes residual gradients from each channel of the given image with automated background extraction
+// on a grid of the given spacing in pixels. Foreground objects are detected with the given sigma, and the
+// brightest clip grid cells are replaced by interpolation. Keeps the overall background level
+func RemoveGradients(img *fits.Image, gridSpacing int32, sigma float32, clip int32) error {
+	if gridSpacing<=0 || gridSpacing>img.Naxisn[0] || gridSpacing>img.Naxisn[1] {
+		return errors.New(fmt.Sprintf("Invalid background grid spacing %d for image size %v", gridSpacing, img.Naxisn))
+	}
+	img.RemoveGradients(gridSpacing, sigma, clip)
+	return nil
+}
+
+// Reduces noise in the given single-channel image with wavelet thresholding, using one threshold per layer
+// in multiples of the layer noise. Areas brighter than lumMask times the image range are protected, 0=off
+func Denoise(img *fits.Image, thresholds []float32, lumMask float32) error {
+	if len(img.Naxisn)!=2 { return errors.New("Denoising requires a single-channel image") }
+	stats:=nl.CalcBasicStats(img.Data)
+	img.Data, _=nl.WaveletDenoise(img.Data, int(img.Naxisn[0]), thresholds, lumMask, stats.Min, stats.Max)
+	img.Stats=nil
+	return nil
+}
+
+// Combines the given red, green and blue images into a new color image, normalized to [0,1].
+// The stars of the optional reference image are carried over
+func CombineRGB(r, g, b, ref *fits.Image) (*fits.Image, error) {
+	for _, c:=range []*fits.Image{g, b} {
+		if !nl.EqualInt32Slice(r.Naxisn, c.Naxisn) {
+			return nil, errors.New(fmt.Sprintf("Channel sizes %v and %v differ", r.Naxisn, c.Naxisn))
+		}
+	}
+	rgb:=nl.CombineRGB([]*fits.Image{r, g, b}, ref)
+	return &rgb, nil
+}
+
+// Sets the black point of each channel of the given color image so the background peaks match,
+// and the white points so that the median star color is neutral
+func SetBlackWhitePoints(rgb *fits.Image, est fits.Estimator) error {
+	if len(rgb.Naxisn)!=3 || rgb.Naxisn[2]!=3 { return errors.New("Setting black and white points requires an RGB image") }
+	return rgb.SetBlackWhitePoints(est)
+}
+
+// Applies a midtone stretch to the given single-channel image, which must be normalized to [0,1].
+// The midtone and black points are given in multiples of the image scale, relative to the image location
+func StretchMidtones(img *fits.Image, mid, black float32, est fits.Estimator) error {
+	if len(img.Naxisn)!=2 { return errors.New("Midtone stretch requires a single-channel image") }
+	if err:=fits.CalcStats(img, est); err!=nil { return err }
+	img.ApplyMidtones(mid*img.Stats.Scale, img.Stats.Location-black*img.Stats.Scale)
+	return fits.CalcStats(img, est)
+}
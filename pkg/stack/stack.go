@@ -0,0 +1,206 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+
+// Package stack calibrates light frames and stacks them into a single image with outlier rejection.
+//
+// A typical pipeline loads the calibration frames, preprocesses the lights with PreProcess, aligns them
+// with the align package, and combines them with Stack. Functions return errors instead of exiting the process.
+package stack
+
+import (
+	"context"
+	"errors"
+	nl "github.com/mlnoga/nightlight/internal"
+	"github.com/mlnoga/nightlight/pkg/fits"
+	"github.com/mlnoga/nightlight/pkg/pipeline"
+	"runtime"
+)
+
+
+// Stacking mode, selecting the combination and outlier rejection algorithm
+type Mode = nl.StackMode
+
+const (
+	Median       = nl.StMedian        // Median
+	Mean         = nl.StMean          // Mean, without rejection
+	Sigma        = nl.StSigma         // Mean after iterative sigma clipping
+	WinsorSigma  = nl.StWinsorSigma   // Mean after iterative winsorized sigma clipping
+	LinearFit    = nl.StLinearFit     // Mean after clipping against a linear fit
+	Auto         = nl.StAuto          // Per-pixel choice of the above, based on the number of valid samples
+	Percentile   = nl.StPercentile    // Mean after clipping values too far from the median
+	Sum          = nl.StSum           // Sum
+	IntAverage   = nl.StIntAverage    // Integer average
+	Max          = nl.StMax           // Maximum
+	Min          = nl.StMin           // Minimum
+)
+
+// In-memory storage format for aligned frames awaiting stacking. Pack frames with Image.Pack after alignment
+type Storage = nl.FrameStorage
+
+const (
+	Float32      = nl.FSFloat32       // Full precision 32-bit floating point
+	Float16      = nl.FSFloat16       // Half precision 16-bit floating point
+	Uint16       = nl.FSUint16        // 16-bit unsigned integers, scaled linearly
+)
+
+// Priority of processing on the worker pool shared by all packages. Set it on the context passed to processing functions
+type Priority = nl.Priority
+
+const (
+	PriorityBatch       = nl.PriorityBatch        // Bulk processing, like preprocessing and stacking many frames. Default
+	PriorityInteractive = nl.PriorityInteractive  // Interactive requests like previews, which run ahead of bulk processing
+)
+
+// Returns a copy of the context whose processing runs at the given priority on the shared worker pool
+func WithPriority(ctx context.Context, prio Priority) context.Context {
+	return nl.WithPriority(ctx, prio)
+}
+
+// Sets the number of workers shared by all processing. Takes effect while processing is running
+func SetWorkers(n int) {
+	nl.DefaultPool.SetSize(n)
+}
+
+// Settings for preprocessing light frames
+type PreProcessOptions struct {
+	Dark              *fits.Image    // Dark frame to subtract, or nil
+	Flat              *fits.Image    // Flat frame to divide by, or nil
+	Debayer           string         // Color channel to extract from a color filter array: R, G or B. Empty for mono data
+	CFA               string         // Color filter array layout, e.g. RGGB
+	Binning           int32          // Bin NxN pixels, 1=off
+	NormRange         bool           // Normalize the value range to [0,1]
+	BadPixelSigmaLow  float32        // Low sigma for bad pixel removal, 0=off
+	BadPixelSigmaHigh float32        // High sigma for bad pixel removal, 0=off
+	StarSigma         float32        // Sigma for star detection
+	StarBadPixelSigma float32        // Sigma for rejecting bad pixels in star detection, 0=off
+	StarRadius        int32          // Radius for star detection in pixels
+	BackGrid          int32          // Grid size for automated background extraction in pixels, 0=off
+	BackSigma         float32        // Sigma for detecting foreground objects in background extraction
+	BackClip          int32          // Number of brightest background grid cells to clip
+	Estimator         fits.Estimator // Location and scale estimator
+	Parallelism       int32          // Number of frames to process in parallel, 0=number of CPUs
+}
+
+// Returns the default preprocessing settings, matching the command line defaults for a stack of subexposures
+func DefaultPreProcessOptions() PreProcessOptions {
+	return PreProcessOptions{
+		Binning          : 1,
+		BadPixelSigmaLow : 3,
+		BadPixelSigmaHigh: 5,
+		StarSigma        : 10,
+		StarBadPixelSigma: 5,
+		StarRadius       : 16,
+		BackSigma        : 1.5,
+		Estimator        : fits.EstDefault,
+	}
+}
+
+// Settings for stacking
+type Options struct {
+	Mode         Mode           // Stacking mode
+	Weights      []float32      // Weight per light frame, or nil for unweighted stacking
+	SigmaLow     float32        // Low clipping sigma, or fraction of the median for percentile clipping. -1=find from ClipPercLow
+	SigmaHigh    float32        // High clipping sigma, or fraction of the median for percentile clipping. -1=find from ClipPercHigh
+	ClipPercLow  float32        // Desired percentage of values clipped low, if the sigmas are to be found
+	ClipPercHigh float32        // Desired percentage of values clipped high, if the sigmas are to be found
+	MaxIter      int32          // Maximum number of clipping iterations per pixel, 0=until converged
+	Convergence  float32        // Stop clipping once at most this fraction of the remaining values is clipped
+	Rescale      bool           // For Sum, rescale pixels missing in some frames to the full number of frames
+	Precision    int32          // Precision for accumulating sums, 32 or 64 bits
+	Estimator    fits.Estimator // Location and scale estimator for the statistics of the result
+}
+
+// Returns the default stacking settings, matching the command line defaults: automatic per-pixel rejection,
+// with sigmas found to clip 0.5% of the values low and high
+func DefaultOptions() Options {
+	return Options{
+		Mode        : Auto,
+		SigmaLow    : -1,
+		SigmaHigh   : -1,
+		ClipPercLow : 0.5,
+		ClipPercHigh: 0.5,
+		Rescale     : true,
+		Precision   : 32,
+		Estimator   : fits.EstDefault,
+	}
+}
+
+
+// Loads a dark frame from the given FITS file and calculates its statistics
+func LoadDark(fileName string) (*fits.Image, error) {
+	return nl.LoadDark(fileName)
+}
+
+// Loads a flat frame from the given FITS file and calculates its statistics
+func LoadFlat(fileName string) (*fits.Image, error) {
+	return nl.LoadFlat(fileName)
+}
+
+// Returns the preprocessing pipeline for the given settings: calibration, bad pixel removal, debayering,
+// binning, background extraction, statistics and star detection. Steps can be added, removed or reordered
+func PreProcessPipeline(opts PreProcessOptions) *pipeline.Pipeline {
+	normRange:=int32(0)
+	if opts.NormRange { normRange=1 }
+	return nl.NewPreProcessPipeline(opts.Dark, opts.Flat, opts.Debayer, opts.CFA, opts.Binning, normRange,
+		opts.BadPixelSigmaLow, opts.BadPixelSigmaHigh, opts.StarSigma, opts.StarBadPixelSigma, opts.StarRadius,
+		opts.BackGrid, opts.BackSigma, opts.BackClip, "", opts.Estimator)
+}
+
+// Preprocesses the light frames with the given file names: calibration, bad pixel removal, debayering,
+// binning, background extraction, statistics and star detection. Frames which fail to load or preprocess
+// are nil in the result. Stops early and returns the context error if the context is cancelled
+func PreProcess(ctx context.Context, fileNames []string, opts PreProcessOptions) (lights []*fits.Image, err error) {
+	if opts.Dark!=nil && opts.Flat!=nil && !nl.EqualInt32Slice(opts.Dark.Naxisn, opts.Flat.Naxisn) {
+		return nil, errors.New("Flat and dark frames differ in size")
+	}
+	return PreProcessWith(ctx, fileNames, PreProcessPipeline(opts), opts.Parallelism)
+}
+
+// Loads the light frames with the given file names and applies the given preprocessing pipeline to each.
+// Processes the given number of frames in parallel, 0=number of CPUs. Frames which fail to load or preprocess
+// are nil in the result. Stops early and returns the context error if the context is cancelled
+func PreProcessWith(ctx context.Context, fileNames []string, p *pipeline.Pipeline, numParallel int32) (lights []*fits.Image, err error) {
+	ids:=make([]int, len(fileNames))
+	for i:=range ids { ids[i]=i }
+	return nl.PreProcessLightsPipeline(ctx, ids, fileNames, p, "", "", parallelism(numParallel))
+}
+
+// Stacks the given aligned light frames into a new image. Nil frames are skipped, packed frames are unpacked
+// on the fly. The reference location fills pixels without valid data. Stops early and returns the context error if the context is cancelled
+func Stack(ctx context.Context, lights []*fits.Image, refLocation float32, opts Options) (*fits.Image, error) {
+	if opts.Weights!=nil && len(opts.Weights)!=len(lights) { return nil, errors.New("Number of weights differs from number of frames") }
+	valid:=make([]*fits.Image, 0, len(lights))
+	var weights []float32
+	for i, l:=range lights {
+		if l==nil { continue }
+		valid=append(valid, l)
+		if opts.Weights!=nil { weights=append(weights, opts.Weights[i]) }
+	}
+	if len(valid)==0 { return nil, errors.New("No frames to stack") }
+
+	if opts.SigmaLow<0 || opts.SigmaHigh<0 {
+		res, _, _, _, _, err:=nl.FindSigmasAndStack(ctx, valid, opts.Mode, weights, refLocation, opts.ClipPercLow, opts.ClipPercHigh, opts.MaxIter, opts.Convergence, opts.Rescale, opts.Precision, opts.Estimator)
+		return res, err
+	}
+	res, _, _, err:=nl.Stack(ctx, valid, opts.Mode, weights, refLocation, opts.SigmaLow, opts.SigmaHigh, opts.MaxIter, opts.Convergence, opts.Rescale, opts.Precision, opts.Estimator)
+	return res, err
+}
+
+// Returns the given parallelism, or the number of CPUs if zero or negative
+func parallelism(p int32) int32 {
+	if p<=0 { return int32(runtime.NumCPU()) }
+	return p
+}
@@ -0,0 +1,65 @@
+// Copyright (C) 2020 Markus L. Noga
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package stack
+
+import (
+	"context"
+	"fmt"
+	"github.com/mlnoga/nightlight/pkg/fits"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreProcessAndStack(t *testing.T) {
+	dir, err:=ioutil.TempDir("", "nightlight")
+	if err!=nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+
+	// write three flat frames with different levels
+	fileNames:=[]string{}
+	for i:=0; i<3; i++ {
+		img:=fits.New()
+		img.Bitpix, img.Naxisn, img.Pixels=-32, []int32{32, 32}, 32*32
+		img.Data=make([]float32, img.Pixels)
+		for j:=range img.Data { img.Data[j]=float32(100*(i+1)+j%3) }
+		fileName:=filepath.Join(dir, fmt.Sprintf("light%d.fits", i))
+		if err:=fits.Write(img, fileName); err!=nil { t.Fatal(err) }
+		fileNames=append(fileNames, fileName)
+	}
+	fileNames=append(fileNames, filepath.Join(dir, "missing.fits"))
+
+	opts:=DefaultPreProcessOptions()
+	opts.BadPixelSigmaLow, opts.BadPixelSigmaHigh, opts.StarBadPixelSigma=0, 0, 0
+	lights, err:=PreProcess(context.Background(), fileNames, opts)
+	if err!=nil { t.Fatal(err) }
+	if len(lights)!=4 || lights[3]!=nil { t.Fatalf("expected three preprocessed lights and a nil for the missing file, got %v", lights) }
+
+	sopts:=DefaultOptions()
+	sopts.Mode=Mean
+	res, err:=Stack(context.Background(), lights, 0, sopts)
+	if err!=nil { t.Fatal(err) }
+	if res.Data[0]!=200 || res.Data[1]!=201 { t.Errorf("mean stack: got %v %v, want 200 201", res.Data[0], res.Data[1]) }
+
+	sopts.Weights=[]float32{1, 1}
+	if _, err:=Stack(context.Background(), lights, 0, sopts); err==nil { t.Errorf("expected error for mismatched weights") }
+
+	sopts.Weights=nil
+	ctx, cancel:=context.WithCancel(context.Background())
+	cancel()
+	if _, err:=Stack(ctx, lights, 0, sopts); err!=context.Canceled { t.Errorf("cancelled stack: got error %v, want %v", err, context.Canceled) }
+}